@@ -0,0 +1,245 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+/*
+ * An append-only audit log of the operations that change the data model.  Each
+ * record is passed to every sink of the log, for example a rotating file and
+ * syslog, and can be read back through a sink that supports queries.
+ *
+ * A nil *Log is valid and records nothing, so auditing can be left disabled
+ * without checks at each call site.
+ */
+
+// DEFAULT_IDENTITY is recorded when the context of an operation carries no
+// identity, for example a call to the coordinator from within its process
+const DEFAULT_IDENTITY = "local"
+
+type Operation string
+
+const (
+	OperationSet       Operation = "Set"
+	OperationAddRow    Operation = "AddRow"
+	OperationDeleteRow Operation = "DeleteRow"
+	OperationOperate   Operation = "Operate"
+	// The decision of a transaction, recorded when a source in doubt refuses
+	// it
+	OperationCommit Operation = "Commit"
+	OperationAbort  Operation = "Abort"
+)
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	// The sources of a transaction applied different decisions
+	OutcomeHeuristic Outcome = "heuristic"
+)
+
+// Record is a single audited operation
+type Record struct {
+	// Sequence numbers records in the order they were logged, starting at 1
+	Sequence  uint64    `json:"sequence"`
+	Time      time.Time `json:"time"`
+	Operation Operation `json:"operation"`
+	// Identity of the requester, for example the source or controller name
+	Identity string `json:"identity"`
+	// Path of the object, dynamic list, row or command operated on
+	Path string `json:"path"`
+	// Row is the row created by an AddRow
+	Row            string      `json:"row,omitempty"`
+	OldValue       interface{} `json:"oldValue,omitempty"`
+	NewValue       interface{} `json:"newValue,omitempty"`
+	Outcome        Outcome     `json:"outcome"`
+	Error          string      `json:"error,omitempty"`
+	TransactionUID string      `json:"transactionUID,omitempty"`
+}
+
+// NewRecord creates a record of `operation` on `path` by the identity in
+// `ctx`, with the outcome given by `err`
+func NewRecord(ctx context.Context, operation Operation, path string, oldValue interface{}, newValue interface{}, err error) Record {
+	record := Record{
+		Operation: operation,
+		Identity:  IdentityFromContext(ctx),
+		Path:      path,
+		OldValue:  oldValue,
+		NewValue:  newValue,
+		Outcome:   OutcomeSuccess,
+	}
+	if err != nil {
+		record.Outcome = OutcomeFailure
+		record.Error = err.Error()
+	}
+	return record
+}
+
+// Sink stores or forwards audit records
+type Sink interface {
+	Write(record Record) error
+	Close() error
+}
+
+// Querier is implemented by sinks that can read back the records written
+type Querier interface {
+	Query(query Query) ([]Record, error)
+}
+
+// Query selects audit records.  Empty fields match any record.
+type Query struct {
+	// PathPrefix matches records with a path starting with the prefix
+	PathPrefix     string
+	Identity       string
+	Operation      Operation
+	Outcome        Outcome
+	TransactionUID string
+	// Since and Until bound the time of the records (inclusive)
+	Since time.Time
+	Until time.Time
+	// Limit returns only the most recent matching records when not 0
+	Limit int
+}
+
+// Matches returns true if `record` is selected by the query
+func (qu Query) Matches(record Record) bool {
+	switch {
+	case qu.PathPrefix != "" && !strings.HasPrefix(record.Path, qu.PathPrefix):
+		return false
+	case qu.Identity != "" && record.Identity != qu.Identity:
+		return false
+	case qu.Operation != "" && record.Operation != qu.Operation:
+		return false
+	case qu.Outcome != "" && record.Outcome != qu.Outcome:
+		return false
+	case qu.TransactionUID != "" && record.TransactionUID != qu.TransactionUID:
+		return false
+	case !qu.Since.IsZero() && record.Time.Before(qu.Since):
+		return false
+	case !qu.Until.IsZero() && record.Time.After(qu.Until):
+		return false
+	}
+	return true
+}
+
+// limit applies the Limit of the query to `records` in log order
+func (qu Query) limit(records []Record) []Record {
+	if qu.Limit > 0 && len(records) > qu.Limit {
+		return records[len(records)-qu.Limit:]
+	}
+	return records
+}
+
+// Log passes audit records to its sinks
+type Log struct {
+	log        *logrus.Entry
+	lock       sync.Mutex
+	sinks      []Sink
+	sequence   uint64
+	lastValues map[string]interface{}
+}
+
+// NewLog creates an audit log writing each record to all `sinks`
+func NewLog(log *logrus.Entry, sinks ...Sink) *Log {
+	return &Log{
+		log:        log,
+		sinks:      sinks,
+		lastValues: make(map[string]interface{}),
+	}
+}
+
+// Record numbers and timestamps `record` and writes it to the sinks.  A sink
+// that fails is logged and doesn't stop the record reaching the others.
+func (al *Log) Record(record Record) {
+	if al == nil {
+		return
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	al.sequence++
+	record.Sequence = al.sequence
+	if record.Time.IsZero() {
+		record.Time = time.Now().UTC()
+	}
+	if record.Identity == "" {
+		record.Identity = DEFAULT_IDENTITY
+	}
+	if record.Operation == OperationSet && record.Outcome == OutcomeSuccess {
+		al.lastValues[record.Path] = record.NewValue
+	}
+
+	for _, sink := range al.sinks {
+		if err := sink.Write(record); err != nil {
+			al.log.Errorf("Failed to write audit record %d: %v", record.Sequence, err)
+		}
+	}
+}
+
+// LastValue returns the value last set on `path` through the log, which is
+// recorded as the old value when the current value can't be fetched
+func (al *Log) LastValue(path string) (value interface{}, ok bool) {
+	if al == nil {
+		return nil, false
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	value, ok = al.lastValues[path]
+	return value, ok
+}
+
+// Query reads records back from the first sink that supports queries
+func (al *Log) Query(query Query) ([]Record, error) {
+	if al == nil {
+		return nil, fmt.Errorf("audit log not enabled")
+	}
+	for _, sink := range al.sinks {
+		if querier, ok := sink.(Querier); ok {
+			return querier.Query(query)
+		}
+	}
+	return nil, fmt.Errorf("no audit sink supports queries")
+}
+
+// Close closes all sinks of the log
+func (al *Log) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+
+	var err error
+	for _, sink := range al.sinks {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type identityKey struct{}
+
+// ContextWithIdentity returns a copy of `ctx` carrying the identity of the
+// requester, which is recorded for operations made with the context
+func ContextWithIdentity(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// IdentityFromContext returns the identity carried by `ctx`, or
+// DEFAULT_IDENTITY
+func IdentityFromContext(ctx context.Context) string {
+	if ctx != nil {
+		if identity, ok := ctx.Value(identityKey{}).(string); ok && identity != "" {
+			return identity
+		}
+	}
+	return DEFAULT_IDENTITY
+}
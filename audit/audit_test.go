@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getLogger() *logrus.Entry {
+	return logrus.NewEntry(logrus.New())
+}
+
+func TestLog(t *testing.T) {
+	ring := NewRingSink(10)
+	auditLog := NewLog(getLogger(), ring)
+
+	ctx := ContextWithIdentity(context.Background(), "controller")
+	auditLog.Record(NewRecord(ctx, OperationSet, "Device.Custom.Setting1", "1", "2", nil))
+	auditLog.Record(NewRecord(context.Background(), OperationSet, "Device.Custom.Setting2", "1", "2", fmt.Errorf("failed")))
+
+	records := ring.Records()
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, uint64(1), records[0].Sequence)
+	assert.Equal(t, "controller", records[0].Identity)
+	assert.Equal(t, OutcomeSuccess, records[0].Outcome)
+	assert.False(t, records[0].Time.IsZero())
+	assert.Equal(t, uint64(2), records[1].Sequence)
+	assert.Equal(t, DEFAULT_IDENTITY, records[1].Identity)
+	assert.Equal(t, OutcomeFailure, records[1].Outcome)
+	assert.Equal(t, "failed", records[1].Error)
+
+	// Only successful sets are kept as the last value
+	value, ok := auditLog.LastValue("Device.Custom.Setting1")
+	assert.True(t, ok)
+	assert.Equal(t, "2", value)
+	_, ok = auditLog.LastValue("Device.Custom.Setting2")
+	assert.False(t, ok)
+
+	failures, err := auditLog.Query(Query{Outcome: OutcomeFailure})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(failures))
+	assert.Equal(t, "Device.Custom.Setting2", failures[0].Path)
+
+	assert.Nil(t, auditLog.Close())
+
+	// Without a querier
+	_, err = NewLog(getLogger()).Query(Query{})
+	assert.NotNil(t, err)
+
+	// A nil log records nothing
+	var nilLog *Log
+	nilLog.Record(Record{})
+	_, err = nilLog.Query(Query{})
+	assert.NotNil(t, err)
+}
+
+func TestQuery(t *testing.T) {
+	now := time.Now()
+	record := Record{
+		Time:           now,
+		Operation:      OperationAddRow,
+		Identity:       "admin",
+		Path:           "Device.NAT.PortMapping.",
+		Outcome:        OutcomeSuccess,
+		TransactionUID: "1234",
+	}
+
+	assert.True(t, Query{}.Matches(record))
+	assert.True(t, Query{PathPrefix: "Device.NAT.", Identity: "admin", Operation: OperationAddRow, Outcome: OutcomeSuccess, TransactionUID: "1234"}.Matches(record))
+	assert.True(t, Query{Since: now, Until: now}.Matches(record))
+	assert.False(t, Query{PathPrefix: "Device.WiFi."}.Matches(record))
+	assert.False(t, Query{Identity: "other"}.Matches(record))
+	assert.False(t, Query{Operation: OperationSet}.Matches(record))
+	assert.False(t, Query{Outcome: OutcomeFailure}.Matches(record))
+	assert.False(t, Query{TransactionUID: "5678"}.Matches(record))
+	assert.False(t, Query{Since: now.Add(time.Second)}.Matches(record))
+	assert.False(t, Query{Until: now.Add(-time.Second)}.Matches(record))
+}
+
+func TestRingSink(t *testing.T) {
+	ring := NewRingSink(3)
+	for i := 1; i <= 5; i++ {
+		ring.Write(Record{Sequence: uint64(i), Path: fmt.Sprintf("Device.Custom.Setting%d", i)})
+	}
+
+	records := ring.Records()
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, uint64(3), records[0].Sequence)
+	assert.Equal(t, uint64(5), records[2].Sequence)
+
+	records, err := ring.Query(Query{PathPrefix: "Device.Custom.", Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, uint64(4), records[0].Sequence)
+	assert.Equal(t, uint64(5), records[1].Sequence)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	// Each record is about 150 bytes, so the file rotates every few records
+	sink, err := NewFileSink(path, 512, 2)
+	assert.Nil(t, err)
+	auditLog := NewLog(getLogger(), sink)
+	for i := 0; i < 20; i++ {
+		auditLog.Record(NewRecord(context.Background(), OperationSet, fmt.Sprintf("Device.Custom.Setting%d", i), nil, i, nil))
+	}
+
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	// Only the records of the kept files remain, in order
+	records, err := auditLog.Query(Query{})
+	assert.Nil(t, err)
+	assert.True(t, len(records) > 0 && len(records) < 20)
+	for i, record := range records {
+		assert.Equal(t, uint64(20-len(records)+i+1), record.Sequence)
+	}
+	assert.Equal(t, "Device.Custom.Setting19", records[len(records)-1].Path)
+	assert.Equal(t, float64(19), records[len(records)-1].NewValue)
+
+	records, err = auditLog.Query(Query{PathPrefix: "Device.Custom.Setting19"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(records))
+	assert.Nil(t, auditLog.Close())
+
+	// Records are appended after reopening the file
+	sink, err = NewFileSink(path, 512, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Write(Record{Sequence: 21, Path: "Device.Custom.Reopened"}))
+	records, err = sink.Query(Query{Limit: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(records))
+	assert.Equal(t, "Device.Custom.Setting19", records[0].Path)
+	assert.Equal(t, "Device.Custom.Reopened", records[1].Path)
+	assert.Nil(t, sink.Close())
+	assert.NotNil(t, sink.Write(Record{}))
+}
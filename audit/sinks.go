@@ -0,0 +1,221 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_FILE_SIZE    = 10 * 1024 * 1024
+	DEFAULT_MAX_FILE_BACKUPS = 5
+)
+
+// FileSink appends records as JSON lines to a file.  Once the file reaches
+// its maximum size it is renamed to `path`.1, the previous `path`.1 to
+// `path`.2 and so on, keeping at most the configured number of backups.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+}
+
+// NewFileSink appends records to the file at `path`, rotating it once it
+// exceeds `maxSize` bytes and keeping `maxBackups` rotated files.  Zero values
+// select DEFAULT_MAX_FILE_SIZE and DEFAULT_MAX_FILE_BACKUPS.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_FILE_SIZE
+	}
+	if maxBackups <= 0 {
+		maxBackups = DEFAULT_MAX_FILE_BACKUPS
+	}
+	fs := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := fs.open(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.file == nil {
+		return fmt.Errorf("audit file %s is closed", fs.path)
+	}
+	if fs.size > 0 && fs.size+int64(len(line)) > fs.maxSize {
+		if err := fs.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := fs.file.Write(line)
+	fs.size += int64(n)
+	if err != nil {
+		return err
+	}
+	// An audit record must survive a crash of the process
+	return fs.file.Sync()
+}
+
+// Query reads the matching records from the rotated files and the current file
+func (fs *FileSink) Query(query Query) ([]Record, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	var records []Record
+	for backup := fs.maxBackups; backup >= 0; backup-- {
+		fileRecords, err := readRecords(fs.backupPath(backup), query)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, fileRecords...)
+	}
+	return query.limit(records), nil
+}
+
+func (fs *FileSink) Close() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if fs.file == nil {
+		return nil
+	}
+	err := fs.file.Close()
+	fs.file = nil
+	return err
+}
+
+func (fs *FileSink) open() error {
+	file, err := os.OpenFile(fs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	fs.file = file
+	fs.size = info.Size()
+	return nil
+}
+
+func (fs *FileSink) rotate() error {
+	if err := fs.file.Close(); err != nil {
+		return err
+	}
+	fs.file = nil
+
+	for backup := fs.maxBackups - 1; backup >= 0; backup-- {
+		err := os.Rename(fs.backupPath(backup), fs.backupPath(backup+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return fs.open()
+}
+
+// backupPath returns the path of the rotated file `backup`, where 0 is the
+// current file
+func (fs *FileSink) backupPath(backup int) string {
+	if backup == 0 {
+		return fs.path
+	}
+	return fmt.Sprintf("%s.%d", fs.path, backup)
+}
+
+func readRecords(path string, query Query) (records []Record, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid audit record in %s: %v", path, err)
+		}
+		if query.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// RingSink keeps the most recent records in memory, for example for tests or
+// to serve recent changes without reading files
+type RingSink struct {
+	lock    sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+// NewRingSink keeps the last `size` records
+func NewRingSink(size int) *RingSink {
+	if size <= 0 {
+		size = 1
+	}
+	return &RingSink{
+		records: make([]Record, size),
+	}
+}
+
+func (rs *RingSink) Write(record Record) error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	rs.records[rs.next] = record
+	rs.next = (rs.next + 1) % len(rs.records)
+	if rs.next == 0 {
+		rs.full = true
+	}
+	return nil
+}
+
+// Records returns the kept records, oldest first
+func (rs *RingSink) Records() []Record {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+
+	if !rs.full {
+		return append([]Record{}, rs.records[:rs.next]...)
+	}
+	return append(append([]Record{}, rs.records[rs.next:]...), rs.records[:rs.next]...)
+}
+
+func (rs *RingSink) Query(query Query) ([]Record, error) {
+	var records []Record
+	for _, record := range rs.Records() {
+		if query.Matches(record) {
+			records = append(records, record)
+		}
+	}
+	return query.limit(records), nil
+}
+
+func (rs *RingSink) Close() error {
+	return nil
+}
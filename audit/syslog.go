@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"log/syslog"
+)
+
+// SyslogSink sends records as JSON to syslog with the auth facility.  Failed
+// operations are sent as warnings.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+// NewSyslogSink connects to the syslog daemon at `raddr` over `network`, or
+// to the local daemon when both are empty, logging with `tag`
+func NewSyslogSink(network string, raddr string, tag string) (*SyslogSink, error) {
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{writer: writer}, nil
+}
+
+func (ss *SyslogSink) Write(record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if record.Outcome == OutcomeFailure {
+		return ss.writer.Warning(string(line))
+	}
+	return ss.writer.Info(string(line))
+}
+
+func (ss *SyslogSink) Close() error {
+	return ss.writer.Close()
+}
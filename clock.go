@@ -0,0 +1,24 @@
+package nanodm
+
+import "time"
+
+// Clock tells the time and waits for it.  The coordinator server, sources and
+// controllers time their pings with a Clock, so that tests can replace the
+// system clock with a fake one (see nanodmtest.FakeClock).
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is the Clock of the system, the default
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,604 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+)
+
+const (
+	// The url the controller listens on for replies unless another is set.
+	// The system chooses the port.
+	DefaultListenUrl = "tcp://127.0.0.1:0"
+
+	defaultRequestTimeout  = 10 * time.Second
+	defaultPingCheckPeriod = 15 * time.Second
+	defaultPingTimeout     = 30 * time.Second
+	// The notifications buffered for a subscription before they're dropped
+	notificationBuffer = 64
+)
+
+// The transaction policies of a candidate commit, the values of
+// coordinator.TransactionPolicy
+const (
+	rejectNonTransactional uint = iota
+	lastResourceNonTransactional
+)
+
+// Controller makes requests of a coordinator server without registering any
+// objects, for tools such as nanodmcli.  It's safe for concurrent use.
+type Controller struct {
+	log            *logrus.Entry
+	name           string
+	serverUrl      string
+	listenUrl      string
+	requestTimeout time.Duration
+
+	pusher     *nanodm.Pusher
+	pusherChan chan nanodm.Message
+	puller     *nanodm.Puller
+	pullerChan chan nanodm.Message
+	closeChan  chan struct{}
+	ackMap     *nanodm.ConcurrentMessageMap
+
+	clock         nanodm.Clock
+	faults        *nanodm.FaultInjector
+	limits        nanodm.Limits
+	lastPing      time.Time
+	lastPingMutex sync.Mutex
+
+	subscriptions      map[*Subscription]bool
+	subscriptionsMutex sync.Mutex
+}
+
+// Notification is a change to an object a subscription is subscribed to
+type Notification struct {
+	// The time the notification was received
+	Time      time.Time
+	Operation nanodm.Operation
+}
+
+// Change is a difference between the candidate of the controller and the
+// running values
+type Change struct {
+	Type nanodm.OperationType
+	Name string
+	// The running value, or the values of a row being deleted by parameter
+	// name
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// CommitOptions are the options of a candidate commit
+type CommitOptions struct {
+	// Apply the operations of one source that doesn't take part in
+	// transactions once the others have prepared, instead of failing
+	LastResource bool
+	// If set, the commit is reverted unless it's confirmed within the timeout
+	ConfirmTimeout time.Duration
+}
+
+// CommitResult is the result of a candidate commit
+type CommitResult struct {
+	// The ID of the transaction of the commit
+	ID string
+	// The rows added, in the order of the staged AddRows
+	Rows []string
+}
+
+// Subscription receives the changes to the paths it's subscribed to
+type Subscription struct {
+	controller *Controller
+	paths      []string
+	c          chan Notification
+}
+
+// NewController creates a controller of the server at `serverUrl`
+func NewController(log *logrus.Entry, serverUrl string) *Controller {
+	return &Controller{
+		log:            log,
+		name:           fmt.Sprintf("controller-%s", uuid.New().String()),
+		serverUrl:      serverUrl,
+		listenUrl:      DefaultListenUrl,
+		requestTimeout: defaultRequestTimeout,
+		pusherChan:     make(chan nanodm.Message),
+		pullerChan:     make(chan nanodm.Message),
+		closeChan:      make(chan struct{}),
+		ackMap:         nanodm.NewConcurrentMessageMap(),
+		subscriptions:  make(map[*Subscription]bool),
+		clock:          nanodm.SystemClock,
+		limits:         nanodm.DefaultLimits,
+	}
+}
+
+// Name returns the name the controller connects to the server with
+func (co *Controller) Name() string {
+	return co.name
+}
+
+// SetListenUrl sets the url the controller listens on for replies, which
+// the server must be able to reach.  Call it before Connect.
+func (co *Controller) SetListenUrl(url string) {
+	co.listenUrl = url
+}
+
+// SetRequestTimeout sets the time to wait for the server to answer a
+// request.  A deadline on the context of a request also applies.
+func (co *Controller) SetRequestTimeout(timeout time.Duration) {
+	co.requestTimeout = timeout
+}
+
+// SetClock sets the clock that times the pings of the server.  Call it
+// before Connect.
+func (co *Controller) SetClock(clock nanodm.Clock) {
+	co.clock = clock
+}
+
+// SetFaultInjector injects the faults of `faults` into the messages the
+// controller sends and receives.  Call it before Connect.
+func (co *Controller) SetFaultInjector(faults *nanodm.FaultInjector) {
+	co.faults = faults
+}
+
+// SetLimits sets the limits of the messages the controller accepts from the
+// server, nanodm.DefaultLimits unless set.  Call it before Connect.
+func (co *Controller) SetLimits(limits nanodm.Limits) {
+	co.limits = limits
+}
+
+// Connect connects the controller to the server
+func (co *Controller) Connect() error {
+	co.puller = nanodm.NewPuller(co.log, co.listenUrl, co.pullerChan)
+	co.puller.SetFaultInjector(co.faults)
+	co.puller.SetLimits(co.limits)
+	err := co.puller.Start()
+	if err != nil {
+		return err
+	}
+
+	co.pusher = nanodm.NewPusher(co.log, co.serverUrl, co.pusherChan)
+	co.pusher.SetFaultInjector(co.faults)
+	err = co.pusher.Start()
+	if err != nil {
+		co.puller.Stop()
+		return err
+	}
+
+	go co.pullerTask()
+
+	err = co.register()
+	if err != nil {
+		co.stop()
+		return err
+	}
+
+	go co.pingTask()
+	return nil
+}
+
+// Close disconnects the controller from the server, and closes its
+// subscriptions
+func (co *Controller) Close() error {
+	unregMessage := co.newMessage(nanodm.UnregisterMessageType)
+	_, err := co.request(context.Background(), unregMessage)
+
+	co.subscriptionsMutex.Lock()
+	for subscription := range co.subscriptions {
+		close(subscription.c)
+		delete(co.subscriptions, subscription)
+	}
+	co.subscriptionsMutex.Unlock()
+
+	co.stop()
+	return err
+}
+
+func (co *Controller) stop() {
+	close(co.closeChan)
+	co.pusher.Stop()
+	co.puller.Stop()
+}
+
+// Get gets objects.  A partial path (ending in ".") gets every object under
+// it.  If some objects fail the objects fetched are returned with the error.
+func (co *Controller) Get(ctx context.Context, names ...string) ([]nanodm.Object, error) {
+	getMessage := co.newMessage(nanodm.GetMessageType)
+	for _, name := range names {
+		getMessage.Objects = append(getMessage.Objects, nanodm.Object{Name: name})
+	}
+
+	ackMessage, err := co.request(ctx, getMessage)
+	if ackMessage != nil {
+		return ackMessage.Objects, err
+	}
+	return nil, err
+}
+
+// Set sets objects
+func (co *Controller) Set(ctx context.Context, objects ...nanodm.Object) error {
+	setMessage := co.newMessage(nanodm.SetMessageType)
+	setMessage.Objects = objects
+
+	_, err := co.request(ctx, setMessage)
+	return err
+}
+
+// List lists the objects registered at `path`, or under it if it's a partial
+// path
+func (co *Controller) List(ctx context.Context, path string) ([]nanodm.Object, error) {
+	listMessage := co.newMessage(nanodm.ListMessagesType)
+	listMessage.Objects = []nanodm.Object{{Name: path}}
+
+	ackMessage, err := co.request(ctx, listMessage)
+	if err != nil {
+		return nil, err
+	}
+	return ackMessage.Objects, nil
+}
+
+// NextLevel returns the names registered directly below the partial path
+// `path`: objects, dynamic lists and the partial paths of deeper branches
+func (co *Controller) NextLevel(ctx context.Context, path string) ([]string, error) {
+	nextLevelMessage := co.newMessage(nanodm.NextLevelMessageType)
+	nextLevelMessage.Objects = []nanodm.Object{{Name: path}}
+
+	ackMessage, err := co.request(ctx, nextLevelMessage)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, object := range ackMessage.Objects {
+		names = append(names, object.Name)
+	}
+	return names, nil
+}
+
+// Registry returns the objects and dynamic lists registered under the
+// partial path `path`, or at `path`, with the sources owning them
+func (co *Controller) Registry(ctx context.Context, path string) ([]nanodm.RegisteredObject, error) {
+	registryMessage := co.newMessage(nanodm.RegistryMessageType)
+	registryMessage.Objects = []nanodm.Object{{Name: path}}
+
+	ackMessage, err := co.request(ctx, registryMessage)
+	if err != nil {
+		return nil, err
+	}
+	var registered []nanodm.RegisteredObject
+	for _, object := range ackMessage.Objects {
+		// The value of each object is its owner's name
+		owner, _ := object.Value.(string)
+		object.Value = nil
+		registered = append(registered, nanodm.RegisteredObject{Object: object, Owner: owner})
+	}
+	return registered, nil
+}
+
+// AddRow adds a row to the dynamic list `object`.  The value of `object` holds
+// the initial values of the row by parameter name.  Returns the name of the
+// row added.
+func (co *Controller) AddRow(ctx context.Context, object nanodm.Object) (string, error) {
+	addRowMessage := co.newMessage(nanodm.AddRowMessageType)
+	addRowMessage.Objects = []nanodm.Object{object}
+
+	ackMessage, err := co.request(ctx, addRowMessage)
+	if err != nil {
+		return "", err
+	}
+	if len(ackMessage.Objects) != 1 {
+		return "", nanodm.Errorf(nanodm.CodeInternal, "received %d rows added", len(ackMessage.Objects))
+	}
+	return ackMessage.Objects[0].Name, nil
+}
+
+// DeleteRow deletes the row `object`
+func (co *Controller) DeleteRow(ctx context.Context, object nanodm.Object) error {
+	deleteRowMessage := co.newMessage(nanodm.DeleteRowMessageType)
+	deleteRowMessage.Objects = []nanodm.Object{object}
+
+	_, err := co.request(ctx, deleteRowMessage)
+	return err
+}
+
+// Stage stages `operations` in the candidate of the controller without
+// changing the sources.  Each controller session has its own candidate, which
+// is dropped when the controller is closed.
+func (co *Controller) Stage(ctx context.Context, operations ...nanodm.Operation) error {
+	stageMessage := co.newMessage(nanodm.CandidateStageMessageType)
+	stageMessage.Operations = operations
+
+	_, err := co.request(ctx, stageMessage)
+	return err
+}
+
+// Diff returns the changes the staged operations make to the running values,
+// in the order they were staged
+func (co *Controller) Diff(ctx context.Context) ([]Change, error) {
+	diffMessage := co.newMessage(nanodm.CandidateDiffMessageType)
+
+	ackMessage, err := co.request(ctx, diffMessage)
+	if err != nil {
+		return nil, err
+	}
+	if len(ackMessage.Operations) != len(ackMessage.Objects) {
+		return nil, nanodm.Errorf(nanodm.CodeInternal, "received %d changes with %d old values", len(ackMessage.Operations), len(ackMessage.Objects))
+	}
+	var changes []Change
+	for i, operation := range ackMessage.Operations {
+		changes = append(changes, Change{
+			Type:     operation.Type,
+			Name:     operation.Object.Name,
+			OldValue: ackMessage.Objects[i].Value,
+			NewValue: operation.Object.Value,
+		})
+	}
+	return changes, nil
+}
+
+// Commit applies the staged operations to the sources as one transaction,
+// and clears them if it succeeds.  With a confirm timeout the commit is
+// reverted unless Confirm is called in time.
+func (co *Controller) Commit(ctx context.Context, options CommitOptions) (*CommitResult, error) {
+	commitMessage := co.newMessage(nanodm.CandidateCommitMessageType)
+	commitMessage.Policy = rejectNonTransactional
+	if options.LastResource {
+		commitMessage.Policy = lastResourceNonTransactional
+	}
+	commitMessage.ConfirmTimeout = options.ConfirmTimeout
+
+	ackMessage, err := co.request(ctx, commitMessage)
+	if err != nil {
+		return nil, err
+	}
+	result := &CommitResult{ID: ackMessage.TxnID.String()}
+	for _, object := range ackMessage.Objects {
+		result.Rows = append(result.Rows, object.Name)
+	}
+	return result, nil
+}
+
+// Confirm confirms the commit waiting to be confirmed, so it's not reverted
+func (co *Controller) Confirm(ctx context.Context) error {
+	confirmMessage := co.newMessage(nanodm.CandidateConfirmMessageType)
+
+	_, err := co.request(ctx, confirmMessage)
+	return err
+}
+
+// Discard drops the staged operations
+func (co *Controller) Discard(ctx context.Context) error {
+	discardMessage := co.newMessage(nanodm.CandidateDiscardMessageType)
+
+	_, err := co.request(ctx, discardMessage)
+	return err
+}
+
+// Subscribe subscribes to the changes to `paths`.  A partial path (ending in
+// ".") subscribes to every object under it.  The server notifies the changes
+// made through it, and the changes sources report.
+func (co *Controller) Subscribe(ctx context.Context, paths ...string) (*Subscription, error) {
+	if len(paths) == 0 {
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "no paths to subscribe to")
+	}
+	subscription := &Subscription{
+		controller: co,
+		paths:      paths,
+		c:          make(chan Notification, notificationBuffer),
+	}
+	if err := co.subscribe(ctx, paths); err != nil {
+		return nil, err
+	}
+
+	co.subscriptionsMutex.Lock()
+	co.subscriptions[subscription] = true
+	co.subscriptionsMutex.Unlock()
+	return subscription, nil
+}
+
+// C returns the channel the notifications are delivered on, which is closed
+// when the subscription ends.  Notifications are dropped if the channel is
+// full.
+func (su *Subscription) C() <-chan Notification {
+	return su.c
+}
+
+// Paths returns the paths of the subscription
+func (su *Subscription) Paths() []string {
+	return su.paths
+}
+
+// Unsubscribe ends the subscription
+func (su *Subscription) Unsubscribe(ctx context.Context) error {
+	co := su.controller
+	co.subscriptionsMutex.Lock()
+	if !co.subscriptions[su] {
+		co.subscriptionsMutex.Unlock()
+		return nil
+	}
+	delete(co.subscriptions, su)
+	close(su.c)
+
+	// The paths of other subscriptions stay subscribed
+	inUse := co.subscribedPaths()
+	var paths []string
+	for _, path := range su.paths {
+		if !inUse[path] {
+			paths = append(paths, path)
+		}
+	}
+	co.subscriptionsMutex.Unlock()
+
+	if len(paths) == 0 {
+		return nil
+	}
+	unsubscribeMessage := co.newMessage(nanodm.UnsubscribeMessageType)
+	for _, path := range paths {
+		unsubscribeMessage.Objects = append(unsubscribeMessage.Objects, nanodm.Object{Name: path})
+	}
+	_, err := co.request(ctx, unsubscribeMessage)
+	return err
+}
+
+// subscribedPaths returns the paths of the subscriptions.  The caller holds
+// the subscriptionsMutex.
+func (co *Controller) subscribedPaths() map[string]bool {
+	paths := make(map[string]bool)
+	for subscription := range co.subscriptions {
+		for _, path := range subscription.paths {
+			paths[path] = true
+		}
+	}
+	return paths
+}
+
+func (co *Controller) subscribe(ctx context.Context, paths []string) error {
+	subscribeMessage := co.newMessage(nanodm.SubscribeMessageType)
+	for _, path := range paths {
+		subscribeMessage.Objects = append(subscribeMessage.Objects, nanodm.Object{Name: path})
+	}
+	_, err := co.request(ctx, subscribeMessage)
+	return err
+}
+
+// register connects the controller to the server, and restores its
+// subscriptions if it's reconnecting
+func (co *Controller) register() error {
+	registerMessage := co.newMessage(nanodm.RegisterMessageType)
+	registerMessage.Capabilities = []string{nanodm.CapabilityController}
+	_, err := co.request(context.Background(), registerMessage)
+	if err != nil {
+		return err
+	}
+	co.updatePing()
+
+	co.subscriptionsMutex.Lock()
+	var paths []string
+	for path := range co.subscribedPaths() {
+		paths = append(paths, path)
+	}
+	co.subscriptionsMutex.Unlock()
+	if len(paths) > 0 {
+		return co.subscribe(context.Background(), paths)
+	}
+	return nil
+}
+
+func (co *Controller) newMessage(msgType nanodm.MessageType) nanodm.Message {
+	return nanodm.Message{
+		Type:           msgType,
+		SourceName:     co.name,
+		Source:         co.puller.Address(),
+		Destination:    co.serverUrl,
+		TransactionUID: nanodm.GetTransactionUID(),
+	}
+}
+
+// request sends `message` to the server and waits for the ack.  A nack is
+// returned with its error.
+func (co *Controller) request(ctx context.Context, message nanodm.Message) (*nanodm.Message, error) {
+	waitCtx, cancel := context.WithTimeout(ctx, co.requestTimeout)
+	defer cancel()
+
+	select {
+	case co.pusherChan <- message:
+	case <-co.closeChan:
+		return nil, nanodm.Errorf(nanodm.CodeSourceUnavailable, "the controller is closed")
+	}
+	ackMessage, err := co.ackMap.WaitForKeyContext(waitCtx, message.TransactionUID.String())
+	if err != nil {
+		return nil, err
+	}
+	switch ackMessage.Type {
+	case nanodm.AckMessageType:
+		return ackMessage, nil
+	case nanodm.NackMessageType:
+		return ackMessage, fmt.Errorf("received %s error: %w", message.Type.Name(), nanodm.MessageError(ackMessage))
+	}
+	return ackMessage, fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
+}
+
+func (co *Controller) pullerTask() {
+	for {
+		select {
+		case message := <-co.pullerChan:
+			switch message.Type {
+			case nanodm.AckMessageType, nanodm.NackMessageType:
+				co.ackMap.Set(message.TransactionUID.String(), message)
+			case nanodm.PingMessageType:
+				co.updatePing()
+				select {
+				case co.pusherChan <- co.newMessage(nanodm.PingMessageType):
+				case <-co.closeChan:
+					return
+				}
+			case nanodm.NotifyMessageType:
+				co.notify(message.Operations)
+			}
+		case <-co.closeChan:
+			return
+		}
+	}
+}
+
+// notify delivers `operations` to the subscriptions they match
+func (co *Controller) notify(operations []nanodm.Operation) {
+	now := time.Now()
+	co.subscriptionsMutex.Lock()
+	defer co.subscriptionsMutex.Unlock()
+	for _, operation := range operations {
+		for subscription := range co.subscriptions {
+			if !subscription.matches(operation) {
+				continue
+			}
+			select {
+			case subscription.c <- Notification{Time: now, Operation: operation}:
+			default:
+				co.log.Warnf("Dropping the notification of %s, the subscription isn't keeping up", operation.Object.Name)
+			}
+		}
+	}
+}
+
+// matches returns true if the change `operation` is to a path of the
+// subscription.  A row being deleted also changes the paths under it.
+func (su *Subscription) matches(operation nanodm.Operation) bool {
+	name := operation.Object.Name
+	for _, path := range su.paths {
+		if nanodm.MatchesPath(path, name) || (operation.Type == nanodm.OperationDeleteRow && strings.HasPrefix(path, strings.TrimSuffix(name, ".")+".")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (co *Controller) updatePing() {
+	co.lastPingMutex.Lock()
+	co.lastPing = co.clock.Now()
+	co.lastPingMutex.Unlock()
+}
+
+// pingTask reconnects the controller if the server stops pinging it, for
+// example because the server restarted
+func (co *Controller) pingTask() {
+	for {
+		select {
+		case now := <-co.clock.After(defaultPingCheckPeriod):
+			co.lastPingMutex.Lock()
+			lastPing := co.lastPing
+			co.lastPingMutex.Unlock()
+			if now.After(lastPing.Add(defaultPingTimeout)) {
+				co.log.Warnf("reconnecting controller %s, last ping was %s ago", co.name, now.Sub(lastPing).String())
+				if err := co.register(); err != nil {
+					co.log.Errorf("failed to reconnect: %v", err)
+				}
+			}
+		case <-co.closeChan:
+			return
+		}
+	}
+}
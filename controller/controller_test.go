@@ -0,0 +1,274 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+	"github.com/zackwine/nanodm/source"
+)
+
+func getLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetOutput(os.Stdout)
+	logger.SetLevel(logrus.InfoLevel)
+	return logrus.NewEntry(logger)
+}
+
+// MapSource serves the objects of a map, and the rows of the dynamic list
+// Device.NAT.PortMapping.
+type MapSource struct {
+	lock      sync.Mutex
+	values    map[string]interface{}
+	nextIndex int
+}
+
+func (ms *MapSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, name := range objectNames {
+		found := false
+		for objName, value := range ms.values {
+			if nanodm.MatchesPath(name, objName) {
+				objects = append(objects, nanodm.Object{Name: objName, Type: nanodm.TypeString, Value: value})
+				found = true
+			}
+		}
+		if !found && !strings.HasSuffix(name, ".") {
+			return objects, nanodm.ObjectErrorf(name, nanodm.CodeNotFound, "no object %s", name)
+		}
+	}
+	return objects, nil
+}
+
+func (ms *MapSource) SetObjects(objects []nanodm.Object) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for _, object := range objects {
+		ms.values[object.Name] = object.Value
+	}
+	return nil
+}
+
+func (ms *MapSource) AddRow(object nanodm.Object) (row string, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.nextIndex++
+	row = fmt.Sprintf("%s%d.", object.Name, ms.nextIndex)
+	values, _ := object.Value.(map[string]interface{})
+	for name, value := range values {
+		ms.values[row+name] = value
+	}
+	return row, nil
+}
+
+func (ms *MapSource) DeleteRow(row nanodm.Object) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	for name := range ms.values {
+		if strings.HasPrefix(name, row.Name) {
+			delete(ms.values, name)
+		}
+	}
+	return nil
+}
+
+func TestController(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4549"
+
+	var objects = []nanodm.Object{
+		{Name: "Device.WiFi.SSID", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		{Name: "Device.WiFi.Channel", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		{Name: "Device.NAT.PortMapping.", Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList},
+	}
+
+	log := getLogger()
+
+	server := coordinator.NewServer(log, serverUrl, nil)
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	mapSource := &MapSource{values: map[string]interface{}{"Device.WiFi.SSID": "home", "Device.WiFi.Channel": "6"}}
+	src := source.NewSource(log, "wifiSource", serverUrl, "tcp://127.0.0.1:4550", mapSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+	err = src.Register(objects)
+	assert.Nil(t, err)
+
+	// Two controllers listen on ports chosen by the system
+	ctrl := NewController(log, serverUrl)
+	err = ctrl.Connect()
+	assert.Nil(t, err)
+	defer ctrl.Close()
+	other := NewController(log, serverUrl)
+	err = other.Connect()
+	assert.Nil(t, err)
+
+	// Controllers aren't sources
+	assert.Equal(t, 1, len(server.Sources()))
+	assert.Equal(t, 2, len(server.Controllers()))
+	// Their sessions share a label in the metrics
+	assert.Equal(t, float64(2), server.Metrics().Received.Value("Register", coordinator.CONTROLLER_LABEL))
+	assert.Equal(t, float64(0), server.Metrics().Received.Value("Register", ctrl.Name()))
+
+	ctx := context.Background()
+	got, err := ctrl.Get(ctx, "Device.WiFi.SSID")
+	assert.Nil(t, err)
+	assert.Equal(t, []nanodm.Object{{Name: "Device.WiFi.SSID", Type: nanodm.TypeString, Value: "home"}}, got)
+
+	_, err = ctrl.Get(ctx, "Device.Missing")
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+
+	// The objects fetched are returned with the error of the others
+	got, err = ctrl.Get(ctx, "Device.WiFi.SSID", "Device.Missing")
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	assert.Equal(t, []nanodm.Object{{Name: "Device.WiFi.SSID", Type: nanodm.TypeString, Value: "home"}}, got)
+
+	// A partial path gets the objects under it
+	got, err = ctrl.Get(ctx, "Device.WiFi.")
+	assert.Nil(t, err)
+	assert.Equal(t, []nanodm.Object{
+		{Name: "Device.WiFi.Channel", Type: nanodm.TypeString, Value: "6"},
+		{Name: "Device.WiFi.SSID", Type: nanodm.TypeString, Value: "home"},
+	}, got)
+	_, err = ctrl.Get(ctx, "Device.Missing.")
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+
+	listed, err := ctrl.List(ctx, "Device.WiFi.")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(listed))
+
+	names, err := ctrl.NextLevel(ctx, "Device.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.NAT.", "Device.WiFi."}, names)
+	names, err = ctrl.NextLevel(ctx, "Device.WiFi.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.WiFi.Channel", "Device.WiFi.SSID"}, names)
+
+	registered, err := ctrl.Registry(ctx, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []nanodm.RegisteredObject{
+		{Object: objects[2], Owner: "wifiSource"},
+		{Object: objects[1], Owner: "wifiSource"},
+		{Object: objects[0], Owner: "wifiSource"},
+	}, registered)
+	_, err = ctrl.Registry(ctx, "Device.Missing")
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+
+	// Requests are safe to make concurrently
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := other.Get(ctx, "Device.WiFi.Channel")
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(got))
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, other.Close())
+	assert.Equal(t, 1, len(server.Controllers()))
+
+	// Changes are notified to the subscriptions
+	subscription, err := ctrl.Subscribe(ctx, "Device.WiFi.", "Device.NAT.PortMapping.")
+	assert.Nil(t, err)
+
+	err = ctrl.Set(ctx, nanodm.Object{Name: "Device.WiFi.SSID", Value: "guest"})
+	assert.Nil(t, err)
+	notification := <-subscription.C()
+	assert.Equal(t, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.WiFi.SSID", Value: "guest"}}, notification.Operation)
+
+	row, err := ctrl.AddRow(ctx, nanodm.Object{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeRow, Value: map[string]interface{}{"ExternalPort": "80"}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Device.NAT.PortMapping.1.", row)
+	notification = <-subscription.C()
+	assert.Equal(t, nanodm.OperationAddRow, notification.Operation.Type)
+	assert.Equal(t, row, notification.Operation.Object.Name)
+
+	got, err = ctrl.Get(ctx, row)
+	assert.Nil(t, err)
+	assert.Equal(t, []nanodm.Object{{Name: row + "ExternalPort", Type: nanodm.TypeString, Value: "80"}}, got)
+
+	err = ctrl.DeleteRow(ctx, nanodm.Object{Name: row, Type: nanodm.TypeRow})
+	assert.Nil(t, err)
+	notification = <-subscription.C()
+	assert.Equal(t, nanodm.OperationDeleteRow, notification.Operation.Type)
+
+	// Sources report the changes they make
+	err = src.Notify([]nanodm.Object{{Name: "Device.WiFi.Channel", Value: "11"}})
+	assert.Nil(t, err)
+	notification = <-subscription.C()
+	assert.Equal(t, "Device.WiFi.Channel", notification.Operation.Object.Name)
+	assert.Equal(t, "11", notification.Operation.Object.Value)
+
+	err = src.Notify([]nanodm.Object{{Name: "Device.Other", Value: "1"}})
+	assert.True(t, errors.Is(err, nanodm.ErrAccessDenied))
+
+	err = subscription.Unsubscribe(ctx)
+	assert.Nil(t, err)
+	_, open := <-subscription.C()
+	assert.False(t, open)
+
+	// Operations are staged in the candidate of the controller session
+	err = ctrl.Stage(ctx, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.WiFi.SSID", Value: "staged"}})
+	assert.Nil(t, err)
+	err = ctrl.Stage(ctx, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.Missing", Value: "0"}})
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	changes, err := ctrl.Diff(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Type: nanodm.OperationSet, Name: "Device.WiFi.SSID", OldValue: "guest", NewValue: "staged"}}, changes)
+
+	third := NewController(log, serverUrl)
+	err = third.Connect()
+	assert.Nil(t, err)
+	changes, err = third.Diff(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+	assert.Nil(t, third.Close())
+
+	// The source isn't transactional, so it's committed as the last resource
+	_, err = ctrl.Commit(ctx, CommitOptions{})
+	assert.True(t, errors.Is(err, nanodm.ErrAccessDenied))
+	result, err := ctrl.Commit(ctx, CommitOptions{LastResource: true})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.ID)
+	got, err = ctrl.Get(ctx, "Device.WiFi.SSID")
+	assert.Nil(t, err)
+	assert.Equal(t, "staged", got[0].Value)
+	changes, err = ctrl.Diff(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+	err = ctrl.Confirm(ctx)
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+
+	err = ctrl.Stage(ctx, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.WiFi.SSID", Value: "discarded"}})
+	assert.Nil(t, err)
+	assert.Nil(t, ctrl.Discard(ctx))
+	changes, err = ctrl.Diff(ctx)
+	assert.Nil(t, err)
+	assert.Empty(t, changes)
+
+	// Wait for a notification that shouldn't come
+	subscription, err = ctrl.Subscribe(ctx, "Device.NAT.")
+	assert.Nil(t, err)
+	err = ctrl.Set(ctx, nanodm.Object{Name: "Device.WiFi.SSID", Value: "home"})
+	assert.Nil(t, err)
+	select {
+	case notification := <-subscription.C():
+		t.Errorf("unexpected notification %+v", notification)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
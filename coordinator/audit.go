@@ -0,0 +1,65 @@
+package coordinator
+
+import (
+	"context"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+)
+
+// SetAuditLog records every Set, AddRow and DeleteRow handled by the server in
+// `auditLog`.  Auditing is disabled if `auditLog` is nil.
+func (se *Server) SetAuditLog(auditLog *audit.Log) {
+	se.auditLog = auditLog
+}
+
+// AuditLog returns the audit log of the server, or nil if auditing is disabled
+func (se *Server) AuditLog() *audit.Log {
+	return se.auditLog
+}
+
+// auditOldValue fetches the value of `path` before it's changed.  The value
+// of a row is a map of its object names to values.  If the value can't be
+// fetched the value last set through the audit log is used.
+func (se *Server) auditOldValue(ctx context.Context, path string) interface{} {
+	if se.auditLog == nil {
+		return nil
+	}
+
+	var objects []nanodm.Object
+	var errs []error
+	if strings.HasSuffix(path, ".") {
+		objects, errs = se.GetPartialContext(ctx, path)
+	} else {
+		objects, errs = se.GetContext(ctx, []string{path})
+	}
+
+	if len(errs) == 0 {
+		if !strings.HasSuffix(path, ".") && len(objects) == 1 {
+			return objects[0].Value
+		}
+		values := make(map[string]interface{}, len(objects))
+		for _, object := range objects {
+			values[object.Name] = object.Value
+		}
+		return values
+	}
+	value, _ := se.auditLog.LastValue(path)
+	return value
+}
+
+// audit records an operation of the server sent to a source with
+// `transactionUID`
+func (se *Server) audit(ctx context.Context, operation audit.Operation, path string, row string, oldValue interface{}, newValue interface{}, transactionUID uuid.UUID, err error) {
+	if se.auditLog == nil {
+		return
+	}
+	record := audit.NewRecord(ctx, operation, path, oldValue, newValue, err)
+	record.Row = row
+	if transactionUID != uuid.Nil {
+		record.TransactionUID = transactionUID.String()
+	}
+	se.auditLog.Record(record)
+}
@@ -0,0 +1,495 @@
+package coordinator
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zackwine/nanodm"
+)
+
+// Candidate is a candidate datastore: Sets, AddRows and DeleteRows are staged
+// in it without changing the sources, and can be viewed and compared with the
+// running values before they're committed or discarded.  A commit can be
+// confirmed, in which case it's reverted unless Confirm is called in time, so
+// a change that cuts off the controller undoes itself.
+type Candidate struct {
+	server *Server
+
+	mutex      sync.Mutex
+	operations []nanodm.Operation
+	pending    *confirmedCommit
+	// Set while a commit is applied, which is done without holding the mutex
+	committing bool
+	// Incremented by Discard, so a commit doesn't clear operations staged
+	// after them
+	discards int
+}
+
+// CommitOptions are the options of a Candidate commit
+type CommitOptions struct {
+	// How the transaction of the commit handles non-transactional sources
+	Policy TransactionPolicy
+	// If set, the commit is reverted unless it's confirmed within the timeout
+	ConfirmTimeout time.Duration
+}
+
+// Change is a difference between the candidate and running values
+type Change struct {
+	Type nanodm.OperationType
+	Name string
+	// The running value, or the values of a row being deleted by parameter
+	// name
+	OldValue interface{}
+	NewValue interface{}
+}
+
+// confirmedCommit is a commit waiting to be confirmed
+type confirmedCommit struct {
+	policy   TransactionPolicy
+	timer    *time.Timer
+	rollback []nanodm.Operation
+}
+
+// Candidate returns the candidate datastore of the server
+func (se *Server) Candidate() *Candidate {
+	return se.candidate
+}
+
+func newCandidate(se *Server) *Candidate {
+	return &Candidate{server: se}
+}
+
+// controllerCandidate returns the candidate of the controller `name`, which
+// is created on first use.  Each controller session has its own candidate.
+func (se *Server) controllerCandidate(name string) *Candidate {
+	se.candidatesMutex.Lock()
+	defer se.candidatesMutex.Unlock()
+	candidate, ok := se.candidates[name]
+	if !ok {
+		candidate = newCandidate(se)
+		se.candidates[name] = candidate
+	}
+	return candidate
+}
+
+// dropCandidate drops the candidate of the controller `name` once it's
+// removed.  A commit it didn't confirm is still reverted when it times out.
+func (se *Server) dropCandidate(name string) {
+	se.candidatesMutex.Lock()
+	candidate, ok := se.candidates[name]
+	delete(se.candidates, name)
+	se.candidatesMutex.Unlock()
+	if ok {
+		candidate.Discard()
+	}
+}
+
+// handleClientCandidate stages, diffs, commits, confirms or discards the
+// operations of the candidate of the controller sending `message`
+func (se *Server) handleClientCandidate(message nanodm.Message) {
+	client, exists := se.routingTable().requester(message.SourceName)
+	if !exists {
+		se.log.Errorf("Error candidate client (%s) it isn't a registered client? %+v", message.SourceName, message)
+		return
+	}
+
+	ctx, span := se.startHandlerSpan(message)
+	ackMessage := client.GetMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = message.TransactionUID
+	ackMessage.Source = se.url
+	err := se.candidateRequest(ctx, se.controllerCandidate(message.SourceName), message, &ackMessage)
+	span.SetError(err)
+	span.End()
+
+	if err != nil {
+		se.log.Errorf("Failed %s: %v", message.Type.Name(), err)
+		se.respondNack(client, message, err)
+		return
+	}
+	client.Send(ackMessage)
+}
+
+// candidateRequest applies the candidate request `message` to `candidate`,
+// and fills `ackMessage` with its result.  The changes of a diff are sent as
+// operations with their new values, and objects with their old values.  The
+// rows added by a commit are sent as objects.
+func (se *Server) candidateRequest(ctx context.Context, candidate *Candidate, message nanodm.Message, ackMessage *nanodm.Message) error {
+	switch message.Type {
+	case nanodm.CandidateStageMessageType:
+		if len(message.Operations) == 0 {
+			return nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid stage request with empty operations list")
+		}
+		return candidate.stageOperations(message.Operations)
+	case nanodm.CandidateDiffMessageType:
+		changes, err := candidate.Diff(ctx)
+		if err != nil {
+			return err
+		}
+		routes := se.routingTable()
+		for _, change := range changes {
+			object := nanodm.Object{Name: change.Name}
+			if change.Type == nanodm.OperationSet {
+				if cobject := routes.object(change.Name); cobject != nil {
+					object.Type = cobject.object.Type
+				}
+			}
+			newObject, oldObject := object, object
+			newObject.Value, oldObject.Value = change.NewValue, change.OldValue
+			ackMessage.Operations = append(ackMessage.Operations, nanodm.Operation{Type: change.Type, Object: newObject})
+			ackMessage.Objects = append(ackMessage.Objects, oldObject)
+		}
+		return nil
+	case nanodm.CandidateCommitMessageType:
+		if message.Policy > uint(LastResourceNonTransactional) {
+			return nanodm.Errorf(nanodm.CodeInvalidValue, "unknown transaction policy %d", message.Policy)
+		}
+		result, err := candidate.Commit(ctx, CommitOptions{Policy: TransactionPolicy(message.Policy), ConfirmTimeout: message.ConfirmTimeout})
+		if err != nil {
+			return err
+		}
+		ackMessage.TxnID, _ = uuid.Parse(result.ID)
+		for _, row := range result.Rows {
+			ackMessage.Objects = append(ackMessage.Objects, nanodm.Object{Name: row, Type: nanodm.TypeRow})
+		}
+		return nil
+	case nanodm.CandidateConfirmMessageType:
+		return candidate.Confirm()
+	case nanodm.CandidateDiscardMessageType:
+		candidate.Discard()
+		return nil
+	}
+	return nanodm.Errorf(nanodm.CodeInvalidValue, "unknown candidate request %s", message.Type.Name())
+}
+
+// Set stages setting `object`
+func (ca *Candidate) Set(object nanodm.Object) error {
+	return ca.stage(nanodm.OperationSet, object)
+}
+
+// AddRow stages adding a row to the dynamic list `object`.  The row is named
+// when the candidate is committed.
+func (ca *Candidate) AddRow(object nanodm.Object) error {
+	return ca.stage(nanodm.OperationAddRow, object)
+}
+
+// DeleteRow stages deleting the row `object`
+func (ca *Candidate) DeleteRow(object nanodm.Object) error {
+	return ca.stage(nanodm.OperationDeleteRow, object)
+}
+
+func (ca *Candidate) stage(operationType nanodm.OperationType, object nanodm.Object) error {
+	return ca.stageOperations([]nanodm.Operation{{Type: operationType, Object: object}})
+}
+
+// stageOperations stages `operations`, or none of them if one isn't handled
+func (ca *Candidate) stageOperations(operations []nanodm.Operation) error {
+	routes := ca.server.routingTable()
+	for _, operation := range operations {
+		name := operation.Object.Name
+		switch {
+		case operation.Type > nanodm.OperationDeleteRow:
+			return nanodm.ObjectErrorf(name, nanodm.CodeInvalidValue, "unknown operation type %d on %s", operation.Type, name)
+		case routes.dynamicListFor(name) == nil && (operation.Type != nanodm.OperationSet || routes.object(name) == nil):
+			return nanodm.ObjectErrorf(name, nanodm.CodeNotFound, "the object %s isn't handled", name)
+		}
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.operations = append(ca.operations, operations...)
+	return nil
+}
+
+// Operations returns the staged operations, in order
+func (ca *Candidate) Operations() []nanodm.Operation {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return append([]nanodm.Operation(nil), ca.operations...)
+}
+
+// Discard drops the staged operations
+func (ca *Candidate) Discard() {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.operations = nil
+	ca.discards++
+}
+
+// Get gets objects from the candidate: the running values with the staged
+// Sets applied, and without the rows staged for deletion.  Staged AddRows
+// aren't shown, as their rows are only named on commit.
+func (ca *Candidate) Get(ctx context.Context, objectNames []string) *GetResult {
+	operations := ca.Operations()
+	result := ca.server.GetResults(ctx, objectNames)
+
+	var objects []nanodm.Object
+	for _, object := range result.Objects {
+		deleted := false
+		for _, operation := range operations {
+			switch {
+			case operation.Type == nanodm.OperationSet && operation.Object.Name == object.Name:
+				object.Value = operation.Object.Value
+			case operation.Type == nanodm.OperationDeleteRow && strings.HasPrefix(object.Name, rowPrefix(operation.Object.Name)):
+				deleted = true
+			}
+		}
+		if !deleted {
+			objects = append(objects, object)
+		}
+	}
+	result.Objects = objects
+	return result
+}
+
+// Diff returns the changes the staged operations make to the running values,
+// in the order they were staged.  A Set to the running value isn't a change.
+func (ca *Candidate) Diff(ctx context.Context) ([]Change, error) {
+	operations := ca.Operations()
+	running, err := ca.runningValues(ctx, operations)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	setChanges := make(map[string]int)
+	for _, operation := range operations {
+		name := operation.Object.Name
+		switch operation.Type {
+		case nanodm.OperationSet:
+			if i, ok := setChanges[name]; ok {
+				changes[i].NewValue = operation.Object.Value
+				continue
+			}
+			setChanges[name] = len(changes)
+			changes = append(changes, Change{Type: operation.Type, Name: name, OldValue: running.values[name].Value, NewValue: operation.Object.Value})
+		case nanodm.OperationAddRow:
+			changes = append(changes, Change{Type: operation.Type, Name: name, NewValue: operation.Object.Value})
+		case nanodm.OperationDeleteRow:
+			changes = append(changes, Change{Type: operation.Type, Name: name, OldValue: running.rows[name]})
+		}
+	}
+
+	var diff []Change
+	for _, change := range changes {
+		if change.Type != nanodm.OperationSet || !reflect.DeepEqual(change.OldValue, change.NewValue) {
+			diff = append(diff, change)
+		}
+	}
+	return diff, nil
+}
+
+// Commit applies the staged operations to the sources as one transaction,
+// and clears them if it succeeds.  With a confirm timeout the running values
+// are saved first, and restored unless Confirm is called in time; a deleted
+// row is restored by adding a row with its values.  The candidate isn't
+// locked while the sources apply the operations, so operations can be staged
+// for the next commit meanwhile.
+func (ca *Candidate) Commit(ctx context.Context, options CommitOptions) (*TransactionResult, error) {
+	ca.mutex.Lock()
+	switch {
+	case ca.pending != nil:
+		ca.mutex.Unlock()
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "a confirmed commit is waiting to be confirmed")
+	case ca.committing:
+		ca.mutex.Unlock()
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "a commit is in progress")
+	}
+	operations := append([]nanodm.Operation(nil), ca.operations...)
+	discards := ca.discards
+	ca.committing = true
+	ca.mutex.Unlock()
+
+	result, pending, err := ca.apply(ctx, operations, options)
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	ca.committing = false
+	if err != nil {
+		return result, err
+	}
+	if pending != nil {
+		pending.timer = time.AfterFunc(options.ConfirmTimeout, func() {
+			ca.expire(pending)
+		})
+		ca.pending = pending
+		ca.server.log.Infof("Commit %s must be confirmed within %s", result.ID, options.ConfirmTimeout)
+	}
+	if ca.discards == discards {
+		ca.operations = ca.operations[len(operations):]
+	}
+	return result, nil
+}
+
+// apply commits `operations` as one transaction, and returns the commit to
+// confirm if there's a confirm timeout
+func (ca *Candidate) apply(ctx context.Context, operations []nanodm.Operation, options CommitOptions) (*TransactionResult, *confirmedCommit, error) {
+	var running *runningValues
+	if options.ConfirmTimeout > 0 {
+		var err error
+		running, err = ca.runningValues(ctx, operations)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	tx := ca.server.Transaction(options.Policy)
+	for _, operation := range operations {
+		tx.add(operation.Type, operation.Object)
+	}
+	result, err := tx.Commit(ctx)
+	if err != nil || options.ConfirmTimeout <= 0 {
+		return result, nil, err
+	}
+	return result, &confirmedCommit{
+		policy:   options.Policy,
+		rollback: running.rollback(ca.server.routingTable(), operations, result.Rows),
+	}, nil
+}
+
+// Confirm confirms the pending confirmed commit, so it's not reverted
+func (ca *Candidate) Confirm() error {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	if ca.pending == nil || !ca.pending.timer.Stop() {
+		return nanodm.Errorf(nanodm.CodeNotFound, "no commit is waiting to be confirmed")
+	}
+	ca.pending = nil
+	return nil
+}
+
+// CancelCommit reverts the pending confirmed commit without waiting for it
+// to time out
+func (ca *Candidate) CancelCommit(ctx context.Context) (*TransactionResult, error) {
+	ca.mutex.Lock()
+	if ca.pending == nil || !ca.pending.timer.Stop() {
+		ca.mutex.Unlock()
+		return nil, nanodm.Errorf(nanodm.CodeNotFound, "no commit is waiting to be confirmed")
+	}
+	pending := ca.pending
+	ca.pending = nil
+	ca.mutex.Unlock()
+	return ca.revert(ctx, pending)
+}
+
+// PendingConfirm returns true if a confirmed commit is waiting to be
+// confirmed
+func (ca *Candidate) PendingConfirm() bool {
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+	return ca.pending != nil
+}
+
+// expire reverts `pending` when it isn't confirmed in time.  The candidate
+// isn't locked while it's reverted, so staging isn't blocked by the sources.
+func (ca *Candidate) expire(pending *confirmedCommit) {
+	ca.mutex.Lock()
+	if ca.pending != pending {
+		ca.mutex.Unlock()
+		return
+	}
+	ca.pending = nil
+	ca.mutex.Unlock()
+	ca.server.log.Warnf("Reverting a commit that wasn't confirmed in time")
+	if _, err := ca.revert(context.Background(), pending); err != nil {
+		ca.server.log.Errorf("Failed to revert an unconfirmed commit: %v", err)
+	}
+}
+
+func (ca *Candidate) revert(ctx context.Context, pending *confirmedCommit) (*TransactionResult, error) {
+	tx := ca.server.Transaction(pending.policy)
+	for _, operation := range pending.rollback {
+		tx.add(operation.Type, operation.Object)
+	}
+	return tx.Commit(ctx)
+}
+
+// runningValues are the running values the operations of a commit change
+type runningValues struct {
+	// The objects set, with their running values and types, by name
+	values map[string]nanodm.Object
+	// The values of the rows deleted by row and parameter name
+	rows map[string]map[string]interface{}
+}
+
+// runningValues gets the running values changed by `operations`
+func (ca *Candidate) runningValues(ctx context.Context, operations []nanodm.Operation) (*runningValues, error) {
+	running := &runningValues{
+		values: make(map[string]nanodm.Object),
+		rows:   make(map[string]map[string]interface{}),
+	}
+
+	// Rows are fetched from their dynamic lists, as sources may not get a row
+	// by its name
+	var names []string
+	lists := make(map[string]bool)
+	routes := ca.server.routingTable()
+	for _, operation := range operations {
+		name := operation.Object.Name
+		switch operation.Type {
+		case nanodm.OperationSet:
+			names = append(names, name)
+		case nanodm.OperationDeleteRow:
+			running.rows[name] = make(map[string]interface{})
+			if dynObject := routes.dynamicListFor(name); dynObject != nil && !lists[dynObject.object.Name] {
+				lists[dynObject.object.Name] = true
+				names = append(names, dynObject.object.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return running, nil
+	}
+
+	result := ca.server.GetResults(ctx, names)
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+	for _, object := range result.Objects {
+		running.values[object.Name] = object
+		for row, values := range running.rows {
+			if prefix := rowPrefix(row); strings.HasPrefix(object.Name, prefix) {
+				values[strings.TrimPrefix(object.Name, prefix)] = object.Value
+			}
+		}
+	}
+	return running, nil
+}
+
+// rollback returns the operations reverting `operations`, which added `rows`
+func (rv *runningValues) rollback(routes *routingTable, operations []nanodm.Operation, rows []string) (rollback []nanodm.Operation) {
+	addRow := len(rows)
+	for i := len(operations) - 1; i >= 0; i-- {
+		object := operations[i].Object
+		switch operations[i].Type {
+		case nanodm.OperationSet:
+			running := rv.values[object.Name]
+			rollback = append(rollback, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: object.Name, Type: running.Type, Value: running.Value}})
+		case nanodm.OperationAddRow:
+			addRow--
+			if rows[addRow] != "" {
+				rollback = append(rollback, nanodm.Operation{Type: nanodm.OperationDeleteRow, Object: nanodm.Object{Name: rows[addRow], Type: nanodm.TypeRow}})
+			}
+		case nanodm.OperationDeleteRow:
+			if dynObject := routes.dynamicListFor(object.Name); dynObject != nil {
+				values := make(map[string]interface{}, len(rv.rows[object.Name]))
+				for name, value := range rv.rows[object.Name] {
+					values[name] = value
+				}
+				rollback = append(rollback, nanodm.Operation{Type: nanodm.OperationAddRow, Object: nanodm.Object{Name: dynObject.object.Name, Value: values, Type: nanodm.TypeRow}})
+			}
+		}
+	}
+	return rollback
+}
+
+// rowPrefix returns the prefix of the objects of the row `row`
+func rowPrefix(row string) string {
+	if strings.HasSuffix(row, ".") {
+		return row
+	}
+	return row + "."
+}
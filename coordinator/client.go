@@ -1,6 +1,8 @@
 package coordinator
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -17,9 +19,15 @@ type Client struct {
 	clientUrl  string
 	pusher     *nanodm.Pusher
 	pusherChan chan nanodm.Message
+	// The capabilities the source registered with
+	capabilities []string
+	// The faults injected into the messages sent to the client
+	faults *nanodm.FaultInjector
+	// The pipe the client's messages are received on, accessed atomically
+	pipe uint32
 
-	objects  []nanodm.Object
-	lastPing time.Time
+	lastPing      time.Time
+	lastPingMutex sync.Mutex
 }
 
 func NewClient(log *logrus.Entry, sourceName string, clientUrl string) *Client {
@@ -34,6 +42,7 @@ func NewClient(log *logrus.Entry, sourceName string, clientUrl string) *Client {
 // Connect - connect to the client nanomsg pull socket
 func (cl *Client) Connect() error {
 	cl.pusher = nanodm.NewPusher(cl.log, cl.clientUrl, cl.pusherChan)
+	cl.pusher.SetFaultInjector(cl.faults)
 	return cl.pusher.Start()
 }
 
@@ -47,8 +56,39 @@ func (cl *Client) Send(message nanodm.Message) {
 
 func (cl *Client) GetMessage(msgType nanodm.MessageType) nanodm.Message {
 	return nanodm.Message{
-		Type:        msgType,
-		SourceName:  cl.sourceName,
-		Destination: cl.clientUrl,
+		Type:           msgType,
+		TransactionUID: nanodm.GetTransactionUID(),
+		SourceName:     cl.sourceName,
+		Destination:    cl.clientUrl,
 	}
 }
+
+// hasCapability returns true if the source registered with `capability`
+func (cl *Client) hasCapability(capability string) bool {
+	for _, clientCapability := range cl.capabilities {
+		if clientCapability == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (cl *Client) setLastPing(lastPing time.Time) {
+	cl.lastPingMutex.Lock()
+	defer cl.lastPingMutex.Unlock()
+	cl.lastPing = lastPing
+}
+
+func (cl *Client) getLastPing() time.Time {
+	cl.lastPingMutex.Lock()
+	defer cl.lastPingMutex.Unlock()
+	return cl.lastPing
+}
+
+func (cl *Client) setPipe(pipe uint32) {
+	atomic.StoreUint32(&cl.pipe, pipe)
+}
+
+func (cl *Client) getPipe() uint32 {
+	return atomic.LoadUint32(&cl.pipe)
+}
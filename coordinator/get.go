@@ -0,0 +1,165 @@
+package coordinator
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/tracing"
+)
+
+// GetResult is the result of a Get spanning sources.  A source that fails or
+// doesn't answer in time doesn't stop the objects of the other sources being
+// returned.
+type GetResult struct {
+	// The objects fetched, grouped by source
+	Objects []nanodm.Object
+	// The error of each requested name that couldn't be fetched
+	Errors map[string]error
+
+	names []string
+}
+
+// Errs returns the errors of the result in the order the names were
+// requested.  An error shared by the names requested from a source is
+// returned once.
+func (gr *GetResult) Errs() (errs []error) {
+	seen := make(map[error]bool)
+	for _, name := range gr.names {
+		if err, ok := gr.Errors[name]; ok && !seen[err] {
+			seen[err] = true
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Err returns the errors of the result as nanodm.Errors naming each object
+// that couldn't be fetched, or nil if every object was
+func (gr *GetResult) Err() error {
+	return objectErrors(gr.names, gr.Errors)
+}
+
+// objectErrors returns the errors of `names` in `errs` as nanodm.Errors naming
+// each object, or nil if there are none
+func objectErrors(names []string, errs map[string]error) error {
+	var objErrs nanodm.Errors
+	for _, name := range names {
+		if err, ok := errs[name]; ok {
+			objErrs = append(objErrs, nanodm.ObjectErrorf(name, nanodm.CodeOf(err), "%s", err.Error()))
+		}
+	}
+	if len(objErrs) == 0 {
+		return nil
+	}
+	return objErrs
+}
+
+// objectError returns the error of the object `name` from the error of a
+// source.  If the source named the objects that failed, the error of an
+// object it didn't name is nil.
+func objectError(err error, name string) error {
+	var errs nanodm.Errors
+	if errors.As(err, &errs) {
+		for _, objErr := range errs {
+			if isErrorOf(objErr, name) {
+				return objErr
+			}
+		}
+		return nil
+	}
+	var objErr *nanodm.Error
+	if errors.As(err, &objErr) && !isErrorOf(objErr, name) {
+		return nil
+	}
+	return err
+}
+
+// isErrorOf returns true if `err` doesn't name an object, or names `name` or
+// an object under it
+func isErrorOf(err *nanodm.Error, name string) bool {
+	return err.Name == "" || err.Name == name || (strings.HasSuffix(name, ".") && strings.HasPrefix(err.Name, name))
+}
+
+// sourceGet is the part of a Get sent to one source
+type sourceGet struct {
+	sourceName string
+	names      []string
+	objects    []nanodm.Object
+
+	retObjects []nanodm.Object
+	err        error
+}
+
+// GetResults gets objects as part of the trace in `ctx`.  The objects are
+// requested from their sources concurrently, so the Get takes as long as the
+// slowest source.  A deadline on `ctx` is the deadline of the whole Get; the
+// sources that haven't answered by then fail.
+func (se *Server) GetResults(ctx context.Context, objectNames []string) (result *GetResult) {
+	ctx, span := se.tracer.Start(ctx, "coordinator.Get", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.objects", len(objectNames))
+	result = &GetResult{
+		Errors: make(map[string]error),
+		names:  objectNames,
+	}
+	defer func() {
+		if errs := result.Errs(); len(errs) > 0 {
+			span.SetError(errs[0])
+		}
+		span.End()
+	}()
+
+	// Build a list for each client, in the order the sources are first requested
+	var gets []*sourceGet
+	sourceGets := make(map[string]*sourceGet)
+	routes := se.routingTable()
+	for _, objName := range objectNames {
+		var client *Client
+		var object nanodm.Object
+		if cobject := routes.object(objName); cobject != nil {
+			client, object = cobject.client, cobject.object
+		} else if dynamicObject := routes.dynamicList(objName); dynamicObject != nil {
+			client, object = dynamicObject.client, dynamicObject.object
+		} else if dynamicObject := routes.dynamicListFor(objName); dynamicObject != nil {
+			client, object = dynamicObject.client, nanodm.Object{Name: objName}
+		} else {
+			result.Errors[objName] = nanodm.ObjectErrorf(objName, nanodm.CodeNotFound, "object (%s) doesn't exist", objName)
+			continue
+		}
+
+		get, ok := sourceGets[client.sourceName]
+		if !ok {
+			get = &sourceGet{sourceName: client.sourceName}
+			sourceGets[client.sourceName] = get
+			gets = append(gets, get)
+		}
+		get.names = append(get.names, objName)
+		get.objects = append(get.objects, object)
+	}
+	span.SetAttribute("nanodm.sources", len(gets))
+
+	done := make(chan *sourceGet, len(gets))
+	for _, get := range gets {
+		go func(get *sourceGet) {
+			get.retObjects, get.err = se.getSource(ctx, get.sourceName, get.objects)
+			done <- get
+		}(get)
+	}
+	for range gets {
+		<-done
+	}
+
+	for _, get := range gets {
+		result.Objects = append(result.Objects, get.retObjects...)
+		if get.err != nil {
+			for _, name := range get.names {
+				if err := objectError(get.err, name); err != nil {
+					result.Errors[name] = err
+				}
+			}
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,90 @@
+package coordinator
+
+import (
+	"net/http"
+
+	"github.com/zackwine/nanodm/metrics"
+)
+
+// Results of a request sent to a source
+const (
+	ResultAck     = "ack"
+	ResultNack    = "nack"
+	ResultTimeout = "timeout"
+)
+
+// ServerMetrics are the metrics maintained by a coordinator server.  Requests
+// are labelled by the message type and the name of the source they were sent
+// to.
+type ServerMetrics struct {
+	Registry *metrics.Registry
+
+	// Requests sent to sources
+	Requests *metrics.Counter
+	// Responses to requests by result (ack, nack or timeout)
+	Responses *metrics.Counter
+	// Round-trip latency of requests that were acked or nacked
+	Latency *metrics.Histogram
+	// Requests waiting for a response
+	InFlight *metrics.Gauge
+	// Messages received from sources, and from controllers labelled
+	// CONTROLLER_LABEL
+	Received *metrics.Counter
+	// Objects registered by each source
+	Objects *metrics.Gauge
+	// Ping periods in which a source (or a controller, labelled
+	// CONTROLLER_LABEL) didn't ping the server
+	PingMisses *metrics.Counter
+	// Number of registered sources
+	Sources *metrics.Gauge
+	// Messages received that were rejected, by reason (size, decode, invalid
+	// or sender)
+	Rejected *metrics.Counter
+	// Notifications dropped because the queue of the subscriber was full.
+	// Controllers are labelled CONTROLLER_LABEL.
+	NotificationsDropped *metrics.Counter
+	// Sources that refused the decision of an in-doubt transaction, or didn't
+	// confirm it in time, by decision (commit or abort)
+	HeuristicOutcomes *metrics.Counter
+}
+
+func newServerMetrics() *ServerMetrics {
+	registry := metrics.NewRegistry()
+	return &ServerMetrics{
+		Registry:             registry,
+		Requests:             registry.NewCounter("nanodm_coordinator_requests_total", "Requests sent to sources.", "type", "source"),
+		Responses:            registry.NewCounter("nanodm_coordinator_responses_total", "Responses to requests sent to sources by result (ack, nack or timeout).", "type", "source", "result"),
+		Latency:              registry.NewHistogram("nanodm_coordinator_request_duration_seconds", "Round-trip latency of requests sent to sources.", metrics.DefaultLatencyBuckets, "type", "source"),
+		InFlight:             registry.NewGauge("nanodm_coordinator_requests_in_flight", "Requests waiting for a response from a source.", "source"),
+		Received:             registry.NewCounter("nanodm_coordinator_messages_received_total", "Messages received from sources.", "type", "source"),
+		Objects:              registry.NewGauge("nanodm_coordinator_objects", "Objects registered by each source.", "source"),
+		PingMisses:           registry.NewCounter("nanodm_coordinator_ping_misses_total", "Ping periods in which a source didn't ping the server.", "source"),
+		Sources:              registry.NewGauge("nanodm_coordinator_sources", "Number of registered sources."),
+		Rejected:             registry.NewCounter("nanodm_coordinator_messages_rejected_total", "Messages received that were rejected by reason (size, decode, invalid or sender).", "reason"),
+		NotificationsDropped: registry.NewCounter("nanodm_coordinator_notifications_dropped_total", "Notifications dropped because the queue of the subscriber was full.", "client"),
+		HeuristicOutcomes:    registry.NewCounter("nanodm_coordinator_transaction_heuristic_outcomes_total", "Sources that refused the decision of an in-doubt transaction, or didn't confirm it in time, by decision (commit or abort).", "decision"),
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (sm *ServerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sm.Registry.ServeHTTP(w, r)
+}
+
+// CONTROLLER_LABEL replaces the names of controllers in the labels of the
+// metrics, as controllers connect with a new name each session
+const CONTROLLER_LABEL = "controller"
+
+// clientLabel returns the label of the client `name` in the metrics: its name
+// if it's a source, or CONTROLLER_LABEL if it's a controller
+func (se *Server) clientLabel(name string) string {
+	if _, ok := se.routingTable().controllers[name]; ok {
+		return CONTROLLER_LABEL
+	}
+	return name
+}
+
+// removeSource drops the object count of a source once it is removed
+func (sm *ServerMetrics) removeSource(sourceName string) {
+	sm.Objects.Delete(sourceName)
+}
@@ -0,0 +1,281 @@
+package coordinator
+
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+ * pathIndex is a trie of the registered objects and dynamic lists keyed by
+ * path segment, so "Device.WiFi.Radio.1.Enable" is stored under the nodes
+ * "Device", "WiFi", "Radio", "1" and "Enable".  A dynamic list such as
+ * "Device.NAT.PortMapping." is stored on the node of its last segment.
+ *
+ * The index is persistent to suit the copy-on-write routing table: a clone
+ * shares all nodes with the original, and a change copies only the nodes on
+ * the path it changes.  Nodes created or copied since the clone belong to it
+ * (they carry its edit number), so a batch of changes to a clone copies each
+ * node at most once.
+ */
+
+var lastPathIndexEdit uint64
+
+type pathIndex struct {
+	root         *pathNode
+	edit         uint64
+	objects      int
+	dynamicLists int
+}
+
+type pathNode struct {
+	edit        uint64
+	children    map[string]*pathNode
+	object      *CoordinatorObject
+	dynamicList *CoordinatorObject
+	// The number of objects and dynamic lists at and below the node
+	size int
+}
+
+func newPathIndex() *pathIndex {
+	pi := &pathIndex{edit: atomic.AddUint64(&lastPathIndexEdit, 1)}
+	pi.root = &pathNode{edit: pi.edit}
+	return pi
+}
+
+// clone returns a copy of the index that can be changed without changing
+// the original
+func (pi *pathIndex) clone() *pathIndex {
+	return &pathIndex{
+		root:         pi.root,
+		edit:         atomic.AddUint64(&lastPathIndexEdit, 1),
+		objects:      pi.objects,
+		dynamicLists: pi.dynamicLists,
+	}
+}
+
+// splitPath returns the segments of `path`, ignoring the trailing "." of a
+// partial path
+func splitPath(path string) []string {
+	path = strings.TrimSuffix(path, ".")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// nextSegment returns the first segment of `path` and the rest of it,
+// without allocating as lookups are on the request path
+func nextSegment(path string) (segment string, rest string) {
+	if i := strings.IndexByte(path, '.'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// node returns the node of `path`, or nil
+func (pi *pathIndex) node(path string) *pathNode {
+	node := pi.root
+	for rest := strings.TrimSuffix(path, "."); rest != ""; {
+		var segment string
+		segment, rest = nextSegment(rest)
+		if node = node.children[segment]; node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// object returns the object registered as `name`, or nil
+func (pi *pathIndex) object(name string) *CoordinatorObject {
+	if strings.HasSuffix(name, ".") {
+		return nil
+	}
+	if node := pi.node(name); node != nil {
+		return node.object
+	}
+	return nil
+}
+
+// dynamicList returns the dynamic list registered as `name`, or nil
+func (pi *pathIndex) dynamicList(name string) *CoordinatorObject {
+	if node := pi.node(name); node != nil && node.dynamicList != nil && node.dynamicList.object.Name == name {
+		return node.dynamicList
+	}
+	return nil
+}
+
+// dynamicListFor returns the dynamic list with the longest name that
+// `objectName` starts with, or nil
+func (pi *pathIndex) dynamicListFor(objectName string) *CoordinatorObject {
+	var dynamicList *CoordinatorObject
+	node := pi.root
+	for rest := strings.TrimSuffix(objectName, "."); rest != ""; {
+		var segment string
+		segment, rest = nextSegment(rest)
+		if node = node.children[segment]; node == nil {
+			break
+		}
+		if node.dynamicList != nil && strings.HasPrefix(objectName, node.dynamicList.object.Name) {
+			dynamicList = node.dynamicList
+		}
+	}
+	return dynamicList
+}
+
+// hasEntriesUnder returns true if an object or dynamic list is registered
+// under the partial path `path`, or `path` is handled by a dynamic list
+func (pi *pathIndex) hasEntriesUnder(path string) bool {
+	if node := pi.node(path); node != nil && node.size > 0 {
+		return true
+	}
+	return pi.dynamicListFor(path) != nil
+}
+
+// walk calls `fn` for each object and dynamic list at or under `path` in
+// name order.  A path that isn't partial only matches an exact name.
+func (pi *pathIndex) walk(path string, fn func(coordinatorObject *CoordinatorObject)) {
+	node := pi.node(path)
+	if node == nil {
+		return
+	}
+	if !strings.HasSuffix(path, ".") && path != "" {
+		if node.object != nil {
+			fn(node.object)
+		}
+		return
+	}
+	node.walk(fn)
+}
+
+func (pn *pathNode) walk(fn func(coordinatorObject *CoordinatorObject)) {
+	if pn.object != nil {
+		fn(pn.object)
+	}
+	if pn.dynamicList != nil {
+		fn(pn.dynamicList)
+	}
+	for _, segment := range pn.sortedSegments() {
+		pn.children[segment].walk(fn)
+	}
+}
+
+func (pn *pathNode) sortedSegments() []string {
+	segments := make([]string, 0, len(pn.children))
+	for segment := range pn.children {
+		segments = append(segments, segment)
+	}
+	sort.Strings(segments)
+	return segments
+}
+
+// nextLevel returns the names of the objects directly under the partial path
+// `path`, and the partial paths (ending in ".") of the objects and dynamic
+// lists directly under it, in name order
+func (pi *pathIndex) nextLevel(path string) (names []string, ok bool) {
+	node := pi.node(path)
+	if node == nil {
+		return nil, false
+	}
+	for _, segment := range node.sortedSegments() {
+		child := node.children[segment]
+		if child.object != nil {
+			names = append(names, path+segment)
+		}
+		if child.dynamicList != nil || len(child.children) > 0 {
+			names = append(names, path+segment+".")
+		}
+	}
+	return names, true
+}
+
+// mutable returns `node` if it belongs to the index, or a copy that does
+func (pi *pathIndex) mutable(node *pathNode) *pathNode {
+	if node.edit == pi.edit {
+		return node
+	}
+	copied := *node
+	copied.edit = pi.edit
+	copied.children = make(map[string]*pathNode, len(node.children))
+	for segment, child := range node.children {
+		copied.children[segment] = child
+	}
+	return &copied
+}
+
+// set registers `coordinatorObject` under its name, replacing any object or
+// dynamic list of the same name
+func (pi *pathIndex) set(coordinatorObject *CoordinatorObject, isDynamicList bool) {
+	pi.root = pi.mutable(pi.root)
+	path := []*pathNode{pi.root}
+	node := pi.root
+	for _, segment := range splitPath(coordinatorObject.object.Name) {
+		var child *pathNode
+		if existing, exists := node.children[segment]; exists {
+			child = pi.mutable(existing)
+		} else {
+			child = &pathNode{edit: pi.edit}
+		}
+		if node.children == nil {
+			node.children = make(map[string]*pathNode)
+		}
+		node.children[segment] = child
+		node = child
+		path = append(path, node)
+	}
+
+	added := false
+	if isDynamicList {
+		added = node.dynamicList == nil
+		node.dynamicList = coordinatorObject
+	} else {
+		added = node.object == nil
+		node.object = coordinatorObject
+	}
+	if added {
+		for _, pathNode := range path {
+			pathNode.size++
+		}
+		if isDynamicList {
+			pi.dynamicLists++
+		} else {
+			pi.objects++
+		}
+	}
+}
+
+// remove removes the object or dynamic list registered as `name`
+func (pi *pathIndex) remove(name string, isDynamicList bool) {
+	if isDynamicList && pi.dynamicList(name) == nil || !isDynamicList && pi.object(name) == nil {
+		return
+	}
+
+	segments := splitPath(name)
+	pi.root = pi.mutable(pi.root)
+	path := []*pathNode{pi.root}
+	node := pi.root
+	for _, segment := range segments {
+		node = pi.mutable(node.children[segment])
+		path[len(path)-1].children[segment] = node
+		path = append(path, node)
+	}
+
+	if isDynamicList {
+		node.dynamicList = nil
+		pi.dynamicLists--
+	} else {
+		node.object = nil
+		pi.objects--
+	}
+	for _, pathNode := range path {
+		pathNode.size--
+	}
+
+	// Prune the nodes left empty
+	for i := len(segments); i > 0; i-- {
+		if path[i].size > 0 {
+			break
+		}
+		delete(path[i-1].children, segments[i-1])
+	}
+}
@@ -0,0 +1,375 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+)
+
+func testCoordinatorObject(name string, objectType nanodm.ObjectType) *CoordinatorObject {
+	return &CoordinatorObject{
+		object: nanodm.Object{Name: name, Type: objectType},
+		client: &Client{sourceName: "test"},
+	}
+}
+
+func walkNames(pi *pathIndex, path string) (names []string) {
+	pi.walk(path, func(coordinatorObject *CoordinatorObject) {
+		names = append(names, coordinatorObject.object.Name)
+	})
+	return names
+}
+
+func TestPathIndexSetRemove(t *testing.T) {
+	pi := newPathIndex()
+	pi.set(testCoordinatorObject("Device.WiFi.Radio.1.Enable", nanodm.TypeBool), false)
+	pi.set(testCoordinatorObject("Device.WiFi.Radio.1.Channel", nanodm.TypeInt), false)
+	pi.set(testCoordinatorObject("Device.NAT.PortMapping.", nanodm.TypeDynamicList), true)
+
+	assert.Equal(t, 2, pi.objects)
+	assert.Equal(t, 1, pi.dynamicLists)
+	assert.NotNil(t, pi.object("Device.WiFi.Radio.1.Enable"))
+	assert.Nil(t, pi.object("Device.WiFi.Radio.1."))
+	assert.Nil(t, pi.object("Device.WiFi.Radio.1"))
+	assert.Nil(t, pi.object("Device.WiFi.Radio.1.Enable."))
+	assert.NotNil(t, pi.dynamicList("Device.NAT.PortMapping."))
+	assert.Nil(t, pi.dynamicList("Device.NAT.PortMapping"))
+
+	// Replacing an object doesn't change the counts
+	pi.set(testCoordinatorObject("Device.WiFi.Radio.1.Enable", nanodm.TypeString), false)
+	assert.Equal(t, 2, pi.objects)
+	assert.Equal(t, nanodm.TypeString, pi.object("Device.WiFi.Radio.1.Enable").object.Type)
+
+	pi.remove("Device.WiFi.Radio.1.Enable", false)
+	assert.Nil(t, pi.object("Device.WiFi.Radio.1.Enable"))
+	assert.NotNil(t, pi.object("Device.WiFi.Radio.1.Channel"))
+	assert.Equal(t, 1, pi.objects)
+
+	// Removing what isn't registered is a no-op
+	pi.remove("Device.WiFi.Radio.1.Enable", false)
+	pi.remove("Device.NAT.PortMapping.", false)
+	assert.Equal(t, 1, pi.objects)
+	assert.Equal(t, 1, pi.dynamicLists)
+
+	// Empty branches are pruned
+	pi.remove("Device.WiFi.Radio.1.Channel", false)
+	assert.Nil(t, pi.node("Device.WiFi."))
+	assert.NotNil(t, pi.node("Device."))
+	pi.remove("Device.NAT.PortMapping.", true)
+	assert.Empty(t, pi.root.children)
+	assert.Equal(t, 0, pi.root.size)
+}
+
+func TestPathIndexClone(t *testing.T) {
+	pi := newPathIndex()
+	pi.set(testCoordinatorObject("Device.A.One", nanodm.TypeInt), false)
+	pi.set(testCoordinatorObject("Device.A.Two", nanodm.TypeInt), false)
+
+	clone := pi.clone()
+	clone.set(testCoordinatorObject("Device.A.Three", nanodm.TypeInt), false)
+	clone.remove("Device.A.One", false)
+	clone.set(testCoordinatorObject("Device.B.", nanodm.TypeDynamicList), true)
+
+	// The original is unchanged
+	assert.Equal(t, []string{"Device.A.One", "Device.A.Two"}, walkNames(pi, ""))
+	assert.Equal(t, 2, pi.objects)
+	assert.Equal(t, 0, pi.dynamicLists)
+	assert.Equal(t, 2, pi.root.size)
+
+	assert.Equal(t, []string{"Device.A.Three", "Device.A.Two", "Device.B."}, walkNames(clone, ""))
+	assert.Equal(t, 2, clone.objects)
+	assert.Equal(t, 1, clone.dynamicLists)
+	assert.Equal(t, 3, clone.root.size)
+
+	// Unchanged branches are shared
+	pi.set(testCoordinatorObject("Device.C.One", nanodm.TypeInt), false)
+	clone2 := pi.clone()
+	clone2.set(testCoordinatorObject("Device.A.Four", nanodm.TypeInt), false)
+	assert.True(t, pi.node("Device.C.") == clone2.node("Device.C."))
+	assert.False(t, pi.node("Device.A.") == clone2.node("Device.A."))
+}
+
+func TestPathIndexDynamicListFor(t *testing.T) {
+	pi := newPathIndex()
+	pi.set(testCoordinatorObject("Device.NAT.PortMapping.", nanodm.TypeDynamicList), true)
+	pi.set(testCoordinatorObject("Device.NAT.PortMapping.1.Rule.", nanodm.TypeDynamicList), true)
+	pi.set(testCoordinatorObject("Device.NAT.Enable", nanodm.TypeBool), false)
+
+	assert.Equal(t, "Device.NAT.PortMapping.", pi.dynamicListFor("Device.NAT.PortMapping.").object.Name)
+	assert.Equal(t, "Device.NAT.PortMapping.", pi.dynamicListFor("Device.NAT.PortMapping.2.Rule.1.Enable").object.Name)
+	assert.Equal(t, "Device.NAT.PortMapping.1.Rule.", pi.dynamicListFor("Device.NAT.PortMapping.1.Rule.").object.Name)
+	assert.Equal(t, "Device.NAT.PortMapping.1.Rule.", pi.dynamicListFor("Device.NAT.PortMapping.1.Rule.3.Enable").object.Name)
+	assert.Nil(t, pi.dynamicListFor("Device.NAT.PortMapping"))
+	assert.Nil(t, pi.dynamicListFor("Device.NAT.Enable"))
+	assert.Nil(t, pi.dynamicListFor("Device.NAT."))
+	assert.Nil(t, pi.dynamicListFor("Device.Other.Thing"))
+}
+
+func TestPathIndexWalk(t *testing.T) {
+	pi := newPathIndex()
+	for _, name := range []string{"Device.B.Two", "Device.A.One", "Device.B.One", "Device.AB.One", "Other.One"} {
+		pi.set(testCoordinatorObject(name, nanodm.TypeInt), false)
+	}
+	pi.set(testCoordinatorObject("Device.B.List.", nanodm.TypeDynamicList), true)
+
+	assert.Equal(t, []string{"Device.A.One", "Device.AB.One", "Device.B.List.", "Device.B.One", "Device.B.Two", "Other.One"}, walkNames(pi, ""))
+	assert.Equal(t, []string{"Device.B.List.", "Device.B.One", "Device.B.Two"}, walkNames(pi, "Device.B."))
+	assert.Equal(t, []string{"Device.A.One"}, walkNames(pi, "Device.A."))
+	assert.Equal(t, []string{"Device.A.One"}, walkNames(pi, "Device.A.One"))
+	assert.Empty(t, walkNames(pi, "Device.A"))
+	assert.Empty(t, walkNames(pi, "Device.C."))
+}
+
+func TestPathIndexNextLevel(t *testing.T) {
+	pi := newPathIndex()
+	for _, name := range []string{"Device.DeviceInfo.Model", "Device.DeviceInfo.Uptime", "Device.Enable", "Device.WiFi.Radio.1.Enable"} {
+		pi.set(testCoordinatorObject(name, nanodm.TypeString), false)
+	}
+	pi.set(testCoordinatorObject("Device.NAT.", nanodm.TypeDynamicList), true)
+
+	names, ok := pi.nextLevel("")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Device."}, names)
+
+	names, ok = pi.nextLevel("Device.")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Device.DeviceInfo.", "Device.Enable", "Device.NAT.", "Device.WiFi."}, names)
+
+	names, ok = pi.nextLevel("Device.DeviceInfo.")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"Device.DeviceInfo.Model", "Device.DeviceInfo.Uptime"}, names)
+
+	_, ok = pi.nextLevel("Device.Missing.")
+	assert.False(t, ok)
+}
+
+func TestPathIndexConflicts(t *testing.T) {
+	rt := newRoutingTable()
+	client1 := &Client{sourceName: "src1"}
+	client2 := &Client{sourceName: "src2"}
+
+	err := rt.addObjects(client1, []nanodm.Object{
+		{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeDynamicList},
+		{Name: "Device.WiFi.Radio.1.Enable", Type: nanodm.TypeBool},
+	})
+	assert.Nil(t, err)
+
+	// Objects already registered are rejected
+	err = rt.addObjects(client2, []nanodm.Object{{Name: "Device.WiFi.Radio.1.Enable", Type: nanodm.TypeBool}})
+	assert.NotNil(t, err)
+	assert.Empty(t, rt.clientObjects["src2"])
+
+	// Dynamic lists under a dynamic list, or over registered objects,
+	// conflict but are registered
+	nested := []nanodm.Object{
+		{Name: "Device.NAT.PortMapping.1.Rule.", Type: nanodm.TypeDynamicList},
+		{Name: "Device.WiFi.", Type: nanodm.TypeDynamicList},
+		{Name: "Device.IP.Interface.", Type: nanodm.TypeDynamicList},
+	}
+	assert.Equal(t, []string{"Device.NAT.PortMapping.1.Rule.", "Device.WiFi."}, rt.conflictingDynamicLists(nested))
+	err = rt.addObjects(client2, nested)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, rt.objectCount())
+
+	// The innermost dynamic list handles the objects under it, and objects
+	// registered under a dynamic list are routed to their source
+	assert.Equal(t, client2, rt.dynamicListFor("Device.NAT.PortMapping.1.Rule.2.Enable").client)
+	assert.Equal(t, client1, rt.dynamicListFor("Device.NAT.PortMapping.1.Enable").client)
+	assert.Equal(t, client1, rt.object("Device.WiFi.Radio.1.Enable").client)
+	assert.Equal(t, client2, rt.dynamicListFor("Device.WiFi.SSID.1.Enable").client)
+
+	rt.removeObjects(client1)
+	assert.Equal(t, 0, rt.objectCount())
+	assert.Nil(t, rt.dynamicListFor("Device.NAT.PortMapping.1.Enable"))
+	assert.NotNil(t, rt.dynamicListFor("Device.NAT.PortMapping.1.Rule.1.Enable"))
+	assert.NotNil(t, rt.dynamicListFor("Device.WiFi.SSID.1.Enable"))
+}
+
+func TestServerDynamicListConflicts(t *testing.T) {
+	server := NewServer(logrus.NewEntry(logrus.New()), "tcp://127.0.0.1:4529", nil)
+	client := &Client{sourceName: "src1"}
+	err := server.addClient(client, []nanodm.Object{
+		{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeDynamicList},
+	})
+	assert.Nil(t, err)
+	err = server.addClient(&Client{sourceName: "src2"}, []nanodm.Object{
+		{Name: "Device.NAT.PortMapping.1.Rule.", Type: nanodm.TypeDynamicList},
+	})
+	assert.Nil(t, err)
+
+	// An update adding a nested dynamic list is applied too
+	updated, _, err := server.replaceObjects(nanodm.Message{SourceName: "src1", Objects: []nanodm.Object{
+		{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeDynamicList},
+		{Name: "Device.NAT.PortMapping.1.Rule.1.Filter.", Type: nanodm.TypeDynamicList},
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, client, updated)
+
+	routes := server.routingTable()
+	assert.Equal(t, "src1", routes.dynamicListFor("Device.NAT.PortMapping.1.Rule.1.Filter.3.Enable").client.sourceName)
+	assert.Equal(t, "src2", routes.dynamicListFor("Device.NAT.PortMapping.1.Rule.1.Enable").client.sourceName)
+	assert.Equal(t, "src1", routes.dynamicListFor("Device.NAT.PortMapping.1.Enable").client.sourceName)
+}
+
+func TestServerNextLevel(t *testing.T) {
+	server := NewServer(logrus.NewEntry(logrus.New()), "tcp://127.0.0.1:4529", nil)
+	err := server.addClient(&Client{sourceName: "src1"}, []nanodm.Object{
+		{Name: "Device.DeviceInfo.Model", Type: nanodm.TypeString},
+		{Name: "Device.Enable", Type: nanodm.TypeBool},
+		{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeDynamicList},
+	})
+	assert.Nil(t, err)
+
+	names, err := server.NextLevel("Device.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.DeviceInfo.", "Device.Enable", "Device.NAT."}, names)
+
+	assert.Equal(t, []string{"Device.NAT.PortMapping."}, objectNames(server.ListDynamicLists("Device.")))
+	objects, err := server.List("Device.")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.DeviceInfo.Model", "Device.Enable"}, objectNames(objects))
+
+	_, err = server.NextLevel("Device.WiFi.")
+	assert.NotNil(t, err)
+}
+
+func objectNames(objects []nanodm.Object) (names []string) {
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	return names
+}
+
+/*
+ * Benchmarks of the path index against the map based routing it replaced,
+ * which scanned every registered object and dynamic list for prefix matches.
+ */
+
+const benchmarkObjectCount = 100000
+
+type benchmarkMaps struct {
+	objects      map[string]*CoordinatorObject
+	dynamicLists map[string]*CoordinatorObject
+}
+
+func (bm *benchmarkMaps) dynamicListFor(objectName string) *CoordinatorObject {
+	var dynamicList *CoordinatorObject
+	for prefix, dynObject := range bm.dynamicLists {
+		if strings.HasPrefix(objectName, prefix) && (dynamicList == nil || len(prefix) > len(dynamicList.object.Name)) {
+			dynamicList = dynObject
+		}
+	}
+	return dynamicList
+}
+
+func (bm *benchmarkMaps) list(path string) (objects []nanodm.Object) {
+	for objName, regObject := range bm.objects {
+		if strings.HasPrefix(objName, path) {
+			objects = append(objects, regObject.object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects
+}
+
+func (bm *benchmarkMaps) isDynamicListConflicting(dynamicListPrefix string) bool {
+	for objName := range bm.objects {
+		if strings.HasPrefix(objName, dynamicListPrefix) {
+			return true
+		}
+	}
+	return bm.dynamicListFor(dynamicListPrefix) != nil
+}
+
+func benchmarkRoutes() (*pathIndex, *benchmarkMaps) {
+	pi := newPathIndex()
+	bm := &benchmarkMaps{
+		objects:      make(map[string]*CoordinatorObject),
+		dynamicLists: make(map[string]*CoordinatorObject),
+	}
+	for i := 0; i < benchmarkObjectCount; i++ {
+		name := fmt.Sprintf("Device.Service.%d.Instance.%d.Param%d", i%100, (i/100)%100, i/10000)
+		cobj := testCoordinatorObject(name, nanodm.TypeString)
+		pi.set(cobj, false)
+		bm.objects[name] = cobj
+	}
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("Device.List.%d.Entry.", i)
+		cobj := testCoordinatorObject(name, nanodm.TypeDynamicList)
+		pi.set(cobj, true)
+		bm.dynamicLists[name] = cobj
+	}
+	return pi, bm
+}
+
+func BenchmarkPathIndexObject(b *testing.B) {
+	pi, _ := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi.object("Device.Service.42.Instance.17.Param3")
+	}
+}
+
+func BenchmarkMapObject(b *testing.B) {
+	_, bm := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = bm.objects["Device.Service.42.Instance.17.Param3"]
+	}
+}
+
+func BenchmarkPathIndexDynamicListFor(b *testing.B) {
+	pi, _ := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi.dynamicListFor("Device.List.500.Entry.3.Enable")
+	}
+}
+
+func BenchmarkMapDynamicListFor(b *testing.B) {
+	_, bm := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bm.dynamicListFor("Device.List.500.Entry.3.Enable")
+	}
+}
+
+func BenchmarkPathIndexList(b *testing.B) {
+	pi, _ := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var objects []nanodm.Object
+		pi.walk("Device.Service.42.", func(coordinatorObject *CoordinatorObject) {
+			objects = append(objects, coordinatorObject.object)
+		})
+	}
+}
+
+func BenchmarkMapList(b *testing.B) {
+	_, bm := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bm.list("Device.Service.42.")
+	}
+}
+
+func BenchmarkPathIndexConflict(b *testing.B) {
+	pi, _ := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pi.hasEntriesUnder("Device.Other.")
+	}
+}
+
+func BenchmarkMapConflict(b *testing.B) {
+	_, bm := benchmarkRoutes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bm.isDynamicListConflicting("Device.Other.")
+	}
+}
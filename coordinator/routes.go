@@ -0,0 +1,169 @@
+package coordinator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/zackwine/nanodm"
+)
+
+/*
+ * routingTable maps each registered object and dynamic list to the
+ * client/source that handles it.  The table is copy-on-write: a published
+ * table is never modified, so requests look up routes without a lock and never
+ * wait on registrations, and registrations never wait on requests in flight.
+ * Registrations change a clone of the table under the registration mutex and
+ * then publish the clone.
+ */
+type routingTable struct {
+	clients map[string]*Client
+	// The controllers, which make requests but don't own objects, by name
+	controllers map[string]*Client
+	// The objects registered by each client, by source name
+	clientObjects map[string][]nanodm.Object
+	index         *pathIndex
+}
+
+func newRoutingTable() *routingTable {
+	return &routingTable{
+		clients:       make(map[string]*Client),
+		controllers:   make(map[string]*Client),
+		clientObjects: make(map[string][]nanodm.Object),
+		index:         newPathIndex(),
+	}
+}
+
+// clone returns a copy of the table that can be changed and then published.
+// The CoordinatorObjects are shared, so they are replaced rather than changed.
+func (rt *routingTable) clone() *routingTable {
+	clone := &routingTable{
+		clients:       make(map[string]*Client, len(rt.clients)),
+		controllers:   make(map[string]*Client, len(rt.controllers)),
+		clientObjects: make(map[string][]nanodm.Object, len(rt.clientObjects)),
+		index:         rt.index.clone(),
+	}
+	for name, client := range rt.clients {
+		clone.clients[name] = client
+	}
+	for name, controller := range rt.controllers {
+		clone.controllers[name] = controller
+	}
+	for name, objects := range rt.clientObjects {
+		clone.clientObjects[name] = objects
+	}
+	return clone
+}
+
+// requester returns the source or controller named `name`, which can make
+// requests of the server
+func (rt *routingTable) requester(name string) (*Client, bool) {
+	if client, ok := rt.clients[name]; ok {
+		return client, true
+	}
+	client, ok := rt.controllers[name]
+	return client, ok
+}
+
+// object returns the object registered as `objectName`, or nil
+func (rt *routingTable) object(objectName string) *CoordinatorObject {
+	return rt.index.object(objectName)
+}
+
+// dynamicList returns the dynamic list registered as `objectName`, or nil
+func (rt *routingTable) dynamicList(objectName string) *CoordinatorObject {
+	return rt.index.dynamicList(objectName)
+}
+
+// dynamicListFor returns the dynamic list handling `objectName`, or nil.  If
+// dynamic lists are nested the longest (innermost) one is returned.
+func (rt *routingTable) dynamicListFor(objectName string) *CoordinatorObject {
+	return rt.index.dynamicListFor(objectName)
+}
+
+// expandPath returns the names of the objects and dynamic lists under the
+// partial path `path` (a path ending in "."), sorted.  A path that isn't
+// partial, is handled by a dynamic list or has nothing under it is returned
+// as it is.
+func (rt *routingTable) expandPath(path string) []string {
+	if !strings.HasSuffix(path, ".") || rt.dynamicListFor(path) != nil {
+		return []string{path}
+	}
+	var names []string
+	rt.index.walk(path, func(object *CoordinatorObject) {
+		names = append(names, object.object.Name)
+	})
+	if len(names) == 0 {
+		return []string{path}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// objectCount returns the number of registered objects, excluding dynamic
+// lists
+func (rt *routingTable) objectCount() int {
+	return rt.index.objects
+}
+
+func (rt *routingTable) isObjectRegistered(objectName string) bool {
+	return rt.object(objectName) != nil || rt.dynamicList(objectName) != nil
+}
+
+// isDynamicListConflicting returns true if objects are registered under the
+// dynamic list `dynamicListPrefix`, or it's under another dynamic list
+func (rt *routingTable) isDynamicListConflicting(dynamicListPrefix string) bool {
+	return rt.index.hasEntriesUnder(dynamicListPrefix)
+}
+
+// conflictingDynamicLists returns the names of the dynamic lists of `objects`
+// that conflict with the registered objects (see isDynamicListConflicting).
+// They are still registered: an object registered under a dynamic list is
+// routed to its own source, and the innermost of nested dynamic lists handles
+// the objects under it.
+func (rt *routingTable) conflictingDynamicLists(objects []nanodm.Object) (names []string) {
+	for _, object := range objects {
+		if object.Type == nanodm.TypeDynamicList && rt.isDynamicListConflicting(object.Name) {
+			names = append(names, object.Name)
+		}
+	}
+	return names
+}
+
+func (rt *routingTable) addObjects(client *Client, objects []nanodm.Object) error {
+	// Are these objects already registered
+	for _, object := range objects {
+		if rt.isObjectRegistered(object.Name) {
+			return fmt.Errorf("failed to add objects object (%s) already exists", object.Name)
+		}
+	}
+
+	rt.clientObjects[client.sourceName] = objects
+
+	for _, object := range objects {
+		rt.setObject(client, object)
+	}
+
+	return nil
+}
+
+// setObject routes `object` to `client`
+func (rt *routingTable) setObject(client *Client, object nanodm.Object) {
+	coordinatorObject := &CoordinatorObject{
+		object: object,
+		client: client,
+	}
+	rt.index.set(coordinatorObject, object.Type == nanodm.TypeDynamicList)
+}
+
+func (rt *routingTable) removeObject(object nanodm.Object) {
+	rt.index.remove(object.Name, object.Type == nanodm.TypeDynamicList)
+}
+
+func (rt *routingTable) removeObjects(client *Client) {
+	// remove all objects owned by this client
+	for _, object := range rt.clientObjects[client.sourceName] {
+		rt.removeObject(object)
+	}
+	delete(rt.clientObjects, client.sourceName)
+}
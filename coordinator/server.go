@@ -1,17 +1,25 @@
 package coordinator
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/tracing"
 )
 
 const (
 	PING_PERIOD = 15 * time.Second
+	// The default time to wait for a source to answer a request
+	REQUEST_TIMEOUT = 10 * time.Second
 )
 
 type Server struct {
@@ -23,11 +31,32 @@ type Server struct {
 	pullerChan chan nanodm.Message
 	closeChan  chan struct{}
 
-	clients           map[string]*Client
-	objects           map[string]*CoordinatorObject
-	dynamicLists      map[string]*CoordinatorObject
+	// routes holds the current *routingTable.  Changes are serialized by the
+	// registrationMutex.
+	routes            atomic.Value
 	ackMap            *nanodm.ConcurrentMessageMap
+	requestTimeout    time.Duration
 	registrationMutex sync.Mutex
+	metrics           *ServerMetrics
+	tracer            *tracing.Tracer
+	auditLog          *audit.Log
+	clock             nanodm.Clock
+	faults            *nanodm.FaultInjector
+	limits            nanodm.Limits
+
+	// The transactions in doubt, and those with a heuristic outcome, by ID.
+	// They're only kept in memory.
+	transactions      map[string]*inDoubtTransaction
+	heuristics        map[string]*HeuristicOutcome
+	transactionsMutex sync.Mutex
+	candidate         *Candidate
+	// The candidates of the controllers, by controller name
+	candidates      map[string]*Candidate
+	candidatesMutex sync.Mutex
+
+	// The subscriptions of each client, by client name
+	subscriptions      map[string]*subscriber
+	subscriptionsMutex sync.Mutex
 }
 
 type CoordinatorObject struct {
@@ -36,25 +65,75 @@ type CoordinatorObject struct {
 }
 
 func NewServer(log *logrus.Entry, url string, handler CoordinatorHandler) *Server {
-	return &Server{
-		log:          log,
-		url:          url,
-		handler:      handler,
-		pullerChan:   make(chan nanodm.Message),
-		closeChan:    make(chan struct{}),
-		clients:      make(map[string]*Client),
-		objects:      make(map[string]*CoordinatorObject),
-		dynamicLists: make(map[string]*CoordinatorObject),
-		ackMap:       nanodm.NewConcurrentMessageMap(),
+	se := &Server{
+		log:            log,
+		url:            url,
+		handler:        handler,
+		pullerChan:     make(chan nanodm.Message),
+		closeChan:      make(chan struct{}),
+		ackMap:         nanodm.NewConcurrentMessageMap(),
+		requestTimeout: REQUEST_TIMEOUT,
+		metrics:        newServerMetrics(),
+		transactions:   make(map[string]*inDoubtTransaction),
+		heuristics:     make(map[string]*HeuristicOutcome),
+		candidates:     make(map[string]*Candidate),
+		subscriptions:  make(map[string]*subscriber),
+		clock:          nanodm.SystemClock,
+		limits:         nanodm.DefaultLimits,
 	}
+	se.routes.Store(newRoutingTable())
+	se.candidate = newCandidate(se)
+	return se
 }
 func (se *Server) SetHandler(handler CoordinatorHandler) {
 	se.handler = handler
 }
 
+// SetRequestTimeout sets the time to wait for a source to answer a request.
+// A deadline on the context of a request also applies.
+func (se *Server) SetRequestTimeout(timeout time.Duration) {
+	se.requestTimeout = timeout
+}
+
+// SetTracer enables tracing of requests through the server.  Tracing is
+// disabled if `tracer` is nil.
+func (se *Server) SetTracer(tracer *tracing.Tracer) {
+	se.tracer = tracer
+}
+
+// SetClock sets the clock that times the pings of the clients and the
+// recovery of in-doubt transactions.  Call it before Start.
+func (se *Server) SetClock(clock nanodm.Clock) {
+	se.clock = clock
+}
+
+// SetFaultInjector injects the faults of `faults` into the messages the
+// server sends and receives, to test how it and its clients behave when the
+// transport fails.  Call it before Start.
+func (se *Server) SetFaultInjector(faults *nanodm.FaultInjector) {
+	se.faults = faults
+}
+
+// SetLimits sets the limits of the messages the server accepts from its
+// clients, nanodm.DefaultLimits unless set.  Call it before Start.
+func (se *Server) SetLimits(limits nanodm.Limits) {
+	se.limits = limits
+}
+
+// Metrics returns the metrics of the server, which can be served as a
+// /metrics endpoint
+func (se *Server) Metrics() *ServerMetrics {
+	return se.metrics
+}
+
 func (se *Server) Start() error {
 	var err error
 	se.puller = nanodm.NewPuller(se.log, se.url, se.pullerChan)
+	se.puller.SetFaultInjector(se.faults)
+	se.puller.SetLimits(se.limits)
+	se.puller.SetRejectHook(func(reason string) {
+		se.metrics.Rejected.Inc(reason)
+	})
 
 	go se.pullerTask()
 
@@ -65,6 +144,7 @@ func (se *Server) Start() error {
 	}
 
 	go se.pingTask()
+	go se.transactionTask()
 
 	return nil
 }
@@ -75,176 +155,342 @@ func (se *Server) Stop() error {
 }
 
 func (se *Server) Set(object nanodm.Object) error {
-	var setMessage nanodm.Message
-	if cobject, ok := se.objects[object.Name]; ok {
+	return se.SetContext(context.Background(), object)
+}
+
+// SetContext sets an object as part of the trace in `ctx`
+func (se *Server) SetContext(ctx context.Context, object nanodm.Object) (err error) {
+	ctx, span := se.tracer.Start(ctx, "coordinator.Set", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.object", object.Name)
+	var transactionUID uuid.UUID
+	oldValue := se.auditOldValue(ctx, object.Name)
+	defer func() {
+		se.audit(ctx, audit.OperationSet, object.Name, "", oldValue, object.Value, transactionUID, err)
+		if err == nil {
+			se.notifyChange(nanodm.OperationSet, object.Name, object.Value)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+
+	var client *Client
+	routes := se.routingTable()
+	if cobject := routes.object(object.Name); cobject != nil {
 		se.log.Infof("Calling Set on object (%+v) %+v", object, cobject.object)
-		setMessage = cobject.client.GetMessage(nanodm.SetMessageType)
-		setMessage.Source = se.url
-		setMessage.Objects = []nanodm.Object{object}
-		cobject.client.Send(setMessage)
-	} else if dynObject := se.isObjectHandledByDynamicList(object.Name); dynObject != nil {
+		client = cobject.client
+	} else if dynObject := routes.dynamicListFor(object.Name); dynObject != nil {
 		se.log.Infof("Calling Set on object on dynamic list object (%+v) %+v", object, dynObject.object)
-		setMessage = dynObject.client.GetMessage(nanodm.SetMessageType)
-		setMessage.Source = se.url
-		setMessage.Objects = []nanodm.Object{object}
-		dynObject.client.Send(setMessage)
+		client = dynObject.client
 	} else {
-		return fmt.Errorf("the object %s isn't registered", object.Name)
+		return nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "the object %s isn't registered", object.Name)
 	}
 
-	ackMessage, err := se.ackMap.WaitForKey(setMessage.TransactionUID.String(), 10*time.Second)
+	setMessage := client.GetMessage(nanodm.SetMessageType)
+	setMessage.Source = se.url
+	setMessage.Objects = []nanodm.Object{object}
+	transactionUID = setMessage.TransactionUID
+
+	ackMessage, err := se.sendRequest(ctx, client, setMessage)
 	if err != nil {
 		return err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		return nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("failed to set object %s: %v", object.Name, ackMessage.Error)
+		return fmt.Errorf("failed to set object %s: %w", object.Name, nanodm.MessageError(ackMessage))
 	} else {
-		return fmt.Errorf("set received unknown message response type (%d)", ackMessage.Type)
+		return nanodm.Errorf(nanodm.CodeInternal, "set received unknown message response type (%d)", ackMessage.Type)
 	}
 
 }
 
 func (se *Server) Get(objectNames []string) (objects []nanodm.Object, errs []error) {
-	clientToObject := make(map[string][]nanodm.Object)
-
-	// Build a list for each client
-	for _, objName := range objectNames {
-		if cobject, ok := se.objects[objName]; ok {
-			clientToObject[cobject.client.sourceName] = append(clientToObject[cobject.client.sourceName], cobject.object)
-		} else if dynamicObject, exists := se.dynamicLists[objName]; exists {
-			se.log.Infof("dynamicObject: %+v", dynamicObject)
-			se.log.Infof("clientToObject: %+v", clientToObject)
-			clientToObject[dynamicObject.client.sourceName] = append(clientToObject[dynamicObject.client.sourceName], dynamicObject.object)
-		} else if dynamicObject := se.isObjectHandledByDynamicList(objName); dynamicObject != nil {
-			clientToObject[dynamicObject.client.sourceName] = append(clientToObject[dynamicObject.client.sourceName], nanodm.Object{Name: objName})
-		} else {
-			errs = append(errs, fmt.Errorf("object (%s) doesn't exist", objName))
-		}
-	}
-	if len(errs) > 0 {
-		return objects, errs
-	}
-
-	for sourceName, getObjects := range clientToObject {
-		retObjects, err := se.getSource(sourceName, getObjects)
-		if err != nil {
-			errs = append(errs, err)
-		}
-		if retObjects != nil {
-			objects = append(objects, retObjects...)
-		}
-	}
+	return se.GetContext(context.Background(), objectNames)
+}
 
-	return objects, errs
+// GetContext gets objects as part of the trace in `ctx`.  The objects are
+// fetched from their sources concurrently; see GetResults.
+func (se *Server) GetContext(ctx context.Context, objectNames []string) (objects []nanodm.Object, errs []error) {
+	result := se.GetResults(ctx, objectNames)
+	return result.Objects, result.Errs()
 }
 
 func (se *Server) AddRow(object nanodm.Object) (row string, err error) {
-	var addRowMessage nanodm.Message
-
-	if dynObject := se.isObjectHandledByDynamicList(object.Name); dynObject != nil {
-		se.log.Infof("Calling AddRow on object on dynamic list (%+v) %+v", object, dynObject.object)
-		addRowMessage = dynObject.client.GetMessage(nanodm.AddRowMessageType)
-		addRowMessage.Source = se.url
-		addRowMessage.Objects = []nanodm.Object{object}
-		dynObject.client.Send(addRowMessage)
-	} else {
-		return row, fmt.Errorf("the object %s isn't handled", object.Name)
+	return se.AddRowContext(context.Background(), object)
+}
+
+// AddRowContext adds a row as part of the trace in `ctx`
+func (se *Server) AddRowContext(ctx context.Context, object nanodm.Object) (row string, err error) {
+	ctx, span := se.tracer.Start(ctx, "coordinator.AddRow", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.object", object.Name)
+	var transactionUID uuid.UUID
+	defer func() {
+		se.audit(ctx, audit.OperationAddRow, object.Name, row, nil, object.Value, transactionUID, err)
+		if err == nil {
+			se.notifyChange(nanodm.OperationAddRow, row, object.Value)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+
+	dynObject := se.routingTable().dynamicListFor(object.Name)
+	if dynObject == nil {
+		return row, nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "the object %s isn't handled", object.Name)
 	}
+	se.log.Infof("Calling AddRow on object on dynamic list (%+v) %+v", object, dynObject.object)
+	row, transactionUID, err = se.addRowSource(ctx, dynObject.client, object)
+	return row, err
+}
+
+// addRowSource sends an AddRow of `object` to `client`, without auditing it
+func (se *Server) addRowSource(ctx context.Context, client *Client, object nanodm.Object) (row string, transactionUID uuid.UUID, err error) {
+	addRowMessage := client.GetMessage(nanodm.AddRowMessageType)
+	addRowMessage.Source = se.url
+	addRowMessage.Objects = []nanodm.Object{object}
 
-	ackMessage, err := se.ackMap.WaitForKey(addRowMessage.TransactionUID.String(), 10*time.Second)
+	ackMessage, err := se.sendRequest(ctx, client, addRowMessage)
 	if err != nil {
-		return row, err
+		return row, addRowMessage.TransactionUID, err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		if len(ackMessage.Objects) == 1 {
 			row = ackMessage.Objects[0].Name
 		}
-		return row, nil
+		return row, addRowMessage.TransactionUID, nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return row, fmt.Errorf("failed to add row %s: %v", object.Name, ackMessage.Error)
-	} else {
-		return row, fmt.Errorf("AddRow received unknown message response type (%d)", ackMessage.Type)
+		return row, addRowMessage.TransactionUID, fmt.Errorf("failed to add row %s: %w", object.Name, nanodm.MessageError(ackMessage))
 	}
-
+	return row, addRowMessage.TransactionUID, nanodm.Errorf(nanodm.CodeInternal, "AddRow received unknown message response type (%d)", ackMessage.Type)
 }
 
 func (se *Server) DeleteRow(object nanodm.Object) error {
-	var deleteRowMessage nanodm.Message
-
-	if dynObject := se.isObjectHandledByDynamicList(object.Name); dynObject != nil {
-		se.log.Infof("Calling DeleteRow on object on dynamic list (%+v) %+v", object, dynObject.object)
-		deleteRowMessage = dynObject.client.GetMessage(nanodm.DeleteRowMessageType)
-		deleteRowMessage.Source = se.url
-		deleteRowMessage.Objects = []nanodm.Object{object}
-		dynObject.client.Send(deleteRowMessage)
-	} else {
-		return fmt.Errorf("the object %s isn't handled", object.Name)
+	return se.DeleteRowContext(context.Background(), object)
+}
+
+// DeleteRowContext deletes a row as part of the trace in `ctx`
+func (se *Server) DeleteRowContext(ctx context.Context, object nanodm.Object) (err error) {
+	ctx, span := se.tracer.Start(ctx, "coordinator.DeleteRow", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.object", object.Name)
+	var transactionUID uuid.UUID
+	oldValue := se.auditOldValue(ctx, object.Name)
+	defer func() {
+		se.audit(ctx, audit.OperationDeleteRow, object.Name, "", oldValue, nil, transactionUID, err)
+		if err == nil {
+			se.notifyChange(nanodm.OperationDeleteRow, object.Name, nil)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+
+	dynObject := se.routingTable().dynamicListFor(object.Name)
+	if dynObject == nil {
+		return nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "the object %s isn't handled", object.Name)
 	}
+	se.log.Infof("Calling DeleteRow on object on dynamic list (%+v) %+v", object, dynObject.object)
+	transactionUID, err = se.deleteRowSource(ctx, dynObject.client, object)
+	return err
+}
+
+// deleteRowSource sends a DeleteRow of `object` to `client`, without auditing
+// it
+func (se *Server) deleteRowSource(ctx context.Context, client *Client, object nanodm.Object) (uuid.UUID, error) {
+	deleteRowMessage := client.GetMessage(nanodm.DeleteRowMessageType)
+	deleteRowMessage.Source = se.url
+	deleteRowMessage.Objects = []nanodm.Object{object}
 
-	ackMessage, err := se.ackMap.WaitForKey(deleteRowMessage.TransactionUID.String(), 10*time.Second)
+	ackMessage, err := se.sendRequest(ctx, client, deleteRowMessage)
 	if err != nil {
-		return err
+		return deleteRowMessage.TransactionUID, err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
-		return nil
+		return deleteRowMessage.TransactionUID, nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("failed to delete row %s: %v", object.Name, ackMessage.Error)
-	} else {
-		return fmt.Errorf("DeleteRow received unknown message response type (%d)", ackMessage.Type)
+		return deleteRowMessage.TransactionUID, fmt.Errorf("failed to delete row %s: %w", object.Name, nanodm.MessageError(ackMessage))
 	}
-
+	return deleteRowMessage.TransactionUID, nanodm.Errorf(nanodm.CodeInternal, "DeleteRow received unknown message response type (%d)", ackMessage.Type)
 }
 
 // PrintObjectMap: For debugging purposes
 func (se *Server) PrintObjectMap() {
 
-	se.log.Infof("Printing (%d) objects", len(se.objects))
-	for name, object := range se.objects {
-		se.log.Infof("- %s", name)
-		se.log.Infof("     %+v", object)
+	routes := se.routingTable()
+	se.log.Infof("Printing (%d) objects", routes.objectCount())
+	routes.index.walk("", func(object *CoordinatorObject) {
+		if object.object.Type != nanodm.TypeDynamicList {
+			se.log.Infof("- %s", object.object.Name)
+			se.log.Infof("     %+v", object)
+		}
+	})
+}
+
+// GetPartial gets every object under the partial path `path` (a path ending in
+// "."), including the rows of any dynamic lists under the path.  A path that
+// isn't partial is passed directly to Get.
+func (se *Server) GetPartial(path string) (objects []nanodm.Object, errs []error) {
+	return se.GetPartialContext(context.Background(), path)
+}
+
+// GetPartialContext gets every object under the partial path `path` as part
+// of the trace in `ctx`; see GetPartial.
+func (se *Server) GetPartialContext(ctx context.Context, path string) (objects []nanodm.Object, errs []error) {
+	return se.GetContext(ctx, se.routingTable().expandPath(path))
+}
+
+// SourceInfo describes a registered client/source
+type SourceInfo struct {
+	Name     string    `json:"name"`
+	Url      string    `json:"url"`
+	Objects  int       `json:"objects"`
+	LastPing time.Time `json:"lastPing"`
+}
+
+// Sources returns a description of each registered client/source sorted by name
+func (se *Server) Sources() (sources []SourceInfo) {
+	routes := se.routingTable()
+	for _, client := range routes.clients {
+		sources = append(sources, SourceInfo{
+			Name:     client.sourceName,
+			Url:      client.clientUrl,
+			Objects:  len(routes.clientObjects[client.sourceName]),
+			LastPing: client.getLastPing(),
+		})
 	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i].Name < sources[j].Name
+	})
+	return sources
 }
 
-func (se *Server) getSource(sourceName string, getObjects []nanodm.Object) (objects []nanodm.Object, err error) {
+func (se *Server) getSource(ctx context.Context, sourceName string, getObjects []nanodm.Object) (objects []nanodm.Object, err error) {
 	var getMessage nanodm.Message
-	if client, ok := se.clients[sourceName]; ok {
+	if client, ok := se.routingTable().clients[sourceName]; ok {
 
 		getMessage = client.GetMessage(nanodm.GetMessageType)
 		getMessage.Source = se.url
 		getMessage.Objects = getObjects
-		client.Send(getMessage)
 
-		ackMessage, err := se.ackMap.WaitForKey(getMessage.TransactionUID.String(), 10*time.Second)
+		ackMessage, err := se.sendRequest(ctx, client, getMessage)
 		if err != nil {
 			return nil, err
 		}
 		if ackMessage.Type == nanodm.AckMessageType {
 			return ackMessage.Objects, nil
 		} else if ackMessage.Type == nanodm.NackMessageType {
-			return ackMessage.Objects, fmt.Errorf("failed to get objects: %v", ackMessage.Error)
+			return ackMessage.Objects, fmt.Errorf("failed to get objects: %w", nanodm.MessageError(ackMessage))
 		} else {
-			return ackMessage.Objects, fmt.Errorf("get received unknown message response type (%d)", ackMessage.Type)
+			return ackMessage.Objects, nanodm.Errorf(nanodm.CodeInternal, "get received unknown message response type (%d)", ackMessage.Type)
 		}
 
 	}
 
-	return nil, fmt.Errorf("failed to find source %s", sourceName)
+	return nil, nanodm.Errorf(nanodm.CodeSourceUnavailable, "failed to find source %s", sourceName)
+}
+
+// sendRequest sends `message` to `client` and waits for the ack or nack
+func (se *Server) sendRequest(ctx context.Context, client *Client, message nanodm.Message) (ackMessage *nanodm.Message, err error) {
+	msgType := message.Type.Name()
+	_, span := se.tracer.Start(ctx, "coordinator.send "+msgType, tracing.SpanKindClient)
+	span.SetAttribute("nanodm.source", client.sourceName)
+	span.SetAttribute("nanodm.transaction_uid", message.TransactionUID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	message.TraceParent = span.TraceParent()
+
+	se.metrics.Requests.Inc(msgType, client.sourceName)
+	se.metrics.InFlight.Inc(client.sourceName)
+	defer se.metrics.InFlight.Dec(client.sourceName)
+
+	waitCtx, cancel := context.WithTimeout(ctx, se.requestTimeout)
+	defer cancel()
+
+	start := time.Now()
+	client.Send(message)
+	ackMessage, err = se.ackMap.WaitForKeyContext(waitCtx, message.TransactionUID.String())
+	if err != nil {
+		se.log.Errorf("Timeout waiting for %s response from source (%s)", msgType, client.sourceName)
+		se.metrics.Responses.Inc(msgType, client.sourceName, ResultTimeout)
+		return nil, err
+	}
+	se.metrics.Latency.Observe(time.Since(start).Seconds(), msgType, client.sourceName)
+
+	result := ResultAck
+	if ackMessage.Type != nanodm.AckMessageType {
+		result = ResultNack
+	}
+	se.metrics.Responses.Inc(msgType, client.sourceName, result)
+	span.SetAttribute("nanodm.result", result)
+	return ackMessage, nil
+}
+
+// routingTable returns the current routing table, which must not be changed
+func (se *Server) routingTable() *routingTable {
+	return se.routes.Load().(*routingTable)
+}
+
+// messageLabel returns the label of the sender of `message` in the metrics,
+// including controllers registering
+func (se *Server) messageLabel(message nanodm.Message) string {
+	if message.Type == nanodm.RegisterMessageType {
+		for _, capability := range message.Capabilities {
+			if capability == nanodm.CapabilityController {
+				return CONTROLLER_LABEL
+			}
+		}
+	}
+	return se.clientLabel(message.SourceName)
+}
+
+// checkSender returns an error if `message` isn't a Register but claims to be
+// from a client that isn't registered, or claims to be from a registered
+// client but wasn't sent from its url, or on the connection the client
+// registered on.  A client that reconnects is bound to its new connection once
+// the old one is closed.
+func (se *Server) checkSender(message nanodm.Message) error {
+	client, exists := se.routingTable().requester(message.SourceName)
+	if !exists {
+		if message.Type == nanodm.RegisterMessageType {
+			return nil
+		}
+		return fmt.Errorf("%s message from %s claims to be from unregistered client (%s)",
+			message.Type.Name(), message.Source, message.SourceName)
+	}
+	if message.Pipe == 0 {
+		return nil
+	}
+	if message.Type != nanodm.RegisterMessageType && message.Source != client.clientUrl {
+		return fmt.Errorf("%s message from %s claims to be from client (%s) at %s",
+			message.Type.Name(), message.Source, message.SourceName, client.clientUrl)
+	}
+	pipe := client.getPipe()
+	if pipe == message.Pipe {
+		return nil
+	}
+	if pipe != 0 && se.puller.Connected(pipe) {
+		return fmt.Errorf("%s message on pipe %d claims to be from client (%s) connected on pipe %d",
+			message.Type.Name(), message.Pipe, message.SourceName, pipe)
+	}
+	se.log.Infof("Client (%s) reconnected on pipe %d", message.SourceName, message.Pipe)
+	client.setPipe(message.Pipe)
+	return nil
 }
 
 func (se *Server) handleMessage(message nanodm.Message) {
+	if err := se.checkSender(message); err != nil {
+		se.log.Warnf("Rejected message: %v", err)
+		se.metrics.Rejected.Inc(nanodm.RejectSender)
+		return
+	}
+	se.metrics.Received.Inc(message.Type.Name(), se.messageLabel(message))
+
 	switch {
 	case message.Type == nanodm.RegisterMessageType:
 		se.log.Infof("Registering new client (%s)", message.SourceName)
-		se.registrationMutex.Lock()
 		se.registerClient(message)
-		se.registrationMutex.Unlock()
 	case message.Type == nanodm.UnregisterMessageType:
 		se.log.Infof("Unregistering client (%s)", message.SourceName)
-		se.registrationMutex.Lock()
 		se.unregisterClient(message)
-		se.registrationMutex.Unlock()
 	case message.Type == nanodm.UpdateObjectsMessageType:
 		se.log.Infof("Updating client (%s)", message.SourceName)
 		se.updateObjects(message)
@@ -254,12 +500,36 @@ func (se *Server) handleMessage(message nanodm.Message) {
 	case message.Type == nanodm.SetMessageType:
 		se.log.Infof("Set message from client (%s)", message.SourceName)
 		go se.handleClientSet(message)
+	case message.Type == nanodm.SubscribeMessageType:
+		se.log.Infof("Subscribe message from client (%s)", message.SourceName)
+		se.handleClientSubscribe(message)
+	case message.Type == nanodm.UnsubscribeMessageType:
+		se.log.Infof("Unsubscribe message from client (%s)", message.SourceName)
+		se.handleClientUnsubscribe(message)
+	case message.Type == nanodm.NotifyMessageType:
+		se.log.Infof("Notify message from client (%s)", message.SourceName)
+		go se.handleClientNotify(message)
+	case message.Type == nanodm.AddRowMessageType:
+		se.log.Infof("AddRow message from client (%s)", message.SourceName)
+		go se.handleClientAddRow(message)
+	case message.Type == nanodm.DeleteRowMessageType:
+		se.log.Infof("DeleteRow message from client (%s)", message.SourceName)
+		go se.handleClientDeleteRow(message)
 	case message.Type == nanodm.AckMessageType || message.Type == nanodm.NackMessageType:
 		se.ackMap.Set(message.TransactionUID.String(), message)
 	case message.Type == nanodm.ListMessagesType:
 		se.handleClientList(message)
+	case message.Type == nanodm.NextLevelMessageType:
+		se.handleClientNextLevel(message)
+	case message.Type == nanodm.RegistryMessageType:
+		se.handleClientRegistry(message)
 	case message.Type == nanodm.PingMessageType:
 		se.handleClientPing(message)
+	case message.Type == nanodm.CandidateStageMessageType || message.Type == nanodm.CandidateDiffMessageType ||
+		message.Type == nanodm.CandidateCommitMessageType || message.Type == nanodm.CandidateConfirmMessageType ||
+		message.Type == nanodm.CandidateDiscardMessageType:
+		se.log.Infof("%s message from client (%s)", message.Type.Name(), message.SourceName)
+		go se.handleClientCandidate(message)
 	}
 }
 
@@ -279,69 +549,66 @@ func (se *Server) pingTask() {
 	defer se.log.Warnf("Exiting server pingTask (%s)", se.url)
 	for {
 		select {
-		case now := <-time.After(PING_PERIOD):
-			// Given this handler runs as a goroutine, block modifications caused by registration
-			se.registrationMutex.Lock()
-			for _, client := range se.clients {
-				if now.After(client.lastPing.Add(5 * PING_PERIOD)) {
-					diff := now.Sub(client.lastPing)
-					se.log.Warnf("removing client %s, last ping was %s ago", client.sourceName, diff.String())
-					se.removeClient(client)
-				}
-				message := client.GetMessage(nanodm.PingMessageType)
-				message.Source = se.url
-				client.Send(message)
+		case now := <-se.clock.After(PING_PERIOD):
+			routes := se.routingTable()
+			for _, client := range routes.clients {
+				se.pingClient(now, client)
+			}
+			for _, controller := range routes.controllers {
+				se.pingClient(now, controller)
 			}
-			se.registrationMutex.Unlock()
 		case <-se.closeChan:
 			return
 		}
 	}
 }
 
-func (se *Server) respondNack(client *Client, request nanodm.Message, errMsg string) {
+// pingClient pings `client`, removing it if it hasn't answered the last pings
+func (se *Server) pingClient(now time.Time, client *Client) {
+	lastPing := client.getLastPing()
+	if now.Sub(lastPing) > PING_PERIOD+PING_PERIOD/2 {
+		se.metrics.PingMisses.Inc(se.clientLabel(client.sourceName))
+	}
+	if now.After(lastPing.Add(5 * PING_PERIOD)) {
+		diff := now.Sub(lastPing)
+		se.log.Warnf("removing client %s, last ping was %s ago", client.sourceName, diff.String())
+		se.removeClient(client)
+	}
+	message := client.GetMessage(nanodm.PingMessageType)
+	message.Source = se.url
+	client.Send(message)
+}
+
+// respondNack nacks `request` with `err`, which keeps its code if it's a
+// nanodm.Error (or nanodm.Errors)
+func (se *Server) respondNack(client *Client, request nanodm.Message, err error) {
 	nackMessage := client.GetMessage(nanodm.NackMessageType)
 	nackMessage.TransactionUID = request.TransactionUID
 	nackMessage.Source = se.url
-	nackMessage.Error = errMsg
+	nackMessage.SetError(err)
 	client.Send(nackMessage)
 }
 
 func (se *Server) registerClient(message nanodm.Message) {
 
 	newClient := NewClient(se.log, message.SourceName, message.Source)
+	newClient.capabilities = message.Capabilities
+	newClient.faults = se.faults
+	newClient.setPipe(message.Pipe)
 	err := newClient.Connect()
 	if err != nil {
 		se.log.Errorf("Failed to connect to source %s at %s.", message.SourceName, message.Source)
 		return
 	}
 
-	existingClient, clientExists := se.clients[message.SourceName]
-	if clientExists && existingClient.clientUrl != newClient.clientUrl {
-
-		errStr := fmt.Sprintf("error source name (%s) already exists", message.SourceName)
-		se.log.Error(errStr)
-		se.respondNack(newClient, message, errStr)
-		go func() {
-			// TODO: Can this be event driven?
-			// Give time for nack message to send, then disconnect
-			<-time.After(2 * time.Second)
-			newClient.Disconnect()
-		}()
-
-		return
-	}
-
-	if clientExists {
-		se.log.Infof("Reregistering client (%s)", message.SourceName)
-		se.removeObjects(existingClient)
+	if newClient.hasCapability(nanodm.CapabilityController) {
+		err = se.addController(newClient)
+	} else {
+		err = se.addClient(newClient, message.Objects)
 	}
-
-	err = se.addObjects(newClient, message.Objects)
 	if err != nil {
-		errStr := fmt.Sprintf("failed to add objects for %s: %v", message.SourceName, err)
-		se.log.Error(errStr)
-		se.respondNack(newClient, message, errStr)
+		se.log.Error(err.Error())
+		se.respondNack(newClient, message, err)
 		go func() {
 			// TODO: Can this be event driven?
 			// Give time for nack message to send, then disconnect
@@ -352,94 +619,115 @@ func (se *Server) registerClient(message nanodm.Message) {
 	}
 
 	se.log.Infof("Registered client (%s)", message.SourceName)
-	newClient.lastPing = time.Now()
-	se.clients[message.SourceName] = newClient
 
 	ackMessage := newClient.GetMessage(nanodm.AckMessageType)
 	ackMessage.TransactionUID = message.TransactionUID
 	ackMessage.Source = se.url
 	newClient.Send(ackMessage)
 
-	if se.handler != nil {
+	if se.handler != nil && !newClient.hasCapability(nanodm.CapabilityController) {
 		se.handler.Registered(se, message.SourceName, message.Objects)
 	}
 
 }
 
-func (se *Server) isObjectRegistered(objectName string) bool {
-	if _, ok := se.objects[objectName]; ok {
-		return true
+// addClient routes `objects` to `newClient`, replacing any previous
+// registration of the client from the same url
+func (se *Server) addClient(newClient *Client, objects []nanodm.Object) error {
+	se.registrationMutex.Lock()
+	defer se.registrationMutex.Unlock()
+
+	routes := se.routingTable().clone()
+	existingClient, clientExists := routes.clients[newClient.sourceName]
+	if clientExists && existingClient.clientUrl != newClient.clientUrl {
+		return fmt.Errorf("error source name (%s) already exists", newClient.sourceName)
 	}
-	if _, ok := se.dynamicLists[objectName]; ok {
-		return true
+	if _, isController := routes.controllers[newClient.sourceName]; isController {
+		return fmt.Errorf("error source name (%s) is a controller", newClient.sourceName)
 	}
-	return false
-}
-
-func (se *Server) isDynamicListConflicting(dynamicListPrefix string) bool {
 
-	for objName := range se.objects {
-		if strings.Contains(objName, dynamicListPrefix) {
-			return true
-		}
+	if clientExists {
+		se.log.Infof("Reregistering client (%s)", newClient.sourceName)
+		routes.removeObjects(existingClient)
 	}
 
-	for prefixName := range se.dynamicLists {
-		if strings.Contains(prefixName, dynamicListPrefix) {
-			return true
-		}
+	se.warnDynamicListConflicts(routes, newClient.sourceName, objects)
+	err := routes.addObjects(newClient, objects)
+	if err != nil {
+		return fmt.Errorf("failed to add objects for %s: %v", newClient.sourceName, err)
 	}
 
-	return false
-}
+	newClient.setLastPing(se.clock.Now())
+	routes.clients[newClient.sourceName] = newClient
+	se.routes.Store(routes)
 
-func (se *Server) addObjects(client *Client, objects []nanodm.Object) error {
-	// Are these objects already registered
-	for _, object := range objects {
-		if se.isObjectRegistered(object.Name) {
-			return fmt.Errorf("failed to add objects object (%s) already exists", object.Name)
-		}
-		if object.Type == nanodm.TypeDynamicList {
-			se.isDynamicListConflicting(object.Name)
-		}
-	}
+	se.metrics.Objects.Set(float64(len(objects)), newClient.sourceName)
+	se.metrics.Sources.Set(float64(len(routes.clients)))
+	return nil
+}
 
-	client.objects = objects
+// addController adds the controller `newController`, replacing any previous
+// connection of the controller from the same url
+func (se *Server) addController(newController *Client) error {
+	se.registrationMutex.Lock()
+	defer se.registrationMutex.Unlock()
 
-	for _, object := range objects {
-		if object.Type == nanodm.TypeDynamicList {
-			//se.log.Debugf("Registering object (%+v)", object)
-			se.dynamicLists[object.Name] = &CoordinatorObject{
-				object: object,
-				client: client,
-			}
-		} else {
-			//se.log.Debugf("Registering object (%+v)", object)
-			se.objects[object.Name] = &CoordinatorObject{
-				object: object,
-				client: client,
-			}
-		}
+	routes := se.routingTable().clone()
+	if _, isSource := routes.clients[newController.sourceName]; isSource {
+		return fmt.Errorf("error controller name (%s) is a source", newController.sourceName)
+	}
+	existingController, exists := routes.controllers[newController.sourceName]
+	if exists && existingController.clientUrl != newController.clientUrl {
+		return fmt.Errorf("error controller name (%s) already exists", newController.sourceName)
 	}
 
+	newController.setLastPing(se.clock.Now())
+	routes.controllers[newController.sourceName] = newController
+	se.routes.Store(routes)
 	return nil
 }
 
-func (se *Server) removeClient(client *Client) {
+// removeClient removes `client` and its objects from the routing table.
+// Returns false if `client` isn't registered, for example because it was
+// replaced by a new registration.
+func (se *Server) removeClient(client *Client) bool {
+	se.registrationMutex.Lock()
+	routes := se.routingTable()
+	if routes.controllers[client.sourceName] == client {
+		routes = routes.clone()
+		delete(routes.controllers, client.sourceName)
+		se.routes.Store(routes)
+		se.metrics.removeSource(client.sourceName)
+		se.registrationMutex.Unlock()
+		se.unsubscribe(client.sourceName, nil)
+		se.dropCandidate(client.sourceName)
+		return true
+	}
+	if routes.clients[client.sourceName] != client {
+		se.registrationMutex.Unlock()
+		return false
+	}
+	routes = routes.clone()
+	objects := routes.clientObjects[client.sourceName]
+	routes.removeObjects(client)
+	delete(routes.clients, client.sourceName)
+	se.routes.Store(routes)
+	se.metrics.removeSource(client.sourceName)
+	se.metrics.Sources.Set(float64(len(routes.clients)))
+	se.registrationMutex.Unlock()
+	se.dropCandidate(client.sourceName)
 
 	if se.handler != nil {
-		err := se.handler.Unregistered(se, client.sourceName, client.objects)
+		err := se.handler.Unregistered(se, client.sourceName, objects)
 		if err != nil {
 			se.log.Errorf("failed in unregister callback: %v", err)
 		}
 	}
-	se.removeObjects(client)
-	delete(se.clients, client.sourceName)
+	return true
 }
 
 func (se *Server) unregisterClient(message nanodm.Message) {
-	if client, exists := se.clients[message.SourceName]; exists {
-		se.removeClient(client)
+	if client, exists := se.routingTable().requester(message.SourceName); exists && se.removeClient(client) {
 
 		// Notify the client they have been unregistered
 		ackMessage := client.GetMessage(nanodm.AckMessageType)
@@ -452,55 +740,65 @@ func (se *Server) unregisterClient(message nanodm.Message) {
 	}
 }
 
-func (se *Server) removeObjects(client *Client) {
-	// remove all objects owned by this client
-	for _, object := range client.objects {
-		if object.Type == nanodm.TypeDynamicList {
-			delete(se.dynamicLists, object.Name)
-		} else {
-			delete(se.objects, object.Name)
-		}
+func (se *Server) updateObjects(message nanodm.Message) {
+
+	client, deletedMap, err := se.replaceObjects(message)
+	if client == nil {
+		se.log.Errorf("error received update to non-existent client")
+		return
+	}
+	if err != nil {
+		se.log.Error(err.Error())
+		se.respondNack(client, message, err)
+		return
+	}
+
+	ackMessage := client.GetMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = message.TransactionUID
+	ackMessage.Source = se.url
+	client.Send(ackMessage)
 
+	if se.handler != nil {
+		se.handler.UpdateObjects(se, client.sourceName, message.Objects, deletedMap)
 	}
 }
 
-func (se *Server) updateObjects(message nanodm.Message) {
+// replaceObjects replaces the objects routed to the source of `message` with
+// the objects of the message.  Returns the client of the source, or nil if it
+// isn't registered, and the objects removed.
+func (se *Server) replaceObjects(message nanodm.Message) (client *Client, deletedMap map[string]nanodm.Object, err error) {
+	se.registrationMutex.Lock()
+	defer se.registrationMutex.Unlock()
 
 	// Does the client exist
-	client, clientExists := se.clients[message.SourceName]
+	routes := se.routingTable().clone()
+	client, clientExists := routes.clients[message.SourceName]
 	if !clientExists {
-		se.log.Errorf("error received update to non-existent client")
-		return
+		return nil, nil, nil
 	}
 
 	// Create maps for sorting objects
 	existingMap := make(map[string]nanodm.Object)
 	newMap := make(map[string]nanodm.Object)
-	deletedMap := make(map[string]nanodm.Object)
+	deletedMap = make(map[string]nanodm.Object)
 
 	for _, updatedObject := range message.Objects {
 		se.log.Infof("Checking updated object (%s)", updatedObject.Name)
 		if updatedObject.Type == nanodm.TypeDynamicList {
-			if existingDynamic, exists := se.dynamicLists[updatedObject.Name]; exists {
+			if existingDynamic := routes.dynamicList(updatedObject.Name); existingDynamic != nil {
 				// Are these updated objects registed with another client
 				if existingDynamic.client.sourceName != message.SourceName {
-					errStr := fmt.Sprintf("failed to add objects object (%s) already exists and is owned by %s", updatedObject.Name, existingDynamic.client.sourceName)
-					se.log.Error(errStr)
-					se.respondNack(client, message, errStr)
-					return
+					return client, nil, fmt.Errorf("failed to add objects object (%s) already exists and is owned by %s", updatedObject.Name, existingDynamic.client.sourceName)
 				}
 				existingMap[updatedObject.Name] = updatedObject
 			} else {
 				newMap[updatedObject.Name] = updatedObject
 			}
 
-		} else if existingObject, ok := se.objects[updatedObject.Name]; ok {
+		} else if existingObject := routes.object(updatedObject.Name); existingObject != nil {
 			// Are these updated objects registed with another client
 			if existingObject.client.sourceName != message.SourceName {
-				errStr := fmt.Sprintf("failed to add objects object (%s) already exists and is owned by %s", updatedObject.Name, existingObject.client.sourceName)
-				se.log.Error(errStr)
-				se.respondNack(client, message, errStr)
-				return
+				return client, nil, fmt.Errorf("failed to add objects object (%s) already exists and is owned by %s", updatedObject.Name, existingObject.client.sourceName)
 			}
 			existingMap[updatedObject.Name] = updatedObject
 		} else {
@@ -508,126 +806,116 @@ func (se *Server) updateObjects(message nanodm.Message) {
 		}
 	}
 
-	// Update existing objects, and remove missing objects
-	for _, oldObject := range client.objects {
-		if _, exists := existingMap[oldObject.Name]; exists {
-			if oldObject.Type == nanodm.TypeDynamicList {
-				// Update existing objects
-				se.dynamicLists[oldObject.Name].object = existingMap[oldObject.Name]
-			} else {
-				// Update existing objects
-				se.objects[oldObject.Name].object = existingMap[oldObject.Name]
-			}
+	se.warnDynamicListConflicts(routes, client.sourceName, nanodm.GetObjectsFromMap(newMap))
 
+	// Update existing objects, and remove missing objects
+	for _, oldObject := range routes.clientObjects[client.sourceName] {
+		if existingObject, exists := existingMap[oldObject.Name]; exists {
+			// Update existing objects
+			routes.setObject(client, existingObject)
 		} else {
 			// Delete objects missing from the new updated list
 			deletedMap[oldObject.Name] = oldObject
-			if oldObject.Type == nanodm.TypeDynamicList {
-				delete(se.dynamicLists, oldObject.Name)
-			} else {
-				delete(se.objects, oldObject.Name)
-			}
+			routes.removeObject(oldObject)
 		}
 	}
 
 	// Add new objects
-	for objectName, newObject := range newMap {
-		if newObject.Type == nanodm.TypeDynamicList {
-			se.dynamicLists[objectName] = &CoordinatorObject{
-				object: newObject,
-				client: client,
-			}
-		} else {
-			se.objects[objectName] = &CoordinatorObject{
-				object: newObject,
-				client: client,
-			}
-		}
-
+	for _, newObject := range newMap {
+		routes.setObject(client, newObject)
 	}
-	client.objects = message.Objects
+	routes.clientObjects[client.sourceName] = message.Objects
+	se.routes.Store(routes)
+	se.metrics.Objects.Set(float64(len(message.Objects)), client.sourceName)
 
-	ackMessage := client.GetMessage(nanodm.AckMessageType)
-	ackMessage.TransactionUID = message.TransactionUID
-	ackMessage.Source = se.url
-	client.Send(ackMessage)
+	return client, deletedMap, nil
+}
 
-	if se.handler != nil {
-		se.handler.UpdateObjects(se, client.sourceName, client.objects, deletedMap)
+// warnDynamicListConflicts logs the dynamic lists of `objects`, registered by
+// `sourceName`, that conflict with the objects routed by `routes`
+func (se *Server) warnDynamicListConflicts(routes *routingTable, sourceName string, objects []nanodm.Object) {
+	for _, name := range routes.conflictingDynamicLists(objects) {
+		se.log.Warnf("Dynamic list (%s) of %s overlaps registered objects or dynamic lists", name, sourceName)
 	}
 }
 
 func (se *Server) handleClientPing(message nanodm.Message) {
-	if client, exists := se.clients[message.SourceName]; exists {
-		client.lastPing = time.Now()
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
+		client.setLastPing(se.clock.Now())
 	}
 }
 
 func (se *Server) handleClientGet(message nanodm.Message) {
 	var objNames []string
 
-	// Given this handler runs as a goroutine, block modifications caused by registration
-	se.registrationMutex.Lock()
-	defer se.registrationMutex.Unlock()
-
-	if client, exists := se.clients[message.SourceName]; exists {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
 		if message.Objects == nil || len(message.Objects) == 0 {
 			se.log.Errorf("Invalid get request with empty objects list")
-			se.respondNack(client, message, "Invalid get request with empty objects list")
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid get request with empty objects list"))
 			return
 		}
 
+		// Partial paths get the objects under them, as with GetPartial
+		routes := se.routingTable()
 		for _, obj := range message.Objects {
-			objNames = append(objNames, obj.Name)
+			objNames = append(objNames, routes.expandPath(obj.Name)...)
 		}
-		objects, err := se.Get(objNames)
+		ctx, span := se.startHandlerSpan(message)
+		result := se.GetResults(ctx, objNames)
+		err := result.Err()
+		span.SetError(err)
+		span.End()
 		if err != nil {
-			errStr := fmt.Sprintf("Failed to get objects with %v", err)
-			se.log.Errorf(errStr)
-			se.respondNack(client, message, errStr)
+			// The objects that were fetched are sent with the errors of the
+			// others
+			se.log.Errorf("Failed to get objects with %v", err)
+			nackMessage := client.GetMessage(nanodm.NackMessageType)
+			nackMessage.TransactionUID = message.TransactionUID
+			nackMessage.Source = se.url
+			nackMessage.SetError(err)
+			nackMessage.Objects = result.Objects
+			client.Send(nackMessage)
 			return
 		}
 		ackMessage := client.GetMessage(nanodm.AckMessageType)
 		ackMessage.TransactionUID = message.TransactionUID
 		ackMessage.Source = se.url
-		ackMessage.Objects = objects
+		ackMessage.Objects = result.Objects
 		client.Send(ackMessage)
 	} else {
 		se.log.Errorf("Error get client (%s) it isn't a registered client? %+v", message.SourceName, message)
 	}
 }
 
-func (se *Server) handleClientSet(message nanodm.Message) {
-	var err error
-	var errStr string
-	var failedObjects []nanodm.Object
-
-	// Given this handler runs as a goroutine, block modifications caused by registration
-	se.registrationMutex.Lock()
-	defer se.registrationMutex.Unlock()
+// startHandlerSpan starts the span of a request from a source, continuing
+// the trace of the source.  The context also carries the source as the
+// identity of the request for the audit log.
+func (se *Server) startHandlerSpan(message nanodm.Message) (context.Context, *tracing.Span) {
+	ctx := audit.ContextWithIdentity(context.Background(), message.SourceName)
+	ctx = tracing.ContextWithTraceParent(ctx, message.TraceParent)
+	ctx, span := se.tracer.Start(ctx, "coordinator.handle "+message.Type.Name(), tracing.SpanKindServer)
+	span.SetAttribute("nanodm.source", message.SourceName)
+	span.SetAttribute("nanodm.transaction_uid", message.TransactionUID)
+	return ctx, span
+}
 
-	if client, exists := se.clients[message.SourceName]; exists {
+func (se *Server) handleClientSet(message nanodm.Message) {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
 		if message.Objects == nil || len(message.Objects) == 0 {
 			se.log.Errorf("Invalid set request with empty objects list")
-			se.respondNack(client, message, "Invalid set request with empty objects list")
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid set request with empty objects list"))
 			return
 		}
 
-		for _, object := range message.Objects {
-			err = se.Set(object)
-			if err != nil {
-				errStr = fmt.Sprintf("%s %s;", errStr, err.Error())
-				failedObjects = append(failedObjects, object)
-			}
-		}
+		ctx, span := se.startHandlerSpan(message)
+		err := se.SetObjects(ctx, message.Objects, false).Err()
+		span.SetError(err)
+		span.End()
 
-		if errStr != "" {
-			se.log.Errorf("Failed to set objects: %s", errStr)
-			nackMessage := client.GetMessage(nanodm.NackMessageType)
-			nackMessage.TransactionUID = message.TransactionUID
-			nackMessage.Source = se.url
-			nackMessage.Objects = failedObjects
-			client.Send(nackMessage)
+		if err != nil {
+			se.log.Errorf("Failed to set objects: %v", err)
+			se.respondNack(client, message, err)
+			return
 		}
 
 		ackMessage := client.GetMessage(nanodm.AckMessageType)
@@ -641,40 +929,141 @@ func (se *Server) handleClientSet(message nanodm.Message) {
 	}
 }
 
+func (se *Server) handleClientAddRow(message nanodm.Message) {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
+		if len(message.Objects) != 1 {
+			se.log.Errorf("Invalid add row request with %d objects", len(message.Objects))
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in add row", len(message.Objects)))
+			return
+		}
+
+		ctx, span := se.startHandlerSpan(message)
+		row, err := se.AddRowContext(ctx, message.Objects[0])
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			se.log.Errorf("Failed to add row: %v", err)
+			se.respondNack(client, message, err)
+			return
+		}
+
+		ackMessage := client.GetMessage(nanodm.AckMessageType)
+		ackMessage.TransactionUID = message.TransactionUID
+		ackMessage.Source = se.url
+		ackMessage.Objects = []nanodm.Object{{Name: row, Type: nanodm.TypeRow}}
+		client.Send(ackMessage)
+
+	} else {
+		se.log.Errorf("Error add row client (%s) it isn't a registered client? %+v", message.SourceName, message)
+	}
+}
+
+func (se *Server) handleClientDeleteRow(message nanodm.Message) {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
+		if len(message.Objects) != 1 {
+			se.log.Errorf("Invalid delete row request with %d objects", len(message.Objects))
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in delete row", len(message.Objects)))
+			return
+		}
+
+		ctx, span := se.startHandlerSpan(message)
+		err := se.DeleteRowContext(ctx, message.Objects[0])
+		span.SetError(err)
+		span.End()
+
+		if err != nil {
+			se.log.Errorf("Failed to delete row: %v", err)
+			se.respondNack(client, message, err)
+			return
+		}
+
+		ackMessage := client.GetMessage(nanodm.AckMessageType)
+		ackMessage.TransactionUID = message.TransactionUID
+		ackMessage.Source = se.url
+		client.Send(ackMessage)
+
+	} else {
+		se.log.Errorf("Error delete row client (%s) it isn't a registered client? %+v", message.SourceName, message)
+	}
+}
+
 func (se *Server) List(path string) (objects []nanodm.Object, err error) {
 
+	routes := se.routingTable()
 	if strings.HasSuffix(path, ".") {
-		for objName, regObject := range se.objects {
-			if strings.HasPrefix(objName, path) {
+		routes.index.walk(path, func(regObject *CoordinatorObject) {
+			if regObject.object.Type != nanodm.TypeDynamicList {
 				objects = append(objects, regObject.object)
 			}
-		}
-	} else if regObject, exists := se.objects[path]; exists {
+		})
+	} else if regObject := routes.object(path); regObject != nil {
 		objects = append(objects, regObject.object)
 	} else {
-		err = fmt.Errorf("failed to find object at path %s", path)
+		err = nanodm.ObjectErrorf(path, nanodm.CodeNotFound, "failed to find object at path %s", path)
+	}
+
+	return
+}
+
+// ListDynamicLists returns the registered dynamic lists under the partial path
+// `path`, or the dynamic list at `path` if it isn't partial
+func (se *Server) ListDynamicLists(path string) (objects []nanodm.Object) {
+	routes := se.routingTable()
+	if !strings.HasSuffix(path, ".") {
+		if dynObject := routes.dynamicList(path); dynObject != nil {
+			objects = append(objects, dynObject.object)
+		}
+		return objects
 	}
+	routes.index.walk(path, func(dynObject *CoordinatorObject) {
+		if dynObject.object.Type == nanodm.TypeDynamicList {
+			objects = append(objects, dynObject.object)
+		}
+	})
+	return objects
+}
 
+// Registry returns the objects and dynamic lists registered under the
+// partial path `path`, or at `path` if it isn't partial, with the sources
+// owning them
+func (se *Server) Registry(path string) (registered []nanodm.RegisteredObject, err error) {
+	se.routingTable().index.walk(path, func(regObject *CoordinatorObject) {
+		registered = append(registered, nanodm.RegisteredObject{Object: regObject.object, Owner: regObject.client.sourceName})
+	})
+	if !strings.HasSuffix(path, ".") && path != "" && len(registered) == 0 {
+		err = nanodm.ObjectErrorf(path, nanodm.CodeNotFound, "failed to find object at path %s", path)
+	}
 	return
 }
 
+// NextLevel returns the names directly below the partial path `path`: the
+// objects and dynamic lists registered there, and the partial paths (ending
+// in ".") of the deeper branches
+func (se *Server) NextLevel(path string) ([]string, error) {
+	names, ok := se.routingTable().index.nextLevel(path)
+	if !ok {
+		return nil, nanodm.ObjectErrorf(path, nanodm.CodeNotFound, "failed to find path %s", path)
+	}
+	return names, nil
+}
+
 func (se *Server) handleClientList(message nanodm.Message) {
 
 	var retObjects []nanodm.Object
 
-	if client, exists := se.clients[message.SourceName]; exists {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
 		if message.Objects == nil || len(message.Objects) == 0 {
 			se.log.Errorf("Invalid get request with empty objects list")
-			se.respondNack(client, message, "Invalid get request with empty objects list")
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid get request with empty objects list"))
 			return
 		}
 
 		for _, obj := range message.Objects {
 			objects, err := se.List(obj.Name)
 			if err != nil {
-				errStr := fmt.Sprintf("Failed to get objects with %v", err)
-				se.log.Errorf(errStr)
-				se.respondNack(client, message, errStr)
+				se.log.Errorf("Failed to get objects with %v", err)
+				se.respondNack(client, message, err)
 				return
 			}
 			retObjects = append(retObjects, objects...)
@@ -690,28 +1079,71 @@ func (se *Server) handleClientList(message nanodm.Message) {
 	}
 }
 
-// isObjectHandledByDynamicList searches the dynamic object list of prefixes to
-// see if `objectName` is handled by a dynamic list.  Returns the dynamic object
-// if found, and nil otherwise
-func (se *Server) isObjectHandledByDynamicList(objectName string) *CoordinatorObject {
-	for dynObjName, dynObject := range se.dynamicLists {
-		if strings.HasPrefix(objectName, dynObjName) {
-			// if objectName has the prefix dynObjName, then return
-			return dynObject
+// handleClientNextLevel answers with the names directly below the path of
+// the message, for browsing the registry
+func (se *Server) handleClientNextLevel(message nanodm.Message) {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
+		if len(message.Objects) != 1 {
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in next level request", len(message.Objects)))
+			return
+		}
+
+		names, err := se.NextLevel(message.Objects[0].Name)
+		if err != nil {
+			se.respondNack(client, message, err)
+			return
+		}
+
+		ackMessage := client.GetMessage(nanodm.AckMessageType)
+		ackMessage.TransactionUID = message.TransactionUID
+		ackMessage.Source = se.url
+		for _, name := range names {
+			ackMessage.Objects = append(ackMessage.Objects, nanodm.Object{Name: name})
 		}
+		client.Send(ackMessage)
+	} else {
+		se.log.Errorf("Error next level client (%s) it isn't a registered client? %+v", message.SourceName, message)
 	}
-	return nil
+}
+
+// handleClientRegistry answers with the registered objects and dynamic lists
+// under the path of the message.  The value of each is its owner's name.
+func (se *Server) handleClientRegistry(message nanodm.Message) {
+	if client, exists := se.routingTable().requester(message.SourceName); exists {
+		if len(message.Objects) != 1 {
+			se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in registry request", len(message.Objects)))
+			return
+		}
+
+		registered, err := se.Registry(message.Objects[0].Name)
+		if err != nil {
+			se.respondNack(client, message, err)
+			return
+		}
+
+		ackMessage := client.GetMessage(nanodm.AckMessageType)
+		ackMessage.TransactionUID = message.TransactionUID
+		ackMessage.Source = se.url
+		for _, regObject := range registered {
+			object := regObject.Object
+			object.Value = regObject.Owner
+			ackMessage.Objects = append(ackMessage.Objects, object)
+		}
+		client.Send(ackMessage)
+	} else {
+		se.log.Errorf("Error registry client (%s) it isn't a registered client? %+v", message.SourceName, message)
+	}
+}
+
+// isObjectHandledByDynamicList looks up the dynamic list handling `objectName`.
+// Returns the innermost dynamic object if found, and nil otherwise
+func (se *Server) isObjectHandledByDynamicList(objectName string) *CoordinatorObject {
+	return se.routingTable().dynamicListFor(objectName)
 }
 
 //
 // Exported version of isObjectHandledByDynamicList(), but only returns a boolean
 //
 func (se *Server) IsObjectHandledByDynamicList(objectName string) bool {
-	for dynObjName, _ := range se.dynamicLists {
-		if strings.HasPrefix(objectName, dynObjName) {
-			// if objectName has the prefix dynObjName, then return
-			return true
-		}
-	}
-	return false
+	return se.isObjectHandledByDynamicList(objectName) != nil
 }
@@ -1,19 +1,25 @@
 package coordinator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
 	"github.com/zackwine/nanodm/source"
+	"github.com/zackwine/nanodm/tracing"
 )
 
 type TestSource struct {
 	log          *logrus.Entry
+	lock         sync.Mutex
 	objectMap    map[string]nanodm.Object
 	objectValues map[string]interface{}
 	nextIndex    int
@@ -21,6 +27,8 @@ type TestSource struct {
 
 func (ts *TestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
 	ts.log.Infof("Calling GetObjects %+v", objectNames)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 	var errString string
 	for _, name := range objectNames {
 		if object, ok := ts.objectMap[name]; ok {
@@ -51,6 +59,8 @@ func (ts *TestSource) GetObjects(objectNames []string) (objects []nanodm.Object,
 
 func (ts *TestSource) SetObjects(objects []nanodm.Object) error {
 	ts.log.Infof("Calling SetObjects %+v", objects)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 	for _, object := range objects {
 		ts.objectValues[object.Name] = object.Value
 	}
@@ -59,6 +69,8 @@ func (ts *TestSource) SetObjects(objects []nanodm.Object) error {
 
 func (ts *TestSource) AddRow(objects nanodm.Object) (row string, err error) {
 	ts.log.Infof("Calling AddRow %+v", objects)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
 
 	parameterMap, typeOk := objects.Value.(map[string]interface{})
 	if !typeOk {
@@ -83,6 +95,8 @@ func (ts *TestSource) AddRow(objects nanodm.Object) (row string, err error) {
 
 func (ex *TestSource) DeleteRow(row nanodm.Object) error {
 	ex.log.Infof("Called DeleteRow for: %s", row.Name)
+	ex.lock.Lock()
+	defer ex.lock.Unlock()
 	var toDeleteObjs []string
 
 	for objName, _ := range ex.objectMap {
@@ -102,6 +116,7 @@ func (ex *TestSource) DeleteRow(row nanodm.Object) error {
 
 type TestCoordinator struct {
 	log                 *logrus.Entry
+	lock                sync.Mutex
 	registeredSource    string
 	registeredObjects   []nanodm.Object
 	unregisteredSource  string
@@ -112,6 +127,8 @@ type TestCoordinator struct {
 
 func (ch *TestCoordinator) Registered(server *Server, sourceName string, objects []nanodm.Object) error {
 	ch.log.Infof("Registered source %s", sourceName)
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
 	ch.registeredSource = sourceName
 	ch.registeredObjects = objects
 	return nil
@@ -119,6 +136,8 @@ func (ch *TestCoordinator) Registered(server *Server, sourceName string, objects
 
 func (ch *TestCoordinator) Unregistered(server *Server, sourceName string, objects []nanodm.Object) error {
 	ch.log.Infof("Unregistered source %s", sourceName)
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
 	ch.unregisteredSource = sourceName
 	ch.unregisteredObjects = objects
 	return nil
@@ -126,6 +145,8 @@ func (ch *TestCoordinator) Unregistered(server *Server, sourceName string, objec
 
 func (ch *TestCoordinator) UpdateObjects(server *Server, sourceName string, objects []nanodm.Object, deletedObjects map[string]nanodm.Object) error {
 	ch.log.Infof("UpdateObjects called for source %s", sourceName)
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
 	ch.updatedSource = sourceName
 	ch.updatedObjects = objects
 	return nil
@@ -200,8 +221,10 @@ func TestServerRegistration(t *testing.T) {
 	// Give the registration a few seconds to take
 	<-time.After(2 * time.Second)
 	// Verify the source is registered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.registeredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.registeredObjects))
+	testCorrdinator.lock.Unlock()
 
 	// Create a source with same name
 	testSource2 := &TestSource{
@@ -213,10 +236,14 @@ func TestServerRegistration(t *testing.T) {
 	err = src2.Connect()
 	assert.Nil(t, err)
 
+	testCorrdinator.lock.Lock()
 	testCorrdinator.registeredSource = ""
+	testCorrdinator.lock.Unlock()
 	err = src2.Register(nanodm.GetObjectsFromMap(objectMapSource))
 	assert.NotNil(t, err)
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, "", testCorrdinator.registeredSource)
+	testCorrdinator.lock.Unlock()
 }
 
 func TestServerUnregistration(t *testing.T) {
@@ -277,18 +304,22 @@ func TestServerUnregistration(t *testing.T) {
 	// Give the registration a few seconds to take
 	<-time.After(2 * time.Second)
 	// Verify the source is registered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.registeredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.registeredObjects))
-	assert.Equal(t, len(objectMapSource), len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, len(objectMapSource), server.routingTable().objectCount())
 
 	err = source.Unregister()
 	assert.Nil(t, err)
 
 	<-time.After(2 * time.Second)
 	// Verify the source is unregistered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.unregisteredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.unregisteredObjects))
-	assert.Equal(t, 0, len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, 0, server.routingTable().objectCount())
 }
 
 func TestServerGet(t *testing.T) {
@@ -349,9 +380,11 @@ func TestServerGet(t *testing.T) {
 	// Give the registration a few seconds to take
 	<-time.After(2 * time.Second)
 	// Verify the source is registered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.registeredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.registeredObjects))
-	assert.Equal(t, len(objectMapSource), len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, len(objectMapSource), server.routingTable().objectCount())
 
 	// happy path
 	gotObjects, errs := server.Get([]string{"Device.Custom.Setting1", "Device.Custom.Setting2"})
@@ -431,9 +464,11 @@ func TestServerSet(t *testing.T) {
 	// Give the registration a few seconds to take
 	<-time.After(2 * time.Second)
 	// Verify the source is registered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.registeredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.registeredObjects))
-	assert.Equal(t, len(objectMapSource), len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, len(objectMapSource), server.routingTable().objectCount())
 
 	// happy path
 	gotObjects, errs := server.Get([]string{"Device.Custom.Setting1"})
@@ -514,9 +549,11 @@ func TestServerUpdate(t *testing.T) {
 	// Give the registration a few seconds to take
 	<-time.After(2 * time.Second)
 	// Verify the source is registered
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.registeredSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.registeredObjects))
-	assert.Equal(t, len(objectMapSource), len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, len(objectMapSource), server.routingTable().objectCount())
 
 	delete(objectMapSource, "Device.Custom.Setting1")
 	source.UpdateObjects(nanodm.GetObjectsFromMap(objectMapSource))
@@ -525,9 +562,11 @@ func TestServerUpdate(t *testing.T) {
 	<-time.After(2 * time.Second)
 
 	// Verify server callbacks were called
+	testCorrdinator.lock.Lock()
 	assert.Equal(t, sourceName, testCorrdinator.updatedSource)
 	assert.Equal(t, len(objectMapSource), len(testCorrdinator.updatedObjects))
-	assert.Equal(t, len(objectMapSource), len(server.objects))
+	testCorrdinator.lock.Unlock()
+	assert.Equal(t, len(objectMapSource), server.routingTable().objectCount())
 
 }
 
@@ -1024,3 +1063,1269 @@ func TestServerDynamicListAddAndDeleteRow(t *testing.T) {
 	assert.NotZero(t, len(errs), "Should have received an error for deleted entry")
 
 }
+
+func TestServerTracing(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4519"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4520"
+	sourceName2 := "testSource2"
+	sourceUrl2 := "tcp://127.0.0.1:4521"
+
+	var objectMapSource = map[string]nanodm.Object{
+		"Device.Custom.Version": {
+			Name:   "Device.Custom.Version",
+			Access: nanodm.AccessRO,
+			Type:   nanodm.TypeString,
+		},
+	}
+
+	var objectValuesSource = map[string]interface{}{
+		"Device.Custom.Version": "2.3.4",
+	}
+
+	log := getLogger()
+	exporter := tracing.NewMemoryExporter()
+
+	// Create a coordinator server
+	testCorrdinator := &TestCoordinator{
+		log: log,
+	}
+	server := NewServer(log, serverUrl, testCorrdinator)
+	server.SetTracer(tracing.NewTracer("coordinator", exporter))
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	// Create a test source
+	testSource := &TestSource{
+		log:          log,
+		objectMap:    objectMapSource,
+		objectValues: objectValuesSource,
+	}
+	src1 := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	src1.SetTracer(tracing.NewTracer(sourceName, exporter))
+	err = src1.Connect()
+	assert.Nil(t, err)
+	defer src1.Disconnect()
+
+	err = src1.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+
+	src2 := source.NewSource(log, sourceName2, serverUrl, sourceUrl2, nil)
+	src2.SetTracer(tracing.NewTracer(sourceName2, exporter))
+	err = src2.Connect()
+	assert.Nil(t, err)
+	defer src2.Disconnect()
+
+	err = src2.Register(nil)
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+	exporter.Reset()
+
+	gotObjects, err := src2.GetObjects([]nanodm.Object{{
+		Name: "Device.Custom.Version",
+	}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(gotObjects))
+
+	// Give the handler span of the source a moment to end
+	<-time.After(100 * time.Millisecond)
+
+	// The Get is traced from src2 through the server to src1 as one trace
+	spans := exporter.Spans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.ServiceName+": "+span.Name)
+	}
+	assert.Equal(t, []string{
+		"testSource2: source.send Get",
+		"coordinator: coordinator.handle Get",
+		"coordinator: coordinator.Get",
+		"coordinator: coordinator.send Get",
+		"testSource: source.handle Get",
+	}, names)
+	if len(spans) != 5 {
+		return
+	}
+
+	assert.False(t, spans[0].ParentSpanID.IsValid())
+	for i := 1; i < len(spans); i++ {
+		assert.Equal(t, spans[0].TraceID, spans[i].TraceID)
+		assert.Equal(t, spans[i-1].SpanID, spans[i].ParentSpanID)
+	}
+	assert.Equal(t, sourceName, spans[3].Attributes["nanodm.source"])
+	assert.Equal(t, ResultAck, spans[3].Attributes["nanodm.result"])
+}
+
+func TestServerAudit(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4522"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4523"
+	sourceName2 := "testSource2"
+	sourceUrl2 := "tcp://127.0.0.1:4524"
+
+	var objectMapSource = map[string]nanodm.Object{
+		"Device.Custom.Setting1": {
+			Name:   "Device.Custom.Setting1",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Dynamic.": {
+			Name:   "Device.Custom.Dynamic.",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeDynamicList,
+		},
+	}
+
+	var objectValuesSource = map[string]interface{}{
+		"Device.Custom.Setting1": "8.8.8.8",
+	}
+
+	log := getLogger()
+	ring := audit.NewRingSink(10)
+
+	// Create a coordinator server
+	testCorrdinator := &TestCoordinator{
+		log: log,
+	}
+	server := NewServer(log, serverUrl, testCorrdinator)
+	server.SetAuditLog(audit.NewLog(log, ring))
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	// Create a test source
+	testSource := &TestSource{
+		log:          log,
+		objectMap:    objectMapSource,
+		objectValues: objectValuesSource,
+	}
+	src1 := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src1.Connect()
+	assert.Nil(t, err)
+	defer src1.Disconnect()
+
+	err = src1.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+
+	src2 := source.NewSource(log, sourceName2, serverUrl, sourceUrl2, nil)
+	err = src2.Connect()
+	assert.Nil(t, err)
+	defer src2.Disconnect()
+
+	err = src2.Register(nil)
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	err = server.Set(nanodm.Object{Name: "Device.Custom.Setting1", Value: "1.1.1.1", Type: nanodm.TypeString})
+	assert.Nil(t, err)
+	err = src2.SetObject(nanodm.Object{Name: "Device.Custom.Setting1", Value: "9.9.9.9", Type: nanodm.TypeString})
+	assert.Nil(t, err)
+	err = server.Set(nanodm.Object{Name: "Device.Custom.Missing", Value: "1"})
+	assert.NotNil(t, err)
+
+	ctx := audit.ContextWithIdentity(context.Background(), "admin")
+	row, err := server.AddRowContext(ctx, nanodm.Object{
+		Name:  "Device.Custom.Dynamic.",
+		Value: map[string]interface{}{"Value1": "val1"},
+		Type:  nanodm.TypeRow,
+	})
+	assert.Nil(t, err)
+	err = server.DeleteRowContext(ctx, nanodm.Object{Name: row, Type: nanodm.TypeRow})
+	assert.Nil(t, err)
+
+	records := ring.Records()
+	if !assert.Equal(t, 5, len(records)) {
+		return
+	}
+
+	assert.Equal(t, uint64(1), records[0].Sequence)
+	assert.Equal(t, audit.OperationSet, records[0].Operation)
+	assert.Equal(t, audit.DEFAULT_IDENTITY, records[0].Identity)
+	assert.Equal(t, "Device.Custom.Setting1", records[0].Path)
+	assert.Equal(t, "8.8.8.8", records[0].OldValue)
+	assert.Equal(t, "1.1.1.1", records[0].NewValue)
+	assert.Equal(t, audit.OutcomeSuccess, records[0].Outcome)
+	assert.NotEqual(t, "", records[0].TransactionUID)
+
+	assert.Equal(t, sourceName2, records[1].Identity)
+	assert.Equal(t, "1.1.1.1", records[1].OldValue)
+	assert.Equal(t, "9.9.9.9", records[1].NewValue)
+	assert.NotEqual(t, records[0].TransactionUID, records[1].TransactionUID)
+
+	assert.Equal(t, "Device.Custom.Missing", records[2].Path)
+	assert.Equal(t, audit.OutcomeFailure, records[2].Outcome)
+	assert.NotEqual(t, "", records[2].Error)
+
+	assert.Equal(t, audit.OperationAddRow, records[3].Operation)
+	assert.Equal(t, "admin", records[3].Identity)
+	assert.Equal(t, "Device.Custom.Dynamic.", records[3].Path)
+	assert.Equal(t, row, records[3].Row)
+
+	assert.Equal(t, audit.OperationDeleteRow, records[4].Operation)
+	assert.Equal(t, row, records[4].Path)
+	assert.Equal(t, audit.OutcomeSuccess, records[4].Outcome)
+
+	// Query the changes made by the second source
+	changes, err := server.AuditLog().Query(audit.Query{Identity: sourceName2})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(changes))
+}
+
+// SlowTestSource delays each get, like a source blocked on hardware
+type SlowTestSource struct {
+	*TestSource
+	delay time.Duration
+}
+
+func (ts *SlowTestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	<-time.After(ts.delay)
+	return ts.TestSource.GetObjects(objectNames)
+}
+
+func TestServerConcurrentRequests(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4525"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4526"
+	slowSourceName := "slowSource"
+	slowSourceUrl := "tcp://127.0.0.1:4527"
+	sourceName3 := "testSource3"
+	sourceUrl3 := "tcp://127.0.0.1:4528"
+
+	var objectMapSource = map[string]nanodm.Object{
+		"Device.Custom.Setting1": {
+			Name:   "Device.Custom.Setting1",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Setting2": {
+			Name:   "Device.Custom.Setting2",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeInt,
+		},
+	}
+
+	var objectMapSlowSource = map[string]nanodm.Object{
+		"Device.Slow.Value": {
+			Name:   "Device.Slow.Value",
+			Access: nanodm.AccessRO,
+			Type:   nanodm.TypeString,
+		},
+	}
+
+	log := getLogger()
+
+	// Create a coordinator server
+	testCorrdinator := &TestCoordinator{
+		log: log,
+	}
+	server := NewServer(log, serverUrl, testCorrdinator)
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		log:          log,
+		objectMap:    objectMapSource,
+		objectValues: map[string]interface{}{"Device.Custom.Setting1": "8.8.8.8", "Device.Custom.Setting2": 600},
+	}
+	src1 := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src1.Connect()
+	assert.Nil(t, err)
+	defer src1.Disconnect()
+	err = src1.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+
+	slowSource := &SlowTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSlowSource,
+			objectValues: map[string]interface{}{"Device.Slow.Value": "slow"},
+		},
+		delay: 4 * time.Second,
+	}
+	srcSlow := source.NewSource(log, slowSourceName, serverUrl, slowSourceUrl, slowSource)
+	err = srcSlow.Connect()
+	assert.Nil(t, err)
+	defer srcSlow.Disconnect()
+	err = srcSlow.Register(nanodm.GetObjectsFromMap(objectMapSlowSource))
+	assert.Nil(t, err)
+
+	src3 := source.NewSource(log, sourceName3, serverUrl, sourceUrl3, &TestSource{
+		log:          log,
+		objectMap:    map[string]nanodm.Object{},
+		objectValues: map[string]interface{}{},
+	})
+	err = src3.Connect()
+	assert.Nil(t, err)
+	defer src3.Disconnect()
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// A source waits on the slow source through the server
+	slowDone := make(chan error)
+	go func() {
+		objects, err := src1.GetObjects([]nanodm.Object{{Name: "Device.Slow.Value"}})
+		if err == nil && len(objects) != 1 {
+			err = fmt.Errorf("expected 1 object, got %d", len(objects))
+		}
+		slowDone <- err
+	}()
+	<-time.After(200 * time.Millisecond)
+
+	// Registrations and requests to other sources don't wait on the slow source
+	start := time.Now()
+	err = src3.Register([]nanodm.Object{{Name: "Device.Third.Value0", Access: nanodm.AccessRW, Type: nanodm.TypeString}})
+	assert.Nil(t, err)
+	objects, errs := server.Get([]string{"Device.Custom.Setting1"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 1, len(objects))
+	assert.True(t, time.Since(start) < slowSource.delay/2, "blocked for %v", time.Since(start))
+
+	// Load the routing table from many goroutines while the third source
+	// changes its objects
+	var wg sync.WaitGroup
+	errChan := make(chan error, 100)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for j := 0; j < 3; j++ {
+				objects, errs := server.Get([]string{"Device.Custom.Setting1", "Device.Custom.Setting2"})
+				if len(errs) > 0 || len(objects) != 2 {
+					errChan <- fmt.Errorf("worker %d get failed %v", worker, errs)
+				}
+				err := server.Set(nanodm.Object{Name: "Device.Custom.Setting1", Value: fmt.Sprintf("10.0.%d.%d", worker, j), Type: nanodm.TypeString})
+				if err != nil {
+					errChan <- err
+				}
+				if _, err := server.List("Device."); err != nil {
+					errChan <- err
+				}
+				server.Sources()
+				server.IsObjectHandledByDynamicList("Device.Third.Value0")
+			}
+		}(i)
+	}
+
+	for i := 1; i <= 5; i++ {
+		err = src3.UpdateObjects([]nanodm.Object{{Name: fmt.Sprintf("Device.Third.Value%d", i), Access: nanodm.AccessRW, Type: nanodm.TypeString}})
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+	close(errChan)
+	for err := range errChan {
+		assert.Nil(t, err)
+	}
+
+	list, err := server.List("Device.Third.")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, "Device.Third.Value5", list[0].Name)
+
+	err = src3.Unregister()
+	assert.Nil(t, err)
+	<-time.After(500 * time.Millisecond)
+	_, err = server.List("Device.Third.Value5")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, <-slowDone)
+}
+
+func TestServerParallelGet(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4530"
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	// Two slow sources, a fast one, and one that fails every get
+	sources := []struct {
+		name       string
+		url        string
+		objectName string
+		delay      time.Duration
+		broken     bool
+	}{
+		{"slowSourceA", "tcp://127.0.0.1:4531", "Device.SlowA.Value", time.Second, false},
+		{"slowSourceB", "tcp://127.0.0.1:4532", "Device.SlowB.Value", time.Second, false},
+		{"brokenSource", "tcp://127.0.0.1:4533", "Device.Broken.Value", 0, true},
+		{"fastSource", "tcp://127.0.0.1:4534", "Device.Fast.Value", 0, false},
+	}
+	for _, s := range sources {
+		object := nanodm.Object{Name: s.objectName, Access: nanodm.AccessRO, Type: nanodm.TypeString}
+		testSource := &TestSource{
+			log:          log,
+			objectMap:    map[string]nanodm.Object{s.objectName: object},
+			objectValues: map[string]interface{}{s.objectName: s.name},
+		}
+		if s.broken {
+			testSource.objectMap = map[string]nanodm.Object{}
+		}
+		src := source.NewSource(log, s.name, serverUrl, s.url, &SlowTestSource{TestSource: testSource, delay: s.delay})
+		err = src.Connect()
+		assert.Nil(t, err)
+		defer src.Disconnect()
+		err = src.Register([]nanodm.Object{object})
+		assert.Nil(t, err)
+	}
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// The sources are requested concurrently, and the failures don't stop the
+	// other objects being returned
+	start := time.Now()
+	result := server.GetResults(context.Background(), []string{"Device.SlowA.Value", "Device.Unknown", "Device.SlowB.Value", "Device.Broken.Value", "Device.Fast.Value"})
+	assert.Less(t, int64(time.Since(start)), int64(1900*time.Millisecond))
+	values := make(map[string]interface{})
+	for _, object := range result.Objects {
+		values[object.Name] = object.Value
+	}
+	assert.Equal(t, map[string]interface{}{
+		"Device.SlowA.Value": "slowSourceA",
+		"Device.SlowB.Value": "slowSourceB",
+		"Device.Fast.Value":  "fastSource",
+	}, values)
+	assert.Equal(t, 2, len(result.Errors))
+	assert.True(t, errors.Is(result.Errors["Device.Unknown"], nanodm.ErrNotFound))
+	assert.NotNil(t, result.Errors["Device.Broken.Value"])
+	errs := result.Errs()
+	if assert.Equal(t, 2, len(errs)) {
+		assert.Contains(t, errs[0].Error(), "Device.Unknown")
+	}
+
+	objects, errs := server.Get([]string{"Device.Fast.Value", "Device.Broken.Value"})
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, 1, len(errs))
+
+	// The deadline of the context applies to the whole get
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	result = server.GetResults(ctx, []string{"Device.SlowA.Value", "Device.Fast.Value"})
+	assert.Less(t, int64(time.Since(start)), int64(900*time.Millisecond))
+	if assert.Equal(t, 1, len(result.Objects)) {
+		assert.Equal(t, "Device.Fast.Value", result.Objects[0].Name)
+	}
+	assert.True(t, errors.Is(result.Errors["Device.SlowA.Value"], context.DeadlineExceeded))
+
+	// Let the late answer arrive before the sources disconnect
+	<-time.After(time.Second)
+}
+
+// CodedErrorTestSource fails with coded errors: sets of the value "bad", gets
+// of the objects named in `failGets`, and every row added
+type CodedErrorTestSource struct {
+	*TestSource
+	failGets map[string]bool
+}
+
+func (ts *CodedErrorTestSource) SetObjects(objects []nanodm.Object) error {
+	for _, object := range objects {
+		if object.Value == "bad" {
+			return nanodm.ObjectErrorf(object.Name, nanodm.CodeInvalidValue, "bad value for %s", object.Name)
+		}
+	}
+	return ts.TestSource.SetObjects(objects)
+}
+
+func (ts *CodedErrorTestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	var errs nanodm.Errors
+	var getNames []string
+	for _, name := range objectNames {
+		if ts.failGets[name] {
+			errs = append(errs, nanodm.ObjectErrorf(name, nanodm.CodeAccessDenied, "access to %s denied", name))
+		} else {
+			getNames = append(getNames, name)
+		}
+	}
+	objects, err = ts.TestSource.GetObjects(getNames)
+	if err == nil && len(errs) > 0 {
+		err = errs
+	}
+	return objects, err
+}
+
+func (ts *CodedErrorTestSource) AddRow(object nanodm.Object) (row string, err error) {
+	return "", nanodm.Errorf(nanodm.CodeResourcesExceeded, "no more rows in %s", object.Name)
+}
+
+func TestServerErrorCodes(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4535"
+	sourceName := "codedSource"
+	sourceUrl := "tcp://127.0.0.1:4536"
+
+	var objectMapSource = map[string]nanodm.Object{
+		"Device.Coded.Value": {
+			Name:   "Device.Coded.Value",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Coded.Secret": {
+			Name:   "Device.Coded.Secret",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Coded.List.": {
+			Name: "Device.Coded.List.",
+			Type: nanodm.TypeDynamicList,
+		},
+	}
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &CodedErrorTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSource,
+			objectValues: map[string]interface{}{"Device.Coded.Value": "good", "Device.Coded.Secret": "secret"},
+		},
+		failGets: map[string]bool{"Device.Coded.Secret": true},
+	}
+	src := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+	err = src.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// The codes of the source handler reach the server
+	err = server.Set(nanodm.Object{Name: "Device.Coded.Value", Value: "bad", Type: nanodm.TypeString})
+	assert.True(t, errors.Is(err, nanodm.ErrInvalidValue))
+	assert.Contains(t, err.Error(), "bad value for Device.Coded.Value")
+	err = server.Set(nanodm.Object{Name: "Device.Coded.Value", Value: "better", Type: nanodm.TypeString})
+	assert.Nil(t, err)
+
+	_, err = server.AddRow(nanodm.Object{Name: "Device.Coded.List.", Type: nanodm.TypeRow, Value: map[string]interface{}{}})
+	assert.True(t, errors.Is(err, nanodm.ErrResourcesExceeded))
+	assert.Equal(t, nanodm.CodeResourcesExceeded, nanodm.CodeOf(err))
+
+	// As do the errors of the server
+	err = server.Set(nanodm.Object{Name: "Device.Coded.Missing", Value: "1"})
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	assert.False(t, errors.Is(err, nanodm.ErrInvalidValue))
+
+	// The objects named in the errors of a source fail, and the others don't
+	result := server.GetResults(context.Background(), []string{"Device.Coded.Value", "Device.Coded.Secret"})
+	if assert.Equal(t, 1, len(result.Objects)) {
+		assert.Equal(t, "better", result.Objects[0].Value)
+	}
+	assert.Equal(t, 1, len(result.Errors))
+	assert.True(t, errors.Is(result.Errors["Device.Coded.Secret"], nanodm.ErrAccessDenied))
+
+	// Sources see the codes of the server
+	_, err = src.GetObjects([]nanodm.Object{{Name: "Device.Coded.Missing"}})
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	err = src.SetObject(nanodm.Object{Name: "Device.Coded.Value", Value: "bad"})
+	assert.True(t, errors.Is(err, nanodm.ErrInvalidValue))
+}
+
+func TestServerSetObjects(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4537"
+
+	var objectMapSourceA = map[string]nanodm.Object{
+		"Device.A.One": {Name: "Device.A.One", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		"Device.A.Two": {Name: "Device.A.Two", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+	}
+	var objectMapSourceB = map[string]nanodm.Object{
+		"Device.B.Value": {Name: "Device.B.Value", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+	}
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSourceA := &TestSource{
+		log:          log,
+		objectMap:    objectMapSourceA,
+		objectValues: map[string]interface{}{"Device.A.One": "1", "Device.A.Two": "2"},
+	}
+	srcA := source.NewSource(log, "sourceA", serverUrl, "tcp://127.0.0.1:4538", testSourceA)
+	err = srcA.Connect()
+	assert.Nil(t, err)
+	defer srcA.Disconnect()
+	err = srcA.Register(nanodm.GetObjectsFromMap(objectMapSourceA))
+	assert.Nil(t, err)
+
+	testSourceB := &CodedErrorTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSourceB,
+			objectValues: map[string]interface{}{"Device.B.Value": "b"},
+		},
+	}
+	srcB := source.NewSource(log, "sourceB", serverUrl, "tcp://127.0.0.1:4539", testSourceB)
+	err = srcB.Connect()
+	assert.Nil(t, err)
+	defer srcB.Disconnect()
+	err = srcB.Register(nanodm.GetObjectsFromMap(objectMapSourceB))
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// One set is sent to each source, and an unknown object doesn't stop the
+	// others being set
+	result := server.SetObjects(context.Background(), []nanodm.Object{
+		{Name: "Device.A.One", Value: "11"},
+		{Name: "Device.B.Value", Value: "bb"},
+		{Name: "Device.A.Two", Value: "22"},
+		{Name: "Device.Missing", Value: "0"},
+	}, false)
+	assert.Equal(t, 1, len(result.Errors))
+	assert.True(t, errors.Is(result.Errors["Device.Missing"], nanodm.ErrNotFound))
+	assert.Equal(t, float64(1), server.Metrics().Requests.Value("Set", "sourceA"))
+	assert.Equal(t, float64(1), server.Metrics().Requests.Value("Set", "sourceB"))
+	testSourceA.lock.Lock()
+	assert.Equal(t, "11", testSourceA.objectValues["Device.A.One"])
+	assert.Equal(t, "22", testSourceA.objectValues["Device.A.Two"])
+	testSourceA.lock.Unlock()
+
+	// Without all or nothing the objects of the other sources stay set
+	result = server.SetObjects(context.Background(), []nanodm.Object{
+		{Name: "Device.A.One", Value: "111"},
+		{Name: "Device.B.Value", Value: "bad"},
+	}, false)
+	assert.Equal(t, 1, len(result.Errors))
+	assert.True(t, errors.Is(result.Errors["Device.B.Value"], nanodm.ErrInvalidValue))
+	testSourceA.lock.Lock()
+	assert.Equal(t, "111", testSourceA.objectValues["Device.A.One"])
+	testSourceA.lock.Unlock()
+
+	// With all or nothing they're restored
+	result = server.SetObjects(context.Background(), []nanodm.Object{
+		{Name: "Device.A.One", Value: "1111"},
+		{Name: "Device.A.Two", Value: "2222"},
+		{Name: "Device.B.Value", Value: "bad"},
+	}, true)
+	assert.Equal(t, 3, len(result.Errors))
+	assert.Empty(t, result.RestoreErrors)
+	assert.True(t, errors.Is(result.Errors["Device.A.One"], nanodm.ErrInvalidValue))
+	assert.Contains(t, result.Errors["Device.A.One"].Error(), "restored")
+	testSourceA.lock.Lock()
+	assert.Equal(t, "111", testSourceA.objectValues["Device.A.One"])
+	assert.Equal(t, "22", testSourceA.objectValues["Device.A.Two"])
+	testSourceA.lock.Unlock()
+
+	// An unknown object fails all or nothing sets before anything is set
+	result = server.SetObjects(context.Background(), []nanodm.Object{
+		{Name: "Device.A.One", Value: "1"},
+		{Name: "Device.Missing", Value: "0"},
+	}, true)
+	assert.Equal(t, 2, len(result.Errors))
+	assert.True(t, errors.Is(result.Errors["Device.A.One"], nanodm.ErrNotFound))
+	assert.NotNil(t, result.Err())
+	testSourceA.lock.Lock()
+	assert.Equal(t, "111", testSourceA.objectValues["Device.A.One"])
+	testSourceA.lock.Unlock()
+
+	result = server.SetObjects(context.Background(), []nanodm.Object{
+		{Name: "Device.A.One", Value: "1"},
+		{Name: "Device.B.Value", Value: "good"},
+	}, true)
+	assert.Nil(t, result.Err())
+}
+
+// TransactionalTestSource stages the operations of transactions, and fails
+// to prepare a Set of the value "bad"
+type TransactionalTestSource struct {
+	*TestSource
+	staged  map[string][]nanodm.Operation
+	aborted []string
+	// The number of commits to fail
+	failCommits  int
+	commitsFails int
+	// Refuse the commits that aren't failed, as if the transactions expired
+	refuseCommits bool
+}
+
+func (ts *TransactionalTestSource) Prepare(transactionID string, operations []nanodm.Operation) error {
+	for _, operation := range operations {
+		if operation.Type == nanodm.OperationSet && operation.Object.Value == "bad" {
+			return nanodm.ObjectErrorf(operation.Object.Name, nanodm.CodeInvalidValue, "bad value for %s", operation.Object.Name)
+		}
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.staged[transactionID] = operations
+	return nil
+}
+
+func (ts *TransactionalTestSource) Commit(transactionID string) (rows []string, err error) {
+	ts.lock.Lock()
+	operations := ts.staged[transactionID]
+	if ts.commitsFails < ts.failCommits {
+		ts.commitsFails++
+		ts.lock.Unlock()
+		return nil, nanodm.Errorf(nanodm.CodeInternal, "failed to commit %s", transactionID)
+	}
+	if ts.refuseCommits {
+		ts.lock.Unlock()
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "transaction %s was aborted", transactionID)
+	}
+	delete(ts.staged, transactionID)
+	ts.lock.Unlock()
+
+	for _, operation := range operations {
+		switch operation.Type {
+		case nanodm.OperationSet:
+			err = ts.SetObjects([]nanodm.Object{operation.Object})
+		case nanodm.OperationAddRow:
+			var row string
+			row, err = ts.AddRow(operation.Object)
+			rows = append(rows, row)
+		case nanodm.OperationDeleteRow:
+			err = ts.DeleteRow(operation.Object)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func (ts *TransactionalTestSource) Abort(transactionID string) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	delete(ts.staged, transactionID)
+	ts.aborted = append(ts.aborted, transactionID)
+	return nil
+}
+
+func TestServerTransaction(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4540"
+
+	var objectMapSourceA = map[string]nanodm.Object{
+		"Device.A.Value": {Name: "Device.A.Value", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		"Device.A.Rows.": {Name: "Device.A.Rows.", Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList},
+	}
+	var objectMapSourceB = map[string]nanodm.Object{
+		"Device.B.Value": {Name: "Device.B.Value", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+	}
+	var objectMapSourceC = map[string]nanodm.Object{
+		"Device.C.Value": {Name: "Device.C.Value", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		"Device.C.Rows.": {Name: "Device.C.Rows.", Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList},
+	}
+
+	log := getLogger()
+	ring := audit.NewRingSink(100)
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	server.SetAuditLog(audit.NewLog(log, ring))
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSourceA := &TransactionalTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSourceA,
+			objectValues: map[string]interface{}{"Device.A.Value": "a"},
+		},
+		staged: make(map[string][]nanodm.Operation),
+	}
+	srcA := source.NewSource(log, "sourceA", serverUrl, "tcp://127.0.0.1:4541", testSourceA)
+	err = srcA.Connect()
+	assert.Nil(t, err)
+	defer srcA.Disconnect()
+	err = srcA.Register(nanodm.GetObjectsFromMap(objectMapSourceA))
+	assert.Nil(t, err)
+
+	testSourceB := &TransactionalTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSourceB,
+			objectValues: map[string]interface{}{"Device.B.Value": "b"},
+		},
+		staged: make(map[string][]nanodm.Operation),
+	}
+	srcB := source.NewSource(log, "sourceB", serverUrl, "tcp://127.0.0.1:4542", testSourceB)
+	err = srcB.Connect()
+	assert.Nil(t, err)
+	defer srcB.Disconnect()
+	err = srcB.Register(nanodm.GetObjectsFromMap(objectMapSourceB))
+	assert.Nil(t, err)
+
+	testSourceC := &CodedErrorTestSource{
+		TestSource: &TestSource{
+			log:          log,
+			objectMap:    objectMapSourceC,
+			objectValues: map[string]interface{}{"Device.C.Value": "c"},
+		},
+	}
+	srcC := source.NewSource(log, "sourceC", serverUrl, "tcp://127.0.0.1:4543", testSourceC)
+	err = srcC.Connect()
+	assert.Nil(t, err)
+	defer srcC.Disconnect()
+	err = srcC.Register(nanodm.GetObjectsFromMap(objectMapSourceC))
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// The operations are committed across the sources
+	result, err := server.Transaction(RejectNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a1"}).
+		AddRow(nanodm.Object{Name: "Device.A.Rows.", Value: map[string]interface{}{"Name": "row"}}).
+		Set(nanodm.Object{Name: "Device.B.Value", Value: "b1"}).
+		Commit(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.A.Rows.0."}, result.Rows)
+	assert.Empty(t, result.InDoubt)
+	assert.Equal(t, float64(1), server.Metrics().Requests.Value("Prepare", "sourceA"))
+	assert.Equal(t, float64(1), server.Metrics().Requests.Value("Commit", "sourceB"))
+	testSourceA.lock.Lock()
+	assert.Equal(t, "a1", testSourceA.objectValues["Device.A.Value"])
+	assert.Equal(t, "row", testSourceA.objectValues["Device.A.Rows.0.Name"])
+	testSourceA.lock.Unlock()
+	testSourceB.lock.Lock()
+	assert.Equal(t, "b1", testSourceB.objectValues["Device.B.Value"])
+	testSourceB.lock.Unlock()
+
+	// A source failing to prepare aborts the transaction on every source
+	tx := server.Transaction(RejectNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a2"}).
+		Set(nanodm.Object{Name: "Device.B.Value", Value: "bad"})
+	_, err = tx.Commit(context.Background())
+	assert.True(t, errors.Is(err, nanodm.ErrInvalidValue))
+	testSourceA.lock.Lock()
+	assert.Equal(t, "a1", testSourceA.objectValues["Device.A.Value"])
+	assert.Equal(t, []string{tx.ID()}, testSourceA.aborted)
+	assert.Empty(t, testSourceA.staged)
+	testSourceA.lock.Unlock()
+
+	// Non-transactional sources are rejected by default
+	_, err = server.Transaction(RejectNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a3"}).
+		Set(nanodm.Object{Name: "Device.C.Value", Value: "c3"}).
+		Commit(context.Background())
+	assert.True(t, errors.Is(err, nanodm.ErrAccessDenied))
+	assert.Equal(t, float64(0), server.Metrics().Requests.Value("Set", "sourceC"))
+
+	// Or applied as the last resource
+	_, err = server.Transaction(LastResourceNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a3"}).
+		Set(nanodm.Object{Name: "Device.C.Value", Value: "c3"}).
+		Commit(context.Background())
+	assert.Nil(t, err)
+	testSourceA.lock.Lock()
+	assert.Equal(t, "a3", testSourceA.objectValues["Device.A.Value"])
+	testSourceA.lock.Unlock()
+	testSourceC.lock.Lock()
+	assert.Equal(t, "c3", testSourceC.objectValues["Device.C.Value"])
+	testSourceC.lock.Unlock()
+
+	// The last resource failing aborts the prepared sources
+	_, err = server.Transaction(LastResourceNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a4"}).
+		Set(nanodm.Object{Name: "Device.C.Value", Value: "bad"}).
+		Commit(context.Background())
+	assert.True(t, errors.Is(err, nanodm.ErrInvalidValue))
+	testSourceA.lock.Lock()
+	assert.Equal(t, "a3", testSourceA.objectValues["Device.A.Value"])
+	testSourceA.lock.Unlock()
+
+	// The operations of the last resource are audited once, with the
+	// transaction
+	tx = server.Transaction(LastResourceNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a4"}).
+		AddRow(nanodm.Object{Name: "Device.C.Rows.", Value: map[string]interface{}{"Name": "row"}})
+	_, err = tx.Commit(context.Background())
+	assert.NotNil(t, err)
+	var rowRecords []audit.Record
+	for _, record := range ring.Records() {
+		if record.Path == "Device.C.Rows." {
+			rowRecords = append(rowRecords, record)
+		}
+	}
+	if assert.Equal(t, 1, len(rowRecords)) {
+		assert.Equal(t, tx.ID(), rowRecords[0].TransactionUID)
+		assert.Equal(t, audit.OutcomeFailure, rowRecords[0].Outcome)
+	}
+
+	// A source that fails to commit is in doubt until the commit is resent
+	testSourceB.lock.Lock()
+	testSourceB.failCommits = 1
+	testSourceB.lock.Unlock()
+	result, err = server.Transaction(RejectNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a5"}).
+		Set(nanodm.Object{Name: "Device.B.Value", Value: "b5"}).
+		Commit(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sourceB"}, result.InDoubt)
+	assert.Equal(t, []string{result.ID}, server.InDoubtTransactions())
+
+	<-time.After(TRANSACTION_RETRY_PERIOD + time.Second)
+	assert.Empty(t, server.InDoubtTransactions())
+	testSourceB.lock.Lock()
+	assert.Equal(t, "b5", testSourceB.objectValues["Device.B.Value"])
+	testSourceB.lock.Unlock()
+	assert.Empty(t, server.HeuristicTransactions())
+
+	// A source refusing the resent commit leaves a heuristic outcome
+	testSourceB.lock.Lock()
+	testSourceB.failCommits = 2
+	testSourceB.refuseCommits = true
+	testSourceB.lock.Unlock()
+	result, err = server.Transaction(RejectNonTransactional).
+		Set(nanodm.Object{Name: "Device.A.Value", Value: "a6"}).
+		Set(nanodm.Object{Name: "Device.B.Value", Value: "b6"}).
+		Commit(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sourceB"}, result.InDoubt)
+
+	<-time.After(TRANSACTION_RETRY_PERIOD + time.Second)
+	assert.Empty(t, server.InDoubtTransactions())
+	outcomes := server.HeuristicTransactions()
+	if assert.Equal(t, 1, len(outcomes)) {
+		assert.Equal(t, result.ID, outcomes[0].ID)
+		assert.True(t, outcomes[0].Commit)
+		assert.True(t, errors.Is(outcomes[0].Sources["sourceB"], nanodm.ErrInvalidValue))
+	}
+	assert.Equal(t, float64(1), server.Metrics().HeuristicOutcomes.Value("commit"))
+	records, err := ring.Query(audit.Query{TransactionUID: result.ID, Outcome: audit.OutcomeHeuristic})
+	assert.Nil(t, err)
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, audit.OperationCommit, records[0].Operation)
+	}
+	testSourceB.lock.Lock()
+	assert.Equal(t, "b5", testSourceB.objectValues["Device.B.Value"])
+	testSourceB.lock.Unlock()
+
+	assert.Nil(t, server.ForgetHeuristicTransaction(result.ID))
+	assert.Empty(t, server.HeuristicTransactions())
+	assert.True(t, errors.Is(server.ForgetHeuristicTransaction(result.ID), nanodm.ErrNotFound))
+}
+
+func TestServerCandidate(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4544"
+
+	var objectMapSource = map[string]nanodm.Object{
+		"Device.WAN.Address": {Name: "Device.WAN.Address", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+		"Device.WAN.Routes.": {Name: "Device.WAN.Routes.", Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList},
+	}
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TransactionalTestSource{
+		TestSource: &TestSource{
+			log: log,
+			objectMap: map[string]nanodm.Object{
+				"Device.WAN.Address":      objectMapSource["Device.WAN.Address"],
+				"Device.WAN.Routes.":      objectMapSource["Device.WAN.Routes."],
+				"Device.WAN.Routes.1.Via": {Name: "Device.WAN.Routes.1.Via", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+			},
+			objectValues: map[string]interface{}{"Device.WAN.Address": "10.0.0.1", "Device.WAN.Routes.1.Via": "10.0.0.254"},
+			nextIndex:    2,
+		},
+		staged: make(map[string][]nanodm.Operation),
+	}
+	src := source.NewSource(log, "wanSource", serverUrl, "tcp://127.0.0.1:4545", testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+	err = src.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	values := func(result *GetResult) map[string]interface{} {
+		assert.Nil(t, result.Err())
+		values := make(map[string]interface{})
+		for _, object := range result.Objects {
+			values[object.Name] = object.Value
+		}
+		return values
+	}
+	names := []string{"Device.WAN.Address", "Device.WAN.Routes."}
+	candidate := server.Candidate()
+
+	// Staged operations only change the candidate
+	err = candidate.Set(nanodm.Object{Name: "Device.Missing", Value: "0"})
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	assert.Nil(t, candidate.Set(nanodm.Object{Name: "Device.WAN.Address", Value: "10.0.0.2"}))
+	assert.Nil(t, candidate.DeleteRow(nanodm.Object{Name: "Device.WAN.Routes.1.", Type: nanodm.TypeRow}))
+	assert.Equal(t, map[string]interface{}{"Device.WAN.Address": "10.0.0.2"}, values(candidate.Get(context.Background(), names)))
+	assert.Equal(t, map[string]interface{}{"Device.WAN.Address": "10.0.0.1", "Device.WAN.Routes.1.Via": "10.0.0.254"},
+		values(server.GetResults(context.Background(), names)))
+
+	diff, err := candidate.Diff(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Type: nanodm.OperationSet, Name: "Device.WAN.Address", OldValue: "10.0.0.1", NewValue: "10.0.0.2"},
+		{Type: nanodm.OperationDeleteRow, Name: "Device.WAN.Routes.1.", OldValue: map[string]interface{}{"Via": "10.0.0.254"}},
+	}, diff)
+
+	candidate.Discard()
+	diff, err = candidate.Diff(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, diff)
+
+	// A commit applies the staged operations
+	assert.Nil(t, candidate.Set(nanodm.Object{Name: "Device.WAN.Address", Value: "10.0.0.2"}))
+	_, err = candidate.Commit(context.Background(), CommitOptions{})
+	assert.Nil(t, err)
+	assert.Empty(t, candidate.Operations())
+	assert.Equal(t, "10.0.0.2", values(server.GetResults(context.Background(), names))["Device.WAN.Address"])
+
+	// A confirmed commit that's confirmed stays
+	assert.Nil(t, candidate.Set(nanodm.Object{Name: "Device.WAN.Address", Value: "10.0.0.3"}))
+	_, err = candidate.Commit(context.Background(), CommitOptions{ConfirmTimeout: time.Second})
+	assert.Nil(t, err)
+	assert.True(t, candidate.PendingConfirm())
+	_, err = candidate.Commit(context.Background(), CommitOptions{})
+	assert.True(t, errors.Is(err, nanodm.ErrInvalidValue))
+	assert.Nil(t, candidate.Confirm())
+	<-time.After(2 * time.Second)
+	assert.Equal(t, "10.0.0.3", values(server.GetResults(context.Background(), names))["Device.WAN.Address"])
+
+	// A confirmed commit that isn't confirmed is reverted
+	assert.Nil(t, candidate.Set(nanodm.Object{Name: "Device.WAN.Address", Value: "192.168.0.1"}))
+	assert.Nil(t, candidate.AddRow(nanodm.Object{Name: "Device.WAN.Routes.", Value: map[string]interface{}{"Via": "192.168.0.254"}, Type: nanodm.TypeRow}))
+	assert.Nil(t, candidate.DeleteRow(nanodm.Object{Name: "Device.WAN.Routes.1.", Type: nanodm.TypeRow}))
+	result, err := candidate.Commit(context.Background(), CommitOptions{ConfirmTimeout: time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"Device.WAN.Routes.2."}, result.Rows)
+	assert.Equal(t, map[string]interface{}{"Device.WAN.Address": "192.168.0.1", "Device.WAN.Routes.2.Via": "192.168.0.254"},
+		values(server.GetResults(context.Background(), names)))
+
+	<-time.After(2 * time.Second)
+	assert.False(t, candidate.PendingConfirm())
+	assert.True(t, errors.Is(candidate.Confirm(), nanodm.ErrNotFound))
+	assert.Equal(t, map[string]interface{}{"Device.WAN.Address": "10.0.0.3", "Device.WAN.Routes.3.Via": "10.0.0.254"},
+		values(server.GetResults(context.Background(), names)))
+}
+
+func TestCandidateRollback(t *testing.T) {
+	routes := newRoutingTable()
+	client := &Client{sourceName: "wanSource"}
+	assert.Nil(t, routes.addObjects(client, []nanodm.Object{
+		{Name: "Device.WAN.MTU", Type: nanodm.TypeUnsignedInt},
+		{Name: "Device.WAN.Routes.", Type: nanodm.TypeDynamicList},
+	}))
+	running := &runningValues{
+		values: map[string]nanodm.Object{"Device.WAN.MTU": {Name: "Device.WAN.MTU", Type: nanodm.TypeUnsignedInt, Value: uint64(1500)}},
+		rows:   map[string]map[string]interface{}{"Device.WAN.Routes.1.": {"Via": "10.0.0.254"}},
+	}
+	operations := []nanodm.Operation{
+		{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.WAN.MTU", Value: uint64(9000)}},
+		{Type: nanodm.OperationAddRow, Object: nanodm.Object{Name: "Device.WAN.Routes.", Type: nanodm.TypeRow}},
+		{Type: nanodm.OperationDeleteRow, Object: nanodm.Object{Name: "Device.WAN.Routes.1.", Type: nanodm.TypeRow}},
+	}
+
+	// The operations are reverted in reverse order, and the values set back
+	// keep their types
+	assert.Equal(t, []nanodm.Operation{
+		{Type: nanodm.OperationAddRow, Object: nanodm.Object{Name: "Device.WAN.Routes.", Type: nanodm.TypeRow, Value: map[string]interface{}{"Via": "10.0.0.254"}}},
+		{Type: nanodm.OperationDeleteRow, Object: nanodm.Object{Name: "Device.WAN.Routes.2.", Type: nanodm.TypeRow}},
+		{Type: nanodm.OperationSet, Object: nanodm.Object{Name: "Device.WAN.MTU", Type: nanodm.TypeUnsignedInt, Value: uint64(1500)}},
+	}, running.rollback(routes, operations, []string{"Device.WAN.Routes.2."}))
+}
+
+func TestServerRemoteRows(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4546"
+
+	var objectMap = map[string]nanodm.Object{
+		"Device.NAT.PortMapping.": {Name: "Device.NAT.PortMapping.", Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList},
+	}
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		log:          log,
+		objectMap:    map[string]nanodm.Object{"Device.NAT.PortMapping.": objectMap["Device.NAT.PortMapping."]},
+		objectValues: make(map[string]interface{}),
+		nextIndex:    1,
+	}
+	src := source.NewSource(log, "natSource", serverUrl, "tcp://127.0.0.1:4547", testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+	err = src.Register(nanodm.GetObjectsFromMap(objectMap))
+	assert.Nil(t, err)
+
+	controller := source.NewSource(log, "controller", serverUrl, "tcp://127.0.0.1:4548", nil)
+	err = controller.Connect()
+	assert.Nil(t, err)
+	defer controller.Disconnect()
+	err = controller.Register(nil)
+	assert.Nil(t, err)
+
+	// Give the registration a few seconds to take
+	<-time.After(2 * time.Second)
+
+	// The row is added by the owning source with its initial values
+	row, err := controller.AddRow(nanodm.Object{
+		Name:  "Device.NAT.PortMapping.",
+		Type:  nanodm.TypeRow,
+		Value: map[string]interface{}{"ExternalPort": "8080"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "Device.NAT.PortMapping.1.", row)
+	testSource.lock.Lock()
+	assert.Equal(t, "8080", testSource.objectValues["Device.NAT.PortMapping.1.ExternalPort"])
+	testSource.lock.Unlock()
+
+	_, err = controller.AddRow(nanodm.Object{Name: "Device.Missing.", Type: nanodm.TypeRow})
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+
+	err = controller.DeleteRow(nanodm.Object{Name: row, Type: nanodm.TypeRow})
+	assert.Nil(t, err)
+	testSource.lock.Lock()
+	assert.NotContains(t, testSource.objectValues, "Device.NAT.PortMapping.1.ExternalPort")
+	testSource.lock.Unlock()
+}
+
+func TestServerSenderBinding(t *testing.T) {
+
+	serverUrl := "tcp://127.0.0.1:4554"
+	sourceUrl := "tcp://127.0.0.1:4555"
+	impostorUrl := "tcp://127.0.0.1:4556"
+
+	var objectMap = map[string]nanodm.Object{
+		"Device.Custom.Setting1": {Name: "Device.Custom.Setting1", Access: nanodm.AccessRW, Type: nanodm.TypeString},
+	}
+
+	log := getLogger()
+
+	server := NewServer(log, serverUrl, &TestCoordinator{log: log})
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		log:          log,
+		objectMap:    objectMap,
+		objectValues: map[string]interface{}{"Device.Custom.Setting1": "8.8.8.8"},
+	}
+	src := source.NewSource(log, "testSource", serverUrl, sourceUrl, testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+	err = src.Register(nanodm.GetObjectsFromMap(objectMap))
+	assert.Nil(t, err)
+
+	// An impostor connected to the server claims to be the source
+	impostorChan := make(chan nanodm.Message, 16)
+	puller := nanodm.NewPuller(log, impostorUrl, impostorChan)
+	assert.Nil(t, puller.Start())
+	defer puller.Stop()
+	pusherChan := make(chan nanodm.Message)
+	pusher := nanodm.NewPusher(log, serverUrl, pusherChan)
+	assert.Nil(t, pusher.Start())
+	defer pusher.Stop()
+
+	pusherChan <- nanodm.Message{Type: nanodm.UnregisterMessageType, SourceName: "testSource", Source: sourceUrl, TransactionUID: nanodm.GetTransactionUID()}
+	pusherChan <- nanodm.Message{Type: nanodm.UnregisterMessageType, SourceName: "testSource", Source: impostorUrl, TransactionUID: nanodm.GetTransactionUID()}
+	pusherChan <- nanodm.Message{Type: nanodm.RegisterMessageType, SourceName: "testSource", Source: impostorUrl, TransactionUID: nanodm.GetTransactionUID(),
+		Objects: []nanodm.Object{{Name: "Device.Custom.Impostor", Type: nanodm.TypeString}}}
+	assert.Eventually(t, func() bool { return server.Metrics().Rejected.Value(nanodm.RejectSender) == 3 }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case message := <-impostorChan:
+		t.Errorf("impostor received %+v", message)
+	default:
+	}
+
+	// The source is still registered and answers
+	_, err = server.List("Device.Custom.Impostor")
+	assert.True(t, errors.Is(err, nanodm.ErrNotFound))
+	objects, errs := server.Get([]string{"Device.Custom.Setting1"})
+	assert.Equal(t, 0, len(errs))
+	assert.Equal(t, 1, len(objects))
+	assert.Equal(t, "8.8.8.8", objects[0].Value)
+	assert.Equal(t, float64(3), server.Metrics().Rejected.Value(nanodm.RejectSender))
+
+	// Messages from unregistered clients are rejected before being counted
+	pusherChan <- nanodm.Message{Type: nanodm.PingMessageType, SourceName: "ghostSource", Source: impostorUrl, TransactionUID: nanodm.GetTransactionUID()}
+	assert.Eventually(t, func() bool { return server.Metrics().Rejected.Value(nanodm.RejectSender) == 4 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(0), server.Metrics().Received.Value("Ping", "ghostSource"))
+}
+
+func TestServerNotificationQueue(t *testing.T) {
+	log := getLogger()
+	server := NewServer(log, "tcp://127.0.0.1:4552", nil)
+	// The client isn't connected, so its messages are read from its channel
+	client := NewClient(log, "slowController", "tcp://127.0.0.1:4553")
+	assert.Nil(t, server.addController(client))
+
+	go server.handleClientSubscribe(nanodm.Message{Type: nanodm.SubscribeMessageType, SourceName: "slowController", Objects: []nanodm.Object{{Name: "Device.WiFi."}}})
+	ack := <-client.pusherChan
+	assert.Equal(t, nanodm.AckMessageType, ack.Type)
+
+	// Changes are queued without waiting for the subscriber, and dropped
+	// once its queue is full
+	changes := NOTIFICATION_BUFFER + 10
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < changes; i++ {
+			server.notifyChange(nanodm.OperationSet, "Device.WiFi.Channel", int64(i))
+		}
+		server.notifyChange(nanodm.OperationSet, "Device.Other", "ignored")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout notifying a subscriber that doesn't read")
+	}
+	dropped := int(server.Metrics().NotificationsDropped.Value(CONTROLLER_LABEL))
+	assert.True(t, dropped >= changes-NOTIFICATION_BUFFER-1)
+
+	// The changes queued are sent in order
+	for i := 0; i < changes-dropped; i++ {
+		notify := <-client.pusherChan
+		assert.Equal(t, nanodm.NotifyMessageType, notify.Type)
+		if assert.Equal(t, 1, len(notify.Operations)) {
+			assert.Equal(t, int64(i), notify.Operations[0].Object.Value)
+		}
+	}
+	select {
+	case notify := <-client.pusherChan:
+		t.Errorf("Unexpected notification %+v", notify)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	server.unsubscribe("slowController", nil)
+	server.notifyChange(nanodm.OperationSet, "Device.WiFi.Channel", int64(0))
+	assert.Equal(t, float64(dropped), server.Metrics().NotificationsDropped.Value(CONTROLLER_LABEL))
+}
@@ -0,0 +1,241 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/tracing"
+)
+
+// SetResult is the result of SetObjects
+type SetResult struct {
+	// The error of each object that wasn't set, or was set and then restored
+	// (or failed to be) when another object failed, by name
+	Errors map[string]error
+	// The error of each object of an all or nothing set that was set but
+	// couldn't be restored when another failed, by name
+	RestoreErrors map[string]error
+
+	names []string
+}
+
+// Err returns the errors of the result as nanodm.Errors naming each object
+// that wasn't set, or nil if every object was
+func (sr *SetResult) Err() error {
+	return objectErrors(sr.names, sr.Errors)
+}
+
+// sourceSet is the part of a SetObjects sent to one source
+type sourceSet struct {
+	client  *Client
+	objects []nanodm.Object
+
+	transactionUID uuid.UUID
+	err            error
+}
+
+// SetObjects sets `objects` as part of the trace in `ctx`, sending one Set to
+// each source concurrently.  If `allOrNothing` is set the current values of
+// the objects are fetched first, and if any object fails to be set the
+// objects set by the other sources are restored to them.
+func (se *Server) SetObjects(ctx context.Context, objects []nanodm.Object, allOrNothing bool) (result *SetResult) {
+	ctx, span := se.tracer.Start(ctx, "coordinator.SetObjects", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.objects", len(objects))
+	span.SetAttribute("nanodm.all_or_nothing", allOrNothing)
+	result = &SetResult{
+		Errors:        make(map[string]error),
+		RestoreErrors: make(map[string]error),
+	}
+	defer func() {
+		span.SetError(result.Err())
+		span.End()
+	}()
+
+	// Build a set for each client, in the order the sources are first set
+	var sets []*sourceSet
+	sourceSets := make(map[string]*sourceSet)
+	routes := se.routingTable()
+	for _, object := range objects {
+		result.names = append(result.names, object.Name)
+		var client *Client
+		if cobject := routes.object(object.Name); cobject != nil {
+			client = cobject.client
+		} else if dynObject := routes.dynamicListFor(object.Name); dynObject != nil {
+			client = dynObject.client
+		} else {
+			result.Errors[object.Name] = nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "the object %s isn't registered", object.Name)
+			continue
+		}
+
+		set, ok := sourceSets[client.sourceName]
+		if !ok {
+			set = &sourceSet{client: client}
+			sourceSets[client.sourceName] = set
+			sets = append(sets, set)
+		}
+		set.objects = append(set.objects, object)
+	}
+	span.SetAttribute("nanodm.sources", len(sets))
+
+	if allOrNothing && len(result.Errors) > 0 {
+		se.abortSet(result, sets, result.Err())
+		return result
+	}
+
+	// The current values are needed to restore them, and for the audit log
+	var oldObjects map[string]nanodm.Object
+	if allOrNothing || se.auditLog != nil {
+		var names []string
+		for _, set := range sets {
+			for _, object := range set.objects {
+				names = append(names, object.Name)
+			}
+		}
+		current := se.GetResults(ctx, names)
+		if err := current.Err(); allOrNothing && err != nil {
+			se.abortSet(result, sets, fmt.Errorf("failed to get the values to restore: %w", err))
+			return result
+		}
+		oldObjects = make(map[string]nanodm.Object, len(current.Objects))
+		for _, object := range current.Objects {
+			oldObjects[object.Name] = object
+		}
+		for _, name := range names {
+			if _, ok := oldObjects[name]; allOrNothing && !ok {
+				se.abortSet(result, sets, nanodm.ObjectErrorf(name, nanodm.CodeInternal, "failed to get the value of %s to restore", name))
+				return result
+			}
+		}
+	}
+
+	se.sendSets(ctx, sets)
+	var changes []nanodm.Operation
+	for _, set := range sets {
+		for _, object := range set.objects {
+			if set.err != nil {
+				if err := objectError(set.err, object.Name); err != nil {
+					result.Errors[object.Name] = err
+				}
+			}
+			se.audit(ctx, audit.OperationSet, object.Name, "", se.oldValue(oldObjects, object.Name), object.Value, set.transactionUID, result.Errors[object.Name])
+			if result.Errors[object.Name] == nil {
+				changes = append(changes, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: object.Name, Value: object.Value}})
+			}
+		}
+	}
+	se.notifySubscribers(changes)
+
+	if allOrNothing && len(result.Errors) > 0 {
+		se.restoreSet(ctx, result, sets, oldObjects)
+	}
+	return result
+}
+
+// sendSets sends each set to its source concurrently
+func (se *Server) sendSets(ctx context.Context, sets []*sourceSet) {
+	var wg sync.WaitGroup
+	for _, set := range sets {
+		wg.Add(1)
+		go func(set *sourceSet) {
+			defer wg.Done()
+			set.transactionUID, set.err = se.setSource(ctx, set.client, set.objects)
+		}(set)
+	}
+	wg.Wait()
+}
+
+func (se *Server) setSource(ctx context.Context, client *Client, objects []nanodm.Object) (uuid.UUID, error) {
+	setMessage := client.GetMessage(nanodm.SetMessageType)
+	setMessage.Source = se.url
+	setMessage.Objects = objects
+
+	ackMessage, err := se.sendRequest(ctx, client, setMessage)
+	if err != nil {
+		return setMessage.TransactionUID, err
+	}
+	if ackMessage.Type == nanodm.AckMessageType {
+		return setMessage.TransactionUID, nil
+	} else if ackMessage.Type == nanodm.NackMessageType {
+		return setMessage.TransactionUID, fmt.Errorf("failed to set objects: %w", nanodm.MessageError(ackMessage))
+	}
+	return setMessage.TransactionUID, nanodm.Errorf(nanodm.CodeInternal, "set received unknown message response type (%d)", ackMessage.Type)
+}
+
+// oldValue returns the value of `name` in `oldObjects`, or the value last set
+// through the audit log
+func (se *Server) oldValue(oldObjects map[string]nanodm.Object, name string) interface{} {
+	if object, ok := oldObjects[name]; ok {
+		return object.Value
+	}
+	if se.auditLog == nil {
+		return nil
+	}
+	value, _ := se.auditLog.LastValue(name)
+	return value
+}
+
+// abortSet fails the objects of `sets` without setting them because of `err`
+func (se *Server) abortSet(result *SetResult, sets []*sourceSet, err error) {
+	for _, set := range sets {
+		for _, object := range set.objects {
+			result.Errors[object.Name] = nanodm.ObjectErrorf(object.Name, nanodm.CodeOf(err), "%s not set: %v", object.Name, err)
+		}
+	}
+}
+
+// restoreSet restores the objects of `sets` that were set to their values in
+// `oldObjects` after others failed.  The restoration isn't bound by the
+// deadline of `ctx`, as the set may have failed because it passed.
+func (se *Server) restoreSet(ctx context.Context, result *SetResult, sets []*sourceSet, oldObjects map[string]nanodm.Object) {
+	ctx = detachedContext(ctx)
+	cause := result.Err()
+	var restores []*sourceSet
+	newValues := make(map[string]interface{})
+	for _, set := range sets {
+		restore := &sourceSet{client: set.client}
+		for _, object := range set.objects {
+			if _, failed := result.Errors[object.Name]; !failed {
+				restore.objects = append(restore.objects, oldObjects[object.Name])
+				newValues[object.Name] = object.Value
+			}
+		}
+		if len(restore.objects) > 0 {
+			restores = append(restores, restore)
+		}
+	}
+
+	se.log.Warnf("Restoring the objects of %d sources after a failed set: %v", len(restores), cause)
+	se.sendSets(ctx, restores)
+	var changes []nanodm.Operation
+	for _, restore := range restores {
+		for _, object := range restore.objects {
+			var err error
+			if restore.err != nil {
+				err = objectError(restore.err, object.Name)
+			}
+			if err != nil {
+				se.log.Errorf("Failed to restore %s: %v", object.Name, err)
+				result.RestoreErrors[object.Name] = err
+				result.Errors[object.Name] = nanodm.ObjectErrorf(object.Name, nanodm.CodeOf(cause), "%s set but not restored after the set failed: %v (restore: %v)", object.Name, cause, err)
+			} else {
+				result.Errors[object.Name] = nanodm.ObjectErrorf(object.Name, nanodm.CodeOf(cause), "%s restored after the set failed: %v", object.Name, cause)
+			}
+			se.audit(ctx, audit.OperationSet, object.Name, "", newValues[object.Name], object.Value, restore.transactionUID, err)
+			if err == nil {
+				changes = append(changes, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: object.Name, Value: object.Value}})
+			}
+		}
+	}
+	se.notifySubscribers(changes)
+}
+
+// detachedContext returns a context carrying the span and audit identity of
+// `ctx` without its deadline or cancellation
+func detachedContext(ctx context.Context) context.Context {
+	detached := audit.ContextWithIdentity(context.Background(), audit.IdentityFromContext(ctx))
+	return tracing.ContextWithSpan(detached, tracing.SpanFromContext(ctx))
+}
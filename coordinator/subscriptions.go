@@ -0,0 +1,218 @@
+package coordinator
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/zackwine/nanodm"
+)
+
+// The most notifications queued for a subscriber, beyond which they're dropped
+const NOTIFICATION_BUFFER = 64
+
+// subscriber is a client subscribed to changes.  Its notifications are
+// queued, so that a change isn't held up by sending them.
+type subscriber struct {
+	// The paths subscribed to
+	paths map[string]bool
+	queue chan []nanodm.Operation
+	// Closed when the client unsubscribes from every path
+	done chan struct{}
+}
+
+// Controllers returns the connected controllers, which make requests but
+// don't own objects
+func (se *Server) Controllers() (controllers []SourceInfo) {
+	for _, controller := range se.routingTable().controllers {
+		controllers = append(controllers, SourceInfo{
+			Name:     controller.sourceName,
+			Url:      controller.clientUrl,
+			LastPing: controller.getLastPing(),
+		})
+	}
+	sort.Slice(controllers, func(i, j int) bool {
+		return controllers[i].Name < controllers[j].Name
+	})
+	return controllers
+}
+
+// handleClientSubscribe subscribes the client to the changes of the objects
+// of the message.  A partial path (ending in ".") subscribes to every object
+// under it.
+func (se *Server) handleClientSubscribe(message nanodm.Message) {
+	client, exists := se.routingTable().requester(message.SourceName)
+	if !exists {
+		se.log.Errorf("Error subscribe client (%s) it isn't a registered client? %+v", message.SourceName, message)
+		return
+	}
+	if len(message.Objects) == 0 {
+		se.respondNack(client, message, nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid subscribe request with empty objects list"))
+		return
+	}
+
+	se.subscriptionsMutex.Lock()
+	sub, ok := se.subscriptions[client.sourceName]
+	if !ok {
+		sub = &subscriber{
+			paths: make(map[string]bool),
+			queue: make(chan []nanodm.Operation, NOTIFICATION_BUFFER),
+			done:  make(chan struct{}),
+		}
+		se.subscriptions[client.sourceName] = sub
+		go se.subscriberTask(client.sourceName, sub)
+	}
+	for _, object := range message.Objects {
+		sub.paths[object.Name] = true
+	}
+	se.subscriptionsMutex.Unlock()
+
+	ackMessage := client.GetMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = message.TransactionUID
+	ackMessage.Source = se.url
+	client.Send(ackMessage)
+}
+
+// handleClientUnsubscribe unsubscribes the client from the objects of the
+// message, or from every object if there are none
+func (se *Server) handleClientUnsubscribe(message nanodm.Message) {
+	client, exists := se.routingTable().requester(message.SourceName)
+	if !exists {
+		se.log.Errorf("Error unsubscribe client (%s) it isn't a registered client? %+v", message.SourceName, message)
+		return
+	}
+
+	var paths []string
+	for _, object := range message.Objects {
+		paths = append(paths, object.Name)
+	}
+	se.unsubscribe(client.sourceName, paths)
+
+	ackMessage := client.GetMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = message.TransactionUID
+	ackMessage.Source = se.url
+	client.Send(ackMessage)
+}
+
+// unsubscribe unsubscribes the client `clientName` from `paths`, or from
+// every path if `paths` is empty
+func (se *Server) unsubscribe(clientName string, paths []string) {
+	se.subscriptionsMutex.Lock()
+	defer se.subscriptionsMutex.Unlock()
+	sub, ok := se.subscriptions[clientName]
+	if !ok {
+		return
+	}
+	for _, path := range paths {
+		delete(sub.paths, path)
+	}
+	if len(paths) == 0 || len(sub.paths) == 0 {
+		delete(se.subscriptions, clientName)
+		close(sub.done)
+	}
+}
+
+// handleClientNotify notifies the subscribers of the changes a source made to
+// its own objects
+func (se *Server) handleClientNotify(message nanodm.Message) {
+	routes := se.routingTable()
+	client, exists := routes.clients[message.SourceName]
+	if !exists {
+		se.log.Errorf("Error notify client (%s) it isn't a registered source? %+v", message.SourceName, message)
+		return
+	}
+
+	var operations []nanodm.Operation
+	for _, object := range message.Objects {
+		owner := routes.object(object.Name)
+		if owner == nil {
+			owner = routes.dynamicListFor(object.Name)
+		}
+		if owner == nil || owner.client.sourceName != client.sourceName {
+			se.respondNack(client, message, nanodm.ObjectErrorf(object.Name, nanodm.CodeAccessDenied, "the object %s isn't owned by %s", object.Name, client.sourceName))
+			return
+		}
+		operations = append(operations, nanodm.Operation{Type: nanodm.OperationSet, Object: object})
+	}
+	se.notifySubscribers(operations)
+
+	ackMessage := client.GetMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = message.TransactionUID
+	ackMessage.Source = se.url
+	client.Send(ackMessage)
+}
+
+// notifyChange notifies the subscribers of a change made through the server:
+// a Set of `name` to `value`, the AddRow of the row `name` with the values
+// `value`, or the DeleteRow of the row `name`
+func (se *Server) notifyChange(operationType nanodm.OperationType, name string, value interface{}) {
+	change := nanodm.Operation{Type: operationType, Object: nanodm.Object{Name: name, Value: value}}
+	if operationType != nanodm.OperationSet {
+		change.Object.Type = nanodm.TypeRow
+	}
+	se.notifySubscribers([]nanodm.Operation{change})
+}
+
+// notifySubscribers queues the changes in `operations` to the paths each
+// client is subscribed to.  The changes are sent by the task of the
+// subscriber, and dropped if its queue is full.
+func (se *Server) notifySubscribers(operations []nanodm.Operation) {
+	if len(operations) == 0 {
+		return
+	}
+	se.subscriptionsMutex.Lock()
+	defer se.subscriptionsMutex.Unlock()
+	for clientName, sub := range se.subscriptions {
+		var changes []nanodm.Operation
+		for _, operation := range operations {
+			if isSubscribed(sub.paths, operation) {
+				changes = append(changes, operation)
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		select {
+		case sub.queue <- changes:
+		default:
+			se.log.Warnf("Dropping %d notifications of (%s), its queue is full", len(changes), clientName)
+			se.metrics.NotificationsDropped.Add(float64(len(changes)), se.clientLabel(clientName))
+		}
+	}
+}
+
+// subscriberTask sends the notifications queued for the client `clientName`
+// until it unsubscribes or the server stops
+func (se *Server) subscriberTask(clientName string, sub *subscriber) {
+	for {
+		select {
+		case changes := <-sub.queue:
+			client, exists := se.routingTable().requester(clientName)
+			if !exists {
+				continue
+			}
+			notifyMessage := client.GetMessage(nanodm.NotifyMessageType)
+			notifyMessage.Source = se.url
+			notifyMessage.Operations = changes
+			client.Send(notifyMessage)
+		case <-sub.done:
+			return
+		case <-se.closeChan:
+			return
+		}
+	}
+}
+
+// isSubscribed returns true if `paths` subscribe to the change `operation`.
+// A row being deleted also changes the paths under it.
+func isSubscribed(paths map[string]bool, operation nanodm.Operation) bool {
+	name := operation.Object.Name
+	for path := range paths {
+		if nanodm.MatchesPath(path, name) {
+			return true
+		}
+		if operation.Type == nanodm.OperationDeleteRow && strings.HasPrefix(path, rowPrefix(name)) {
+			return true
+		}
+	}
+	return false
+}
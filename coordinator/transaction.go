@@ -0,0 +1,571 @@
+package coordinator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/tracing"
+)
+
+const (
+	// How often the decision of an in-doubt transaction is resent to the
+	// sources that haven't confirmed it
+	TRANSACTION_RETRY_PERIOD = 5 * time.Second
+	// How long the decision of an in-doubt transaction is resent before it's
+	// given up
+	TRANSACTION_RECOVERY_TIMEOUT = 10 * time.Minute
+)
+
+// TransactionPolicy decides how a transaction handles the sources that
+// didn't register with the transactions capability
+type TransactionPolicy int
+
+const (
+	// A transaction with operations on a non-transactional source fails
+	// without applying any operation
+	RejectNonTransactional TransactionPolicy = iota
+	// A transaction may have operations on one non-transactional source.
+	// They are applied, in order, once the other sources have prepared, and
+	// the transaction is aborted if any fails.  Operations of the source
+	// applied before the failure aren't undone.
+	LastResourceNonTransactional
+)
+
+// Transaction groups Sets, AddRows and DeleteRows across sources that are
+// applied by Commit with a two-phase commit: every source prepares its
+// operations, and they are committed only if all did.
+type Transaction struct {
+	server     *Server
+	id         uuid.UUID
+	policy     TransactionPolicy
+	operations []nanodm.Operation
+}
+
+// TransactionResult is the result of a committed transaction
+type TransactionResult struct {
+	ID string
+	// The rows added, in the order of the AddRow operations.  The row of a
+	// source in doubt is empty.
+	Rows []string
+	// The sources that didn't confirm the commit.  The server keeps sending
+	// them the commit until they do.
+	InDoubt []string
+}
+
+// transactionParticipant is the part of a transaction sent to one source
+type transactionParticipant struct {
+	client     *Client
+	operations []nanodm.Operation
+	// The index of each operation in the transaction
+	indexes []int
+
+	rows []string
+	err  error
+}
+
+// inDoubtTransaction is a transaction that was decided, but that some
+// sources haven't confirmed
+type inDoubtTransaction struct {
+	id      uuid.UUID
+	commit  bool
+	decided time.Time
+	// The names of the sources that haven't confirmed the decision
+	sources map[string]bool
+}
+
+// HeuristicOutcome is a transaction whose decision some sources refused, or
+// didn't confirm in time, once they were in doubt.  Those sources may not have
+// applied the decision the others did.
+type HeuristicOutcome struct {
+	ID string
+	// True if the transaction was committed, false if it was aborted
+	Commit  bool
+	Decided time.Time
+	// The error of each source that didn't apply the decision, by name
+	Sources map[string]error
+}
+
+// Transaction starts a transaction that handles non-transactional sources
+// according to `policy`
+func (se *Server) Transaction(policy TransactionPolicy) *Transaction {
+	return &Transaction{
+		server: se,
+		id:     uuid.New(),
+		policy: policy,
+	}
+}
+
+// ID returns the ID of the transaction, which is sent to the sources and
+// recorded in the audit log
+func (tx *Transaction) ID() string {
+	return tx.id.String()
+}
+
+// Set adds setting `object` to the transaction
+func (tx *Transaction) Set(object nanodm.Object) *Transaction {
+	return tx.add(nanodm.OperationSet, object)
+}
+
+// AddRow adds adding a row to the dynamic list `object` to the transaction
+func (tx *Transaction) AddRow(object nanodm.Object) *Transaction {
+	return tx.add(nanodm.OperationAddRow, object)
+}
+
+// DeleteRow adds deleting the row `object` to the transaction
+func (tx *Transaction) DeleteRow(object nanodm.Object) *Transaction {
+	return tx.add(nanodm.OperationDeleteRow, object)
+}
+
+func (tx *Transaction) add(operationType nanodm.OperationType, object nanodm.Object) *Transaction {
+	tx.operations = append(tx.operations, nanodm.Operation{Type: operationType, Object: object})
+	return tx
+}
+
+// Commit applies the operations of the transaction as part of the trace in
+// `ctx`.  The sources prepare their operations concurrently, and if any source
+// fails to, every source aborts them and the error is returned.  Otherwise the
+// transaction is committed, even if some sources don't confirm it; the result
+// names them, and the server keeps sending them the commit.
+func (tx *Transaction) Commit(ctx context.Context) (result *TransactionResult, err error) {
+	se := tx.server
+	ctx, span := se.tracer.Start(ctx, "coordinator.Transaction", tracing.SpanKindInternal)
+	span.SetAttribute("nanodm.txn_id", tx.ID())
+	span.SetAttribute("nanodm.operations", len(tx.operations))
+	result = &TransactionResult{ID: tx.ID()}
+	oldValues := tx.auditOldValues(ctx)
+	defer func() {
+		tx.audit(ctx, oldValues, result.Rows, err)
+		if err == nil {
+			tx.notify(result.Rows)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+
+	participants, err := tx.route()
+	if err != nil {
+		return result, err
+	}
+	span.SetAttribute("nanodm.sources", len(participants))
+
+	var prepared []*transactionParticipant
+	var lastResource *transactionParticipant
+	for _, participant := range participants {
+		if participant.client.hasCapability(nanodm.CapabilityTransactions) {
+			prepared = append(prepared, participant)
+		} else if tx.policy == LastResourceNonTransactional && lastResource == nil {
+			lastResource = participant
+		} else {
+			return result, nanodm.Errorf(nanodm.CodeAccessDenied, "source %s doesn't support transactions", participant.client.sourceName)
+		}
+	}
+
+	se.sendTransactionMessages(ctx, tx, nanodm.PrepareMessageType, prepared)
+	for _, participant := range prepared {
+		if participant.err != nil {
+			err = fmt.Errorf("transaction %s aborted, %s failed to prepare: %w", tx.ID(), participant.client.sourceName, participant.err)
+			se.decideTransaction(ctx, tx, false, prepared)
+			return result, err
+		}
+	}
+
+	if lastResource != nil {
+		se.applyOperations(ctx, lastResource)
+		if lastResource.err != nil {
+			se.decideTransaction(ctx, tx, false, prepared)
+			return result, fmt.Errorf("transaction %s aborted, %s failed: %w", tx.ID(), lastResource.client.sourceName, lastResource.err)
+		}
+		participants = append(prepared, lastResource)
+	} else {
+		participants = prepared
+	}
+
+	result.InDoubt = se.decideTransaction(ctx, tx, true, prepared)
+
+	rows := make(map[int]string)
+	for _, participant := range participants {
+		addRows := 0
+		for i, operation := range participant.operations {
+			if operation.Type != nanodm.OperationAddRow {
+				continue
+			}
+			if addRows < len(participant.rows) {
+				rows[participant.indexes[i]] = participant.rows[addRows]
+			}
+			addRows++
+		}
+	}
+	for i, operation := range tx.operations {
+		if operation.Type == nanodm.OperationAddRow {
+			result.Rows = append(result.Rows, rows[i])
+		}
+	}
+	return result, nil
+}
+
+// route groups the operations of the transaction by source, in the order the
+// sources are first used
+func (tx *Transaction) route() (participants []*transactionParticipant, err error) {
+	sourceParticipants := make(map[string]*transactionParticipant)
+	routes := tx.server.routingTable()
+	for i, operation := range tx.operations {
+		name := operation.Object.Name
+		var client *Client
+		if cobject := routes.object(name); cobject != nil && operation.Type == nanodm.OperationSet {
+			client = cobject.client
+		} else if dynObject := routes.dynamicListFor(name); dynObject != nil {
+			client = dynObject.client
+		} else {
+			return nil, nanodm.ObjectErrorf(name, nanodm.CodeNotFound, "the object %s isn't handled", name)
+		}
+
+		participant, ok := sourceParticipants[client.sourceName]
+		if !ok {
+			participant = &transactionParticipant{client: client}
+			sourceParticipants[client.sourceName] = participant
+			participants = append(participants, participant)
+		}
+		participant.operations = append(participant.operations, operation)
+		participant.indexes = append(participant.indexes, i)
+	}
+	return participants, nil
+}
+
+// auditOldValues returns the values the Sets and DeleteRows of the
+// transaction replace, if there's an audit log.  The objects set are fetched
+// with one Get, as SetObjects does.
+func (tx *Transaction) auditOldValues(ctx context.Context) []interface{} {
+	se := tx.server
+	if se.auditLog == nil {
+		return nil
+	}
+	var names []string
+	for _, operation := range tx.operations {
+		if operation.Type == nanodm.OperationSet {
+			names = append(names, operation.Object.Name)
+		}
+	}
+	var oldObjects map[string]nanodm.Object
+	if len(names) > 0 {
+		current := se.GetResults(ctx, names)
+		oldObjects = make(map[string]nanodm.Object, len(current.Objects))
+		for _, object := range current.Objects {
+			oldObjects[object.Name] = object
+		}
+	}
+
+	oldValues := make([]interface{}, len(tx.operations))
+	for i, operation := range tx.operations {
+		switch operation.Type {
+		case nanodm.OperationSet:
+			oldValues[i] = se.oldValue(oldObjects, operation.Object.Name)
+		case nanodm.OperationDeleteRow:
+			oldValues[i] = se.auditOldValue(ctx, operation.Object.Name)
+		}
+	}
+	return oldValues
+}
+
+// audit records each operation of the transaction with its outcome
+func (tx *Transaction) audit(ctx context.Context, oldValues []interface{}, rows []string, err error) {
+	addRows := 0
+	for i, operation := range tx.operations {
+		name := operation.Object.Name
+		var oldValue interface{}
+		if oldValues != nil {
+			oldValue = oldValues[i]
+		}
+		switch operation.Type {
+		case nanodm.OperationSet:
+			tx.server.audit(ctx, audit.OperationSet, name, "", oldValue, operation.Object.Value, tx.id, err)
+		case nanodm.OperationAddRow:
+			var row string
+			if addRows < len(rows) {
+				row = rows[addRows]
+			}
+			addRows++
+			tx.server.audit(ctx, audit.OperationAddRow, name, row, nil, operation.Object.Value, tx.id, err)
+		case nanodm.OperationDeleteRow:
+			tx.server.audit(ctx, audit.OperationDeleteRow, name, "", oldValue, nil, tx.id, err)
+		}
+	}
+}
+
+// notify notifies the subscribers of the operations of the committed
+// transaction, which added `rows`
+func (tx *Transaction) notify(rows []string) {
+	var changes []nanodm.Operation
+	addRows := 0
+	for _, operation := range tx.operations {
+		switch operation.Type {
+		case nanodm.OperationSet:
+			changes = append(changes, nanodm.Operation{Type: nanodm.OperationSet, Object: nanodm.Object{Name: operation.Object.Name, Value: operation.Object.Value}})
+		case nanodm.OperationAddRow:
+			if addRows < len(rows) && rows[addRows] != "" {
+				changes = append(changes, nanodm.Operation{Type: nanodm.OperationAddRow, Object: nanodm.Object{Name: rows[addRows], Type: nanodm.TypeRow, Value: operation.Object.Value}})
+			}
+			addRows++
+		case nanodm.OperationDeleteRow:
+			changes = append(changes, nanodm.Operation{Type: nanodm.OperationDeleteRow, Object: nanodm.Object{Name: operation.Object.Name, Type: nanodm.TypeRow}})
+		}
+	}
+	tx.server.notifySubscribers(changes)
+}
+
+// sendTransactionMessages sends a prepare, commit or abort of `tx` to each
+// participant concurrently
+func (se *Server) sendTransactionMessages(ctx context.Context, tx *Transaction, msgType nanodm.MessageType, participants []*transactionParticipant) {
+	var wg sync.WaitGroup
+	for _, participant := range participants {
+		wg.Add(1)
+		go func(participant *transactionParticipant) {
+			defer wg.Done()
+			var operations []nanodm.Operation
+			if msgType == nanodm.PrepareMessageType {
+				operations = participant.operations
+			}
+			participant.rows, participant.err = se.sendTransactionMessage(ctx, participant.client, msgType, tx.id, operations)
+		}(participant)
+	}
+	wg.Wait()
+}
+
+// sendTransactionMessage sends a prepare, commit or abort of the transaction
+// `txnID` to `client`.  Returns the rows added by a commit.
+func (se *Server) sendTransactionMessage(ctx context.Context, client *Client, msgType nanodm.MessageType, txnID uuid.UUID, operations []nanodm.Operation) (rows []string, err error) {
+	message := client.GetMessage(msgType)
+	message.Source = se.url
+	message.TxnID = txnID
+	message.Operations = operations
+
+	ackMessage, err := se.sendRequest(ctx, client, message)
+	if err != nil {
+		return nil, err
+	}
+	if ackMessage.Type == nanodm.AckMessageType {
+		for _, object := range ackMessage.Objects {
+			rows = append(rows, object.Name)
+		}
+		return rows, nil
+	} else if ackMessage.Type == nanodm.NackMessageType {
+		return nil, fmt.Errorf("failed to %s transaction %s: %w", msgType.Name(), txnID, nanodm.MessageError(ackMessage))
+	}
+	return nil, nanodm.Errorf(nanodm.CodeInternal, "%s received unknown message response type (%d)", msgType.Name(), ackMessage.Type)
+}
+
+// applyOperations applies the operations of a non-transactional participant
+// in order, stopping at the first that fails.  They are audited with the
+// transaction.
+func (se *Server) applyOperations(ctx context.Context, participant *transactionParticipant) {
+	for _, operation := range participant.operations {
+		switch operation.Type {
+		case nanodm.OperationSet:
+			_, participant.err = se.setSource(ctx, participant.client, []nanodm.Object{operation.Object})
+		case nanodm.OperationAddRow:
+			var row string
+			row, _, participant.err = se.addRowSource(ctx, participant.client, operation.Object)
+			participant.rows = append(participant.rows, row)
+		case nanodm.OperationDeleteRow:
+			_, participant.err = se.deleteRowSource(ctx, participant.client, operation.Object)
+		}
+		if participant.err != nil {
+			return
+		}
+	}
+}
+
+// decideTransaction commits or aborts `tx` on the prepared participants.  The
+// decision is logged before it's sent, and the sources that don't confirm it
+// are returned and left in doubt until the transactionTask reaches them.  The
+// decision isn't bound by the deadline of `ctx`, as the transaction may have
+// failed because it passed.
+func (se *Server) decideTransaction(ctx context.Context, tx *Transaction, commit bool, participants []*transactionParticipant) (inDoubt []string) {
+	if len(participants) == 0 {
+		return nil
+	}
+	ctx = detachedContext(ctx)
+
+	txn := &inDoubtTransaction{
+		id:      tx.id,
+		commit:  commit,
+		decided: se.clock.Now(),
+		sources: make(map[string]bool),
+	}
+	for _, participant := range participants {
+		txn.sources[participant.client.sourceName] = true
+	}
+	se.transactionsMutex.Lock()
+	se.transactions[tx.ID()] = txn
+	se.transactionsMutex.Unlock()
+
+	msgType := nanodm.AbortMessageType
+	if commit {
+		msgType = nanodm.CommitMessageType
+	}
+	se.sendTransactionMessages(ctx, tx, msgType, participants)
+
+	for _, participant := range participants {
+		if participant.err != nil {
+			se.log.Warnf("Transaction %s in doubt, %s didn't confirm the %s: %v", tx.ID(), participant.client.sourceName, msgType.Name(), participant.err)
+			inDoubt = append(inDoubt, participant.client.sourceName)
+			continue
+		}
+		se.confirmTransaction(txn, participant.client.sourceName)
+	}
+	return inDoubt
+}
+
+// confirmTransaction records that `sourceName` applied the decision of `txn`
+func (se *Server) confirmTransaction(txn *inDoubtTransaction, sourceName string) {
+	se.transactionsMutex.Lock()
+	defer se.transactionsMutex.Unlock()
+	delete(txn.sources, sourceName)
+	if len(txn.sources) == 0 {
+		delete(se.transactions, txn.id.String())
+	}
+}
+
+// heuristicTransaction records that `sourceName` won't apply the decision of
+// `txn` because of `err`, leaving the transaction with a heuristic outcome
+func (se *Server) heuristicTransaction(txn *inDoubtTransaction, sourceName string, err error) {
+	decision, operation := "abort", audit.OperationAbort
+	if txn.commit {
+		decision, operation = "commit", audit.OperationCommit
+	}
+	se.log.Errorf("Transaction %s has a heuristic outcome, %s didn't apply the %s: %v", txn.id, sourceName, decision, err)
+	se.metrics.HeuristicOutcomes.Inc(decision)
+	if se.auditLog != nil {
+		record := audit.NewRecord(context.Background(), operation, "", nil, nil, fmt.Errorf("%s: %w", sourceName, err))
+		record.Outcome = audit.OutcomeHeuristic
+		record.TransactionUID = txn.id.String()
+		se.auditLog.Record(record)
+	}
+
+	se.transactionsMutex.Lock()
+	defer se.transactionsMutex.Unlock()
+	id := txn.id.String()
+	delete(txn.sources, sourceName)
+	if len(txn.sources) == 0 {
+		delete(se.transactions, id)
+	}
+	outcome, ok := se.heuristics[id]
+	if !ok {
+		outcome = &HeuristicOutcome{ID: id, Commit: txn.commit, Decided: txn.decided, Sources: make(map[string]error)}
+		se.heuristics[id] = outcome
+	}
+	outcome.Sources[sourceName] = err
+}
+
+// InDoubtTransactions returns the IDs of the transactions that were committed
+// or aborted, but that some sources haven't confirmed.  They're only kept in
+// memory, so they aren't recovered once the server restarts.
+func (se *Server) InDoubtTransactions() (ids []string) {
+	se.transactionsMutex.Lock()
+	defer se.transactionsMutex.Unlock()
+	for id := range se.transactions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// HeuristicTransactions returns the transactions with a heuristic outcome,
+// sorted by ID, until they're forgotten with ForgetHeuristicTransaction
+func (se *Server) HeuristicTransactions() (outcomes []HeuristicOutcome) {
+	se.transactionsMutex.Lock()
+	defer se.transactionsMutex.Unlock()
+	for _, outcome := range se.heuristics {
+		sources := make(map[string]error, len(outcome.Sources))
+		for sourceName, err := range outcome.Sources {
+			sources[sourceName] = err
+		}
+		copied := *outcome
+		copied.Sources = sources
+		outcomes = append(outcomes, copied)
+	}
+	sort.Slice(outcomes, func(i, j int) bool {
+		return outcomes[i].ID < outcomes[j].ID
+	})
+	return outcomes
+}
+
+// ForgetHeuristicTransaction drops the heuristic outcome of the transaction
+// `id`, for example once the sources were reconciled
+func (se *Server) ForgetHeuristicTransaction(id string) error {
+	se.transactionsMutex.Lock()
+	defer se.transactionsMutex.Unlock()
+	if _, ok := se.heuristics[id]; !ok {
+		return nanodm.Errorf(nanodm.CodeNotFound, "transaction %s has no heuristic outcome", id)
+	}
+	delete(se.heuristics, id)
+	return nil
+}
+
+// recoverTransactions resends the decision of each in-doubt transaction to the
+// registered sources that haven't confirmed it.  A source that refuses the
+// decision, or doesn't confirm it within TRANSACTION_RECOVERY_TIMEOUT, leaves
+// the transaction with a heuristic outcome.
+func (se *Server) recoverTransactions(now time.Time) {
+	type pending struct {
+		txn        *inDoubtTransaction
+		sourceName string
+	}
+	var resends, expired []pending
+
+	se.transactionsMutex.Lock()
+	for _, txn := range se.transactions {
+		for sourceName := range txn.sources {
+			if now.Sub(txn.decided) > TRANSACTION_RECOVERY_TIMEOUT {
+				expired = append(expired, pending{txn: txn, sourceName: sourceName})
+			} else {
+				resends = append(resends, pending{txn: txn, sourceName: sourceName})
+			}
+		}
+	}
+	se.transactionsMutex.Unlock()
+
+	for _, expire := range expired {
+		se.heuristicTransaction(expire.txn, expire.sourceName, nanodm.Errorf(nanodm.CodeTimeout, "the decision wasn't confirmed within %s", TRANSACTION_RECOVERY_TIMEOUT))
+	}
+
+	routes := se.routingTable()
+	for _, resend := range resends {
+		client, ok := routes.clients[resend.sourceName]
+		if !ok {
+			continue
+		}
+		msgType := nanodm.AbortMessageType
+		if resend.txn.commit {
+			msgType = nanodm.CommitMessageType
+		}
+		_, err := se.sendTransactionMessage(context.Background(), client, msgType, resend.txn.id, nil)
+		switch {
+		case err == nil:
+			se.log.Infof("Transaction %s recovered on %s", resend.txn.id, resend.sourceName)
+			se.confirmTransaction(resend.txn, resend.sourceName)
+		case nanodm.CodeOf(err) == nanodm.CodeNotFound || nanodm.CodeOf(err) == nanodm.CodeInvalidValue:
+			// The source can't apply the decision, for example because it
+			// aborted the transaction when it expired
+			se.heuristicTransaction(resend.txn, resend.sourceName, err)
+		}
+	}
+}
+
+// transactionTask periodically resends the decisions of in-doubt transactions
+func (se *Server) transactionTask() {
+	defer se.log.Warnf("Exiting server transactionTask (%s)", se.url)
+	for {
+		select {
+		case <-se.clock.After(TRANSACTION_RETRY_PERIOD):
+			se.recoverTransactions(se.clock.Now())
+		case <-se.closeChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,740 @@
+package cwmp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/coordinator"
+)
+
+// Inform event codes
+const (
+	EventBootstrap         = "0 BOOTSTRAP"
+	EventBoot              = "1 BOOT"
+	EventPeriodic          = "2 PERIODIC"
+	EventValueChange       = "4 VALUE CHANGE"
+	EventConnectionRequest = "6 CONNECTION REQUEST"
+	EventMReboot           = "M Reboot"
+)
+
+const (
+	defaultRootObject  = "Device."
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+var supportedMethods = []string{
+	"GetRPCMethods",
+	"GetParameterValues",
+	"SetParameterValues",
+	"GetParameterNames",
+	"GetParameterAttributes",
+	"SetParameterAttributes",
+	"AddObject",
+	"DeleteObject",
+	"Reboot",
+}
+
+type Config struct {
+	// URL of the ACS
+	AcsURL string
+	// Credentials for HTTP basic authentication with the ACS (optional)
+	Username string
+	Password string
+	// Identifies this CPE in each Inform
+	DeviceID DeviceID
+	// Objects sent in the ParameterList of every Inform
+	InformParameters []string
+	// Period between periodic Informs.  Periodic Informs are disabled if zero.
+	PeriodicInformInterval time.Duration
+	// Object used when GetParameterNames is called with an empty path
+	// (defaults to "Device.")
+	RootObject string
+	// Called once the session in which the ACS requested a Reboot has ended.
+	// Reboot is rejected with a fault if the handler is nil.
+	RebootHandler func(commandKey string) error
+	// File keeping the CommandKey of a Reboot until the restarted agent
+	// reports it in an "M Reboot" event (optional)
+	RebootCommandKeyFile string
+	// Timeout of each HTTP request to the ACS (defaults to 30 seconds)
+	HTTPTimeout time.Duration
+}
+
+// Agent is a CWMP CPE serving the data model of a coordinator server to an ACS
+type Agent struct {
+	log    *logrus.Entry
+	config Config
+	server *coordinator.Server
+
+	sessionMutex     sync.Mutex
+	eventMutex       sync.Mutex
+	pendingEvents    []EventStruct
+	retryCount       int
+	parameterKey     string
+	rebootCommandKey *string
+	attributesMutex  sync.Mutex
+	attributes       map[string]ParameterAttributeStruct
+	closeChan        chan struct{}
+	// Signalled when an event is queued, to start a session right away
+	wakeChan chan struct{}
+}
+
+// NewAgent creates a CWMP agent for the coordinator `server`
+func NewAgent(log *logrus.Entry, server *coordinator.Server, config Config) *Agent {
+	if config.RootObject == "" {
+		config.RootObject = defaultRootObject
+	}
+	if config.HTTPTimeout == 0 {
+		config.HTTPTimeout = defaultHTTPTimeout
+	}
+	return &Agent{
+		log:        log,
+		config:     config,
+		server:     server,
+		attributes: make(map[string]ParameterAttributeStruct),
+		closeChan:  make(chan struct{}),
+		wakeChan:   make(chan struct{}, 1),
+	}
+}
+
+// Start queues a BOOT event, and an "M Reboot" event if the agent restarts
+// after a Reboot requested by the ACS, and starts informing the ACS in the
+// background
+func (ag *Agent) Start() error {
+	if ag.config.AcsURL == "" {
+		return fmt.Errorf("the ACS URL isn't configured")
+	}
+	ag.QueueEvent(EventBoot, "")
+	commandKey, rebooted, err := ag.takeRebootCommandKey()
+	if err != nil {
+		ag.log.Errorf("Unable to take the reboot command key: %v", err)
+	}
+	if rebooted {
+		ag.QueueEvent(EventMReboot, commandKey)
+	}
+	go ag.informTask()
+	return nil
+}
+
+func (ag *Agent) Stop() error {
+	close(ag.closeChan)
+	return nil
+}
+
+// QueueEvent queues an event to be delivered in the next Inform.  Once the
+// agent is started the event starts a session right away, unless a failed
+// session is waiting to be retried.
+func (ag *Agent) QueueEvent(eventCode string, commandKey string) {
+	ag.eventMutex.Lock()
+	defer ag.eventMutex.Unlock()
+	for _, event := range ag.pendingEvents {
+		if event.EventCode == eventCode && event.CommandKey == commandKey {
+			return
+		}
+	}
+	ag.pendingEvents = append(ag.pendingEvents, EventStruct{EventCode: eventCode, CommandKey: commandKey})
+	select {
+	case ag.wakeChan <- struct{}{}:
+	default:
+	}
+}
+
+// ParameterKey returns the ParameterKey of the last successful
+// SetParameterValues, AddObject or DeleteObject
+func (ag *Agent) ParameterKey() string {
+	ag.sessionMutex.Lock()
+	defer ag.sessionMutex.Unlock()
+	return ag.parameterKey
+}
+
+// Inform opens a session with the ACS delivering any queued events, and
+// handles the RPCs requested by the ACS until it ends the session.  If no
+// events are queued a PERIODIC event is sent.
+func (ag *Agent) Inform() error {
+	ag.sessionMutex.Lock()
+	defer ag.sessionMutex.Unlock()
+
+	events := ag.takeEvents()
+	if len(events) == 0 {
+		events = []EventStruct{{EventCode: EventPeriodic}}
+	}
+
+	err := ag.runSession(events)
+	if err != nil {
+		ag.retryCount++
+		ag.requeueEvents(events)
+		return err
+	}
+	ag.retryCount = 0
+
+	// The BOOT and M Reboot events are queued by the restarted agent
+	if ag.rebootCommandKey != nil {
+		commandKey := *ag.rebootCommandKey
+		ag.rebootCommandKey = nil
+		if err := ag.saveRebootCommandKey(commandKey); err != nil {
+			ag.log.Errorf("Unable to save the reboot command key: %v", err)
+		}
+		if err := ag.config.RebootHandler(commandKey); err != nil {
+			ag.log.Errorf("Reboot handler failed: %v", err)
+		}
+	}
+	return nil
+}
+
+// informTask informs the ACS once started, when an event is queued and every
+// PeriodicInformInterval, and retries failed sessions with a backoff
+func (ag *Agent) informTask() {
+	defer ag.log.Warnf("Exiting CWMP informTask (%s)", ag.config.AcsURL)
+
+	timer := time.After(0)
+	retrying := false
+	for {
+		// Events queued while retrying wait for the retry
+		wakeChan := ag.wakeChan
+		if retrying {
+			wakeChan = nil
+		}
+		select {
+		case <-timer:
+		case <-wakeChan:
+			if !ag.hasEvents() {
+				continue
+			}
+		case <-ag.closeChan:
+			return
+		}
+
+		err := ag.Inform()
+		if err != nil {
+			wait := ag.retryWait()
+			ag.log.Errorf("CWMP session with %s failed, retry in (%v): %v", ag.config.AcsURL, wait, err)
+			timer = time.After(wait)
+			retrying = true
+			continue
+		}
+		retrying = false
+		timer = nil
+		if ag.config.PeriodicInformInterval > 0 {
+			timer = time.After(ag.config.PeriodicInformInterval)
+		}
+	}
+}
+
+// retryWait returns the progressive backoff after a failed session
+func (ag *Agent) retryWait() time.Duration {
+	ag.sessionMutex.Lock()
+	defer ag.sessionMutex.Unlock()
+
+	retryWait := nanodm.RETRY_PERIOD
+	for i := 1; i < ag.retryCount && retryWait < nanodm.MAX_RETRY_PERIOD; i++ {
+		retryWait = retryWait * 2
+	}
+	return retryWait
+}
+
+// saveRebootCommandKey keeps the CommandKey of a Reboot for the restarted
+// agent
+func (ag *Agent) saveRebootCommandKey(commandKey string) error {
+	if ag.config.RebootCommandKeyFile == "" {
+		return nil
+	}
+	return os.WriteFile(ag.config.RebootCommandKeyFile, []byte(commandKey), 0600)
+}
+
+// takeRebootCommandKey returns the CommandKey saved before a Reboot, and
+// removes it so it's only reported once
+func (ag *Agent) takeRebootCommandKey() (commandKey string, rebooted bool, err error) {
+	if ag.config.RebootCommandKeyFile == "" {
+		return "", false, nil
+	}
+	data, err := os.ReadFile(ag.config.RebootCommandKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return string(data), true, os.Remove(ag.config.RebootCommandKeyFile)
+}
+
+func (ag *Agent) hasEvents() bool {
+	ag.eventMutex.Lock()
+	defer ag.eventMutex.Unlock()
+	return len(ag.pendingEvents) > 0
+}
+
+func (ag *Agent) takeEvents() []EventStruct {
+	ag.eventMutex.Lock()
+	defer ag.eventMutex.Unlock()
+	events := ag.pendingEvents
+	ag.pendingEvents = nil
+	return events
+}
+
+func (ag *Agent) requeueEvents(events []EventStruct) {
+	for _, event := range events {
+		ag.QueueEvent(event.EventCode, event.CommandKey)
+	}
+}
+
+func (ag *Agent) runSession(events []EventStruct) error {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Jar:     jar,
+		Timeout: ag.config.HTTPTimeout,
+	}
+
+	envelope, err := ag.post(client, "", &Body{Inform: ag.buildInform(events)})
+	if err != nil {
+		return err
+	}
+	if envelope == nil || envelope.Body.InformResponse == nil {
+		if envelope != nil && envelope.Body.Fault != nil {
+			return &envelope.Body.Fault.Detail.Fault
+		}
+		return fmt.Errorf("the ACS didn't respond to the Inform with an InformResponse")
+	}
+
+	// The CPE has no more requests, so an empty POST hands control to the ACS
+	envelope, err = ag.post(client, "", nil)
+	for err == nil && envelope != nil {
+		method := envelope.Body.Method()
+		if method == "Fault" {
+			ag.log.Errorf("ACS responded with a fault: %v", &envelope.Body.Fault.Detail.Fault)
+			return nil
+		}
+		ag.log.Infof("Handling CWMP %s from %s", method, ag.config.AcsURL)
+		response := ag.handleRequest(&envelope.Body)
+		envelope, err = ag.post(client, envelope.Header.ID, response)
+	}
+
+	return err
+}
+
+// post sends `body` to the ACS and returns the envelope in the response, or
+// nil if the ACS responded with an empty body.  A nil `body` sends an empty POST.
+func (ag *Agent) post(client *http.Client, id string, body *Body) (*Envelope, error) {
+	var reqBody []byte
+	var err error
+
+	if body != nil {
+		if reqBody, err = MarshalEnvelope(id, *body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ag.config.AcsURL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("SOAPAction", "")
+	}
+	if ag.config.Username != "" {
+		req.SetBasicAuth(ag.config.Username, ag.config.Password)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNoContent || (resp.StatusCode == http.StatusOK && len(bytes.TrimSpace(respBody)) == 0) {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACS responded with HTTP status %d", resp.StatusCode)
+	}
+
+	return UnmarshalEnvelope(respBody)
+}
+
+func (ag *Agent) buildInform(events []EventStruct) *Inform {
+	inform := &Inform{
+		DeviceId:     ag.config.DeviceID,
+		Event:        EventList{ArrayType: arrayType("cwmp:EventStruct", len(events)), Events: events},
+		MaxEnvelopes: 1,
+		CurrentTime:  time.Now().Format(time.RFC3339),
+		RetryCount:   ag.retryCount,
+	}
+
+	if len(ag.config.InformParameters) > 0 {
+		objects, errs := ag.server.Get(ag.config.InformParameters)
+		for _, err := range errs {
+			ag.log.Errorf("Failed to get inform parameter: %v", err)
+		}
+		inform.ParameterList = parameterValueList(objects)
+	}
+
+	return inform
+}
+
+func (ag *Agent) handleRequest(request *Body) *Body {
+	var response *Body
+	var err error
+
+	switch {
+	case request.GetRPCMethods != nil:
+		response = &Body{GetRPCMethodsResponse: &GetRPCMethodsResponse{
+			MethodList: MethodList{ArrayType: arrayType("xsd:string", len(supportedMethods)), Methods: supportedMethods},
+		}}
+	case request.GetParameterValues != nil:
+		response, err = ag.handleGetParameterValues(request.GetParameterValues)
+	case request.SetParameterValues != nil:
+		response, err = ag.handleSetParameterValues(request.SetParameterValues)
+	case request.GetParameterNames != nil:
+		response, err = ag.handleGetParameterNames(request.GetParameterNames)
+	case request.GetParameterAttributes != nil:
+		response, err = ag.handleGetParameterAttributes(request.GetParameterAttributes)
+	case request.SetParameterAttributes != nil:
+		response, err = ag.handleSetParameterAttributes(request.SetParameterAttributes)
+	case request.AddObject != nil:
+		response, err = ag.handleAddObject(request.AddObject)
+	case request.DeleteObject != nil:
+		response, err = ag.handleDeleteObject(request.DeleteObject)
+	case request.Reboot != nil:
+		response, err = ag.handleReboot(request.Reboot)
+	default:
+		err = NewFault(FaultMethodNotSupported)
+	}
+
+	if err != nil {
+		ag.log.Errorf("CWMP %s failed: %v", request.Method(), err)
+		return &Body{Fault: soapFault(faultFromError(err))}
+	}
+	return response
+}
+
+func (ag *Agent) handleGetParameterValues(request *GetParameterValues) (*Body, error) {
+	var objects []nanodm.Object
+
+	for _, name := range request.ParameterNames.Names {
+		if name == "" {
+			name = ag.config.RootObject
+		}
+		retObjects, errs := ag.server.GetPartial(name)
+		if len(errs) > 0 {
+			return nil, faultFromError(errs[0])
+		}
+		objects = append(objects, retObjects...)
+	}
+
+	return &Body{GetParameterValuesResponse: &GetParameterValuesResponse{
+		ParameterList: parameterValueList(objects),
+	}}, nil
+}
+
+func (ag *Agent) handleSetParameterValues(request *SetParameterValues) (*Body, error) {
+	var objects []nanodm.Object
+	var faults []SetParameterValuesFault
+
+	for _, parameter := range request.ParameterList.Parameters {
+		object, err := ag.objectFromParameter(parameter)
+		if err != nil {
+			faults = append(faults, setParameterValuesFault(parameter.Name, err))
+			continue
+		}
+		objects = append(objects, object)
+	}
+
+	// SetParameterValues is atomic, so a failure restores the parameters that
+	// were set
+	if len(faults) == 0 {
+		result := ag.server.SetObjects(ag.auditContext(), objects, true)
+		for _, object := range objects {
+			if err, failed := result.Errors[object.Name]; failed {
+				faults = append(faults, setParameterValuesFault(object.Name, err))
+			}
+		}
+	}
+
+	if len(faults) > 0 {
+		fault := NewFault(FaultInvalidArguments)
+		fault.SetParameterValuesFaults = faults
+		return nil, fault
+	}
+
+	ag.parameterKey = request.ParameterKey
+	return &Body{SetParameterValuesResponse: &SetParameterValuesResponse{Status: 0}}, nil
+}
+
+// objectFromParameter converts a ParameterValueStruct into an object for Set
+func (ag *Agent) objectFromParameter(parameter ParameterValueStruct) (nanodm.Object, error) {
+	object := nanodm.Object{Name: parameter.Name}
+
+	reqType, typeKnown := objectType(parameter.Value.Type)
+	if parameter.Value.Type != "" && !typeKnown {
+		return object, NewFault(FaultInvalidParameterType)
+	}
+
+	if registered, err := ag.server.List(parameter.Name); err == nil && len(registered) == 1 && !strings.HasSuffix(parameter.Name, ".") {
+		if registered[0].Access != nanodm.AccessRW {
+			return object, NewFault(FaultNonWritableParameter)
+		}
+		if parameter.Value.Type != "" && reqType != registered[0].Type {
+			return object, NewFault(FaultInvalidParameterType)
+		}
+		object.Type = registered[0].Type
+	} else if !strings.HasSuffix(parameter.Name, ".") && ag.server.IsObjectHandledByDynamicList(parameter.Name) {
+		object.Type = reqType
+	} else {
+		return object, NewFault(FaultInvalidParameterName)
+	}
+
+	value, err := nanodm.ParseValue(object.Type, parameter.Value.Value)
+	if err != nil {
+		return object, NewFault(FaultInvalidParameterValue)
+	}
+	object.Value = value
+
+	return object, nil
+}
+
+func (ag *Agent) handleGetParameterNames(request *GetParameterNames) (*Body, error) {
+	infos, err := ag.parameterInfo(request.ParameterPath, request.NextLevel)
+	if err != nil {
+		return nil, err
+	}
+	return &Body{GetParameterNamesResponse: &GetParameterNamesResponse{
+		ParameterList: ParameterInfoList{ArrayType: arrayType("cwmp:ParameterInfoStruct", len(infos)), Parameters: infos},
+	}}, nil
+}
+
+// parameterInfo returns the sorted parameters and objects under `path`.  If
+// `nextLevel` is set only the immediate children of the path are returned.
+func (ag *Agent) parameterInfo(path string, nextLevel bool) ([]ParameterInfoStruct, error) {
+	writable := make(map[string]bool)
+
+	if path == "" {
+		path = ag.config.RootObject
+	}
+	isObject := strings.HasSuffix(path, ".")
+	if nextLevel && !isObject {
+		return nil, NewFault(FaultInvalidArguments)
+	}
+
+	objects, errs := ag.server.GetPartial(path)
+	if len(errs) > 0 {
+		return nil, faultFromError(errs[0])
+	}
+
+	if isObject && !nextLevel {
+		writable[path] = ag.server.IsObjectHandledByDynamicList(path)
+	}
+	for _, object := range objects {
+		if !isObject {
+			writable[object.Name] = object.Access == nanodm.AccessRW
+			continue
+		}
+		if !strings.HasPrefix(object.Name, path) || object.Name == path {
+			continue
+		}
+
+		segments := strings.Split(strings.TrimPrefix(object.Name, path), ".")
+		for i := 1; i < len(segments) && !(nextLevel && i > 1); i++ {
+			objName := path + strings.Join(segments[:i], ".") + "."
+			writable[objName] = ag.server.IsObjectHandledByDynamicList(objName)
+		}
+		if len(segments) == 1 || !nextLevel {
+			writable[object.Name] = object.Access == nanodm.AccessRW
+		}
+	}
+
+	infos := make([]ParameterInfoStruct, 0, len(writable))
+	for name, isWritable := range writable {
+		infos = append(infos, ParameterInfoStruct{Name: name, Writable: isWritable})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// parameterNames returns the names of the parameters (not objects) under `path`
+func (ag *Agent) parameterNames(path string) ([]string, error) {
+	var names []string
+
+	infos, err := ag.parameterInfo(path, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name, ".") {
+			names = append(names, info.Name)
+		}
+	}
+	return names, nil
+}
+
+func (ag *Agent) handleGetParameterAttributes(request *GetParameterAttributes) (*Body, error) {
+	var attributes []ParameterAttributeStruct
+
+	for _, path := range request.ParameterNames.Names {
+		names, err := ag.parameterNames(path)
+		if err != nil {
+			return nil, err
+		}
+		ag.attributesMutex.Lock()
+		for _, name := range names {
+			attribute, exists := ag.attributes[name]
+			if !exists {
+				attribute = ParameterAttributeStruct{Name: name}
+			}
+			attribute.AccessList.ArrayType = arrayType("xsd:string", len(attribute.AccessList.Entries))
+			attributes = append(attributes, attribute)
+		}
+		ag.attributesMutex.Unlock()
+	}
+
+	return &Body{GetParameterAttributesResponse: &GetParameterAttributesResponse{
+		ParameterList: ParameterAttributeList{ArrayType: arrayType("cwmp:ParameterAttributeStruct", len(attributes)), Parameters: attributes},
+	}}, nil
+}
+
+// handleSetParameterAttributes stores the attributes of each parameter in
+// memory.  Attributes aren't persisted, and value change notifications must be
+// queued with QueueEvent by the owner of the agent.
+func (ag *Agent) handleSetParameterAttributes(request *SetParameterAttributes) (*Body, error) {
+	updates := make(map[string]SetParameterAttributesStruct)
+
+	for _, parameter := range request.ParameterList.Parameters {
+		if parameter.NotificationChange && (parameter.Notification < 0 || parameter.Notification > 2) {
+			return nil, NewFault(FaultInvalidArguments)
+		}
+		names, err := ag.parameterNames(parameter.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			updates[name] = parameter
+		}
+	}
+
+	ag.attributesMutex.Lock()
+	defer ag.attributesMutex.Unlock()
+	for name, update := range updates {
+		attribute, exists := ag.attributes[name]
+		if !exists {
+			attribute = ParameterAttributeStruct{Name: name}
+		}
+		if update.NotificationChange {
+			attribute.Notification = update.Notification
+		}
+		if update.AccessListChange {
+			attribute.AccessList.Entries = update.AccessList.Entries
+		}
+		ag.attributes[name] = attribute
+	}
+
+	return &Body{SetParameterAttributesResponse: &SetParameterAttributesResponse{}}, nil
+}
+
+func (ag *Agent) handleAddObject(request *AddObject) (*Body, error) {
+	if !strings.HasSuffix(request.ObjectName, ".") {
+		return nil, NewFault(FaultInvalidParameterName)
+	}
+
+	row, err := ag.server.AddRowContext(ag.auditContext(), nanodm.Object{
+		Name:  request.ObjectName,
+		Type:  nanodm.TypeRow,
+		Value: map[string]interface{}{},
+	})
+	if err != nil {
+		return nil, faultFromError(err)
+	}
+
+	instance, err := instanceNumber(row)
+	if err != nil {
+		return nil, faultFromError(err)
+	}
+
+	ag.parameterKey = request.ParameterKey
+	return &Body{AddObjectResponse: &AddObjectResponse{InstanceNumber: instance, Status: 0}}, nil
+}
+
+func (ag *Agent) handleDeleteObject(request *DeleteObject) (*Body, error) {
+	if !strings.HasSuffix(request.ObjectName, ".") {
+		return nil, NewFault(FaultInvalidParameterName)
+	}
+
+	err := ag.server.DeleteRowContext(ag.auditContext(), nanodm.Object{
+		Name: request.ObjectName,
+		Type: nanodm.TypeRow,
+	})
+	if err != nil {
+		return nil, faultFromError(err)
+	}
+
+	ag.parameterKey = request.ParameterKey
+	return &Body{DeleteObjectResponse: &DeleteObjectResponse{Status: 0}}, nil
+}
+
+func (ag *Agent) handleReboot(request *Reboot) (*Body, error) {
+	if ag.config.RebootHandler == nil {
+		return nil, NewFault(FaultMethodNotSupported)
+	}
+	commandKey := request.CommandKey
+	ag.rebootCommandKey = &commandKey
+	return &Body{RebootResponse: &RebootResponse{}}, nil
+}
+
+// auditContext returns the context of changes requested by the ACS, which
+// are audited as made by the ACS
+func (ag *Agent) auditContext() context.Context {
+	return audit.ContextWithIdentity(context.Background(), ag.config.AcsURL)
+}
+
+func parameterValueList(objects []nanodm.Object) ParameterValueList {
+	parameters := make([]ParameterValueStruct, 0, len(objects))
+	for _, object := range objects {
+		parameters = append(parameters, ParameterValueStruct{
+			Name:  object.Name,
+			Value: ParameterValue{Type: xsdType(object.Type), Value: nanodm.FormatValue(object.Value)},
+		})
+	}
+	return ParameterValueList{
+		ArrayType:  arrayType("cwmp:ParameterValueStruct", len(parameters)),
+		Parameters: parameters,
+	}
+}
+
+func setParameterValuesFault(name string, err error) SetParameterValuesFault {
+	fault := faultFromError(err)
+	return SetParameterValuesFault{
+		ParameterName: name,
+		FaultCode:     fault.FaultCode,
+		FaultString:   fault.FaultString,
+	}
+}
+
+// instanceNumber returns the instance number of a row name, for example 3 for
+// "Device.NAT.PortMapping.3."
+func instanceNumber(row string) (uint, error) {
+	segments := strings.Split(strings.TrimSuffix(row, "."), ".")
+	instance, err := strconv.ParseUint(segments[len(segments)-1], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid row name (%s) returned by source", row)
+	}
+	return uint(instance), nil
+}
@@ -0,0 +1,401 @@
+package cwmp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+	"github.com/zackwine/nanodm/source"
+)
+
+type TestSource struct {
+	objectMap    map[string]nanodm.Object
+	objectValues map[string]interface{}
+	nextIndex    int
+	lock         sync.Mutex
+}
+
+func (ts *TestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, name := range objectNames {
+		object, ok := ts.objectMap[name]
+		if !ok {
+			return objects, fmt.Errorf("unable to get object %s", name)
+		}
+		if object.Type == nanodm.TypeDynamicList {
+			for rowObjName, rowObject := range ts.objectMap {
+				if strings.HasPrefix(rowObjName, name) && rowObjName != name {
+					rowObject.Value = ts.objectValues[rowObjName]
+					objects = append(objects, rowObject)
+				}
+			}
+			continue
+		}
+		object.Value = ts.objectValues[name]
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (ts *TestSource) SetObjects(objects []nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, object := range objects {
+		ts.objectValues[object.Name] = object.Value
+	}
+	return nil
+}
+
+func (ts *TestSource) AddRow(object nanodm.Object) (row string, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	row = fmt.Sprintf("%s%d.", object.Name, ts.nextIndex)
+	ts.objectMap[row+"Enable"] = nanodm.Object{Name: row + "Enable", Access: nanodm.AccessRW, Type: nanodm.TypeBool}
+	ts.objectValues[row+"Enable"] = false
+	ts.nextIndex++
+	return row, nil
+}
+
+func (ts *TestSource) DeleteRow(row nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for objName := range ts.objectMap {
+		if strings.HasPrefix(objName, row.Name) {
+			delete(ts.objectMap, objName)
+			delete(ts.objectValues, objName)
+		}
+	}
+	return nil
+}
+
+// TestACS is a stand-in ACS that sends a scripted list of RPCs in each session
+type TestACS struct {
+	t         *testing.T
+	requests  []Body
+	next      int
+	informs   []*Inform
+	responses []*Envelope
+	lock      sync.Mutex
+}
+
+func (acs *TestACS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	acs.lock.Lock()
+	defer acs.lock.Unlock()
+
+	data, err := ioutil.ReadAll(r.Body)
+	assert.Nil(acs.t, err)
+
+	if len(data) > 0 {
+		envelope, err := UnmarshalEnvelope(data)
+		assert.Nil(acs.t, err)
+		if envelope.Body.Inform != nil {
+			acs.informs = append(acs.informs, envelope.Body.Inform)
+			acs.write(w, "inform", Body{InformResponse: &InformResponse{MaxEnvelopes: 1}})
+			return
+		}
+		acs.responses = append(acs.responses, envelope)
+	}
+
+	if acs.next >= len(acs.requests) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	acs.write(w, fmt.Sprintf("request-%d", acs.next), acs.requests[acs.next])
+	acs.next++
+}
+
+func (acs *TestACS) write(w http.ResponseWriter, id string, body Body) {
+	data, err := MarshalEnvelope(id, body)
+	assert.Nil(acs.t, err)
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(data)
+}
+
+func getLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	return logrus.NewEntry(logger)
+}
+
+func TestEnvelope(t *testing.T) {
+	data, err := MarshalEnvelope("1234", Body{GetParameterValuesResponse: &GetParameterValuesResponse{
+		ParameterList: parameterValueList([]nanodm.Object{{
+			Name:  "Device.Custom.Setting2",
+			Type:  nanodm.TypeInt,
+			Value: 600,
+		}}),
+	}})
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `<cwmp:GetParameterValuesResponse>`)
+	assert.Contains(t, string(data), `<Value xsi:type="xsd:int">600</Value>`)
+	assert.Contains(t, string(data), `soap-enc:arrayType="cwmp:ParameterValueStruct[1]"`)
+
+	envelope, err := UnmarshalEnvelope(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "1234", envelope.Header.ID)
+	assert.Equal(t, "GetParameterValuesResponse", envelope.Body.Method())
+	parameters := envelope.Body.GetParameterValuesResponse.ParameterList.Parameters
+	assert.Equal(t, 1, len(parameters))
+	assert.Equal(t, "xsd:int", parameters[0].Value.Type)
+	assert.Equal(t, "600", parameters[0].Value.Value)
+
+	data, err = MarshalEnvelope("5678", Body{Fault: soapFault(NewFault(FaultInvalidParameterName))})
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `<soap-env:Fault>`)
+	assert.Contains(t, string(data), `<cwmp:Fault>`)
+	envelope, err = UnmarshalEnvelope(data)
+	assert.Nil(t, err)
+	assert.Equal(t, "Client", envelope.Body.Fault.FaultCode)
+	assert.Equal(t, FaultInvalidParameterName, envelope.Body.Fault.Detail.Fault.FaultCode)
+
+	_, err = MarshalEnvelope("", Body{})
+	assert.NotNil(t, err)
+}
+
+func TestAgentSession(t *testing.T) {
+	serverUrl := "tcp://127.0.0.1:4610"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4611"
+
+	objectMapSource := map[string]nanodm.Object{
+		"Device.Custom.Setting1": {
+			Name:   "Device.Custom.Setting1",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Setting2": {
+			Name:   "Device.Custom.Setting2",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeInt,
+		},
+		"Device.Custom.Version": {
+			Name:   "Device.Custom.Version",
+			Access: nanodm.AccessRO,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Dynamic.": {
+			Name:   "Device.Custom.Dynamic.",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeDynamicList,
+		},
+	}
+	objectValuesSource := map[string]interface{}{
+		"Device.Custom.Setting1": "8.8.8.8",
+		"Device.Custom.Setting2": 600,
+		"Device.Custom.Version":  "2.3.4",
+	}
+
+	log := getLogger()
+
+	server := coordinator.NewServer(log, serverUrl, nil)
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		objectMap:    objectMapSource,
+		objectValues: objectValuesSource,
+	}
+	src := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+
+	err = src.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+	<-time.After(2 * time.Second)
+
+	acs := &TestACS{
+		t: t,
+		requests: []Body{
+			{GetParameterValues: &GetParameterValues{ParameterNames: ParameterNames{Names: []string{"Device.Custom.Setting1", "Device.Custom.Setting2"}}}},
+			{SetParameterValues: &SetParameterValues{
+				ParameterList: ParameterValueList{Parameters: []ParameterValueStruct{{
+					Name:  "Device.Custom.Setting2",
+					Value: ParameterValue{Type: "xsd:int", Value: "700"},
+				}}},
+				ParameterKey: "key1",
+			}},
+			{SetParameterValues: &SetParameterValues{
+				ParameterList: ParameterValueList{Parameters: []ParameterValueStruct{{
+					Name:  "Device.Custom.Version",
+					Value: ParameterValue{Value: "1.0"},
+				}}},
+			}},
+			{AddObject: &AddObject{ObjectName: "Device.Custom.Dynamic."}},
+			{GetParameterNames: &GetParameterNames{ParameterPath: "Device.Custom.", NextLevel: true}},
+			{DeleteObject: &DeleteObject{ObjectName: "Device.Custom.Dynamic.0.", ParameterKey: "key2"}},
+			{SetParameterAttributes: &SetParameterAttributes{ParameterList: SetParameterAttributesList{
+				Parameters: []SetParameterAttributesStruct{{Name: "Device.Custom.Setting1", NotificationChange: true, Notification: 2}},
+			}}},
+			{GetParameterAttributes: &GetParameterAttributes{ParameterNames: ParameterNames{Names: []string{"Device.Custom.Setting1"}}}},
+			{GetParameterValues: &GetParameterValues{ParameterNames: ParameterNames{Names: []string{"Not.Valid"}}}},
+			{Reboot: &Reboot{CommandKey: "reboot1"}},
+		},
+	}
+	acsServer := httptest.NewServer(acs)
+	defer acsServer.Close()
+
+	rebootKey := ""
+	config := Config{
+		AcsURL:           acsServer.URL,
+		DeviceID:         DeviceID{Manufacturer: "nanodm", OUI: "000000", ProductClass: "test", SerialNumber: "0101"},
+		InformParameters: []string{"Device.Custom.Version"},
+		RebootHandler: func(commandKey string) error {
+			rebootKey = commandKey
+			return nil
+		},
+		RebootCommandKeyFile: filepath.Join(t.TempDir(), "reboot"),
+	}
+	agent := NewAgent(log, server, config)
+	agent.QueueEvent(EventBoot, "")
+	err = agent.Inform()
+	assert.Nil(t, err)
+
+	// Inform
+	assert.Equal(t, 1, len(acs.informs))
+	assert.Equal(t, "0101", acs.informs[0].DeviceId.SerialNumber)
+	assert.Equal(t, EventBoot, acs.informs[0].Event.Events[0].EventCode)
+	assert.Equal(t, "2.3.4", acs.informs[0].ParameterList.Parameters[0].Value.Value)
+
+	assert.Equal(t, len(acs.requests), len(acs.responses))
+	for i, envelope := range acs.responses {
+		assert.Equal(t, fmt.Sprintf("request-%d", i), envelope.Header.ID)
+	}
+
+	// GetParameterValues
+	parameters := acs.responses[0].Body.GetParameterValuesResponse.ParameterList.Parameters
+	assert.Equal(t, 2, len(parameters))
+	for _, parameter := range parameters {
+		if parameter.Name == "Device.Custom.Setting2" {
+			assert.Equal(t, "xsd:int", parameter.Value.Type)
+			assert.Equal(t, "600", parameter.Value.Value)
+		}
+	}
+
+	// SetParameterValues
+	assert.Equal(t, 0, acs.responses[1].Body.SetParameterValuesResponse.Status)
+	testSource.lock.Lock()
+	assert.EqualValues(t, 700, testSource.objectValues["Device.Custom.Setting2"])
+	testSource.lock.Unlock()
+
+	// SetParameterValues of a read-only parameter
+	fault := acs.responses[2].Body.Fault.Detail.Fault
+	assert.Equal(t, FaultInvalidArguments, fault.FaultCode)
+	assert.Equal(t, 1, len(fault.SetParameterValuesFaults))
+	assert.Equal(t, FaultNonWritableParameter, fault.SetParameterValuesFaults[0].FaultCode)
+
+	// AddObject
+	assert.EqualValues(t, 0, acs.responses[3].Body.AddObjectResponse.InstanceNumber)
+
+	// GetParameterNames
+	infos := acs.responses[4].Body.GetParameterNamesResponse.ParameterList.Parameters
+	assert.Equal(t, []ParameterInfoStruct{
+		{Name: "Device.Custom.Dynamic.", Writable: true},
+		{Name: "Device.Custom.Setting1", Writable: true},
+		{Name: "Device.Custom.Setting2", Writable: true},
+		{Name: "Device.Custom.Version", Writable: false},
+	}, infos)
+
+	// DeleteObject
+	assert.NotNil(t, acs.responses[5].Body.DeleteObjectResponse)
+	testSource.lock.Lock()
+	_, exists := testSource.objectMap["Device.Custom.Dynamic.0.Enable"]
+	testSource.lock.Unlock()
+	assert.False(t, exists)
+	assert.Equal(t, "key2", agent.ParameterKey())
+
+	// Set and get attributes
+	assert.NotNil(t, acs.responses[6].Body.SetParameterAttributesResponse)
+	attributes := acs.responses[7].Body.GetParameterAttributesResponse.ParameterList.Parameters
+	assert.Equal(t, 1, len(attributes))
+	assert.Equal(t, 2, attributes[0].Notification)
+
+	// Invalid parameter name
+	assert.Equal(t, FaultInvalidParameterName, acs.responses[8].Body.Fault.Detail.Fault.FaultCode)
+
+	// Reboot is called after the session, and reported by the restarted agent
+	assert.NotNil(t, acs.responses[9].Body.RebootResponse)
+	assert.Equal(t, "reboot1", rebootKey)
+	assert.False(t, agent.hasEvents())
+
+	restarted := NewAgent(log, server, config)
+	err = restarted.Start()
+	assert.Nil(t, err)
+	defer restarted.Stop()
+	assert.Eventually(t, func() bool {
+		acs.lock.Lock()
+		defer acs.lock.Unlock()
+		return len(acs.informs) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	acs.lock.Lock()
+	events := acs.informs[1].Event.Events
+	acs.lock.Unlock()
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, EventBoot, events[0].EventCode)
+	assert.Equal(t, EventMReboot, events[1].EventCode)
+	assert.Equal(t, "reboot1", events[1].CommandKey)
+
+	// The command key is only reported once
+	_, err = os.Stat(config.RebootCommandKeyFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAgentSessionFailure(t *testing.T) {
+	log := getLogger()
+
+	acsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer acsServer.Close()
+
+	agent := NewAgent(log, coordinator.NewServer(log, "", nil), Config{AcsURL: acsServer.URL})
+	agent.QueueEvent(EventBootstrap, "")
+	err := agent.Inform()
+	assert.NotNil(t, err)
+
+	// Events are kept for the next session
+	assert.Equal(t, 1, len(agent.pendingEvents))
+	assert.Equal(t, 1, agent.retryCount)
+}
+
+func TestAgentInformTask(t *testing.T) {
+	log := getLogger()
+
+	acs := &TestACS{t: t}
+	acsServer := httptest.NewServer(acs)
+	defer acsServer.Close()
+	informs := func() int {
+		acs.lock.Lock()
+		defer acs.lock.Unlock()
+		return len(acs.informs)
+	}
+
+	// Without periodic informs, a queued event starts a session
+	agent := NewAgent(log, coordinator.NewServer(log, "", nil), Config{AcsURL: acsServer.URL})
+	assert.Nil(t, agent.Start())
+	defer agent.Stop()
+	assert.Eventually(t, func() bool { return informs() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	agent.QueueEvent(EventValueChange, "")
+	assert.Eventually(t, func() bool { return informs() == 2 }, 5*time.Second, 10*time.Millisecond)
+	acs.lock.Lock()
+	assert.Equal(t, EventBoot, acs.informs[0].Event.Events[0].EventCode)
+	assert.Equal(t, EventValueChange, acs.informs[1].Event.Events[0].EventCode)
+	acs.lock.Unlock()
+
+	agent.QueueEvent(EventValueChange, "")
+	assert.Eventually(t, func() bool { return informs() == 3 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,387 @@
+package cwmp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+)
+
+const (
+	NS_SOAP_ENV = "http://schemas.xmlsoap.org/soap/envelope/"
+	NS_SOAP_ENC = "http://schemas.xmlsoap.org/soap/encoding/"
+	NS_XSD      = "http://www.w3.org/2001/XMLSchema"
+	NS_XSI      = "http://www.w3.org/2001/XMLSchema-instance"
+	NS_CWMP     = "urn:dslforum-org:cwmp-1-0"
+)
+
+/*
+ * The CWMP types below use un-prefixed element names so they can be decoded
+ * regardless of the prefixes chosen by the peer.  When encoding, the envelope,
+ * RPC method and fault elements are given the soap-env and cwmp prefixes declared
+ * on the envelope by MarshalEnvelope.  RPC arguments are unqualified as
+ * required by the CWMP schema.
+ */
+
+// Envelope is a decoded SOAP envelope containing a single CWMP RPC
+type Envelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Header  Header   `xml:"Header"`
+	Body    Body     `xml:"Body"`
+}
+
+type Header struct {
+	ID           string `xml:"ID"`
+	HoldRequests string `xml:"HoldRequests"`
+}
+
+// Body holds the one RPC request, response or fault of an envelope
+type Body struct {
+	Inform                         *Inform                         `xml:"Inform"`
+	InformResponse                 *InformResponse                 `xml:"InformResponse"`
+	GetRPCMethods                  *GetRPCMethods                  `xml:"GetRPCMethods"`
+	GetRPCMethodsResponse          *GetRPCMethodsResponse          `xml:"GetRPCMethodsResponse"`
+	GetParameterValues             *GetParameterValues             `xml:"GetParameterValues"`
+	GetParameterValuesResponse     *GetParameterValuesResponse     `xml:"GetParameterValuesResponse"`
+	SetParameterValues             *SetParameterValues             `xml:"SetParameterValues"`
+	SetParameterValuesResponse     *SetParameterValuesResponse     `xml:"SetParameterValuesResponse"`
+	GetParameterNames              *GetParameterNames              `xml:"GetParameterNames"`
+	GetParameterNamesResponse      *GetParameterNamesResponse      `xml:"GetParameterNamesResponse"`
+	GetParameterAttributes         *GetParameterAttributes         `xml:"GetParameterAttributes"`
+	GetParameterAttributesResponse *GetParameterAttributesResponse `xml:"GetParameterAttributesResponse"`
+	SetParameterAttributes         *SetParameterAttributes         `xml:"SetParameterAttributes"`
+	SetParameterAttributesResponse *SetParameterAttributesResponse `xml:"SetParameterAttributesResponse"`
+	AddObject                      *AddObject                      `xml:"AddObject"`
+	AddObjectResponse              *AddObjectResponse              `xml:"AddObjectResponse"`
+	DeleteObject                   *DeleteObject                   `xml:"DeleteObject"`
+	DeleteObjectResponse           *DeleteObjectResponse           `xml:"DeleteObjectResponse"`
+	Reboot                         *Reboot                         `xml:"Reboot"`
+	RebootResponse                 *RebootResponse                 `xml:"RebootResponse"`
+	Fault                          *SOAPFault                      `xml:"Fault"`
+}
+
+type DeviceID struct {
+	Manufacturer string `xml:"Manufacturer"`
+	OUI          string `xml:"OUI"`
+	ProductClass string `xml:"ProductClass"`
+	SerialNumber string `xml:"SerialNumber"`
+}
+
+type EventStruct struct {
+	EventCode  string `xml:"EventCode"`
+	CommandKey string `xml:"CommandKey"`
+}
+
+type EventList struct {
+	ArrayType string        `xml:"soap-enc:arrayType,attr,omitempty"`
+	Events    []EventStruct `xml:"EventStruct"`
+}
+
+// ParameterValue is the typed value of a ParameterValueStruct.  `Type` is the
+// xsi:type of the value, for example "xsd:string".
+type ParameterValue struct {
+	Type  string
+	Value string
+}
+
+func (pv ParameterValue) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if pv.Type != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xsi:type"}, Value: pv.Type})
+	}
+	return e.EncodeElement(pv.Value, start)
+}
+
+func (pv *ParameterValue) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "type" {
+			pv.Type = attr.Value
+		}
+	}
+	return d.DecodeElement(&pv.Value, &start)
+}
+
+type ParameterValueStruct struct {
+	Name  string         `xml:"Name"`
+	Value ParameterValue `xml:"Value"`
+}
+
+type ParameterValueList struct {
+	ArrayType  string                 `xml:"soap-enc:arrayType,attr,omitempty"`
+	Parameters []ParameterValueStruct `xml:"ParameterValueStruct"`
+}
+
+type ParameterNames struct {
+	ArrayType string   `xml:"soap-enc:arrayType,attr,omitempty"`
+	Names     []string `xml:"string"`
+}
+
+type ParameterInfoStruct struct {
+	Name     string `xml:"Name"`
+	Writable bool   `xml:"Writable"`
+}
+
+type ParameterInfoList struct {
+	ArrayType  string                `xml:"soap-enc:arrayType,attr,omitempty"`
+	Parameters []ParameterInfoStruct `xml:"ParameterInfoStruct"`
+}
+
+type AccessList struct {
+	ArrayType string   `xml:"soap-enc:arrayType,attr,omitempty"`
+	Entries   []string `xml:"string"`
+}
+
+type ParameterAttributeStruct struct {
+	Name         string     `xml:"Name"`
+	Notification int        `xml:"Notification"`
+	AccessList   AccessList `xml:"AccessList"`
+}
+
+type ParameterAttributeList struct {
+	ArrayType  string                     `xml:"soap-enc:arrayType,attr,omitempty"`
+	Parameters []ParameterAttributeStruct `xml:"ParameterAttributeStruct"`
+}
+
+type SetParameterAttributesStruct struct {
+	Name               string     `xml:"Name"`
+	NotificationChange bool       `xml:"NotificationChange"`
+	Notification       int        `xml:"Notification"`
+	AccessListChange   bool       `xml:"AccessListChange"`
+	AccessList         AccessList `xml:"AccessList"`
+}
+
+type SetParameterAttributesList struct {
+	ArrayType  string                         `xml:"soap-enc:arrayType,attr,omitempty"`
+	Parameters []SetParameterAttributesStruct `xml:"SetParameterAttributesStruct"`
+}
+
+type MethodList struct {
+	ArrayType string   `xml:"soap-enc:arrayType,attr,omitempty"`
+	Methods   []string `xml:"string"`
+}
+
+type Inform struct {
+	DeviceId      DeviceID           `xml:"DeviceId"`
+	Event         EventList          `xml:"Event"`
+	MaxEnvelopes  int                `xml:"MaxEnvelopes"`
+	CurrentTime   string             `xml:"CurrentTime"`
+	RetryCount    int                `xml:"RetryCount"`
+	ParameterList ParameterValueList `xml:"ParameterList"`
+}
+
+type InformResponse struct {
+	MaxEnvelopes int `xml:"MaxEnvelopes"`
+}
+
+type GetRPCMethods struct{}
+
+type GetRPCMethodsResponse struct {
+	MethodList MethodList `xml:"MethodList"`
+}
+
+type GetParameterValues struct {
+	ParameterNames ParameterNames `xml:"ParameterNames"`
+}
+
+type GetParameterValuesResponse struct {
+	ParameterList ParameterValueList `xml:"ParameterList"`
+}
+
+type SetParameterValues struct {
+	ParameterList ParameterValueList `xml:"ParameterList"`
+	ParameterKey  string             `xml:"ParameterKey"`
+}
+
+type SetParameterValuesResponse struct {
+	Status int `xml:"Status"`
+}
+
+type GetParameterNames struct {
+	ParameterPath string `xml:"ParameterPath"`
+	NextLevel     bool   `xml:"NextLevel"`
+}
+
+type GetParameterNamesResponse struct {
+	ParameterList ParameterInfoList `xml:"ParameterList"`
+}
+
+type GetParameterAttributes struct {
+	ParameterNames ParameterNames `xml:"ParameterNames"`
+}
+
+type GetParameterAttributesResponse struct {
+	ParameterList ParameterAttributeList `xml:"ParameterList"`
+}
+
+type SetParameterAttributes struct {
+	ParameterList SetParameterAttributesList `xml:"ParameterList"`
+}
+
+type SetParameterAttributesResponse struct{}
+
+type AddObject struct {
+	ObjectName   string `xml:"ObjectName"`
+	ParameterKey string `xml:"ParameterKey"`
+}
+
+type AddObjectResponse struct {
+	InstanceNumber uint `xml:"InstanceNumber"`
+	Status         int  `xml:"Status"`
+}
+
+type DeleteObject struct {
+	ObjectName   string `xml:"ObjectName"`
+	ParameterKey string `xml:"ParameterKey"`
+}
+
+type DeleteObjectResponse struct {
+	Status int `xml:"Status"`
+}
+
+type Reboot struct {
+	CommandKey string `xml:"CommandKey"`
+}
+
+type RebootResponse struct{}
+
+// SOAPFault is the SOAP fault wrapping a CWMP fault
+type SOAPFault struct {
+	FaultCode   string      `xml:"faultcode"`
+	FaultString string      `xml:"faultstring"`
+	Detail      FaultDetail `xml:"detail"`
+}
+
+type FaultDetail struct {
+	Fault Fault `xml:"Fault"`
+}
+
+func (fd FaultDetail) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	if err := e.EncodeElement(fd.Fault, xml.StartElement{Name: xml.Name{Local: "cwmp:Fault"}}); err != nil {
+		return err
+	}
+	return e.EncodeToken(start.End())
+}
+
+type SetParameterValuesFault struct {
+	ParameterName string `xml:"ParameterName"`
+	FaultCode     int    `xml:"FaultCode"`
+	FaultString   string `xml:"FaultString"`
+}
+
+// Fault is a CWMP fault.  Fault also implements the error interface.
+type Fault struct {
+	FaultCode                int                       `xml:"FaultCode"`
+	FaultString              string                    `xml:"FaultString"`
+	SetParameterValuesFaults []SetParameterValuesFault `xml:"SetParameterValuesFault,omitempty"`
+}
+
+func (fa *Fault) Error() string {
+	return fmt.Sprintf("CWMP fault %d: %s", fa.FaultCode, fa.FaultString)
+}
+
+// Method returns the name of the RPC in the body, or an empty string if the
+// body is empty
+func (bo *Body) Method() string {
+	method, _ := bo.rpc()
+	return method
+}
+
+func (bo *Body) rpc() (string, interface{}) {
+	switch {
+	case bo.Inform != nil:
+		return "Inform", bo.Inform
+	case bo.InformResponse != nil:
+		return "InformResponse", bo.InformResponse
+	case bo.GetRPCMethods != nil:
+		return "GetRPCMethods", bo.GetRPCMethods
+	case bo.GetRPCMethodsResponse != nil:
+		return "GetRPCMethodsResponse", bo.GetRPCMethodsResponse
+	case bo.GetParameterValues != nil:
+		return "GetParameterValues", bo.GetParameterValues
+	case bo.GetParameterValuesResponse != nil:
+		return "GetParameterValuesResponse", bo.GetParameterValuesResponse
+	case bo.SetParameterValues != nil:
+		return "SetParameterValues", bo.SetParameterValues
+	case bo.SetParameterValuesResponse != nil:
+		return "SetParameterValuesResponse", bo.SetParameterValuesResponse
+	case bo.GetParameterNames != nil:
+		return "GetParameterNames", bo.GetParameterNames
+	case bo.GetParameterNamesResponse != nil:
+		return "GetParameterNamesResponse", bo.GetParameterNamesResponse
+	case bo.GetParameterAttributes != nil:
+		return "GetParameterAttributes", bo.GetParameterAttributes
+	case bo.GetParameterAttributesResponse != nil:
+		return "GetParameterAttributesResponse", bo.GetParameterAttributesResponse
+	case bo.SetParameterAttributes != nil:
+		return "SetParameterAttributes", bo.SetParameterAttributes
+	case bo.SetParameterAttributesResponse != nil:
+		return "SetParameterAttributesResponse", bo.SetParameterAttributesResponse
+	case bo.AddObject != nil:
+		return "AddObject", bo.AddObject
+	case bo.AddObjectResponse != nil:
+		return "AddObjectResponse", bo.AddObjectResponse
+	case bo.DeleteObject != nil:
+		return "DeleteObject", bo.DeleteObject
+	case bo.DeleteObjectResponse != nil:
+		return "DeleteObjectResponse", bo.DeleteObjectResponse
+	case bo.Reboot != nil:
+		return "Reboot", bo.Reboot
+	case bo.RebootResponse != nil:
+		return "RebootResponse", bo.RebootResponse
+	case bo.Fault != nil:
+		return "Fault", bo.Fault
+	}
+	return "", nil
+}
+
+// MarshalEnvelope encodes `body` in a SOAP envelope with the CWMP header ID `id`
+func MarshalEnvelope(id string, body Body) ([]byte, error) {
+	var buf bytes.Buffer
+
+	method, rpc := body.rpc()
+	if rpc == nil {
+		return nil, fmt.Errorf("cannot marshal an envelope with an empty body")
+	}
+
+	buf.WriteString(xml.Header)
+	fmt.Fprintf(&buf, `<soap-env:Envelope xmlns:soap-env="%s" xmlns:soap-enc="%s" xmlns:xsd="%s" xmlns:xsi="%s" xmlns:cwmp="%s">`,
+		NS_SOAP_ENV, NS_SOAP_ENC, NS_XSD, NS_XSI, NS_CWMP)
+	buf.WriteString(`<soap-env:Header>`)
+	if id != "" {
+		buf.WriteString(`<cwmp:ID soap-env:mustUnderstand="1">`)
+		if err := xml.EscapeText(&buf, []byte(id)); err != nil {
+			return nil, err
+		}
+		buf.WriteString(`</cwmp:ID>`)
+	}
+	buf.WriteString(`</soap-env:Header><soap-env:Body>`)
+
+	prefix := "cwmp:"
+	if method == "Fault" {
+		prefix = "soap-env:"
+	}
+	encoder := xml.NewEncoder(&buf)
+	if err := encoder.EncodeElement(rpc, xml.StartElement{Name: xml.Name{Local: prefix + method}}); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+
+	buf.WriteString(`</soap-env:Body></soap-env:Envelope>`)
+	return buf.Bytes(), nil
+}
+
+// UnmarshalEnvelope decodes a SOAP envelope
+func UnmarshalEnvelope(data []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return nil, fmt.Errorf("invalid SOAP envelope: %v", err)
+	}
+	return &envelope, nil
+}
+
+func arrayType(typeName string, length int) string {
+	return fmt.Sprintf("%s[%d]", typeName, length)
+}
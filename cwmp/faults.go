@@ -0,0 +1,78 @@
+package cwmp
+
+import (
+	"github.com/zackwine/nanodm"
+)
+
+// CWMP fault codes (TR-069 Annex A.5.1)
+const (
+	FaultMethodNotSupported      = 9000
+	FaultRequestDenied           = 9001
+	FaultInternalError           = 9002
+	FaultInvalidArguments        = 9003
+	FaultResourcesExceeded       = 9004
+	FaultInvalidParameterName    = 9005
+	FaultInvalidParameterType    = 9006
+	FaultInvalidParameterValue   = 9007
+	FaultNonWritableParameter    = 9008
+	FaultNotificationRequestDeny = 9009
+
+	// Vendor specific fault codes
+	FaultTimeout           = 9800
+	FaultSourceUnavailable = 9801
+)
+
+var faultStrings = map[int]string{
+	FaultMethodNotSupported:      "Method not supported",
+	FaultRequestDenied:           "Request denied",
+	FaultInternalError:           "Internal error",
+	FaultInvalidArguments:        "Invalid arguments",
+	FaultResourcesExceeded:       "Resources exceeded",
+	FaultInvalidParameterName:    "Invalid parameter name",
+	FaultInvalidParameterType:    "Invalid parameter type",
+	FaultInvalidParameterValue:   "Invalid parameter value",
+	FaultNonWritableParameter:    "Attempt to set a non-writable parameter",
+	FaultNotificationRequestDeny: "Notification request rejected",
+	FaultTimeout:                 "Timeout",
+	FaultSourceUnavailable:       "Source unavailable",
+}
+
+// NewFault creates a CWMP fault with the standard fault string for `code`
+func NewFault(code int) *Fault {
+	return &Fault{
+		FaultCode:   code,
+		FaultString: faultStrings[code],
+	}
+}
+
+// faultCodeFromError maps an error returned by the coordinator to a CWMP fault code
+func faultCodeFromError(err error) int {
+	if fault, ok := err.(*Fault); ok {
+		return fault.FaultCode
+	}
+
+	return nanodm.CodeOf(err).CWMPCode()
+}
+
+// faultFromError creates a CWMP fault for an error returned by the coordinator
+func faultFromError(err error) *Fault {
+	if fault, ok := err.(*Fault); ok {
+		return fault
+	}
+	fault := NewFault(faultCodeFromError(err))
+	fault.FaultString = fault.FaultString + ": " + err.Error()
+	return fault
+}
+
+func soapFault(fault *Fault) *SOAPFault {
+	faultCode := "Server"
+	if fault.FaultCode == FaultRequestDenied || fault.FaultCode == FaultInvalidArguments ||
+		(fault.FaultCode >= FaultInvalidParameterName && fault.FaultCode <= FaultNotificationRequestDeny) {
+		faultCode = "Client"
+	}
+	return &SOAPFault{
+		FaultCode:   faultCode,
+		FaultString: "CWMP fault",
+		Detail:      FaultDetail{Fault: *fault},
+	}
+}
@@ -0,0 +1,42 @@
+package cwmp
+
+import (
+	"strings"
+
+	"github.com/zackwine/nanodm"
+)
+
+var xsdTypes = map[nanodm.ObjectType]string{
+	nanodm.TypeString:       "xsd:string",
+	nanodm.TypeInt:          "xsd:int",
+	nanodm.TypeUnsignedInt:  "xsd:unsignedInt",
+	nanodm.TypeBool:         "xsd:boolean",
+	nanodm.TypeDateTime:     "xsd:dateTime",
+	nanodm.TypeBase64:       "xsd:base64",
+	nanodm.TypeLong:         "xsd:long",
+	nanodm.TypeUnsignedLong: "xsd:unsignedLong",
+	nanodm.TypeFloat:        "xsd:float",
+	nanodm.TypeDouble:       "xsd:double",
+	nanodm.TypeByte:         "xsd:unsignedByte",
+}
+
+// xsdType returns the xsi:type of an object type
+func xsdType(objType nanodm.ObjectType) string {
+	if typeName, ok := xsdTypes[objType]; ok {
+		return typeName
+	}
+	return "xsd:string"
+}
+
+// objectType returns the object type of an xsi:type, ignoring the prefix
+func objectType(typeName string) (nanodm.ObjectType, bool) {
+	if idx := strings.Index(typeName, ":"); idx >= 0 {
+		typeName = typeName[idx+1:]
+	}
+	for objType, xsdName := range xsdTypes {
+		if xsdName == "xsd:"+typeName {
+			return objType, true
+		}
+	}
+	return nanodm.TypeString, false
+}
@@ -0,0 +1,221 @@
+package nanodm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrorCode classifies an error.  The codes are the USP (TR-369 section
+// 10.13) error codes, with the codes that USP doesn't define taken from its
+// vendor range, and map to CWMP (TR-069 Annex A.5.1) fault codes with
+// CWMPCode().
+type ErrorCode uint32
+
+const (
+	CodeInternal          ErrorCode = 7003
+	CodeResourcesExceeded ErrorCode = 7005
+	CodeAccessDenied      ErrorCode = 7006
+	CodeInvalidType       ErrorCode = 7011
+	CodeInvalidValue      ErrorCode = 7012
+	CodeNotFound          ErrorCode = 7026
+	CodeTimeout           ErrorCode = 7800
+	CodeSourceUnavailable ErrorCode = 7801
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	CodeInternal:          "internal error",
+	CodeResourcesExceeded: "resources exceeded",
+	CodeAccessDenied:      "access denied",
+	CodeInvalidType:       "invalid type",
+	CodeInvalidValue:      "invalid value",
+	CodeNotFound:          "not found",
+	CodeTimeout:           "timeout",
+	CodeSourceUnavailable: "source unavailable",
+}
+
+var cwmpFaultCodes = map[ErrorCode]int{
+	CodeInternal:          9002,
+	CodeResourcesExceeded: 9004,
+	CodeAccessDenied:      9001,
+	CodeInvalidType:       9006,
+	CodeInvalidValue:      9007,
+	CodeNotFound:          9005,
+	CodeTimeout:           9800,
+	CodeSourceUnavailable: 9801,
+}
+
+func (ec ErrorCode) String() string {
+	if name, ok := errorCodeNames[ec]; ok {
+		return name
+	}
+	return fmt.Sprintf("error %d", uint32(ec))
+}
+
+// USPCode returns the USP error code of `ec`
+func (ec ErrorCode) USPCode() uint32 {
+	return uint32(ec)
+}
+
+// CWMPCode returns the CWMP fault code of `ec`
+func (ec ErrorCode) CWMPCode() int {
+	if code, ok := cwmpFaultCodes[ec]; ok {
+		return code
+	}
+	return cwmpFaultCodes[CodeInternal]
+}
+
+// Error is an error with a code, optionally about the object `Name`.  Errors
+// are sent in messages as ErrorEntries, so a coded error returned by a source
+// handler reaches the coordinator (and its callers) with its code.
+//
+// Errors match the sentinel of their code with errors.Is:
+//
+//	if errors.Is(err, nanodm.ErrNotFound) {
+type Error struct {
+	Code    ErrorCode
+	Name    string
+	Message string
+
+	err error
+}
+
+// The sentinel errors of each code, to match errors with errors.Is
+var (
+	ErrInternal          = &Error{Code: CodeInternal}
+	ErrResourcesExceeded = &Error{Code: CodeResourcesExceeded}
+	ErrAccessDenied      = &Error{Code: CodeAccessDenied}
+	ErrInvalidType       = &Error{Code: CodeInvalidType}
+	ErrInvalidValue      = &Error{Code: CodeInvalidValue}
+	ErrNotFound          = &Error{Code: CodeNotFound}
+	ErrTimeout           = &Error{Code: CodeTimeout}
+	ErrSourceUnavailable = &Error{Code: CodeSourceUnavailable}
+)
+
+// Errorf creates an error with `code` and a message formatted like
+// fmt.Errorf, including wrapping an error with %w
+func Errorf(code ErrorCode, format string, args ...interface{}) *Error {
+	err := fmt.Errorf(format, args...)
+	return &Error{Code: code, Message: err.Error(), err: errors.Unwrap(err)}
+}
+
+// ObjectErrorf creates an error with `code` about the object `name`
+func ObjectErrorf(name string, code ErrorCode, format string, args ...interface{}) *Error {
+	err := Errorf(code, format, args...)
+	err.Name = name
+	return err
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Is matches errors with the same code
+func (e *Error) Is(target error) bool {
+	if targetErr, ok := target.(*Error); ok {
+		return targetErr.Code == e.Code
+	}
+	return false
+}
+
+// Errors are the errors of several objects, for example returned by a source
+// handler that failed to set some of the objects of a request
+type Errors []*Error
+
+func (es Errors) Error() string {
+	messages := make([]string, 0, len(es))
+	for _, err := range es {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Is matches if any of the errors matches `target`
+func (es Errors) Is(target error) bool {
+	for _, err := range es {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// CodeOf returns the code of `err`: the code of the first Error in its chain,
+// CodeTimeout if it's a context deadline, and CodeInternal otherwise
+func CodeOf(err error) ErrorCode {
+	var codedErr *Error
+	var codedErrs Errors
+	switch {
+	case errors.As(err, &codedErr):
+		return codedErr.Code
+	case errors.As(err, &codedErrs) && len(codedErrs) > 0:
+		return codedErrs[0].Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return CodeTimeout
+	}
+	return CodeInternal
+}
+
+// ErrorEntry is an error sent in a message, about the object Name if it's
+// set
+type ErrorEntry struct {
+	Name    string    `json:"name,omitempty"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message,omitempty"`
+}
+
+// ErrorEntries returns the entries to send for `err` in a message
+func ErrorEntries(err error) []ErrorEntry {
+	if err == nil {
+		return nil
+	}
+	var codedErrs Errors
+	if errors.As(err, &codedErrs) {
+		entries := make([]ErrorEntry, 0, len(codedErrs))
+		for _, codedErr := range codedErrs {
+			entries = append(entries, ErrorEntry{Name: codedErr.Name, Code: codedErr.Code, Message: codedErr.Error()})
+		}
+		return entries
+	}
+	var codedErr *Error
+	if errors.As(err, &codedErr) {
+		return []ErrorEntry{{Name: codedErr.Name, Code: codedErr.Code, Message: err.Error()}}
+	}
+	return []ErrorEntry{{Code: CodeOf(err), Message: err.Error()}}
+}
+
+// Err returns the error of the entry
+func (ee ErrorEntry) Err() *Error {
+	return &Error{Code: ee.Code, Name: ee.Name, Message: ee.Message}
+}
+
+// MessageError returns the error of a nack `message`: an Error for each of its
+// error entries, or an internal Error with its error string if it has none
+// (as sent by older peers)
+func MessageError(message *Message) error {
+	switch len(message.Errors) {
+	case 0:
+		return Errorf(CodeInternal, "%s", message.Error)
+	case 1:
+		return message.Errors[0].Err()
+	}
+	errs := make(Errors, 0, len(message.Errors))
+	for _, entry := range message.Errors {
+		errs = append(errs, entry.Err())
+	}
+	return errs
+}
+
+// SetError sets the error of a nack message to `err`
+func (m *Message) SetError(err error) {
+	m.Error = err.Error()
+	m.Errors = ErrorEntries(err)
+}
@@ -0,0 +1,74 @@
+package nanodm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	err := ObjectErrorf("Device.Value", CodeInvalidValue, "bad value %d", 7)
+	assert.Equal(t, "bad value 7", err.Error())
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	assert.False(t, errors.Is(err, ErrInvalidType))
+
+	// Codes survive wrapping
+	wrapped := fmt.Errorf("failed to set: %w", err)
+	assert.True(t, errors.Is(wrapped, ErrInvalidValue))
+	assert.Equal(t, CodeInvalidValue, CodeOf(wrapped))
+
+	// As do the errors wrapped by a coded error
+	timeout := Errorf(CodeTimeout, "timeout waiting: %w", context.DeadlineExceeded)
+	assert.True(t, errors.Is(timeout, ErrTimeout))
+	assert.True(t, errors.Is(timeout, context.DeadlineExceeded))
+
+	assert.Equal(t, CodeTimeout, CodeOf(context.DeadlineExceeded))
+	assert.Equal(t, CodeInternal, CodeOf(errors.New("plain")))
+
+	errs := Errors{err, ObjectErrorf("Device.Other", CodeAccessDenied, "denied")}
+	assert.Equal(t, "bad value 7; denied", errs.Error())
+	assert.True(t, errors.Is(errs, ErrAccessDenied))
+	assert.False(t, errors.Is(errs, ErrNotFound))
+	assert.Equal(t, CodeInvalidValue, CodeOf(errs))
+
+	assert.Equal(t, 9007, CodeInvalidValue.CWMPCode())
+	assert.Equal(t, 9005, CodeNotFound.CWMPCode())
+	assert.Equal(t, uint32(7026), CodeNotFound.USPCode())
+}
+
+func TestMessageErrors(t *testing.T) {
+	// A single error keeps its code and name
+	var message Message
+	message.SetError(fmt.Errorf("wrapped: %w", ObjectErrorf("Device.Value", CodeNotFound, "no value")))
+	assert.Equal(t, "wrapped: no value", message.Error)
+	err := MessageError(&message)
+	assert.True(t, errors.Is(err, ErrNotFound))
+	assert.Equal(t, "wrapped: no value", err.Error())
+	var codedErr *Error
+	if assert.True(t, errors.As(err, &codedErr)) {
+		assert.Equal(t, "Device.Value", codedErr.Name)
+	}
+
+	// Errors are sent an entry each
+	message.SetError(Errors{
+		ObjectErrorf("Device.A", CodeInvalidType, "bad type"),
+		ObjectErrorf("Device.B", CodeInvalidValue, "bad value"),
+	})
+	assert.Equal(t, 2, len(message.Errors))
+	err = MessageError(&message)
+	var errs Errors
+	if assert.True(t, errors.As(err, &errs)) {
+		assert.Equal(t, "Device.B", errs[1].Name)
+		assert.True(t, errors.Is(errs[1], ErrInvalidValue))
+	}
+
+	// Plain errors are internal errors, as are the nacks of older peers
+	message.SetError(errors.New("plain"))
+	assert.Equal(t, CodeInternal, message.Errors[0].Code)
+	err = MessageError(&Message{Error: "old"})
+	assert.True(t, errors.Is(err, ErrInternal))
+	assert.Equal(t, "old", err.Error())
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
@@ -122,6 +123,8 @@ func (ch *ExampleCoordinator) testAddAndDeleteRow(server *coordinator.Server) {
 func main() {
 
 	url := "tcp://127.0.0.1:4800"
+	faultsSpec := flag.String("faults", "", "debug: faults to inject into the messages, for example \"drop type=Ping p=0.5; delay=2s type=Ack\"")
+	flag.Parse()
 
 	logrus.SetFormatter(&logrus.TextFormatter{
 		PadLevelText:  true,
@@ -135,9 +138,15 @@ func main() {
 		log: log.WithField("handler", "ExampleCoordinator"),
 	}
 
+	faults, err := newFaultInjector(*faultsSpec)
+	if err != nil {
+		log.Fatalf("Invalid -faults: %v", err)
+	}
+
 	log.Info("Starting dmcoordinator example...")
 	server := coordinator.NewServer(log, url, exCoordinator)
-	err := server.Start()
+	server.SetFaultInjector(faults)
+	err = server.Start()
 	if err != nil {
 		log.Fatalf("Failed to start server with %v", err)
 	}
@@ -148,3 +157,16 @@ func main() {
 	logrus.Infof("Killed with sig %v", sig)
 
 }
+
+// newFaultInjector returns the fault injector of the -faults flag, or nil if
+// it's empty
+func newFaultInjector(spec string) (*nanodm.FaultInjector, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rules, err := nanodm.ParseFaultRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	return nanodm.NewFaultInjector(time.Now().UnixNano(), rules...), nil
+}
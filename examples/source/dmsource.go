@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
@@ -143,7 +144,7 @@ func (ex *ExampleSource) DeleteRow(row nanodm.Object) error {
 	return nil
 }
 
-func startExampleSource1(log *logrus.Entry, coordinatorUrl string, sourceUrl string, sourceName string) *source.Source {
+func startExampleSource1(log *logrus.Entry, coordinatorUrl string, sourceUrl string, sourceName string, faults *nanodm.FaultInjector) *source.Source {
 
 	// Create an ExampleSource that implements SourceHandler
 	example := &ExampleSource{
@@ -156,6 +157,7 @@ func startExampleSource1(log *logrus.Entry, coordinatorUrl string, sourceUrl str
 
 	// Create the new source passing a custom SourceHandler
 	source := source.NewSource(log, sourceName, coordinatorUrl, sourceUrl, example)
+	source.SetFaultInjector(faults)
 	// Connect
 	source.Connect()
 	// Call register to update the list of objects the source owns
@@ -198,7 +200,7 @@ func startExampleSource1(log *logrus.Entry, coordinatorUrl string, sourceUrl str
 	return source
 }
 
-func startExampleSource2(log *logrus.Entry, coordinatorUrl string, sourceUrl string, sourceName string) *source.Source {
+func startExampleSource2(log *logrus.Entry, coordinatorUrl string, sourceUrl string, sourceName string, faults *nanodm.FaultInjector) *source.Source {
 
 	// Create an ExampleSource that implements SourceHandler
 	example := &ExampleSource{
@@ -211,6 +213,7 @@ func startExampleSource2(log *logrus.Entry, coordinatorUrl string, sourceUrl str
 
 	// Create the new source passing a custom SourceHandler
 	source := source.NewSource(log, sourceName, coordinatorUrl, sourceUrl, example)
+	source.SetFaultInjector(faults)
 	// Connect
 	source.Connect()
 	// Call register to update the list of objects the source owns
@@ -226,6 +229,8 @@ func main() {
 	coordinatorUrl := "tcp://127.0.0.1:4800"
 	sourceUrl1 := "tcp://127.0.0.1:4801"
 	sourceUrl2 := "tcp://127.0.0.1:4802"
+	faultsSpec := flag.String("faults", "", "debug: faults to inject into the messages, for example \"drop type=Ping p=0.5; delay=2s type=Ack\"")
+	flag.Parse()
 
 	logrus.SetFormatter(&logrus.TextFormatter{
 		PadLevelText:  true,
@@ -235,9 +240,14 @@ func main() {
 	logrus.SetLevel(logrus.DebugLevel)
 	log := logrus.NewEntry(logrus.New())
 
+	faults, err := newFaultInjector(*faultsSpec)
+	if err != nil {
+		log.Fatalf("Invalid -faults: %v", err)
+	}
+
 	log.Info("Starting dmsource example...")
-	source1 := startExampleSource1(log.WithField("handler", "testSource1"), coordinatorUrl, sourceUrl1, "testSource1")
-	source2 := startExampleSource2(log.WithField("handler", "testSource2"), coordinatorUrl, sourceUrl2, "testSource2")
+	source1 := startExampleSource1(log.WithField("handler", "testSource1"), coordinatorUrl, sourceUrl1, "testSource1", faults)
+	source2 := startExampleSource2(log.WithField("handler", "testSource2"), coordinatorUrl, sourceUrl2, "testSource2", faults)
 
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
@@ -250,3 +260,16 @@ func main() {
 	// Give a few seconds for disconnect to clean up
 	<-time.After(5 * time.Second)
 }
+
+// newFaultInjector returns the fault injector of the -faults flag, or nil if
+// it's empty
+func newFaultInjector(spec string) (*nanodm.FaultInjector, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rules, err := nanodm.ParseFaultRules(spec)
+	if err != nil {
+		return nil, err
+	}
+	return nanodm.NewFaultInjector(time.Now().UnixNano(), rules...), nil
+}
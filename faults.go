@@ -0,0 +1,339 @@
+package nanodm
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultType is a fault a FaultInjector injects into messages
+type FaultType int
+
+const (
+	// FaultDrop drops the message
+	FaultDrop FaultType = iota
+	// FaultDelay delivers the message after the Delay of its rule
+	FaultDelay
+	// FaultDuplicate delivers the message twice
+	FaultDuplicate
+	// FaultReorder delivers the message after the next message sent to (or
+	// received on) the same url, or after the Delay of its rule if there is
+	// none
+	FaultReorder
+	// FaultCorrupt delivers the message with its bytes damaged
+	FaultCorrupt
+)
+
+// The longest time FaultReorder holds a message if its rule has no Delay
+const DEFAULT_REORDER_DELAY = time.Second
+
+var faultTypeNames = map[FaultType]string{
+	FaultDrop:      "drop",
+	FaultDelay:     "delay",
+	FaultDuplicate: "duplicate",
+	FaultReorder:   "reorder",
+	FaultCorrupt:   "corrupt",
+}
+
+func (ft FaultType) String() string {
+	if name, ok := faultTypeNames[ft]; ok {
+		return name
+	}
+	return fmt.Sprintf("fault %d", int(ft))
+}
+
+// FaultRule injects its Fault into the messages it matches.  The empty fields
+// match any message.
+type FaultRule struct {
+	Fault FaultType
+	// The types of the messages
+	Types []MessageType
+	// The name of the source or controller the messages are from or to
+	SourceName string
+	// The url of the sender of the messages, their Source
+	From string
+	// The url the messages are sent to
+	To string
+	// Receive applies the rule to the messages received by the pullers, rather
+	// than to the messages sent by the pushers
+	Receive bool
+	// The probability of the fault for each message matched, always if 0
+	Probability float64
+	// The delay of FaultDelay and FaultReorder
+	Delay time.Duration
+}
+
+// FaultInjector injects faults into the messages of the pushers and pullers
+// it's set on, to test how servers, sources and controllers behave when the
+// transport fails.  The first rule matching a message whose probability hits
+// injects its fault.  It's safe for concurrent use, and a nil FaultInjector
+// injects nothing.
+type FaultInjector struct {
+	mutex    sync.Mutex
+	rules    []FaultRule
+	random   *rand.Rand
+	injected map[FaultType]int
+	// The messages held by FaultReorder, by direction and url
+	held map[string]*heldMessage
+}
+
+type heldMessage struct {
+	msgBytes []byte
+	deliver  func([]byte)
+	timer    *time.Timer
+}
+
+// NewFaultInjector creates a fault injector of `rules`, whose probabilities
+// and corruptions are drawn from `seed`
+func NewFaultInjector(seed int64, rules ...FaultRule) *FaultInjector {
+	return &FaultInjector{
+		rules:    rules,
+		random:   rand.New(rand.NewSource(seed)),
+		injected: make(map[FaultType]int),
+		held:     make(map[string]*heldMessage),
+	}
+}
+
+// SetRules replaces the rules of the injector
+func (fi *FaultInjector) SetRules(rules ...FaultRule) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	fi.rules = rules
+}
+
+// AddRule adds a rule after the rules of the injector
+func (fi *FaultInjector) AddRule(rule FaultRule) {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	fi.rules = append(fi.rules, rule)
+}
+
+// Silence drops every message sent from `url`, as if the server, source or
+// controller listening on `url` went silent
+func (fi *FaultInjector) Silence(url string) {
+	fi.AddRule(FaultRule{Fault: FaultDrop, From: url})
+}
+
+// Clear removes the rules of the injector
+func (fi *FaultInjector) Clear() {
+	fi.SetRules()
+}
+
+// Injected returns the number of times `fault` was injected
+func (fi *FaultInjector) Injected(fault FaultType) int {
+	fi.mutex.Lock()
+	defer fi.mutex.Unlock()
+	return fi.injected[fault]
+}
+
+// inject delivers `msgBytes`, the bytes of `message`, with the fault of the
+// first rule that matches.  The message is sent to `url`, or received on it
+// if `receive` is set.  `deliver` may be called later and from another
+// goroutine, or not at all.
+func (fi *FaultInjector) inject(receive bool, url string, message *Message, msgBytes []byte, deliver func([]byte)) {
+	if fi == nil {
+		deliver(msgBytes)
+		return
+	}
+
+	heldKey := fmt.Sprintf("%t %s", receive, url)
+	fi.mutex.Lock()
+	rule, matched := fi.match(receive, url, message)
+	var held *heldMessage
+	var corrupted []byte
+	if matched && rule.Fault == FaultReorder {
+		// Delivered after the next message, unless a message is held already
+		if _, holding := fi.held[heldKey]; !holding {
+			fi.injected[rule.Fault]++
+			fi.hold(heldKey, msgBytes, deliver, rule.Delay)
+			fi.mutex.Unlock()
+			return
+		}
+		matched = false
+	} else if matched {
+		fi.injected[rule.Fault]++
+		if rule.Fault == FaultCorrupt {
+			corrupted = fi.corrupt(msgBytes)
+		}
+	}
+	// A message held is delivered after this one
+	if held = fi.held[heldKey]; held != nil {
+		held.timer.Stop()
+		delete(fi.held, heldKey)
+	}
+	fi.mutex.Unlock()
+
+	switch {
+	case !matched:
+		deliver(msgBytes)
+	case rule.Fault == FaultDrop:
+	case rule.Fault == FaultDelay:
+		time.AfterFunc(rule.Delay, func() { deliver(msgBytes) })
+	case rule.Fault == FaultDuplicate:
+		deliver(msgBytes)
+		deliver(msgBytes)
+	case rule.Fault == FaultCorrupt:
+		deliver(corrupted)
+	}
+	if held != nil {
+		held.deliver(held.msgBytes)
+	}
+}
+
+// match returns the first rule matching `message` whose probability hits
+func (fi *FaultInjector) match(receive bool, url string, message *Message) (FaultRule, bool) {
+	for _, rule := range fi.rules {
+		if rule.Receive != receive || (rule.To != "" && rule.To != url) ||
+			(rule.From != "" && rule.From != message.Source) ||
+			(rule.SourceName != "" && rule.SourceName != message.SourceName) {
+			continue
+		}
+		if len(rule.Types) > 0 {
+			typeMatches := false
+			for _, msgType := range rule.Types {
+				typeMatches = typeMatches || msgType == message.Type
+			}
+			if !typeMatches {
+				continue
+			}
+		}
+		if rule.Probability > 0 && fi.random.Float64() >= rule.Probability {
+			continue
+		}
+		return rule, true
+	}
+	return FaultRule{}, false
+}
+
+// hold holds a message until the next message of the same direction and
+// url, or until `delay`
+func (fi *FaultInjector) hold(heldKey string, msgBytes []byte, deliver func([]byte), delay time.Duration) {
+	if delay <= 0 {
+		delay = DEFAULT_REORDER_DELAY
+	}
+	held := &heldMessage{msgBytes: msgBytes, deliver: deliver}
+	held.timer = time.AfterFunc(delay, func() {
+		fi.mutex.Lock()
+		stillHeld := fi.held[heldKey] == held
+		if stillHeld {
+			delete(fi.held, heldKey)
+		}
+		fi.mutex.Unlock()
+		if stillHeld {
+			deliver(msgBytes)
+		}
+	})
+	fi.held[heldKey] = held
+}
+
+// corrupt returns a copy of `msgBytes` truncated at a random length, with a
+// random byte flipped, so that it doesn't decode
+func (fi *FaultInjector) corrupt(msgBytes []byte) []byte {
+	if len(msgBytes) == 0 {
+		return msgBytes
+	}
+	corrupted := make([]byte, fi.random.Intn(len(msgBytes)))
+	copy(corrupted, msgBytes)
+	if len(corrupted) > 0 {
+		corrupted[fi.random.Intn(len(corrupted))] ^= 0xff
+	}
+	return corrupted
+}
+
+// ParseFaultRules parses fault rules, for example from a debug flag.  The
+// rules are separated by ";", and each is a fault followed by its fields:
+//
+//	drop type=Ping,Ack from=tcp://127.0.0.1:4801 p=0.5
+//	delay=2s type=Get receive
+//	reorder=500ms source=testSource1 to=tcp://127.0.0.1:4800
+//	duplicate
+//	corrupt type=Set
+//
+// The duration after delay or reorder is the Delay of the rule.
+func ParseFaultRules(spec string) ([]FaultRule, error) {
+	var rules []FaultRule
+	for _, ruleSpec := range strings.Split(spec, ";") {
+		fields := strings.Fields(ruleSpec)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseFaultRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault rule %q: %w", strings.TrimSpace(ruleSpec), err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseFaultRule(fields []string) (FaultRule, error) {
+	var rule FaultRule
+	fault := strings.SplitN(fields[0], "=", 2)
+	found := false
+	for faultType, name := range faultTypeNames {
+		if name == fault[0] {
+			rule.Fault = faultType
+			found = true
+		}
+	}
+	if !found {
+		return rule, fmt.Errorf("unknown fault %s", fault[0])
+	}
+	if len(fault) == 2 {
+		delay, err := time.ParseDuration(fault[1])
+		if err != nil {
+			return rule, err
+		}
+		rule.Delay = delay
+	} else if rule.Fault == FaultDelay {
+		return rule, fmt.Errorf("delay needs a duration, for example delay=2s")
+	}
+
+	for _, field := range fields[1:] {
+		keyValue := strings.SplitN(field, "=", 2)
+		if keyValue[0] == "receive" && len(keyValue) == 1 {
+			rule.Receive = true
+			continue
+		} else if len(keyValue) != 2 {
+			return rule, fmt.Errorf("field %s isn't key=value", field)
+		}
+		key, value := keyValue[0], keyValue[1]
+		switch key {
+		case "type":
+			for _, typeName := range strings.Split(value, ",") {
+				msgType, ok := parseMessageType(typeName)
+				if !ok {
+					return rule, fmt.Errorf("unknown message type %s", typeName)
+				}
+				rule.Types = append(rule.Types, msgType)
+			}
+		case "source":
+			rule.SourceName = value
+		case "from":
+			rule.From = value
+		case "to":
+			rule.To = value
+		case "p":
+			probability, err := strconv.ParseFloat(value, 64)
+			if err != nil || probability < 0 || probability > 1 {
+				return rule, fmt.Errorf("probability %s isn't between 0 and 1", value)
+			}
+			rule.Probability = probability
+		default:
+			return rule, fmt.Errorf("unknown field %s", key)
+		}
+	}
+	return rule, nil
+}
+
+func parseMessageType(name string) (MessageType, bool) {
+	for msgType, typeName := range messageTypeNames {
+		if typeName == name {
+			return msgType, true
+		}
+	}
+	return 0, false
+}
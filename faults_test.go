@@ -0,0 +1,144 @@
+package nanodm
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+// deliveries records the messages delivered by a fault injector
+type deliveries struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (de *deliveries) deliver(msgBytes []byte) {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	de.messages = append(de.messages, string(msgBytes))
+}
+
+func (de *deliveries) get() []string {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	return append([]string{}, de.messages...)
+}
+
+func TestFaultInjector(t *testing.T) {
+	ping := &Message{Type: PingMessageType, SourceName: "wifi", Source: "tcp://127.0.0.1:4801"}
+	get := &Message{Type: GetMessageType, SourceName: "wifi", Source: "tcp://127.0.0.1:4800"}
+	serverUrl := "tcp://127.0.0.1:4800"
+
+	// A nil injector delivers the messages
+	var none *FaultInjector
+	delivered := &deliveries{}
+	none.inject(false, serverUrl, ping, []byte("ping"), delivered.deliver)
+	assert.Equal(t, []string{"ping"}, delivered.get())
+
+	// Drop the pings sent from the source, and duplicate the other messages
+	faults := NewFaultInjector(1,
+		FaultRule{Fault: FaultDrop, Types: []MessageType{PingMessageType}, From: "tcp://127.0.0.1:4801"},
+		FaultRule{Fault: FaultDuplicate, To: serverUrl},
+	)
+	delivered = &deliveries{}
+	faults.inject(false, serverUrl, ping, []byte("ping"), delivered.deliver)
+	faults.inject(false, serverUrl, get, []byte("get"), delivered.deliver)
+	faults.inject(false, "tcp://127.0.0.1:4802", get, []byte("other"), delivered.deliver)
+	// The rules apply to the messages sent
+	faults.inject(true, serverUrl, ping, []byte("received"), delivered.deliver)
+	assert.Equal(t, []string{"get", "get", "other", "received"}, delivered.get())
+	assert.Equal(t, 1, faults.Injected(FaultDrop))
+	assert.Equal(t, 1, faults.Injected(FaultDuplicate))
+
+	// Reorder swaps a message with the next one
+	faults.SetRules(FaultRule{Fault: FaultReorder, Types: []MessageType{PingMessageType}, Receive: true})
+	delivered = &deliveries{}
+	faults.inject(true, serverUrl, ping, []byte("first"), delivered.deliver)
+	faults.inject(true, serverUrl, get, []byte("second"), delivered.deliver)
+	assert.Equal(t, []string{"second", "first"}, delivered.get())
+
+	// or delivers it after its delay if there is no next message
+	faults.SetRules(FaultRule{Fault: FaultReorder, Delay: 10 * time.Millisecond})
+	delivered = &deliveries{}
+	faults.inject(false, serverUrl, ping, []byte("alone"), delivered.deliver)
+	assert.Empty(t, delivered.get())
+	assert.Eventually(t, func() bool { return len(delivered.get()) == 1 }, time.Second, time.Millisecond)
+
+	faults.SetRules(FaultRule{Fault: FaultDelay, Delay: 10 * time.Millisecond})
+	delivered = &deliveries{}
+	start := time.Now()
+	faults.inject(false, serverUrl, get, []byte("late"), delivered.deliver)
+	assert.Eventually(t, func() bool { return len(delivered.get()) == 1 }, time.Second, time.Millisecond)
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
+
+	faults.SetRules(FaultRule{Fault: FaultCorrupt})
+	delivered = &deliveries{}
+	faults.inject(false, serverUrl, get, []byte("intact message"), delivered.deliver)
+	assert.Equal(t, 1, len(delivered.get()))
+	assert.NotEqual(t, "intact message", delivered.get()[0])
+
+	// The probability of a rule
+	faults.SetRules(FaultRule{Fault: FaultDrop, Probability: 0.5})
+	delivered = &deliveries{}
+	for i := 0; i < 1000; i++ {
+		faults.inject(false, serverUrl, get, []byte("get"), delivered.deliver)
+	}
+	assert.InDelta(t, 500, len(delivered.get()), 100)
+
+	faults.Clear()
+	faults.Silence("tcp://127.0.0.1:4801")
+	delivered = &deliveries{}
+	faults.inject(false, serverUrl, ping, []byte("ping"), delivered.deliver)
+	faults.inject(false, serverUrl, get, []byte("get"), delivered.deliver)
+	assert.Equal(t, []string{"get"}, delivered.get())
+}
+
+func TestPullerStopDropsDelayed(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	url := "inproc://nanodm/TestPullerStopDropsDelayed"
+
+	pullerChan := make(chan Message)
+	puller := NewPuller(log, url, pullerChan)
+	puller.SetFaultInjector(NewFaultInjector(1, FaultRule{Fault: FaultDelay, Delay: 100 * time.Millisecond, Receive: true}))
+	assert.Nil(t, puller.Start())
+
+	pusherChan := make(chan Message)
+	pusher := NewPusher(log, url, pusherChan)
+	assert.Nil(t, pusher.Start())
+	defer pusher.Stop()
+
+	pusherChan <- Message{Type: GetMessageType, SourceName: "wifi"}
+	assert.Eventually(t, func() bool { return puller.faults.Injected(FaultDelay) == 1 }, time.Second, time.Millisecond)
+	assert.Nil(t, puller.Stop())
+
+	// The message delayed past the stop isn't delivered, nor left waiting
+	// to be
+	<-time.After(200 * time.Millisecond)
+	select {
+	case message := <-pullerChan:
+		t.Errorf("Message delivered after the puller stopped: %+v", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseFaultRules(t *testing.T) {
+	rules, err := ParseFaultRules("drop type=Ping,Ack from=tcp://127.0.0.1:4801 p=0.5; delay=2s receive source=wifi;reorder to=tcp://127.0.0.1:4800")
+	assert.Nil(t, err)
+	assert.Equal(t, []FaultRule{
+		{Fault: FaultDrop, Types: []MessageType{PingMessageType, AckMessageType}, From: "tcp://127.0.0.1:4801", Probability: 0.5},
+		{Fault: FaultDelay, Delay: 2 * time.Second, Receive: true, SourceName: "wifi"},
+		{Fault: FaultReorder, To: "tcp://127.0.0.1:4800"},
+	}, rules)
+
+	rules, err = ParseFaultRules("")
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+
+	for _, spec := range []string{"lose", "delay", "drop type=Pong", "drop p=2", "drop from", "corrupt size=3"} {
+		_, err := ParseFaultRules(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
@@ -4,8 +4,11 @@ go 1.16
 
 require (
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.5.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.6.1
 	github.com/vmihailenco/msgpack/v5 v5.3.4
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+	google.golang.org/protobuf v1.28.1
 	nanomsg.org/go/mangos/v2 v2.0.8
 )
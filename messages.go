@@ -1,7 +1,9 @@
 package nanodm
 
 import (
+	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -22,8 +24,56 @@ const (
 	PingMessageType
 	AddRowMessageType
 	DeleteRowMessageType
+	PrepareMessageType
+	CommitMessageType
+	AbortMessageType
+	SubscribeMessageType
+	UnsubscribeMessageType
+	NotifyMessageType
+	NextLevelMessageType
+	RegistryMessageType
+	CandidateStageMessageType
+	CandidateDiffMessageType
+	CandidateCommitMessageType
+	CandidateConfirmMessageType
+	CandidateDiscardMessageType
 )
 
+var messageTypeNames = map[MessageType]string{
+	RegisterMessageType:         "Register",
+	UnregisterMessageType:       "Unregister",
+	UpdateObjectsMessageType:    "UpdateObjects",
+	SetMessageType:              "Set",
+	GetMessageType:              "Get",
+	AckMessageType:              "Ack",
+	NackMessageType:             "Nack",
+	ListMessagesType:            "List",
+	PingMessageType:             "Ping",
+	AddRowMessageType:           "AddRow",
+	DeleteRowMessageType:        "DeleteRow",
+	PrepareMessageType:          "Prepare",
+	CommitMessageType:           "Commit",
+	AbortMessageType:            "Abort",
+	SubscribeMessageType:        "Subscribe",
+	UnsubscribeMessageType:      "Unsubscribe",
+	NotifyMessageType:           "Notify",
+	NextLevelMessageType:        "NextLevel",
+	RegistryMessageType:         "Registry",
+	CandidateStageMessageType:   "CandidateStage",
+	CandidateDiffMessageType:    "CandidateDiff",
+	CandidateCommitMessageType:  "CandidateCommit",
+	CandidateConfirmMessageType: "CandidateConfirm",
+	CandidateDiscardMessageType: "CandidateDiscard",
+}
+
+// Name returns the name of the message type, for example in metric labels
+func (mt MessageType) Name() string {
+	if name, ok := messageTypeNames[mt]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown(%d)", mt)
+}
+
 type ObjectType uint
 
 const (
@@ -57,14 +107,64 @@ type Object struct {
 	Value         interface{}  `json:"value,omitempty"`
 }
 
+// OperationType is the type of an operation of a transaction
+type OperationType uint
+
+const (
+	OperationSet OperationType = iota
+	OperationAddRow
+	OperationDeleteRow
+)
+
+// RegisteredObject is an object or dynamic list registered with the
+// coordinator, and the name of the source owning it
+type RegisteredObject struct {
+	Object
+	Owner string `json:"owner"`
+}
+
+// Operation is a Set, AddRow or DeleteRow of a transaction
+type Operation struct {
+	Type   OperationType `json:"type"`
+	Object Object        `json:"object"`
+}
+
+// The capabilities a source registers with
+const (
+	// The source takes part in two-phase commit transactions
+	CapabilityTransactions = "transactions"
+	// The client is a controller, which makes requests but doesn't own
+	// objects
+	CapabilityController = "controller"
+)
+
+// MatchesPath returns true if the object `name` is `path`, or is under the
+// partial path `path` (a path ending in ".")
+func MatchesPath(path string, name string) bool {
+	return name == path || (strings.HasSuffix(path, ".") && strings.HasPrefix(name, path))
+}
+
 type Message struct {
-	Type           MessageType `json:"type"`
-	TransactionUID uuid.UUID   `json:"transactionUID,omitempty"`
-	SourceName     string      `json:"sourceName,omitempty"`
-	Source         string      `json:"source,omitempty"`
-	Destination    string      `json:"destination,omitempty"`
-	Objects        []Object    `json:"object,omitempty"`
-	Error          string      `json:"error,omitempty"`
+	Type           MessageType  `json:"type"`
+	TransactionUID uuid.UUID    `json:"transactionUID,omitempty"`
+	SourceName     string       `json:"sourceName,omitempty"`
+	Source         string       `json:"source,omitempty"`
+	Destination    string       `json:"destination,omitempty"`
+	Objects        []Object     `json:"object,omitempty"`
+	Error          string       `json:"error,omitempty"`
+	Errors         []ErrorEntry `json:"errors,omitempty"`
+	TraceParent    string       `json:"traceParent,omitempty"`
+	// The two-phase commit transaction of a prepare, commit or abort
+	TxnID        uuid.UUID   `json:"txnID,omitempty"`
+	Operations   []Operation `json:"operations,omitempty"`
+	Capabilities []string    `json:"capabilities,omitempty"`
+	// The options of a candidate commit: the transaction policy, and the
+	// time to confirm the commit in (unconfirmed if zero)
+	Policy         uint          `json:"policy,omitempty"`
+	ConfirmTimeout time.Duration `json:"confirmTimeout,omitempty"`
+	// The pipe (connection) the message was received on, set by the Puller
+	// and never sent
+	Pipe uint32 `json:"-" msgpack:"-"`
 }
 
 func GetTransactionUID() uuid.UUID {
@@ -74,12 +174,15 @@ func GetTransactionUID() uuid.UUID {
 // A thread save map for tracking transaction IDs
 type ConcurrentMessageMap struct {
 	messages map[string]Message
-	lock     sync.RWMutex
+	// Closed when the message of the key is set, to wake its waiters
+	waiters map[string]chan struct{}
+	lock    sync.RWMutex
 }
 
 func NewConcurrentMessageMap() *ConcurrentMessageMap {
 	return &ConcurrentMessageMap{
 		messages: make(map[string]Message),
+		waiters:  make(map[string]chan struct{}),
 	}
 }
 func (cm *ConcurrentMessageMap) Get(key string) *Message {
@@ -92,33 +195,60 @@ func (cm *ConcurrentMessageMap) Get(key string) *Message {
 }
 
 func (cm *ConcurrentMessageMap) Set(key string, message Message) {
-	cm.lock.RLock()
-	defer cm.lock.RUnlock()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	cm.messages[key] = message
+	if waiter, ok := cm.waiters[key]; ok {
+		close(waiter)
+		delete(cm.waiters, key)
+	}
 }
 
 func (cm *ConcurrentMessageMap) Delete(key string) {
-	cm.lock.RLock()
-	defer cm.lock.RUnlock()
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
 	delete(cm.messages, key)
+	delete(cm.waiters, key)
+}
+
+// waiter returns the message of `key` if it's set, or else a channel that is
+// closed when it is
+func (cm *ConcurrentMessageMap) waiter(key string) (*Message, chan struct{}) {
+	cm.lock.Lock()
+	defer cm.lock.Unlock()
+	if message, ok := cm.messages[key]; ok {
+		return &message, nil
+	}
+	waiter, ok := cm.waiters[key]
+	if !ok {
+		waiter = make(chan struct{})
+		cm.waiters[key] = waiter
+	}
+	return nil, waiter
 }
 
 func (cm *ConcurrentMessageMap) WaitForKey(key string, timeout time.Duration) (*Message, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return cm.WaitForKeyContext(ctx, key)
+}
+
+// WaitForKeyContext waits until the message of `key` is set, and removes it.
+// Returns an error if `ctx` is done first.
+func (cm *ConcurrentMessageMap) WaitForKeyContext(ctx context.Context, key string) (*Message, error) {
 	defer cm.Delete(key)
-	if message := cm.Get(key); message != nil {
+	message, waiter := cm.waiter(key)
+	if message != nil {
 		return message, nil
 	}
-	loopCnt := 0
-	for {
-		loopCnt++
-		select {
-		case <-time.After(time.Duration(loopCnt*500) * time.Millisecond):
-			if message := cm.Get(key); message != nil {
-				return message, nil
-			}
-		case <-time.After(timeout):
-			return nil, fmt.Errorf("timeout waiting for (%s)", key)
+	select {
+	case <-waiter:
+		return cm.Get(key), nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, Errorf(CodeTimeout, "timeout waiting for (%s): %w", key, ctx.Err())
 		}
+		return nil, Errorf(CodeInternal, "stopped waiting for (%s): %w", key, ctx.Err())
 	}
 }
 
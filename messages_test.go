@@ -0,0 +1,45 @@
+package nanodm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForKey(t *testing.T) {
+	cm := NewConcurrentMessageMap()
+
+	// A message set before waiting is returned immediately
+	cm.Set("before", Message{Type: AckMessageType})
+	message, err := cm.WaitForKey("before", time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, AckMessageType, message.Type)
+	assert.Nil(t, cm.Get("before"))
+
+	// A waiter is woken as soon as the message is set
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		cm.Set("after", Message{Type: NackMessageType})
+	}()
+	start := time.Now()
+	message, err = cm.WaitForKey("after", 5*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, NackMessageType, message.Type)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// The timeout is honored
+	start = time.Now()
+	_, err = cm.WaitForKey("never", 100*time.Millisecond)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// As is cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cm.WaitForKeyContext(ctx, "never")
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, cm.waiters)
+}
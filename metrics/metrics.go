@@ -0,0 +1,315 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+ * A minimal set of counters, gauges and histograms written in the Prometheus
+ * text exposition format (version 0.0.4), so nanodm can expose metrics without
+ * depending on the Prometheus client library.
+ */
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultLatencyBuckets are histogram buckets (in seconds) suited to the
+// round-trip latency of requests to a source
+var DefaultLatencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Registry struct {
+	lock    sync.Mutex
+	metrics []*metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: make(map[string]bool),
+	}
+}
+
+// NewCounter registers a counter with the label names `labelNames`
+func (re *Registry) NewCounter(name string, help string, labelNames ...string) *Counter {
+	return &Counter{re.register(name, help, "counter", nil, labelNames)}
+}
+
+// NewGauge registers a gauge with the label names `labelNames`
+func (re *Registry) NewGauge(name string, help string, labelNames ...string) *Gauge {
+	return &Gauge{re.register(name, help, "gauge", nil, labelNames)}
+}
+
+// NewHistogram registers a histogram with the upper bounds `buckets` (sorted
+// in increasing order) and the label names `labelNames`
+func (re *Registry) NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	return &Histogram{re.register(name, help, "histogram", buckets, labelNames)}
+}
+
+func (re *Registry) register(name string, help string, metricType string, buckets []float64, labelNames []string) *metric {
+	re.lock.Lock()
+	defer re.lock.Unlock()
+	if re.names[name] {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	re.names[name] = true
+
+	m := &metric{
+		name:       name,
+		help:       help,
+		metricType: metricType,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+	re.metrics = append(re.metrics, m)
+	return m
+}
+
+// WriteTo writes every registered metric in the Prometheus text format
+func (re *Registry) WriteTo(w io.Writer) (int64, error) {
+	re.lock.Lock()
+	metrics := append([]*metric{}, re.metrics...)
+	re.lock.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.count, err
+}
+
+// ServeHTTP serves the registered metrics, so a registry can be mounted as a
+// /metrics endpoint
+func (re *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	re.WriteTo(w)
+}
+
+type Counter struct {
+	*metric
+}
+
+// Inc increments the counter for the label values `labelValues`
+func (co *Counter) Inc(labelValues ...string) {
+	co.Add(1, labelValues...)
+}
+
+// Add adds `value` (which must not be negative) to the counter
+func (co *Counter) Add(value float64, labelValues ...string) {
+	co.update(labelValues, func(s *series) {
+		s.value += value
+	})
+}
+
+func (co *Counter) Value(labelValues ...string) float64 {
+	return co.value(labelValues)
+}
+
+type Gauge struct {
+	*metric
+}
+
+func (ga *Gauge) Set(value float64, labelValues ...string) {
+	ga.update(labelValues, func(s *series) {
+		s.value = value
+	})
+}
+
+func (ga *Gauge) Inc(labelValues ...string) {
+	ga.Add(1, labelValues...)
+}
+
+func (ga *Gauge) Dec(labelValues ...string) {
+	ga.Add(-1, labelValues...)
+}
+
+func (ga *Gauge) Add(value float64, labelValues ...string) {
+	ga.update(labelValues, func(s *series) {
+		s.value += value
+	})
+}
+
+func (ga *Gauge) Value(labelValues ...string) float64 {
+	return ga.value(labelValues)
+}
+
+type Histogram struct {
+	*metric
+}
+
+// Observe adds the observation `value` to the histogram
+func (hi *Histogram) Observe(value float64, labelValues ...string) {
+	hi.update(labelValues, func(s *series) {
+		if s.bucketCounts == nil {
+			s.bucketCounts = make([]uint64, len(hi.buckets))
+		}
+		for i, upperBound := range hi.buckets {
+			if value <= upperBound {
+				s.bucketCounts[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// Count returns the number of observations for the label values
+func (hi *Histogram) Count(labelValues ...string) uint64 {
+	hi.lock.Lock()
+	defer hi.lock.Unlock()
+	if s, exists := hi.series[seriesKey(labelValues)]; exists {
+		return s.count
+	}
+	return 0
+}
+
+// Sum returns the sum of the observations for the label values
+func (hi *Histogram) Sum(labelValues ...string) float64 {
+	return hi.value(labelValues)
+}
+
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	buckets    []float64
+	labelNames []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues  []string
+	value        float64
+	count        uint64
+	bucketCounts []uint64
+}
+
+// Delete removes the series for the label values, for example once a source
+// is removed
+func (m *metric) Delete(labelValues ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.series, seriesKey(labelValues))
+}
+
+func (m *metric) update(labelValues []string, update func(s *series)) {
+	if len(labelValues) != len(m.labelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.name, len(m.labelNames), len(labelValues)))
+	}
+	key := seriesKey(labelValues)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	s, exists := m.series[key]
+	if !exists {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		m.series[key] = s
+	}
+	update(s)
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if s, exists := m.series[seriesKey(labelValues)]; exists {
+		return s.value
+	}
+	return 0
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.metricType)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.metricType != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labels(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		for i, upperBound := range m.buckets {
+			var bucketCount uint64
+			if s.bucketCounts != nil {
+				bucketCount = s.bucketCounts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(s.labelValues, formatFloat(upperBound)), bucketCount)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labels(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labels(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labels(s.labelValues, ""), s.count)
+	}
+}
+
+// labels formats the label set of a series, adding the "le" label of a
+// histogram bucket if `le` is set
+func (m *metric) labels(labelValues []string, le string) string {
+	var pairs []string
+	for i, labelName := range m.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labelName, escapeLabelValue(labelValues[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+var labelValueEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
+
+type countingWriter struct {
+	w     io.Writer
+	count int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.count += int64(n)
+	return n, err
+}
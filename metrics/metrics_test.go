@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	requests := registry.NewCounter("test_requests_total", "Requests sent.", "type", "source")
+	requests.Inc("Get", "source1")
+	requests.Inc("Get", "source1")
+	requests.Add(3, "Set", "source\"2\"")
+	assert.Equal(t, float64(2), requests.Value("Get", "source1"))
+	assert.Equal(t, float64(0), requests.Value("Get", "source3"))
+
+	inFlight := registry.NewGauge("test_in_flight", "Requests waiting\nfor a response.")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+	assert.Equal(t, float64(1), inFlight.Value())
+
+	latency := registry.NewHistogram("test_duration_seconds", "Round-trip latency.", []float64{0.1, 1}, "source")
+	latency.Observe(0.05, "source1")
+	latency.Observe(0.5, "source1")
+	latency.Observe(5, "source1")
+	assert.Equal(t, uint64(3), latency.Count("source1"))
+	assert.Equal(t, 5.55, latency.Sum("source1"))
+
+	var buf bytes.Buffer
+	n, err := registry.WriteTo(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+	assert.Equal(t, `# HELP test_requests_total Requests sent.
+# TYPE test_requests_total counter
+test_requests_total{type="Get",source="source1"} 2
+test_requests_total{type="Set",source="source\"2\""} 3
+# HELP test_in_flight Requests waiting\nfor a response.
+# TYPE test_in_flight gauge
+test_in_flight 1
+# HELP test_duration_seconds Round-trip latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{source="source1",le="0.1"} 1
+test_duration_seconds_bucket{source="source1",le="1"} 2
+test_duration_seconds_bucket{source="source1",le="+Inf"} 3
+test_duration_seconds_sum{source="source1"} 5.55
+test_duration_seconds_count{source="source1"} 3
+`, buf.String())
+
+	requests.Delete("Get", "source1")
+	assert.Equal(t, float64(0), requests.Value("Get", "source1"))
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, CONTENT_TYPE, recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "test_in_flight 1\n")
+
+	assert.Panics(t, func() { registry.NewGauge("test_in_flight", "Duplicate.") })
+	assert.Panics(t, func() { requests.Inc("Get") })
+}
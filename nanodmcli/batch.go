@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/zackwine/nanodm/controller"
+)
+
+// batchSummary counts the commands of a batch
+type batchSummary struct {
+	Commands  int
+	Succeeded int
+	Failed    int
+	// ExitCode is the exit code of the first command failed
+	ExitCode int
+}
+
+// runBatch runs the get, set, list, add and delete commands read from
+// `input`, one per line, in the session of `ctrl`.  Blank lines and lines
+// starting with "#" are skipped.  A failed command is reported with its
+// line number and the batch goes on.
+func runBatch(ctx context.Context, ctrl *controller.Controller, out *output, input io.Reader) (batchSummary, error) {
+	var summary batchSummary
+	scanner := bufio.NewScanner(input)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		summary.Commands++
+		args, err := splitArgs(line)
+		if err == nil {
+			err = runCommand(ctx, ctrl, out, args[0], args[1:])
+		}
+		if err != nil {
+			out.error(fmt.Errorf("line %d: %w", lineNumber, err))
+			summary.Failed++
+			if summary.ExitCode == EXIT_OK {
+				summary.ExitCode = exitCode(err)
+			}
+			continue
+		}
+		summary.Succeeded++
+	}
+	return summary, scanner.Err()
+}
+
+// splitArgs splits a command line on spaces.  Arguments can be quoted with
+// single or double quotes to contain spaces, and in double quotes "\"" and
+// "\\" escape a quote and a backslash.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, char := range line {
+		switch {
+		case escaped:
+			arg.WriteRune(char)
+			escaped = false
+		case quote == '"' && char == '\\':
+			escaped = true
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			arg.WriteRune(char)
+		case char == '"' || char == '\'':
+			quote = char
+			inArg = true
+		case char == ' ' || char == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(char)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, &usageError{fmt.Sprintf("unterminated quote in %s", line)}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
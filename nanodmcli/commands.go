@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/controller"
+)
+
+// The exit codes of nanodmcli, by class of failure
+const (
+	EXIT_OK            = 0
+	EXIT_USAGE         = 1
+	EXIT_CONNECT       = 2
+	EXIT_NOT_FOUND     = 3
+	EXIT_INVALID_VALUE = 4
+	EXIT_ACCESS_DENIED = 5
+	EXIT_TIMEOUT       = 6
+	EXIT_UNAVAILABLE   = 7
+	EXIT_FAILED        = 8
+	EXIT_DIFFERENT     = 9
+)
+
+// usageError is a command used with the wrong arguments
+type usageError struct {
+	message string
+}
+
+func (ue *usageError) Error() string {
+	return ue.message
+}
+
+// exitCode returns the exit code of the class of `err`
+func exitCode(err error) int {
+	var usageErr *usageError
+	if err == nil {
+		return EXIT_OK
+	} else if errors.As(err, &usageErr) {
+		return EXIT_USAGE
+	}
+
+	switch nanodm.CodeOf(err) {
+	case nanodm.CodeNotFound:
+		return EXIT_NOT_FOUND
+	case nanodm.CodeInvalidValue, nanodm.CodeInvalidType:
+		return EXIT_INVALID_VALUE
+	case nanodm.CodeAccessDenied:
+		return EXIT_ACCESS_DENIED
+	case nanodm.CodeTimeout:
+		return EXIT_TIMEOUT
+	case nanodm.CodeSourceUnavailable:
+		return EXIT_UNAVAILABLE
+	}
+	return EXIT_FAILED
+}
+
+// runCommand runs one of the get, set, list, add and delete commands, and
+// prints its result to `out`
+func runCommand(ctx context.Context, ctrl *controller.Controller, out *output, command string, args []string) error {
+	switch strings.ToLower(command) {
+	case "get":
+		if len(args) == 0 {
+			return &usageError{"usage: get <path>..."}
+		}
+		objects, err := ctrl.Get(ctx, args...)
+		if err != nil {
+			return err
+		}
+		out.objects(objects, false)
+
+	case "list":
+		if len(args) != 1 {
+			return &usageError{"usage: list <path>"}
+		}
+		objects, err := ctrl.List(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		out.objects(objects, true)
+
+	case "set":
+		if len(args) != 2 {
+			return &usageError{"usage: set <path> <value>"}
+		}
+		objects, err := ctrl.Get(ctx, args[0])
+		if err != nil {
+			return err
+		}
+		if len(objects) != 1 {
+			return nanodm.ObjectErrorf(args[0], nanodm.CodeInvalidValue, "%s isn't a single object", args[0])
+		}
+		object := objects[0]
+		object.Value, err = nanodm.ParseValue(object.Type, args[1])
+		if err != nil {
+			return fmt.Errorf("failed to set %s: %w", args[0], err)
+		}
+		return ctrl.Set(ctx, object)
+
+	case "add":
+		if len(args) == 0 {
+			return &usageError{"usage: add <list> [<name>=<value>...]"}
+		}
+		rowValues, err := parseRowValues(args[1:])
+		if err != nil {
+			return err
+		}
+		row, err := ctrl.AddRow(ctx, nanodm.Object{Name: args[0], Type: nanodm.TypeRow, Value: rowValues})
+		if err != nil {
+			return err
+		}
+		out.row(row)
+
+	case "delete":
+		if len(args) != 1 {
+			return &usageError{"usage: delete <row>"}
+		}
+		return ctrl.DeleteRow(ctx, nanodm.Object{Name: args[0], Type: nanodm.TypeRow})
+
+	default:
+		return &usageError{fmt.Sprintf("unknown command %s, must be get/set/list/add/delete", command)}
+	}
+	return nil
+}
+
+// parseRowValues parses the initial values of a row given as <name>=<value>
+func parseRowValues(args []string) (map[string]interface{}, error) {
+	rowValues := make(map[string]interface{})
+	for _, arg := range args {
+		nameValue := strings.SplitN(arg, "=", 2)
+		if len(nameValue) != 2 {
+			return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "invalid row value %s, must be <name>=<value>", arg)
+		}
+		rowValues[nameValue[0]] = nameValue[1]
+	}
+	return rowValues, nil
+}
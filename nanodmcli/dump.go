@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/controller"
+)
+
+// snapshot is a dump of the objects registered under a prefix, with their
+// values
+type snapshot struct {
+	Time    time.Time   `json:"time"`
+	Server  string      `json:"server"`
+	Prefix  string      `json:"prefix"`
+	Objects []dumpEntry `json:"objects"`
+}
+
+// dumpEntry is an object of a snapshot.  The value is in its TR-106 string
+// form, so snapshots compare the same once written and read back.
+type dumpEntry struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Access string `json:"access"`
+	Owner  string `json:"owner"`
+	Value  string `json:"value"`
+	// Error is set instead of the value if the object failed to be gotten
+	Error string `json:"error,omitempty"`
+}
+
+// snapshotDiff is the difference between two snapshots
+type snapshotDiff struct {
+	Added   []dumpEntry   `json:"added"`
+	Removed []dumpEntry   `json:"removed"`
+	Changed []entryChange `json:"changed"`
+}
+
+type entryChange struct {
+	Name string    `json:"name"`
+	Old  dumpEntry `json:"old"`
+	New  dumpEntry `json:"new"`
+}
+
+func (sd *snapshotDiff) empty() bool {
+	return len(sd.Added) == 0 && len(sd.Removed) == 0 && len(sd.Changed) == 0
+}
+
+// takeSnapshot dumps the objects registered under `prefix`, or the whole
+// model if it's empty, and the rows of the dynamic lists there.  The values
+// are gotten source by source, and an object that fails to be gotten is
+// dumped with its error.
+func takeSnapshot(ctx context.Context, ctrl *controller.Controller, server string, prefix string) (*snapshot, error) {
+	registered, err := ctrl.Registry(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{Time: time.Now().UTC(), Server: server, Prefix: prefix, Objects: []dumpEntry{}}
+	owned := make(map[string][]nanodm.RegisteredObject)
+	dynamicLists := make(map[string]int)
+	var owners []string
+	for _, regObject := range registered {
+		// The dynamic lists are dumped without a value, followed by their rows
+		if regObject.Type == nanodm.TypeDynamicList {
+			dynamicLists[regObject.Name] = len(snap.Objects)
+			snap.Objects = append(snap.Objects, newDumpEntry(regObject, nil, nil))
+		}
+		if _, exists := owned[regObject.Owner]; !exists {
+			owners = append(owners, regObject.Owner)
+		}
+		owned[regObject.Owner] = append(owned[regObject.Owner], regObject)
+	}
+
+	for _, owner := range owners {
+		var names []string
+		for _, regObject := range owned[owner] {
+			names = append(names, regObject.Name)
+		}
+		objects, err := ctrl.Get(ctx, names...)
+		if err != nil {
+			// Get the objects one by one to dump the others
+			objects = nil
+			for _, regObject := range owned[owner] {
+				gotten, err := ctrl.Get(ctx, regObject.Name)
+				if err != nil && regObject.Type == nanodm.TypeDynamicList {
+					// The error of the rows goes to the list already dumped
+					snap.Objects[dynamicLists[regObject.Name]].Error = err.Error()
+					continue
+				} else if err != nil {
+					snap.Objects = append(snap.Objects, newDumpEntry(regObject, nil, err))
+					continue
+				}
+				objects = append(objects, gotten...)
+			}
+		}
+
+		for _, object := range objects {
+			if object.Type == nanodm.TypeDynamicList {
+				continue
+			}
+			snap.Objects = append(snap.Objects, newDumpEntry(registrationOf(owned[owner], object), &object, nil))
+		}
+	}
+
+	sort.Slice(snap.Objects, func(i, j int) bool {
+		return snap.Objects[i].Name < snap.Objects[j].Name
+	})
+	return snap, nil
+}
+
+// registrationOf returns the registration of the object gotten `object`:
+// its own or the one of the dynamic list of its row
+func registrationOf(registered []nanodm.RegisteredObject, object nanodm.Object) nanodm.RegisteredObject {
+	var dynamicList *nanodm.RegisteredObject
+	for i, regObject := range registered {
+		if regObject.Name == object.Name {
+			return regObject
+		}
+		if regObject.Type == nanodm.TypeDynamicList && strings.HasPrefix(object.Name, regObject.Name) &&
+			(dynamicList == nil || len(regObject.Name) > len(dynamicList.Name)) {
+			dynamicList = &registered[i]
+		}
+	}
+	if dynamicList != nil {
+		return nanodm.RegisteredObject{Object: nanodm.Object{Name: object.Name, Access: dynamicList.Access, Type: object.Type}, Owner: dynamicList.Owner}
+	}
+	return nanodm.RegisteredObject{Object: object}
+}
+
+func newDumpEntry(regObject nanodm.RegisteredObject, object *nanodm.Object, err error) dumpEntry {
+	entry := dumpEntry{
+		Name:   regObject.Name,
+		Type:   regObject.Type.String(),
+		Access: accessName(regObject.Access),
+		Owner:  regObject.Owner,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if object != nil {
+		entry.Value = nanodm.FormatValue(object.Value)
+	}
+	return entry
+}
+
+// loadSnapshot reads a snapshot written by dump
+func loadSnapshot(path string) (*snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	snap := &snapshot{}
+	if err := json.NewDecoder(file).Decode(snap); err != nil {
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "invalid snapshot %s: %v", path, err)
+	} else if snap.Objects == nil {
+		return nil, nanodm.Errorf(nanodm.CodeInvalidValue, "invalid snapshot %s: no objects", path)
+	}
+	return snap, nil
+}
+
+// diffSnapshots returns the objects added, removed and changed from the
+// snapshot `from` to the snapshot `to`, in name order
+func diffSnapshots(from *snapshot, to *snapshot) *snapshotDiff {
+	diff := &snapshotDiff{Added: []dumpEntry{}, Removed: []dumpEntry{}, Changed: []entryChange{}}
+	fromEntries := make(map[string]dumpEntry, len(from.Objects))
+	for _, entry := range from.Objects {
+		fromEntries[entry.Name] = entry
+	}
+	toEntries := make(map[string]dumpEntry, len(to.Objects))
+	for _, entry := range to.Objects {
+		toEntries[entry.Name] = entry
+		fromEntry, existed := fromEntries[entry.Name]
+		if !existed {
+			diff.Added = append(diff.Added, entry)
+		} else if fromEntry != entry {
+			diff.Changed = append(diff.Changed, entryChange{Name: entry.Name, Old: fromEntry, New: entry})
+		}
+	}
+	for _, entry := range from.Objects {
+		if _, exists := toEntries[entry.Name]; !exists {
+			diff.Removed = append(diff.Removed, entry)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Name < diff.Added[j].Name })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Name < diff.Removed[j].Name })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Name < diff.Changed[j].Name })
+	return diff
+}
+
+// snapshot prints a snapshot, in the json format as the file diff reads
+func (ou *output) snapshot(snap *snapshot) {
+	switch ou.format {
+	case FORMAT_JSON:
+		jsonBytes, _ := json.MarshalIndent(snap, "", "  ")
+		fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+	case FORMAT_JSONL:
+		for _, entry := range snap.Objects {
+			jsonBytes, _ := json.Marshal(entry)
+			fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+		}
+	case FORMAT_KV:
+		for _, entry := range snap.Objects {
+			fmt.Fprintf(ou.out, "%s=%s\n", entry.Name, entry.Value)
+		}
+	case FORMAT_TABLE:
+		table := tabwriter.NewWriter(ou.out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(table, "NAME\tTYPE\tACCESS\tOWNER\tVALUE")
+		for _, entry := range snap.Objects {
+			value := entry.Value
+			if entry.Error != "" {
+				value = "error: " + entry.Error
+			}
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", entry.Name, entry.Type, entry.Access, entry.Owner, value)
+		}
+		table.Flush()
+	case FORMAT_XML:
+		var objects []nanodm.Object
+		for _, entry := range snap.Objects {
+			objectType, _ := nanodm.ParseObjectType(entry.Type)
+			objects = append(objects, nanodm.Object{Name: entry.Name, Type: objectType, Value: entry.Value})
+		}
+		ou.objects(objects, false)
+	}
+}
+
+// diff prints the difference between snapshots.  The text formats print a
+// line per object: "+" added, "-" removed and "~" changed.
+func (ou *output) diff(diff *snapshotDiff) {
+	switch ou.format {
+	case FORMAT_JSON:
+		jsonBytes, _ := json.MarshalIndent(diff, "", "  ")
+		fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+	case FORMAT_JSONL:
+		type diffLine struct {
+			Change string     `json:"change"`
+			Name   string     `json:"name"`
+			Old    *dumpEntry `json:"old,omitempty"`
+			New    *dumpEntry `json:"new,omitempty"`
+		}
+		var lines []diffLine
+		for i := range diff.Added {
+			lines = append(lines, diffLine{Change: "added", Name: diff.Added[i].Name, New: &diff.Added[i]})
+		}
+		for i := range diff.Removed {
+			lines = append(lines, diffLine{Change: "removed", Name: diff.Removed[i].Name, Old: &diff.Removed[i]})
+		}
+		for i := range diff.Changed {
+			lines = append(lines, diffLine{Change: "changed", Name: diff.Changed[i].Name, Old: &diff.Changed[i].Old, New: &diff.Changed[i].New})
+		}
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].Name < lines[j].Name })
+		for _, line := range lines {
+			jsonBytes, _ := json.Marshal(line)
+			fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+		}
+	default:
+		var lines []string
+		for _, entry := range diff.Added {
+			lines = append(lines, "+ "+formatEntry(entry))
+		}
+		for _, entry := range diff.Removed {
+			lines = append(lines, "- "+formatEntry(entry))
+		}
+		for _, change := range diff.Changed {
+			lines = append(lines, "~ "+formatEntryChange(change))
+		}
+		// Sorted by name, after the change mark
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i][2:] < lines[j][2:] })
+		for _, line := range lines {
+			fmt.Fprintln(ou.out, line)
+		}
+	}
+}
+
+func formatEntry(entry dumpEntry) string {
+	if entry.Error != "" {
+		return fmt.Sprintf("%s (%s, %s, %s) error: %s", entry.Name, entry.Type, entry.Access, entry.Owner, entry.Error)
+	}
+	return fmt.Sprintf("%s (%s, %s, %s) = %q", entry.Name, entry.Type, entry.Access, entry.Owner, entry.Value)
+}
+
+// formatEntryChange formats the fields of an object that changed
+func formatEntryChange(change entryChange) string {
+	var changes []string
+	formatField := func(field string, old string, new string) {
+		if old != new {
+			changes = append(changes, fmt.Sprintf("%s %q -> %q", field, old, new))
+		}
+	}
+	formatField("value", change.Old.Value, change.New.Value)
+	formatField("error", change.Old.Error, change.New.Error)
+	formatField("type", change.Old.Type, change.New.Type)
+	formatField("access", change.Old.Access, change.New.Access)
+	formatField("owner", change.Old.Owner, change.New.Owner)
+	return change.Name + ": " + strings.Join(changes, ", ")
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	HISTORY_SIZE = 500
+)
+
+// lineEditor reads the lines of the shell.  On a terminal it edits the line
+// key by key, with history and tab completion, otherwise it reads plain lines.
+type lineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	terminal bool
+	prompt   string
+	history  []string
+	// complete returns the candidates for the last word of `line`
+	complete func(line string) []string
+
+	line []rune
+	pos  int
+}
+
+func newLineEditor(prompt string, complete func(line string) []string) *lineEditor {
+	le := &lineEditor{
+		in:       bufio.NewReader(os.Stdin),
+		out:      os.Stdout,
+		fd:       int(os.Stdin.Fd()),
+		prompt:   prompt,
+		complete: complete,
+	}
+	// The terminal is only put in raw mode while reading, this checks it can be
+	if restore, err := makeRaw(le.fd); err == nil {
+		restore()
+		le.terminal = true
+	}
+	return le
+}
+
+// readLine reads a line, returning io.EOF on Ctrl-D or the end of the input
+func (le *lineEditor) readLine() (string, error) {
+	if !le.terminal {
+		fmt.Fprint(le.out, le.prompt)
+		line, err := le.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	restore, err := makeRaw(le.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	le.line = nil
+	le.pos = 0
+	historyIndex := len(le.history)
+	editing := ""
+	le.redraw()
+
+	for {
+		key, _, err := le.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch key {
+		case '\r', '\n':
+			fmt.Fprint(le.out, "\n")
+			line := string(le.line)
+			le.addHistory(line)
+			return line, nil
+		case 3: // Ctrl-C drops the line
+			fmt.Fprint(le.out, "^C\n")
+			return "", nil
+		case 4: // Ctrl-D
+			if len(le.line) == 0 {
+				fmt.Fprint(le.out, "\n")
+				return "", io.EOF
+			}
+			le.deleteAt(le.pos)
+		case 127, 8:
+			if le.pos > 0 {
+				le.pos--
+				le.deleteAt(le.pos)
+			}
+		case 1: // Ctrl-A
+			le.pos = 0
+		case 5: // Ctrl-E
+			le.pos = len(le.line)
+		case 21: // Ctrl-U
+			le.line = le.line[le.pos:]
+			le.pos = 0
+		case '\t':
+			le.completeWord()
+		case 27:
+			switch le.readEscape() {
+			case 'A':
+				if historyIndex > 0 {
+					if historyIndex == len(le.history) {
+						editing = string(le.line)
+					}
+					historyIndex--
+					le.setLine(le.history[historyIndex])
+				}
+			case 'B':
+				if historyIndex < len(le.history) {
+					historyIndex++
+					if historyIndex == len(le.history) {
+						le.setLine(editing)
+					} else {
+						le.setLine(le.history[historyIndex])
+					}
+				}
+			case 'C':
+				if le.pos < len(le.line) {
+					le.pos++
+				}
+			case 'D':
+				if le.pos > 0 {
+					le.pos--
+				}
+			case 'H':
+				le.pos = 0
+			case 'F':
+				le.pos = len(le.line)
+			case '3':
+				le.deleteAt(le.pos)
+			}
+		default:
+			if key >= ' ' {
+				le.line = append(le.line[:le.pos], append([]rune{key}, le.line[le.pos:]...)...)
+				le.pos++
+			}
+		}
+		le.redraw()
+	}
+}
+
+// waitKey waits until a key, or a line when not on a terminal, is entered
+func (le *lineEditor) waitKey() {
+	if !le.terminal {
+		le.in.ReadString('\n')
+		return
+	}
+	if restore, err := makeRaw(le.fd); err == nil {
+		defer restore()
+	}
+	le.in.ReadRune()
+}
+
+// readEscape reads the rest of an escape sequence, returning the key of the
+// arrows (A-D), home (H), end (F) and delete (3)
+func (le *lineEditor) readEscape() rune {
+	next, _, err := le.in.ReadRune()
+	if err != nil || (next != '[' && next != 'O') {
+		return 0
+	}
+	key, _, err := le.in.ReadRune()
+	if err != nil {
+		return 0
+	}
+	// Sequences such as "ESC [ 3 ~" end with a tilde
+	for parameter := key; parameter >= '0' && parameter <= '9'; {
+		parameter, _, err = le.in.ReadRune()
+		if err != nil {
+			return 0
+		}
+	}
+	return key
+}
+
+func (le *lineEditor) deleteAt(pos int) {
+	if pos < len(le.line) {
+		le.line = append(le.line[:pos], le.line[pos+1:]...)
+	}
+}
+
+func (le *lineEditor) setLine(line string) {
+	le.line = []rune(line)
+	le.pos = len(le.line)
+}
+
+// redraw draws the prompt and the line, and moves the cursor to its position
+func (le *lineEditor) redraw() {
+	fmt.Fprintf(le.out, "\r%s%s\x1b[K", le.prompt, string(le.line))
+	if back := len(le.line) - le.pos; back > 0 {
+		fmt.Fprintf(le.out, "\x1b[%dD", back)
+	}
+}
+
+// completeWord completes the word before the cursor.  A single candidate
+// replaces the word, several extend it to their common prefix or else are
+// listed.
+func (le *lineEditor) completeWord() {
+	if le.complete == nil {
+		return
+	}
+	before := string(le.line[:le.pos])
+	word := before[strings.LastIndex(before, " ")+1:]
+	candidates := le.complete(before)
+	if len(candidates) == 0 {
+		return
+	}
+
+	completion := candidates[0]
+	for _, candidate := range candidates[1:] {
+		completion = commonPrefix(completion, candidate)
+	}
+	if len(candidates) == 1 && !strings.HasSuffix(completion, ".") {
+		completion += " "
+	}
+	if completion == word && len(candidates) > 1 {
+		fmt.Fprintf(le.out, "\n%s\n", strings.Join(candidates, "  "))
+		return
+	}
+
+	inserted := []rune(strings.TrimPrefix(completion, word))
+	le.line = append(le.line[:le.pos], append(inserted, le.line[le.pos:]...)...)
+	le.pos += len(inserted)
+}
+
+func commonPrefix(a string, b string) string {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[:i]
+		}
+	}
+	if len(a) < len(b) {
+		return a
+	}
+	return b
+}
+
+func (le *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(le.history) > 0 && le.history[len(le.history)-1] == line) {
+		return
+	}
+	le.history = append(le.history, line)
+	if len(le.history) > HISTORY_SIZE {
+		le.history = le.history[len(le.history)-HISTORY_SIZE:]
+	}
+}
+
+// loadHistory loads the history saved by saveHistory to `path`
+func (le *lineEditor) loadHistory(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		le.addHistory(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// saveHistory saves the last HISTORY_SIZE lines of the history to `path`
+func (le *lineEditor) saveHistory(path string) error {
+	return os.WriteFile(path, []byte(strings.Join(le.history, "\n")+"\n"), 0600)
+}
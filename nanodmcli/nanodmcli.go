@@ -1,49 +1,56 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
-	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 	"github.com/zackwine/nanodm"
-	"github.com/zackwine/nanodm/source"
+	"github.com/zackwine/nanodm/controller"
 )
 
 const (
 	VERBOSE = false
 
 	NANODM_URL = "tcp://127.0.0.1:4800"
-	SOURCE_URL = "tcp://127.0.0.1:4803"
+
+	CONNECT_TIMEOUT = 15 * time.Second
 )
 
 var (
 	verbose   = flag.Bool("v", VERBOSE, "If enable let logging level to DEBUG (Normally WARN)")
 	nanoURL   = flag.String("n", NANODM_URL, "Nanodm server URL.")
-	sourceURL = flag.String("s", SOURCE_URL, "Nanodm source URL.")
+	listenURL = flag.String("l", controller.DefaultListenUrl, "URL to listen on for replies.  Port 0 uses a free port.")
+	interval  = flag.Duration("i", 0, "Watch by polling at this interval (e.g. 5s), for sources that don't notify their changes.")
+	format    = flag.String("o", FORMAT_JSON, "Output format: json, jsonl, kv (name=value), table or xml (CWMP).  Watch prints JSON lines with jsonl.")
 )
 
 func main() {
 
 	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage %s [flags] <get/set> <path> [<set-value>]:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage %s [flags] <get/set/list/add/delete/watch> <path> [<set-value> | <name>=<value>... | <path>...]:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "      %s [flags] batch [<file>]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "      %s [flags] dump [<prefix>]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "      %s [flags] diff <snapshot> [<snapshot>]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "      %s [flags] shell\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.Parse()
-	if flag.NArg() < 2 {
+	if flag.NArg() < 1 || (flag.NArg() < 2 && flag.Arg(0) != "shell" && flag.Arg(0) != "batch" && flag.Arg(0) != "dump") {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(EXIT_USAGE)
 	}
 
-	command := flag.Arg(0)
-	path := flag.Arg(1)
-	setVal := flag.Arg(2)
+	command := strings.ToLower(flag.Arg(0))
+	args := flag.Args()[1:]
 
 	logger := logrus.New()
 	log := logrus.NewEntry(logger)
@@ -61,118 +68,152 @@ func main() {
 
 	log.Debugf("Starting nanodmcli (%s)", runtime.GOOS)
 
-	if command != "get" && command != "set" && command != "list" {
-		fmt.Fprintf(flag.CommandLine.Output(), "Invalid command %s used.  Must be get/set/list.\n\n", command)
+	if command != "get" && command != "set" && command != "list" && command != "add" && command != "delete" && command != "watch" && command != "batch" && command != "dump" && command != "diff" && command != "shell" {
+		fmt.Fprintf(flag.CommandLine.Output(), "Invalid command %s used.  Must be get/set/list/add/delete/watch/batch/dump/diff/shell.\n\n", command)
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(EXIT_USAGE)
 	}
 
-	sourceUUID := uuid.New()
-	sourceName := fmt.Sprintf("nanodmcli-%s", sourceUUID.String())
+	out, err := newOutput(*format, os.Stdout, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(flag.CommandLine.Output(), "%v\n\n", err)
+		flag.Usage()
+		os.Exit(EXIT_USAGE)
+	}
 
-	source := source.NewSource(log.WithField("source", sourceName), sourceName, *nanoURL, *sourceURL, nil)
+	// The batch is opened before connecting, so a missing file fails fast
+	input := os.Stdin
+	if command == "batch" && len(args) > 0 && args[0] != "-" {
+		input, err = os.Open(args[0])
+		if err != nil {
+			out.error(err)
+			os.Exit(EXIT_USAGE)
+		}
+		defer input.Close()
+	}
 
-	// Connect
-	err := source.Connect()
-	if err != nil {
-		log.Errorf("Failed to connect client: %v", err)
-		return
+	// Two snapshots are compared without connecting
+	var fromSnapshot *snapshot
+	if command == "diff" {
+		if len(args) > 2 {
+			flag.Usage()
+			os.Exit(EXIT_USAGE)
+		}
+		fromSnapshot, err = loadSnapshot(args[0])
+		if err == nil && len(args) == 2 {
+			var toSnapshot *snapshot
+			if toSnapshot, err = loadSnapshot(args[1]); err == nil {
+				os.Exit(printDiff(out, fromSnapshot, toSnapshot))
+			}
+		}
+		if err != nil {
+			out.error(err)
+			os.Exit(EXIT_USAGE)
+		}
 	}
-	defer func() {
-		source.Disconnect()
-	}()
 
-	// Call register to update the list of objects the source owns
-	err = source.Register(nil)
+	ctrl := controller.NewController(log, *nanoURL)
+	ctrl.SetListenUrl(*listenURL)
+
+	// Connect, the pusher dials until the server is up so it's bounded here
+	connected := make(chan error, 1)
+	go func() {
+		connected <- ctrl.Connect()
+	}()
+	select {
+	case err = <-connected:
+	case <-time.After(CONNECT_TIMEOUT):
+		err = nanodm.Errorf(nanodm.CodeTimeout, "no answer after %v", CONNECT_TIMEOUT)
+	}
 	if err != nil {
-		log.Errorf("Failed to register client: %v", err)
-		return
+		out.error(fmt.Errorf("failed to connect to %s: %w", *nanoURL, err))
+		os.Exit(EXIT_CONNECT)
 	}
+	ctx := context.Background()
 
-	switch strings.ToLower(command) {
-	case "get":
-		objects, err := source.GetObjects([]nanodm.Object{{
-			Name: path,
-		}})
+	code := EXIT_OK
+	switch command {
+	case "shell":
+		code = newShell(ctrl, out).run()
+
+	case "batch":
+		summary, err := runBatch(ctx, ctrl, out, input)
 		if err != nil {
-			fmt.Printf("{\"error\": \"%v\"}\n", err)
-		} else {
-			if len(objects) == 1 {
-				jsonBytes, err := json.MarshalIndent(objects[0], "", "  ")
-				if err != nil {
-					fmt.Printf("{\"error\": \"%v\"}\n", err)
-				}
-				fmt.Printf("%s\n", jsonBytes)
-			} else {
-				jsonBytes, err := json.MarshalIndent(objects, "", "  ")
-				if err != nil {
-					fmt.Printf("{\"error\": \"%v\"}\n", err)
-				}
-				fmt.Printf("%s\n", jsonBytes)
-			}
+			out.error(fmt.Errorf("failed to read the batch: %w", err))
+			summary.ExitCode = EXIT_USAGE
+		}
+		fmt.Fprintf(os.Stderr, "%d commands, %d succeeded, %d failed\n", summary.Commands, summary.Succeeded, summary.Failed)
+		code = summary.ExitCode
 
+	case "dump":
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		snap, err := takeSnapshot(ctx, ctrl, *nanoURL, prefix)
+		if err != nil {
+			out.error(err)
+			code = exitCode(err)
+		} else {
+			out.snapshot(snap)
 		}
 
-	case "list":
-		objects, err := source.ListObjects([]nanodm.Object{{
-			Name: path,
-		}})
+	case "diff":
+		// Compare the snapshot with the live objects under its prefix
+		snap, err := takeSnapshot(ctx, ctrl, *nanoURL, fromSnapshot.Prefix)
 		if err != nil {
-			fmt.Printf("{\"error\": \"%v\"}\n", err)
+			out.error(err)
+			code = exitCode(err)
 		} else {
-			jsonBytes, err := json.MarshalIndent(objects, "", "  ")
-			if err != nil {
-				fmt.Printf("{\"error\": \"%v\"}\n", err)
-			}
-			fmt.Printf("%s\n", jsonBytes)
+			code = printDiff(out, fromSnapshot, snap)
 		}
 
-	case "set":
-		if flag.NArg() != 3 {
-			flag.Usage()
-			os.Exit(1)
+	case "watch":
+		// Stream the changes until interrupted
+		stop := make(chan struct{})
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			close(stop)
+		}()
+		report := func(watched change) {
+			printChange(watched, *format == FORMAT_JSONL)
 		}
-		objects, err := source.GetObjects([]nanodm.Object{{
-			Name: path,
-		}})
-		if err != nil {
-			fmt.Printf("{\"error\": \"%v\"}\n", err)
+
+		if *interval > 0 {
+			err = watchPoll(ctx, ctrl, args, *interval, stop, report)
 		} else {
-			if len(objects) == 1 {
-				setobj := objects[0]
-				switch setobj.Type {
-				case nanodm.TypeInt, nanodm.TypeLong:
-					intVar, err := strconv.ParseInt(setVal, 0, 64)
-					if err != nil {
-						fmt.Printf("{\"error\": \"%v\"}\n", err)
-						return
-					}
-					setobj.Value = intVar
-				case nanodm.TypeUnsignedInt, nanodm.TypeUnsignedLong:
-					uintVar, err := strconv.ParseUint(setVal, 0, 64)
-					if err != nil {
-						fmt.Printf("{\"error\": \"%v\"}\n", err)
-						return
-					}
-					setobj.Value = uintVar
-				case nanodm.TypeFloat:
-					floatVar, err := strconv.ParseFloat(setVal, 64)
-					if err != nil {
-						fmt.Printf("{\"error\": \"%v\"}\n", err)
-						return
-					}
-					setobj.Value = floatVar
-				default:
-					setobj.Value = setVal
-				}
-
-				source.SetObject(setobj)
-			} else {
-				fmt.Printf("{\"error\": \"%v\"}\n", err)
-				return
+			var subscription *controller.Subscription
+			subscription, err = ctrl.Subscribe(ctx, args...)
+			if err == nil {
+				err = watchSubscription(ctx, subscription, stop, report)
 			}
 		}
+		if err != nil {
+			out.error(err)
+			code = exitCode(err)
+		}
 
+	default:
+		err = runCommand(ctx, ctrl, out, command, args)
+		if err != nil {
+			out.error(err)
+			code = exitCode(err)
+		}
 	}
 
+	ctrl.Close()
+	os.Exit(code)
+}
+
+// printDiff prints the difference between snapshots, and returns the exit
+// code telling if they differ
+func printDiff(out *output, from *snapshot, to *snapshot) int {
+	diff := diffSnapshots(from, to)
+	out.diff(diff)
+	if diff.empty() {
+		return EXIT_OK
+	}
+	return EXIT_DIFFERENT
 }
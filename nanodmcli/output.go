@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/zackwine/nanodm"
+)
+
+const (
+	FORMAT_JSON  = "json"
+	FORMAT_JSONL = "jsonl"
+	FORMAT_KV    = "kv"
+	FORMAT_TABLE = "table"
+	FORMAT_XML   = "xml"
+)
+
+var outputFormats = []string{FORMAT_JSON, FORMAT_JSONL, FORMAT_KV, FORMAT_TABLE, FORMAT_XML}
+
+// output prints the results of the commands in one of the output formats.
+// The results go to `out`, and so do the errors of the JSON and XML formats
+// so that they stay parsable, the errors of the text formats go to `errOut`.
+type output struct {
+	format string
+	out    io.Writer
+	errOut io.Writer
+}
+
+func newOutput(format string, out io.Writer, errOut io.Writer) (*output, error) {
+	for _, known := range outputFormats {
+		if format == known {
+			return &output{format: format, out: out, errOut: errOut}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid output format %s, must be one of %s", format, strings.Join(outputFormats, "/"))
+}
+
+// objects prints the objects of a get, or with `listing` the registered
+// objects of a list, which have an access but no value
+func (ou *output) objects(objects []nanodm.Object, listing bool) {
+	switch ou.format {
+	case FORMAT_JSON:
+		// A get of a single object prints the object rather than an array
+		var jsonBytes []byte
+		if len(objects) == 1 && !listing {
+			jsonBytes, _ = json.MarshalIndent(objects[0], "", "  ")
+		} else {
+			if objects == nil {
+				objects = []nanodm.Object{}
+			}
+			jsonBytes, _ = json.MarshalIndent(objects, "", "  ")
+		}
+		fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+
+	case FORMAT_JSONL:
+		for _, object := range objects {
+			jsonBytes, _ := json.Marshal(object)
+			fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+		}
+
+	case FORMAT_KV:
+		for _, object := range objects {
+			if listing {
+				fmt.Fprintln(ou.out, object.Name)
+			} else {
+				fmt.Fprintf(ou.out, "%s=%s\n", object.Name, nanodm.FormatValue(object.Value))
+			}
+		}
+
+	case FORMAT_TABLE:
+		table := tabwriter.NewWriter(ou.out, 0, 4, 2, ' ', 0)
+		if listing {
+			fmt.Fprintln(table, "NAME\tTYPE\tACCESS")
+			for _, object := range objects {
+				fmt.Fprintf(table, "%s\t%s\t%s\n", object.Name, object.Type, accessName(object.Access))
+			}
+		} else {
+			fmt.Fprintln(table, "NAME\tTYPE\tVALUE")
+			for _, object := range objects {
+				fmt.Fprintf(table, "%s\t%s\t%s\n", object.Name, object.Type, nanodm.FormatValue(object.Value))
+			}
+		}
+		table.Flush()
+
+	case FORMAT_XML:
+		// The structures of the CWMP GetParameterValues and GetParameterNames
+		// responses
+		if listing {
+			type parameterInfo struct {
+				Name     string
+				Writable bool
+			}
+			list := struct {
+				XMLName    xml.Name        `xml:"ParameterList"`
+				Parameters []parameterInfo `xml:"ParameterInfoStruct"`
+			}{}
+			for _, object := range objects {
+				list.Parameters = append(list.Parameters, parameterInfo{Name: object.Name, Writable: object.Access == nanodm.AccessRW})
+			}
+			ou.printXML(list)
+		} else {
+			type value struct {
+				Type  string `xml:"xsi:type,attr"`
+				Value string `xml:",chardata"`
+			}
+			type parameterValue struct {
+				Name  string
+				Value value
+			}
+			list := struct {
+				XMLName    xml.Name         `xml:"ParameterList"`
+				Parameters []parameterValue `xml:"ParameterValueStruct"`
+			}{}
+			for _, object := range objects {
+				list.Parameters = append(list.Parameters, parameterValue{Name: object.Name, Value: value{Type: xsdType(object.Type), Value: nanodm.FormatValue(object.Value)}})
+			}
+			ou.printXML(list)
+		}
+	}
+}
+
+// row prints the name of a row added
+func (ou *output) row(row string) {
+	switch ou.format {
+	case FORMAT_JSON, FORMAT_JSONL:
+		jsonBytes, _ := json.Marshal(map[string]string{"row": row})
+		fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+	case FORMAT_KV:
+		fmt.Fprintf(ou.out, "row=%s\n", row)
+	case FORMAT_TABLE:
+		fmt.Fprintf(ou.out, "ROW\n%s\n", row)
+	case FORMAT_XML:
+		// The CWMP AddObject response
+		segments := strings.Split(strings.TrimSuffix(row, "."), ".")
+		instance, _ := strconv.ParseUint(segments[len(segments)-1], 10, 32)
+		ou.printXML(struct {
+			XMLName        xml.Name `xml:"AddObjectResponse"`
+			InstanceNumber uint64
+			Status         int
+		}{InstanceNumber: instance})
+	}
+}
+
+// error prints `err` with its code
+func (ou *output) error(err error) {
+	code := nanodm.CodeOf(err)
+	switch ou.format {
+	case FORMAT_JSON, FORMAT_JSONL:
+		jsonBytes, _ := json.Marshal(struct {
+			Error string `json:"error"`
+			Code  uint32 `json:"code"`
+		}{Error: err.Error(), Code: code.USPCode()})
+		fmt.Fprintf(ou.out, "%s\n", jsonBytes)
+	case FORMAT_XML:
+		// The CWMP fault
+		ou.printXML(struct {
+			XMLName     xml.Name `xml:"Fault"`
+			FaultCode   int
+			FaultString string
+		}{FaultCode: code.CWMPCode(), FaultString: err.Error()})
+	default:
+		fmt.Fprintf(ou.errOut, "error: %v\n", err)
+	}
+}
+
+func (ou *output) printXML(v interface{}) {
+	xmlBytes, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintf(ou.errOut, "error: %v\n", err)
+		return
+	}
+	fmt.Fprintf(ou.out, "%s\n", xmlBytes)
+}
+
+func accessName(access nanodm.ObjectAccess) string {
+	if access == nanodm.AccessRO {
+		return "ro"
+	}
+	return "rw"
+}
+
+// xsdType returns the xsi:type of an object type
+func xsdType(objectType nanodm.ObjectType) string {
+	if !objectType.IsValue() {
+		return "xsd:string"
+	}
+	return "xsd:" + objectType.String()
+}
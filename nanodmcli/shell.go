@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zackwine/nanodm/controller"
+)
+
+const (
+	SHELL_PROMPT = "nanodm> "
+	HISTORY_FILE = ".nanodmcli_history"
+	SHELL_HELP   = `Commands:
+  get <path>...                   Get the objects, and the objects and rows under partial paths
+  set <path> <value>              Set an object, the value is parsed as the object's type
+  list <path>                     List the registered objects under a partial path
+  add <list> [<name>=<value>...]  Add a row to a dynamic list
+  delete <row>                    Delete a row
+  watch <path>...                 Print the changes to the paths until a key is pressed
+  help                            Print this help
+  exit, quit                      Leave the shell
+
+Arguments containing spaces are quoted with ' or ".  Results are printed in
+the -o format.
+`
+)
+
+var shellCommands = []string{"add", "delete", "exit", "get", "help", "list", "quit", "set", "watch"}
+
+// shell runs the commands entered interactively on a single controller
+// connection
+type shell struct {
+	ctrl   *controller.Controller
+	ctx    context.Context
+	out    *output
+	editor *lineEditor
+	// The exit code of the last command
+	exitCode int
+}
+
+func newShell(ctrl *controller.Controller, out *output) *shell {
+	sh := &shell{
+		ctrl: ctrl,
+		ctx:  context.Background(),
+		out:  out,
+	}
+	sh.editor = newLineEditor(SHELL_PROMPT, sh.complete)
+	return sh
+}
+
+// run reads and runs commands until exit, quit or the end of the input, and
+// returns the exit code of the last command
+func (sh *shell) run() int {
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, HISTORY_FILE)
+		sh.editor.loadHistory(historyPath)
+	}
+
+	for {
+		line, err := sh.editor.readLine()
+		if err != nil {
+			break
+		}
+		if !sh.runCommand(line) {
+			break
+		}
+	}
+
+	if historyPath != "" {
+		sh.editor.saveHistory(historyPath)
+	}
+	return sh.exitCode
+}
+
+// runCommand runs the command `line`, returning false to leave the shell.
+// The get, set, list, add and delete commands are run as on the command line.
+func (sh *shell) runCommand(line string) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		sh.fail(err)
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+
+	switch command := strings.ToLower(args[0]); command {
+	case "exit", "quit":
+		return false
+	case "help":
+		fmt.Print(SHELL_HELP)
+	case "watch":
+		err = sh.watch(args[1:])
+	default:
+		err = runCommand(sh.ctx, sh.ctrl, sh.out, command, args[1:])
+	}
+	if err != nil {
+		sh.fail(err)
+	} else {
+		sh.exitCode = EXIT_OK
+	}
+	return true
+}
+
+// fail prints the error of a command, and keeps its exit code
+func (sh *shell) fail(err error) {
+	sh.out.error(err)
+	sh.exitCode = exitCode(err)
+}
+
+// watch prints the changes to the paths until a key is pressed
+func (sh *shell) watch(args []string) error {
+	if len(args) == 0 {
+		return &usageError{"usage: watch <path>..."}
+	}
+	subscription, err := sh.ctrl.Subscribe(sh.ctx, args...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Watching %s, press a key to stop\n", strings.Join(args, " "))
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- watchSubscription(sh.ctx, subscription, stop, func(watched change) {
+			printChange(watched, false)
+		})
+	}()
+	sh.editor.waitKey()
+	close(stop)
+	return <-done
+}
+
+// complete returns the candidates for the last word of `line`: a command for
+// the first word, otherwise a path read level by level from the coordinator
+func (sh *shell) complete(line string) []string {
+	word := line[strings.LastIndex(line, " ")+1:]
+	var names []string
+	if !strings.Contains(line, " ") {
+		names = shellCommands
+	} else {
+		parent := word[:strings.LastIndex(word, ".")+1]
+		var err error
+		names, err = sh.ctrl.NextLevel(sh.ctx, parent)
+		if err != nil {
+			return nil
+		}
+	}
+
+	var candidates []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) {
+			candidates = append(candidates, name)
+		}
+	}
+	return candidates
+}
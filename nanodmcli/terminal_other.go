@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// makeRaw isn't supported on this platform, so the shell reads whole lines
+// without completion
+func makeRaw(fd int) (restore func(), err error) {
+	return nil, errors.New("raw terminal mode isn't supported")
+}
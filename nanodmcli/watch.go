@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/controller"
+)
+
+const (
+	WATCH_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// change is a change to an object reported by watch
+type change struct {
+	Time time.Time `json:"time"`
+	// Change is "set", "added" or "deleted"
+	Change string      `json:"change"`
+	Name   string      `json:"name"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+// changeOf returns the change of the notified operation
+func changeOf(notification controller.Notification) change {
+	operation := notification.Operation
+	watched := change{Time: notification.Time, Name: operation.Object.Name, Value: operation.Object.Value}
+	switch operation.Type {
+	case nanodm.OperationAddRow:
+		watched.Change = "added"
+	case nanodm.OperationDeleteRow:
+		watched.Change = "deleted"
+	default:
+		watched.Change = "set"
+	}
+	return watched
+}
+
+// diffObjects returns the changes from the objects `previous` to `current`,
+// in name order
+func diffObjects(previous map[string]nanodm.Object, current map[string]nanodm.Object, now time.Time) (changes []change) {
+	for name, object := range current {
+		previousObject, existed := previous[name]
+		if !existed {
+			changes = append(changes, change{Time: now, Change: "added", Name: name, Value: object.Value})
+		} else if !reflect.DeepEqual(previousObject.Value, object.Value) {
+			changes = append(changes, change{Time: now, Change: "set", Name: name, Value: object.Value})
+		}
+	}
+	for name := range previous {
+		if _, exists := current[name]; !exists {
+			changes = append(changes, change{Time: now, Change: "deleted", Name: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// formatChange formats a change as "<time> <change> <name> [= <value>]"
+func formatChange(watched change) string {
+	line := fmt.Sprintf("%s %s %s", watched.Time.Format(WATCH_TIME_FORMAT), watched.Change, watched.Name)
+	switch value := watched.Value.(type) {
+	case nil:
+	case string:
+		line += fmt.Sprintf(" = %q", value)
+	case map[string]interface{}:
+		line += formatRowValues(value)
+	default:
+		line += " = " + nanodm.FormatValue(value)
+	}
+	return line
+}
+
+// printChange prints a change formatted for people, or as a JSON line
+func printChange(watched change, jsonLines bool) {
+	if !jsonLines {
+		fmt.Println(formatChange(watched))
+		return
+	}
+	jsonBytes, err := json.Marshal(watched)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal the change of %s: %v\n", watched.Name, err)
+		return
+	}
+	fmt.Printf("%s\n", jsonBytes)
+}
+
+// watchSubscription reports the changes notified to `subscription` until
+// `stop` is closed, and then unsubscribes
+func watchSubscription(ctx context.Context, subscription *controller.Subscription, stop <-chan struct{}, report func(change)) error {
+	for {
+		select {
+		case notification, ok := <-subscription.C():
+			if !ok {
+				return nil
+			}
+			report(changeOf(notification))
+		case <-stop:
+			return subscription.Unsubscribe(ctx)
+		}
+	}
+}
+
+// watchPoll gets `paths` every `interval` and reports the differences
+// between the polls until `stop` is closed, for the sources that don't
+// notify the changes they make
+func watchPoll(ctx context.Context, ctrl *controller.Controller, paths []string, interval time.Duration, stop <-chan struct{}, report func(change)) error {
+	poll := func() (map[string]nanodm.Object, error) {
+		names, err := expandPaths(ctx, ctrl, paths)
+		if err != nil {
+			return nil, err
+		}
+		objects, err := ctrl.Get(ctx, names...)
+		if err != nil {
+			return nil, err
+		}
+		polled := make(map[string]nanodm.Object, len(objects))
+		for _, object := range objects {
+			polled[object.Name] = object
+		}
+		return polled, nil
+	}
+
+	// The first poll is the baseline the changes are reported from
+	previous, err := poll()
+	if err != nil {
+		return err
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			current, err := poll()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to poll %v: %v\n", paths, err)
+				continue
+			}
+			for _, watched := range diffObjects(previous, current, now) {
+				report(watched)
+			}
+			previous = current
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// expandPaths replaces the partial paths of `paths` with the objects and
+// dynamic lists registered under them, since only those can be gotten.  A
+// path under a dynamic list, such as a row, is kept.
+func expandPaths(ctx context.Context, ctrl *controller.Controller, paths []string) (names []string, err error) {
+	for _, path := range paths {
+		if !strings.HasSuffix(path, ".") {
+			names = append(names, path)
+			continue
+		}
+		registered, err := ctrl.Registry(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(registered) == 0 {
+			names = append(names, path)
+		}
+		for _, regObject := range registered {
+			names = append(names, regObject.Name)
+		}
+	}
+	return names, nil
+}
+
+// formatRowValues formats the initial values of an added row in name order
+func formatRowValues(value interface{}) string {
+	values, ok := value.(map[string]interface{})
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var formatted []string
+	for _, name := range names {
+		formatted = append(formatted, fmt.Sprintf("%s=%v", name, values[name]))
+	}
+	return " " + strings.Join(formatted, " ")
+}
@@ -0,0 +1,89 @@
+package nanodmtest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock is a nanodm.Clock that only moves when it's advanced, to test the
+// pings and ping timeouts of servers, sources and controllers without waiting
+// for them.  It's safe for concurrent use.
+type FakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+// NewFakeClock creates a fake clock set to `now`
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the time of the clock
+func (fc *FakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.now
+}
+
+// After returns a channel that receives the time once the clock is advanced
+// by `d`
+func (fc *FakeClock) After(d time.Duration) <-chan time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- fc.now
+		return c
+	}
+	fc.timers = append(fc.timers, &fakeTimer{deadline: fc.now.Add(d), c: c})
+	return c
+}
+
+// Advance moves the clock forward by `d`, firing the timers that expire in
+// the order of their expiry
+func (fc *FakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.now = fc.now.Add(d)
+
+	sort.SliceStable(fc.timers, func(i, j int) bool {
+		return fc.timers[i].deadline.Before(fc.timers[j].deadline)
+	})
+	var pending []*fakeTimer
+	for _, timer := range fc.timers {
+		if timer.deadline.After(fc.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- fc.now
+		}
+	}
+	fc.timers = pending
+}
+
+// Timers returns the number of timers waiting for the clock
+func (fc *FakeClock) Timers() int {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return len(fc.timers)
+}
+
+// WaitForTimers waits until at least `count` timers wait for the clock, for
+// example for a task to wait for its next ping before the clock is advanced.
+// Returns false if they don't within `timeout`.
+func (fc *FakeClock) WaitForTimers(count int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for fc.Timers() < count {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,37 @@
+package nanodmtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	second := clock.After(time.Second)
+	minute := clock.After(time.Minute)
+	assert.Equal(t, 2, clock.Timers())
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(30*time.Second), <-second)
+	select {
+	case <-minute:
+		t.Fatal("the timer of a minute fired after 30 seconds")
+	default:
+	}
+	assert.Equal(t, 1, clock.Timers())
+
+	clock.Advance(30 * time.Second)
+	assert.Equal(t, start.Add(time.Minute), <-minute)
+	assert.Equal(t, start.Add(time.Minute), clock.Now())
+	assert.Equal(t, start.Add(time.Minute), <-clock.After(0))
+
+	go func() {
+		<-clock.After(time.Hour)
+	}()
+	assert.True(t, clock.WaitForTimers(1, time.Second))
+	assert.False(t, clock.WaitForTimers(2, 10*time.Millisecond))
+}
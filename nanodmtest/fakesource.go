@@ -0,0 +1,260 @@
+package nanodmtest
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zackwine/nanodm"
+)
+
+// FakeSource is a source.SourceHandler that serves objects from memory.  It's
+// created from a map of object names to values, where the type of each object
+// is the type of its value, and a name ending in "." with a nil value is a
+// dynamic list.  Values under a dynamic list are its rows, for example
+// "Device.NAT.PortMapping.1.Enable".  It's safe for concurrent use.
+type FakeSource struct {
+	mutex sync.Mutex
+	// The objects with a value, including the objects of the rows
+	objects map[string]nanodm.Object
+	// The dynamic lists, the index of their last row and their rows
+	lists     map[string]nanodm.Object
+	lastIndex map[string]int
+	rows      map[string]bool
+}
+
+// NewFakeSource creates a fake source of the objects `values`
+func NewFakeSource(values map[string]interface{}) *FakeSource {
+	fs := &FakeSource{
+		objects:   make(map[string]nanodm.Object),
+		lists:     make(map[string]nanodm.Object),
+		lastIndex: make(map[string]int),
+		rows:      make(map[string]bool),
+	}
+	for name, value := range values {
+		if value == nil && strings.HasSuffix(name, ".") {
+			fs.lists[name] = nanodm.Object{Name: name, Access: nanodm.AccessRW, Type: nanodm.TypeDynamicList}
+		}
+	}
+	for name, value := range values {
+		if value == nil && strings.HasSuffix(name, ".") {
+			continue
+		}
+		fs.objects[name] = nanodm.Object{Name: name, Access: nanodm.AccessRW, Type: TypeOf(value), Value: value}
+		if list, index, ok := fs.rowOf(name); ok {
+			fs.rows[fmt.Sprintf("%s%d.", list, index)] = true
+			if index > fs.lastIndex[list] {
+				fs.lastIndex[list] = index
+			}
+		}
+	}
+	return fs
+}
+
+// TypeOf returns the object type of the Go value `value`: the type that
+// nanodm.ParseValue parses to, or the type of the size of an integer
+func TypeOf(value interface{}) nanodm.ObjectType {
+	switch value.(type) {
+	case int8, int16, int32:
+		return nanodm.TypeInt
+	case int, int64:
+		return nanodm.TypeLong
+	case uint8:
+		return nanodm.TypeByte
+	case uint16, uint32:
+		return nanodm.TypeUnsignedInt
+	case uint, uint64:
+		return nanodm.TypeUnsignedLong
+	case bool:
+		return nanodm.TypeBool
+	case float32:
+		return nanodm.TypeFloat
+	case float64:
+		return nanodm.TypeDouble
+	case time.Time:
+		return nanodm.TypeDateTime
+	case []byte:
+		return nanodm.TypeBase64
+	default:
+		return nanodm.TypeString
+	}
+}
+
+// Objects returns the objects to register for the source: its objects and
+// dynamic lists, without the objects of the rows, sorted by name
+func (fs *FakeSource) Objects() []nanodm.Object {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var objects []nanodm.Object
+	for name, object := range fs.objects {
+		if _, _, isRow := fs.rowOf(name); !isRow {
+			objects = append(objects, object)
+		}
+	}
+	for _, list := range fs.lists {
+		objects = append(objects, list)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects
+}
+
+// SetReadOnly makes the objects `names` read only, so that setting them fails
+// with nanodm.CodeAccessDenied.  Call it before the source is registered.
+func (fs *FakeSource) SetReadOnly(names ...string) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	for _, name := range names {
+		if object, exists := fs.objects[name]; exists {
+			object.Access = nanodm.AccessRO
+			fs.objects[name] = object
+		}
+	}
+}
+
+// Value returns the value of the object `name`, and false if there is none
+func (fs *FakeSource) Value(name string) (interface{}, bool) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	object, exists := fs.objects[name]
+	return object.Value, exists
+}
+
+// GetObjects gets objects, or every object under a partial path
+func (fs *FakeSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var errs nanodm.Errors
+	for _, name := range objectNames {
+		if !strings.HasSuffix(name, ".") {
+			if object, exists := fs.objects[name]; exists {
+				objects = append(objects, object)
+			} else {
+				errs = append(errs, nanodm.ObjectErrorf(name, nanodm.CodeNotFound, "no object %s", name))
+			}
+			continue
+		}
+
+		var found []nanodm.Object
+		for objName, object := range fs.objects {
+			if nanodm.MatchesPath(name, objName) {
+				found = append(found, object)
+			}
+		}
+		sort.Slice(found, func(i, j int) bool {
+			return found[i].Name < found[j].Name
+		})
+		if _, isList := fs.lists[name]; len(found) == 0 && !isList && !fs.rows[name] {
+			errs = append(errs, nanodm.ObjectErrorf(name, nanodm.CodeNotFound, "no object under %s", name))
+		}
+		objects = append(objects, found...)
+	}
+	if len(errs) > 0 {
+		return objects, errs
+	}
+	return objects, nil
+}
+
+// SetObjects sets objects, all of them or none.  A string value is parsed to
+// the type of its object.
+func (fs *FakeSource) SetObjects(objects []nanodm.Object) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	var errs nanodm.Errors
+	var set []nanodm.Object
+	for _, object := range objects {
+		current, exists := fs.objects[object.Name]
+		if !exists {
+			errs = append(errs, nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "no object %s", object.Name))
+			continue
+		}
+		if current.Access == nanodm.AccessRO {
+			errs = append(errs, nanodm.ObjectErrorf(object.Name, nanodm.CodeAccessDenied, "%s is read only", object.Name))
+			continue
+		}
+		value, err := fs.parseValue(current.Type, object.Value)
+		if err != nil {
+			errs = append(errs, nanodm.ObjectErrorf(object.Name, nanodm.CodeOf(err), "%v", err))
+			continue
+		}
+		current.Value = value
+		set = append(set, current)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	for _, object := range set {
+		fs.objects[object.Name] = object
+	}
+	return nil
+}
+
+// AddRow adds a row to a dynamic list, with the values of the map of relative
+// object names to values of `object`
+func (fs *FakeSource) AddRow(object nanodm.Object) (row string, err error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if _, isList := fs.lists[object.Name]; !isList {
+		return "", nanodm.ObjectErrorf(object.Name, nanodm.CodeNotFound, "no dynamic list %s", object.Name)
+	}
+	values, _ := object.Value.(map[string]interface{})
+	fs.lastIndex[object.Name]++
+	row = fmt.Sprintf("%s%d.", object.Name, fs.lastIndex[object.Name])
+	fs.rows[row] = true
+	for name, value := range values {
+		fs.objects[row+name] = nanodm.Object{Name: row + name, Access: nanodm.AccessRW, Type: TypeOf(value), Value: value}
+	}
+	return row, nil
+}
+
+// DeleteRow deletes a row and its objects
+func (fs *FakeSource) DeleteRow(row nanodm.Object) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	name := row.Name
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if !fs.rows[name] {
+		return nanodm.ObjectErrorf(row.Name, nanodm.CodeNotFound, "no row %s", row.Name)
+	}
+	delete(fs.rows, name)
+	for objName := range fs.objects {
+		if strings.HasPrefix(objName, name) {
+			delete(fs.objects, objName)
+		}
+	}
+	return nil
+}
+
+// rowOf returns the dynamic list and index of the row of the object `name`,
+// and false if it isn't the object of a row
+func (fs *FakeSource) rowOf(name string) (list string, index int, ok bool) {
+	for listName := range fs.lists {
+		if !strings.HasPrefix(name, listName) {
+			continue
+		}
+		segments := strings.SplitN(strings.TrimPrefix(name, listName), ".", 2)
+		if len(segments) < 2 {
+			continue
+		}
+		if index, err := strconv.Atoi(segments[0]); err == nil {
+			return listName, index, true
+		}
+	}
+	return "", 0, false
+}
+
+// parseValue returns `value` as a value of `objectType`: parsed if it's a
+// string, as the protocol gateways send them, and as it is otherwise
+func (fs *FakeSource) parseValue(objectType nanodm.ObjectType, value interface{}) (interface{}, error) {
+	str, isString := value.(string)
+	if !isString || objectType == nanodm.TypeString {
+		return value, nil
+	}
+	return nanodm.ParseValue(objectType, str)
+}
@@ -0,0 +1,96 @@
+package nanodmtest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+)
+
+// advancePings advances the clock of `h` by `count` ping periods, each time
+// once the `timers` ping tasks wait for the clock
+func advancePings(t *testing.T, h *Harness, count int, timers int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		assert.True(t, h.Clock.WaitForTimers(timers, time.Second))
+		h.Clock.Advance(coordinator.PING_PERIOD)
+	}
+}
+
+func TestSilentSource(t *testing.T) {
+	h := New(t)
+	h.AddFakeSource("wifi", map[string]interface{}{"Device.WiFi.SSID": "home"})
+
+	// The server removes a source that stops answering its pings.  Each ping
+	// is answered, and the answer dropped, before the next so that the source
+	// doesn't miss any.
+	h.Faults.Silence(h.SourceURL("wifi"))
+	for i := 0; i < 6; i++ {
+		dropped := h.Faults.Injected(nanodm.FaultDrop)
+		advancePings(t, h, 1, 2)
+		assert.Eventually(t, func() bool { return h.Faults.Injected(nanodm.FaultDrop) > dropped }, time.Second, time.Millisecond)
+	}
+	h.WaitForRemoval("wifi")
+
+	// and the source registers again once the server stops pinging it
+	h.Faults.Clear()
+	advancePings(t, h, 3, 2)
+	h.WaitForSource("wifi")
+	h.AssertValue("Device.WiFi.SSID", "home")
+}
+
+func TestSilentCoordinator(t *testing.T) {
+	h := New(t)
+	fakeSource := NewFakeSource(map[string]interface{}{"Device.WiFi.SSID": "home"})
+	src := h.AddSource("wifi", fakeSource, fakeSource.Objects())
+
+	// A source that isn't pinged registers again, which keeps it registered
+	h.Faults.AddRule(nanodm.FaultRule{Fault: nanodm.FaultDrop, Types: []nanodm.MessageType{nanodm.PingMessageType}, From: h.URL()})
+	advancePings(t, h, 8, 2)
+	assert.True(t, src.Metrics().PingMisses.Value() > 0)
+	h.WaitForSource("wifi")
+	h.AssertValue("Device.WiFi.SSID", "home")
+}
+
+func TestAckFaults(t *testing.T) {
+	h := New(t)
+	h.AddFakeSource("wifi", map[string]interface{}{"Device.WiFi.SSID": "home"})
+	h.Server.SetRequestTimeout(200 * time.Millisecond)
+
+	// A request whose ack is lost times out
+	h.Faults.AddRule(nanodm.FaultRule{Fault: nanodm.FaultDrop, Types: []nanodm.MessageType{nanodm.AckMessageType}, SourceName: "wifi", To: h.URL()})
+	_, errs := h.Server.Get([]string{"Device.WiFi.SSID"})
+	assert.Equal(t, 1, len(errs))
+	assert.True(t, errors.Is(errs[0], nanodm.ErrTimeout), "%v", errs)
+
+	// A duplicated ack is ignored
+	h.Faults.SetRules(nanodm.FaultRule{Fault: nanodm.FaultDuplicate, Types: []nanodm.MessageType{nanodm.AckMessageType}, To: h.URL()})
+	h.AssertSet("Device.WiFi.SSID", "guest")
+	h.AssertValue("Device.WiFi.SSID", "guest")
+
+	// So is a delayed ack that arrives after its request timed out
+	h.Faults.SetRules(nanodm.FaultRule{Fault: nanodm.FaultDelay, Delay: 300 * time.Millisecond, Types: []nanodm.MessageType{nanodm.AckMessageType}, To: h.URL()})
+	h.AssertGetError("Device.WiFi.SSID", nanodm.CodeTimeout)
+	h.Faults.Clear()
+	time.Sleep(200 * time.Millisecond)
+	h.AssertValue("Device.WiFi.SSID", "guest")
+}
+
+func TestCorruptRequest(t *testing.T) {
+	h := New(t)
+	fakeSource := NewFakeSource(map[string]interface{}{"Device.WiFi.SSID": "home"})
+	src := h.AddSource("wifi", fakeSource, fakeSource.Objects())
+	h.Server.SetRequestTimeout(200 * time.Millisecond)
+
+	// A request that doesn't decode is rejected by the source, and times out
+	h.Faults.AddRule(nanodm.FaultRule{Fault: nanodm.FaultCorrupt, Types: []nanodm.MessageType{nanodm.GetMessageType}, To: h.SourceURL("wifi")})
+	h.AssertGetError("Device.WiFi.SSID", nanodm.CodeTimeout)
+	assert.Equal(t, float64(1), src.Metrics().Rejected.Value(nanodm.RejectDecode))
+	assert.Equal(t, float64(0), src.Metrics().Handled.Value("Get", "ack"))
+
+	h.Faults.Clear()
+	h.AssertValue("Device.WiFi.SSID", "home")
+}
@@ -0,0 +1,290 @@
+// Package nanodmtest runs a coordinator server and its sources in the test
+// process, connected over the in-memory inproc transport, to test source
+// handlers and coordinator handlers without ports or sleeps:
+//
+//	func TestWiFi(t *testing.T) {
+//		h := nanodmtest.New(t)
+//		h.AddSource("wifi", &wifiHandler{}, wifiObjects)
+//		h.AssertSet("Device.WiFi.SSID", "home")
+//		h.AssertValue("Device.WiFi.SSID", "home")
+//	}
+//
+// The server, sources and controllers of a harness ping on its FakeClock,
+// which only moves when the test advances it, and their messages go through
+// its FaultInjector, which injects no faults until it's given rules.
+package nanodmtest
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/controller"
+	"github.com/zackwine/nanodm/coordinator"
+	"github.com/zackwine/nanodm/source"
+)
+
+const (
+	// The time to wait for a source to register or to be removed
+	WAIT_TIMEOUT = 5 * time.Second
+	// The time the fake clock of a harness starts at
+	CLOCK_START = "2021-01-01T00:00:00Z"
+)
+
+var urlCount uint64
+
+// NewURL returns an inproc url that no other server, source or controller of
+// the process listens on
+func NewURL() string {
+	return fmt.Sprintf("inproc://nanodmtest/%d", atomic.AddUint64(&urlCount, 1))
+}
+
+// Harness is a coordinator server started for a test, with its sources.  It's
+// stopped when the test ends, and fails the test if it can't be started or a
+// source can't register.
+type Harness struct {
+	Server *coordinator.Server
+	Clock  *FakeClock
+	Faults *nanodm.FaultInjector
+	Log    *logrus.Entry
+
+	t   testing.TB
+	url string
+
+	mutex      sync.Mutex
+	sources    map[string]*source.Source
+	sourceUrls map[string]string
+	controller *controller.Controller
+}
+
+// New starts a coordinator server on an inproc url for the test `t`
+func New(t testing.TB) *Harness {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetOutput(os.Stderr)
+	logger.SetLevel(logrus.WarnLevel)
+
+	start, _ := time.Parse(time.RFC3339, CLOCK_START)
+	h := &Harness{
+		Clock:      NewFakeClock(start),
+		Faults:     nanodm.NewFaultInjector(1),
+		Log:        logrus.NewEntry(logger),
+		t:          t,
+		url:        NewURL(),
+		sources:    make(map[string]*source.Source),
+		sourceUrls: make(map[string]string),
+	}
+	h.Server = coordinator.NewServer(h.Log, h.url, nil)
+	h.Server.SetClock(h.Clock)
+	h.Server.SetFaultInjector(h.Faults)
+	if err := h.Server.Start(); err != nil {
+		t.Fatalf("failed to start the coordinator server: %v", err)
+	}
+	t.Cleanup(h.stop)
+	return h
+}
+
+// URL returns the url of the server, for sources connected by the code under
+// test
+func (h *Harness) URL() string {
+	return h.url
+}
+
+// AddSource connects a source named `name` with `handler` to the server, and
+// returns once it's registered `objects`
+func (h *Harness) AddSource(name string, handler source.SourceHandler, objects []nanodm.Object) *source.Source {
+	h.t.Helper()
+	pullUrl := NewURL()
+	src := source.NewSource(h.Log, name, h.url, pullUrl, handler)
+	src.SetClock(h.Clock)
+	src.SetFaultInjector(h.Faults)
+	if err := src.Connect(); err != nil {
+		h.t.Fatalf("failed to connect source %s: %v", name, err)
+	}
+	// The server acks the registration once the objects are routed
+	if err := src.Register(objects); err != nil {
+		h.t.Fatalf("failed to register source %s: %v", name, err)
+	}
+
+	h.mutex.Lock()
+	h.sources[name] = src
+	h.sourceUrls[name] = pullUrl
+	h.mutex.Unlock()
+	return src
+}
+
+// SourceURL returns the url the source `name` added to the harness listens
+// on, to inject faults into its messages
+func (h *Harness) SourceURL(name string) string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.sourceUrls[name]
+}
+
+// AddFakeSource connects a FakeSource of `values` named `name` to the server,
+// and returns once it's registered
+func (h *Harness) AddFakeSource(name string, values map[string]interface{}) *FakeSource {
+	h.t.Helper()
+	fakeSource := NewFakeSource(values)
+	h.AddSource(name, fakeSource, fakeSource.Objects())
+	return fakeSource
+}
+
+// RemoveSource unregisters the source `name` added to the harness
+func (h *Harness) RemoveSource(name string) {
+	h.t.Helper()
+	h.mutex.Lock()
+	src, exists := h.sources[name]
+	delete(h.sources, name)
+	delete(h.sourceUrls, name)
+	h.mutex.Unlock()
+	if !exists {
+		h.t.Fatalf("no source %s was added", name)
+	}
+	if err := src.Unregister(); err != nil {
+		h.t.Fatalf("failed to unregister source %s: %v", name, err)
+	}
+}
+
+// WaitForSource waits for the source `name` to be registered, for sources
+// connected by the code under test
+func (h *Harness) WaitForSource(name string) {
+	h.t.Helper()
+	if !h.waitFor(func() bool { return h.hasSource(name) }) {
+		h.t.Fatalf("source %s didn't register within %v", name, WAIT_TIMEOUT)
+	}
+}
+
+// WaitForRemoval waits for the source `name` to be removed, by unregistering
+// or by missing its pings
+func (h *Harness) WaitForRemoval(name string) {
+	h.t.Helper()
+	if !h.waitFor(func() bool { return !h.hasSource(name) }) {
+		h.t.Fatalf("source %s wasn't removed within %v", name, WAIT_TIMEOUT)
+	}
+}
+
+// Controller returns a controller connected to the server, created on the
+// first call
+func (h *Harness) Controller() *controller.Controller {
+	h.t.Helper()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.controller == nil {
+		ctrl := controller.NewController(h.Log, h.url)
+		ctrl.SetListenUrl(NewURL())
+		ctrl.SetClock(h.Clock)
+		ctrl.SetFaultInjector(h.Faults)
+		if err := ctrl.Connect(); err != nil {
+			h.t.Fatalf("failed to connect controller: %v", err)
+		}
+		h.controller = ctrl
+	}
+	return h.controller
+}
+
+// AssertValue asserts that the object `name` gets with the value `expected`.
+// The values are compared in their TR-106 string form, so an int matches the
+// int64 the source sent.
+func (h *Harness) AssertValue(name string, expected interface{}) bool {
+	h.t.Helper()
+	return h.AssertValues(map[string]interface{}{name: expected})
+}
+
+// AssertValues asserts that the objects of `expected` get with their values
+func (h *Harness) AssertValues(expected map[string]interface{}) bool {
+	h.t.Helper()
+	var names []string
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	objects, errs := h.Server.Get(names)
+	if !assert.Empty(h.t, errs, "get %s", strings.Join(names, ", ")) {
+		return false
+	}
+	got := make(map[string]string, len(objects))
+	for _, object := range objects {
+		got[object.Name] = nanodm.FormatValue(object.Value)
+	}
+	want := make(map[string]string, len(expected))
+	for name, value := range expected {
+		want[name] = nanodm.FormatValue(value)
+	}
+	return assert.Equal(h.t, want, got)
+}
+
+// AssertGetError asserts that getting the object `name` fails with `code`
+func (h *Harness) AssertGetError(name string, code nanodm.ErrorCode) bool {
+	h.t.Helper()
+	_, errs := h.Server.Get([]string{name})
+	if !assert.NotEmpty(h.t, errs, "get %s should fail with %v", name, code) {
+		return false
+	}
+	return assert.Equal(h.t, code, nanodm.CodeOf(errs[0]), "get %s: %v", name, errs[0])
+}
+
+// AssertSet asserts that setting the object `name` to `value` succeeds
+func (h *Harness) AssertSet(name string, value interface{}) bool {
+	h.t.Helper()
+	err := h.Server.Set(nanodm.Object{Name: name, Type: TypeOf(value), Value: value})
+	return assert.Nil(h.t, err, "set %s", name)
+}
+
+// AssertSetError asserts that setting the object `name` to `value` fails with
+// `code`
+func (h *Harness) AssertSetError(name string, value interface{}, code nanodm.ErrorCode) bool {
+	h.t.Helper()
+	err := h.Server.Set(nanodm.Object{Name: name, Type: TypeOf(value), Value: value})
+	if !assert.NotNil(h.t, err, "set %s should fail with %v", name, code) {
+		return false
+	}
+	return assert.Equal(h.t, code, nanodm.CodeOf(err), "set %s: %v", name, err)
+}
+
+func (h *Harness) hasSource(name string) bool {
+	for _, info := range h.Server.Sources() {
+		if info.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor polls `condition` until it's true, or returns false after
+// WAIT_TIMEOUT
+func (h *Harness) waitFor(condition func() bool) bool {
+	deadline := time.Now().Add(WAIT_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+// stop disconnects the sources and controller and stops the server
+func (h *Harness) stop() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Without faults, for the sources to unregister
+	h.Faults.Clear()
+	for name, src := range h.sources {
+		src.Disconnect()
+		delete(h.sources, name)
+	}
+	if h.controller != nil {
+		h.controller.Close()
+	}
+	h.Server.Stop()
+}
@@ -0,0 +1,86 @@
+package nanodmtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+)
+
+func TestHarness(t *testing.T) {
+	h := New(t)
+	fakeSource := h.AddFakeSource("wifi", map[string]interface{}{
+		"Device.WiFi.SSID":                "home",
+		"Device.WiFi.Channel":             6,
+		"Device.WiFi.Enable":              true,
+		"Device.NAT.PortMapping.":         nil,
+		"Device.NAT.PortMapping.3.Enable": false,
+	})
+	assert.Equal(t, []coordinator.SourceInfo{{Name: "wifi", Url: h.Server.Sources()[0].Url, Objects: 4, LastPing: h.Clock.Now()}}, h.Server.Sources())
+
+	h.AssertValues(map[string]interface{}{"Device.WiFi.SSID": "home", "Device.WiFi.Channel": 6, "Device.WiFi.Enable": true})
+	h.AssertSet("Device.WiFi.SSID", "guest")
+	h.AssertValue("Device.WiFi.SSID", "guest")
+	// String values are parsed to the type of the object
+	h.AssertSet("Device.WiFi.Channel", "11")
+	value, _ := fakeSource.Value("Device.WiFi.Channel")
+	assert.Equal(t, int64(11), value)
+	h.AssertSetError("Device.WiFi.Enable", "maybe", nanodm.CodeInvalidValue)
+	h.AssertGetError("Device.WiFi.Missing", nanodm.CodeNotFound)
+
+	// Rows are numbered after the rows given
+	ctx := context.Background()
+	row, err := h.Controller().AddRow(ctx, nanodm.Object{Name: "Device.NAT.PortMapping.", Type: nanodm.TypeRow, Value: map[string]interface{}{"Enable": true}})
+	assert.Nil(t, err)
+	assert.Equal(t, "Device.NAT.PortMapping.4.", row)
+	h.AssertValue("Device.NAT.PortMapping.4.Enable", true)
+	assert.Nil(t, h.Controller().DeleteRow(ctx, nanodm.Object{Name: "Device.NAT.PortMapping.3.", Type: nanodm.TypeRow}))
+	h.AssertGetError("Device.NAT.PortMapping.3.Enable", nanodm.CodeNotFound)
+
+	h.RemoveSource("wifi")
+	h.WaitForRemoval("wifi")
+	h.AssertGetError("Device.WiFi.SSID", nanodm.CodeNotFound)
+}
+
+func TestHarnessPings(t *testing.T) {
+	h := New(t)
+	h.AddFakeSource("wifi", map[string]interface{}{"Device.WiFi.SSID": "home"})
+
+	// A source that answers its pings stays registered
+	for i := 0; i < 8; i++ {
+		// The ping tasks of the server and the source
+		assert.True(t, h.Clock.WaitForTimers(2, time.Second))
+		h.Clock.Advance(coordinator.PING_PERIOD)
+	}
+	h.WaitForSource("wifi")
+
+	// A source that doesn't is removed after 5 ping periods
+	messageChan := make(chan nanodm.Message, 16)
+	pullUrl := NewURL()
+	puller := nanodm.NewPuller(h.Log, pullUrl, messageChan)
+	assert.Nil(t, puller.Start())
+	defer puller.Stop()
+	pusherChan := make(chan nanodm.Message)
+	pusher := nanodm.NewPusher(h.Log, h.URL(), pusherChan)
+	assert.Nil(t, pusher.Start())
+	defer pusher.Stop()
+	pusherChan <- nanodm.Message{
+		Type:           nanodm.RegisterMessageType,
+		SourceName:     "silent",
+		Source:         pullUrl,
+		TransactionUID: nanodm.GetTransactionUID(),
+		Objects:        []nanodm.Object{{Name: "Device.Silent.Value", Type: nanodm.TypeString}},
+	}
+	ack := <-messageChan
+	assert.Equal(t, nanodm.AckMessageType, ack.Type)
+
+	for i := 0; i < 6; i++ {
+		assert.True(t, h.Clock.WaitForTimers(2, time.Second))
+		h.Clock.Advance(coordinator.PING_PERIOD)
+	}
+	h.WaitForRemoval("silent")
+	h.WaitForSource("wifi")
+}
@@ -0,0 +1,184 @@
+package nanodm
+
+import (
+	"math"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// NewStringObject creates a string object of `value`
+func NewStringObject(name string, value string) Object {
+	return Object{Name: name, Type: TypeString, Value: value}
+}
+
+// NewIntObject creates an int object of `value`
+func NewIntObject(name string, value int32) Object {
+	return Object{Name: name, Type: TypeInt, Value: int64(value)}
+}
+
+// NewLongObject creates a long object of `value`
+func NewLongObject(name string, value int64) Object {
+	return Object{Name: name, Type: TypeLong, Value: value}
+}
+
+// NewUnsignedIntObject creates an unsignedInt object of `value`
+func NewUnsignedIntObject(name string, value uint32) Object {
+	return Object{Name: name, Type: TypeUnsignedInt, Value: uint64(value)}
+}
+
+// NewUnsignedLongObject creates an unsignedLong object of `value`
+func NewUnsignedLongObject(name string, value uint64) Object {
+	return Object{Name: name, Type: TypeUnsignedLong, Value: value}
+}
+
+// NewByteObject creates an unsignedByte object of `value`
+func NewByteObject(name string, value uint8) Object {
+	return Object{Name: name, Type: TypeByte, Value: uint64(value)}
+}
+
+// NewBoolObject creates a boolean object of `value`
+func NewBoolObject(name string, value bool) Object {
+	return Object{Name: name, Type: TypeBool, Value: value}
+}
+
+// NewFloatObject creates a float object of `value`
+func NewFloatObject(name string, value float32) Object {
+	return Object{Name: name, Type: TypeFloat, Value: float64(value)}
+}
+
+// NewDoubleObject creates a double object of `value`
+func NewDoubleObject(name string, value float64) Object {
+	return Object{Name: name, Type: TypeDouble, Value: value}
+}
+
+// NewDateTimeObject creates a dateTime object of `value`, in UTC
+func NewDateTimeObject(name string, value time.Time) Object {
+	return Object{Name: name, Type: TypeDateTime, Value: value.UTC()}
+}
+
+// NewBase64Object creates a base64 object of `value`
+func NewBase64Object(name string, value []byte) Object {
+	return Object{Name: name, Type: TypeBase64, Value: value}
+}
+
+// AsString returns the value of a string object
+func (o Object) AsString() (string, error) {
+	value, err := o.typedValue(TypeString)
+	if err != nil {
+		return "", err
+	}
+	return value.(string), nil
+}
+
+// AsInt64 returns the value of an int, long, unsignedInt, unsignedLong or
+// unsignedByte object
+func (o Object) AsInt64() (int64, error) {
+	value, err := o.typedValue(TypeInt, TypeLong, TypeUnsignedInt, TypeUnsignedLong, TypeByte)
+	if err != nil {
+		return 0, err
+	}
+	switch t := value.(type) {
+	case int64:
+		return t, nil
+	case uint64:
+		if t > math.MaxInt64 {
+			return 0, ObjectErrorf(o.Name, CodeInvalidValue, "%s value %d of %s doesn't fit an int64", o.Type, t, o.Name)
+		}
+		return int64(t), nil
+	}
+	return 0, nil
+}
+
+// AsUint64 returns the value of an unsignedInt, unsignedLong, unsignedByte,
+// int or long object
+func (o Object) AsUint64() (uint64, error) {
+	value, err := o.typedValue(TypeUnsignedInt, TypeUnsignedLong, TypeByte, TypeInt, TypeLong)
+	if err != nil {
+		return 0, err
+	}
+	switch t := value.(type) {
+	case uint64:
+		return t, nil
+	case int64:
+		if t < 0 {
+			return 0, ObjectErrorf(o.Name, CodeInvalidValue, "%s value %d of %s is negative", o.Type, t, o.Name)
+		}
+		return uint64(t), nil
+	}
+	return 0, nil
+}
+
+// AsFloat64 returns the value of a float or double object
+func (o Object) AsFloat64() (float64, error) {
+	value, err := o.typedValue(TypeFloat, TypeDouble)
+	if err != nil {
+		return 0, err
+	}
+	return value.(float64), nil
+}
+
+// AsBool returns the value of a boolean object
+func (o Object) AsBool() (bool, error) {
+	value, err := o.typedValue(TypeBool)
+	if err != nil {
+		return false, err
+	}
+	return value.(bool), nil
+}
+
+// AsTime returns the value of a dateTime object, in UTC
+func (o Object) AsTime() (time.Time, error) {
+	value, err := o.typedValue(TypeDateTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return value.(time.Time), nil
+}
+
+// AsBytes returns the value of a base64 object
+func (o Object) AsBytes() ([]byte, error) {
+	value, err := o.typedValue(TypeBase64)
+	if err != nil {
+		return nil, err
+	}
+	return value.([]byte), nil
+}
+
+// typedValue returns the value of the object converted by NormalizeValue, if
+// the object is one of `objectTypes` and has a value
+func (o Object) typedValue(objectTypes ...ObjectType) (interface{}, error) {
+	typeMatches := false
+	for _, objectType := range objectTypes {
+		typeMatches = typeMatches || o.Type == objectType
+	}
+	if !typeMatches {
+		return nil, ObjectErrorf(o.Name, CodeInvalidType, "%s is a %v, not a %v", o.Name, o.Type, objectTypes[0])
+	}
+	if o.Value == nil {
+		return nil, ObjectErrorf(o.Name, CodeInvalidValue, "%s has no value", o.Name)
+	}
+	value, err := NormalizeValue(o.Type, o.Value)
+	if err != nil {
+		return nil, ObjectErrorf(o.Name, CodeOf(err), "%s: %v", o.Name, err)
+	}
+	return value, nil
+}
+
+// DecodeMsgpack decodes the object, converting its value to the Go type of
+// its ObjectType listed by ParseValue, so that each side sees the same type
+// whatever width msgpack encoded it with.  Strings are parsed as the TR-106
+// form of the value.  Values that don't convert are left as decoded.
+func (o *Object) DecodeMsgpack(dec *msgpack.Decoder) error {
+	// The object without its methods, decoded by msgpack as a struct
+	type object Object
+	if err := dec.Decode((*object)(o)); err != nil {
+		return err
+	}
+	if o.Value != nil {
+		if value, err := NormalizeValue(o.Type, o.Value); err == nil {
+			o.Value = value
+		}
+	}
+	return nil
+}
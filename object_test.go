@@ -0,0 +1,108 @@
+package nanodm
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestObjectAccessors(t *testing.T) {
+	dateTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	str, err := NewStringObject("Device.WiFi.SSID", "home").AsString()
+	assert.Nil(t, err)
+	assert.Equal(t, "home", str)
+	intVal, err := NewIntObject("Device.WiFi.Channel", -6).AsInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(-6), intVal)
+	intVal, err = NewUnsignedIntObject("Device.WiFi.Channel", 6).AsInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), intVal)
+	uintVal, err := NewUnsignedLongObject("Device.Bytes", math.MaxUint64).AsUint64()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(math.MaxUint64), uintVal)
+	uintVal, err = NewByteObject("Device.Byte", 7).AsUint64()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), uintVal)
+	floatVal, err := NewFloatObject("Device.Load", 0.5).AsFloat64()
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, floatVal)
+	boolVal, err := NewBoolObject("Device.WiFi.Enable", true).AsBool()
+	assert.Nil(t, err)
+	assert.True(t, boolVal)
+	timeVal, err := NewDateTimeObject("Device.Time", dateTime.In(time.FixedZone("CEST", 2*3600))).AsTime()
+	assert.Nil(t, err)
+	assert.Equal(t, dateTime, timeVal)
+	bytesVal, err := NewBase64Object("Device.Key", []byte("hello")).AsBytes()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), bytesVal)
+
+	// The values of other Go types convert, including the TR-106 strings
+	intVal, err = Object{Name: "Device.WiFi.Channel", Type: TypeInt, Value: uint8(6)}.AsInt64()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), intVal)
+	timeVal, err = Object{Name: "Device.Time", Type: TypeDateTime, Value: "2021-06-01T12:30:00Z"}.AsTime()
+	assert.Nil(t, err)
+	assert.Equal(t, dateTime, timeVal)
+
+	// The declared type is honored
+	_, err = NewStringObject("Device.WiFi.SSID", "6").AsInt64()
+	assert.True(t, errors.Is(err, ErrInvalidType))
+	_, err = NewLongObject("Device.Offset", -1).AsUint64()
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	_, err = NewUnsignedLongObject("Device.Bytes", math.MaxUint64).AsInt64()
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	_, err = Object{Name: "Device.WiFi.Enable", Type: TypeBool, Value: "yes"}.AsBool()
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	_, err = Object{Name: "Device.WiFi.Enable", Type: TypeBool}.AsBool()
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	var objectErr *Error
+	assert.True(t, errors.As(err, &objectErr))
+	assert.Equal(t, "Device.WiFi.Enable", objectErr.Name)
+}
+
+func TestObjectMsgpack(t *testing.T) {
+	dateTime := time.Date(2021, 6, 1, 12, 30, 0, 500, time.UTC)
+	message := Message{Type: SetMessageType, Objects: []Object{
+		{Name: "Device.Int", Type: TypeInt, Value: 6},
+		{Name: "Device.Long", Type: TypeLong, Value: int64(-9000000000)},
+		{Name: "Device.UnsignedInt", Type: TypeUnsignedInt, Value: uint16(300)},
+		{Name: "Device.Byte", Type: TypeByte, Value: 255},
+		{Name: "Device.Float", Type: TypeFloat, Value: float32(0.5)},
+		{Name: "Device.Bool", Type: TypeBool, Value: true},
+		{Name: "Device.Time", Type: TypeDateTime, Value: dateTime.In(time.FixedZone("CEST", 2*3600))},
+		{Name: "Device.Bytes", Type: TypeBase64, Value: []byte{0, 1, 2}},
+		// Strings are parsed as the TR-106 form of the value, the values that
+		// don't convert are left as they are
+		{Name: "Device.Text", Type: TypeInt, Value: "6"},
+		{Name: "Device.Encoded", Type: TypeBase64, Value: "aGVsbG8="},
+		{Name: "Device.Owned", Type: TypeBase64, Value: "wi-fi!"},
+		{Name: "Device.Word", Type: TypeInt, Value: "six"},
+		{Name: "Device.Bad", Type: TypeInt, Value: 1.5},
+		{Name: "Device.Row.", Type: TypeRow, Value: map[string]interface{}{"Port": "80"}},
+	}}
+	msgBytes, err := msgpack.Marshal(&message)
+	assert.Nil(t, err)
+	var decoded Message
+	assert.Nil(t, msgpack.Unmarshal(msgBytes, &decoded))
+
+	var values []interface{}
+	for _, object := range decoded.Objects {
+		values = append(values, object.Value)
+	}
+	assert.Equal(t, []interface{}{
+		int64(6), int64(-9000000000), uint64(300), uint64(255), 0.5, true, dateTime, []byte{0, 1, 2},
+		int64(6), []byte("hello"), "wi-fi!", "six", 1.5, map[string]interface{}{"Port": "80"},
+	}, values)
+
+	// Also in the objects of operations
+	message = Message{Type: PrepareMessageType, Operations: []Operation{{Object: NewIntObject("Device.Int", 6)}}}
+	msgBytes, err = msgpack.Marshal(&message)
+	assert.Nil(t, err)
+	assert.Nil(t, msgpack.Unmarshal(msgBytes, &decoded))
+	assert.Equal(t, int64(6), decoded.Operations[0].Object.Value)
+}
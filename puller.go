@@ -1,12 +1,15 @@
 package nanodm
 
 import (
+	"sync"
+
 	"github.com/sirupsen/logrus"
 	"github.com/vmihailenco/msgpack/v5"
 	"nanomsg.org/go/mangos/v2"
 	"nanomsg.org/go/mangos/v2/protocol/pull"
 
 	// register transports
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
 	_ "nanomsg.org/go/mangos/v2/transport/tcp"
 )
 
@@ -15,7 +18,17 @@ type Puller struct {
 	url         string
 	messageChan chan Message
 
-	pullSock mangos.Socket
+	pullSock  mangos.Socket
+	listener  mangos.Listener
+	closeChan chan struct{}
+	faults    *FaultInjector
+	limits    Limits
+	// Called with the reason of each message rejected
+	rejectHook func(reason string)
+
+	// The pipes connected, by ID
+	pipes      map[uint32]bool
+	pipesMutex sync.Mutex
 }
 
 func NewPuller(log *logrus.Entry, url string, messageChan chan Message) *Puller {
@@ -24,9 +37,32 @@ func NewPuller(log *logrus.Entry, url string, messageChan chan Message) *Puller
 		log:         log,
 		url:         url,
 		messageChan: messageChan,
+		closeChan:   make(chan struct{}),
+		limits:      DefaultLimits,
+		pipes:       make(map[uint32]bool),
 	}
 }
 
+// SetFaultInjector injects the faults of `faults` into the messages
+// received.  Call it before Start.
+func (pu *Puller) SetFaultInjector(faults *FaultInjector) {
+	pu.faults = faults
+}
+
+// SetLimits sets the limits of the messages received, DefaultLimits unless
+// set.  Over tcp a message larger than the MaxMessageSize closes the
+// connection it was sent on.  Call it before Start.
+func (pu *Puller) SetLimits(limits Limits) {
+	pu.limits = limits
+}
+
+// SetRejectHook sets a function called with the reason (RejectSize,
+// RejectDecode or RejectInvalid) of each message received that is rejected,
+// for example to count them.  Call it before Start.
+func (pu *Puller) SetRejectHook(hook func(reason string)) {
+	pu.rejectHook = hook
+}
+
 func (pu *Puller) Start() error {
 	var err error
 
@@ -34,21 +70,57 @@ func (pu *Puller) Start() error {
 		pu.log.Errorf("Failed to open pull socket: %v", err)
 		return err
 	}
-
-	if err = pu.pullSock.Listen(pu.url); err != nil {
-		pu.log.Errorf("Failed to Listen for pull socket on %s: %v", pu.url, err)
+	if err = pu.pullSock.SetOption(mangos.OptionMaxRecvSize, pu.limits.MaxMessageSize); err != nil {
+		pu.log.Errorf("Failed to set the maximum message size of pull socket: %v", err)
 		return err
 	}
 	pu.pullSock.SetPipeEventHook(func(event mangos.PipeEvent, pipe mangos.Pipe) {
-		pu.log.Debugf("Pull socket event (%s) (%v) %+v", pu.url, event, pipe)
+		pu.log.Debugf("Pull socket event (%s) (%v) pipe %d from %s", pu.url, event, pipe.ID(), pipe.Address())
+		pu.pipesMutex.Lock()
+		defer pu.pipesMutex.Unlock()
+		switch event {
+		case mangos.PipeEventAttached:
+			pu.pipes[pipe.ID()] = true
+		case mangos.PipeEventDetached:
+			delete(pu.pipes, pipe.ID())
+		}
 	})
 
+	if pu.listener, err = pu.pullSock.NewListener(pu.url, nil); err != nil {
+		pu.log.Errorf("Failed to create listener for pull socket on %s: %v", pu.url, err)
+		return err
+	}
+	if err = pu.listener.Listen(); err != nil {
+		pu.log.Errorf("Failed to Listen for pull socket on %s: %v", pu.url, err)
+		return err
+	}
+
 	go pu.pullTask()
 
 	return nil
 }
 
+// Address returns the url the puller listens on once started.  A tcp url with
+// port 0 is given the port chosen by the system.
+func (pu *Puller) Address() string {
+	if pu.listener == nil {
+		return pu.url
+	}
+	return pu.listener.Address()
+}
+
+// Connected returns true if the pipe `pipe`, the Pipe of a message received,
+// is still connected
+func (pu *Puller) Connected(pipe uint32) bool {
+	pu.pipesMutex.Lock()
+	defer pu.pipesMutex.Unlock()
+	return pu.pipes[pipe]
+}
+
+// Stop closes the socket.  The messages still delayed or held by the fault
+// injector are dropped.
 func (pu *Puller) Stop() error {
+	close(pu.closeChan)
 	err := pu.pullSock.Close()
 	if err != nil {
 		pu.log.Errorf("Failed to close pull socket: %v", err)
@@ -60,19 +132,62 @@ func (pu *Puller) Stop() error {
 func (pu *Puller) pullTask() {
 	defer pu.log.Infof("Exiting pullTask (%s)", pu.url)
 	for {
-		var message Message
-		msgBytes, err := pu.pullSock.Recv()
+		msg, err := pu.pullSock.RecvMsg()
 		if err != nil {
 			pu.log.Errorf("cannot receive from mangos Socket (%s): %v", pu.url, err)
 			return
 		}
+		msgBytes := msg.Body
+		var pipe uint32
+		if msg.Pipe != nil {
+			pipe = msg.Pipe.ID()
+		}
 		if len(msgBytes) == 0 {
 			continue
 		}
-		err = msgpack.Unmarshal(msgBytes, &message)
-		if err != nil {
-			pu.log.Errorf("cannot Unmarshal (%s)(%v): %v", pu.url, msgBytes, err)
+		if pu.faults == nil {
+			pu.forward(pipe, msgBytes)
+			continue
 		}
-		pu.messageChan <- message
+		// The faults match the message decoded
+		var message Message
+		msgpack.Unmarshal(msgBytes, &message)
+		pu.faults.inject(true, pu.url, &message, msgBytes, func(msgBytes []byte) {
+			pu.forward(pipe, msgBytes)
+		})
+	}
+}
+
+// forward decodes and validates a message received on `pipe`, and passes it
+// on unless it's rejected or the puller is stopped
+func (pu *Puller) forward(pipe uint32, msgBytes []byte) {
+	message, reason, err := DecodeMessage(msgBytes, pu.limits)
+	if err != nil {
+		pu.log.Warnf("Rejected message received (%s) on pipe %d: %v", pu.url, pipe, err)
+		if pu.rejectHook != nil {
+			pu.rejectHook(reason)
+		}
+		return
+	}
+	message.Pipe = pipe
+	select {
+	case pu.messageChan <- message:
+	case <-pu.closeChan:
+	}
+}
+
+// DecodeMessage decodes and validates the bytes of a message received.  If
+// the message is rejected it returns the reason (RejectSize, RejectDecode or
+// RejectInvalid) and the error.
+func DecodeMessage(msgBytes []byte, limits Limits) (message Message, reason string, err error) {
+	if limits.MaxMessageSize > 0 && len(msgBytes) > limits.MaxMessageSize {
+		return Message{}, RejectSize, Errorf(CodeResourcesExceeded, "message of %d bytes is larger than %d", len(msgBytes), limits.MaxMessageSize)
+	}
+	if err = msgpack.Unmarshal(msgBytes, &message); err != nil {
+		return Message{}, RejectDecode, Errorf(CodeInvalidValue, "cannot decode message: %w", err)
+	}
+	if err = ValidateMessage(&message, limits); err != nil {
+		return Message{}, RejectInvalid, err
 	}
+	return message, "", nil
 }
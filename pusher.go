@@ -9,6 +9,7 @@ import (
 	"nanomsg.org/go/mangos/v2/protocol/push"
 
 	// register transports
+	_ "nanomsg.org/go/mangos/v2/transport/inproc"
 	_ "nanomsg.org/go/mangos/v2/transport/tcp"
 )
 
@@ -24,6 +25,7 @@ type Pusher struct {
 
 	pushSock  mangos.Socket
 	closeChan chan struct{}
+	faults    *FaultInjector
 }
 
 func NewPusher(log *logrus.Entry, url string, messageChan chan Message) *Pusher {
@@ -36,6 +38,12 @@ func NewPusher(log *logrus.Entry, url string, messageChan chan Message) *Pusher
 	}
 }
 
+// SetFaultInjector injects the faults of `faults` into the messages sent.
+// Call it before Start.
+func (pu *Pusher) SetFaultInjector(faults *FaultInjector) {
+	pu.faults = faults
+}
+
 func (pu *Pusher) Start() error {
 	var err error
 
@@ -91,10 +99,12 @@ func (pu *Pusher) pushTask() {
 				pu.log.Errorf("[%s] Failed to Marshal message %+v: %v", pu.url, message, err)
 				continue
 			}
-			err = pu.pushSock.Send(msgBytes)
-			if err != nil {
-				pu.log.Errorf("[%s] Failed to send message %+v: %v", pu.url, message, err)
-			}
+			pu.faults.inject(false, pu.url, &message, msgBytes, func(msgBytes []byte) {
+				err := pu.pushSock.Send(msgBytes)
+				if err != nil {
+					pu.log.Errorf("[%s] Failed to send message %+v: %v", pu.url, message, err)
+				}
+			})
 		case <-pu.closeChan:
 			pu.log.Warnf("[%s] closing push task", pu.url)
 			return
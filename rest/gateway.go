@@ -0,0 +1,425 @@
+package rest
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/coordinator"
+)
+
+const (
+	API_PREFIX = "/api/v1"
+
+	defaultShutdownTimeout = 5 * time.Second
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Gateway exposes the data model of a coordinator server as JSON over HTTP
+type Gateway struct {
+	log    *logrus.Entry
+	addr   string
+	server *coordinator.Server
+
+	httpServer *http.Server
+	listener   net.Listener
+	mux        *http.ServeMux
+}
+
+// ObjectError describes the failure of a request for a single object
+type ObjectError struct {
+	Name   string           `json:"name,omitempty"`
+	Error  string           `json:"error"`
+	Status int              `json:"status"`
+	Code   nanodm.ErrorCode `json:"code,omitempty"`
+}
+
+// Response is the body returned by every endpoint of the gateway
+type Response struct {
+	Objects []nanodm.Object          `json:"objects,omitempty"`
+	Sources []coordinator.SourceInfo `json:"sources,omitempty"`
+	Row     string                   `json:"row,omitempty"`
+	Errors  []ObjectError            `json:"errors,omitempty"`
+}
+
+// SetObject is an object to set in a SetRequest.  The registered type of the
+// object is used if Type is omitted.
+type SetObject struct {
+	Name  string             `json:"name"`
+	Type  *nanodm.ObjectType `json:"type,omitempty"`
+	Value interface{}        `json:"value,omitempty"`
+}
+
+// SetRequest is the body of a PUT to the objects endpoint
+type SetRequest struct {
+	Objects []SetObject `json:"objects"`
+	// Restore the objects that were set if any object fails to be set
+	AllOrNothing bool `json:"allOrNothing,omitempty"`
+}
+
+// NewGateway creates a gateway serving the coordinator `server` on the TCP
+// address `addr` (for example "127.0.0.1:8080").
+func NewGateway(log *logrus.Entry, addr string, server *coordinator.Server) *Gateway {
+	gw := &Gateway{
+		log:    log,
+		addr:   addr,
+		server: server,
+		mux:    http.NewServeMux(),
+	}
+
+	gw.mux.HandleFunc(API_PREFIX+"/objects", gw.handleObjects)
+	gw.mux.HandleFunc(API_PREFIX+"/rows", gw.handleRows)
+	gw.mux.HandleFunc(API_PREFIX+"/list", gw.handleList)
+	gw.mux.HandleFunc(API_PREFIX+"/sources", gw.handleSources)
+	gw.mux.HandleFunc(API_PREFIX+"/openapi.json", gw.handleOpenAPI)
+	gw.mux.Handle("/metrics", server.Metrics())
+
+	return gw
+}
+
+// Start listens on the gateway address and serves requests in the background
+func (gw *Gateway) Start() error {
+	var err error
+
+	if gw.listener, err = net.Listen("tcp", gw.addr); err != nil {
+		gw.log.Errorf("Failed to listen on %s: %v", gw.addr, err)
+		return err
+	}
+	gw.httpServer = &http.Server{Handler: gw}
+
+	go func() {
+		err := gw.httpServer.Serve(gw.listener)
+		if err != nil && err != http.ErrServerClosed {
+			gw.log.Errorf("HTTP gateway on %s exited: %v", gw.addr, err)
+		}
+	}()
+
+	return nil
+}
+
+func (gw *Gateway) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
+	defer cancel()
+	return gw.httpServer.Shutdown(ctx)
+}
+
+// Addr returns the address the gateway is listening on
+func (gw *Gateway) Addr() string {
+	if gw.listener != nil {
+		return gw.listener.Addr().String()
+	}
+	return gw.addr
+}
+
+// ServeHTTP allows the gateway to be mounted on an existing HTTP server
+func (gw *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gw.log.Debugf("%s %s", r.Method, r.URL.String())
+	gw.mux.ServeHTTP(w, r)
+}
+
+func (gw *Gateway) handleObjects(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		gw.handleGet(w, r)
+	case http.MethodPut, http.MethodPatch:
+		gw.handleSet(w, r)
+	default:
+		gw.respondMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodPatch)
+	}
+}
+
+// handleGet gets each `path` query parameter.  Paths ending in "." are partial
+// paths and return every object under the path.
+func (gw *Gateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	var response Response
+
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		gw.respondError(w, http.StatusBadRequest, "", "at least one path query parameter is required")
+		return
+	}
+
+	for _, path := range paths {
+		objects, errs := gw.server.GetPartial(path)
+		response.Objects = append(response.Objects, objects...)
+		for _, err := range errs {
+			response.Errors = append(response.Errors, objectError(path, err))
+		}
+	}
+
+	gw.respond(w, &response, len(response.Objects) > 0)
+}
+
+func (gw *Gateway) handleSet(w http.ResponseWriter, r *http.Request) {
+	var request SetRequest
+	var response Response
+
+	if err := decodeBody(r, &request); err != nil {
+		gw.respondError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if len(request.Objects) == 0 {
+		gw.respondError(w, http.StatusBadRequest, "", "at least one object is required")
+		return
+	}
+
+	var objects []nanodm.Object
+	for _, setObject := range request.Objects {
+		object, err := gw.coerceObject(setObject)
+		if err != nil {
+			response.Errors = append(response.Errors, objectError(setObject.Name, err))
+			continue
+		}
+		objects = append(objects, object)
+	}
+	if request.AllOrNothing && len(response.Errors) > 0 {
+		gw.respond(w, &response, false)
+		return
+	}
+
+	succeeded := false
+	result := gw.server.SetObjects(requestContext(r), objects, request.AllOrNothing)
+	for _, object := range objects {
+		if err, failed := result.Errors[object.Name]; failed {
+			response.Errors = append(response.Errors, objectError(object.Name, err))
+			continue
+		}
+		succeeded = true
+	}
+
+	gw.respond(w, &response, succeeded)
+}
+
+// handleRows adds (POST) or deletes (DELETE) a row of a dynamic list
+func (gw *Gateway) handleRows(w http.ResponseWriter, r *http.Request) {
+	var response Response
+
+	switch r.Method {
+	case http.MethodPost:
+		var object nanodm.Object
+		if err := decodeBody(r, &object); err != nil {
+			gw.respondError(w, http.StatusBadRequest, "", err.Error())
+			return
+		}
+		if object.Name == "" {
+			gw.respondError(w, http.StatusBadRequest, "", "the dynamic list name is required")
+			return
+		}
+		object.Type = nanodm.TypeRow
+		object.Value = normalizeNumbers(object.Value)
+
+		row, err := gw.server.AddRowContext(requestContext(r), object)
+		if err != nil {
+			response.Errors = append(response.Errors, objectError(object.Name, err))
+			gw.respond(w, &response, false)
+			return
+		}
+		response.Row = row
+		gw.writeJSON(w, http.StatusCreated, &response)
+	case http.MethodDelete:
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			gw.respondError(w, http.StatusBadRequest, "", "the name query parameter is required")
+			return
+		}
+
+		err := gw.server.DeleteRowContext(requestContext(r), nanodm.Object{Name: name, Type: nanodm.TypeRow})
+		if err != nil {
+			response.Errors = append(response.Errors, objectError(name, err))
+		}
+		gw.respond(w, &response, err == nil)
+	default:
+		gw.respondMethodNotAllowed(w, http.MethodPost, http.MethodDelete)
+	}
+}
+
+// handleList lists the registered objects at each `path` query parameter
+func (gw *Gateway) handleList(w http.ResponseWriter, r *http.Request) {
+	var response Response
+
+	if r.Method != http.MethodGet {
+		gw.respondMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	paths := r.URL.Query()["path"]
+	if len(paths) == 0 {
+		gw.respondError(w, http.StatusBadRequest, "", "at least one path query parameter is required")
+		return
+	}
+
+	for _, path := range paths {
+		objects, err := gw.server.List(path)
+		if err != nil {
+			response.Errors = append(response.Errors, ObjectError{Name: path, Error: err.Error(), Status: http.StatusNotFound})
+			continue
+		}
+		response.Objects = append(response.Objects, objects...)
+	}
+
+	gw.respond(w, &response, len(response.Objects) > 0)
+}
+
+func (gw *Gateway) handleSources(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		gw.respondMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	gw.writeJSON(w, http.StatusOK, &Response{Sources: gw.server.Sources()})
+}
+
+func (gw *Gateway) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		gw.respondMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// coerceObject converts the JSON decoded value of `setObject` to the Go type
+// of its object type.  If the request didn't specify a type the registered
+// type is used, or string for an object that isn't registered on its own such
+// as the parameter of a row.  Typed values can be given as JSON numbers and
+// booleans, or in their TR-106 string form.
+func (gw *Gateway) coerceObject(setObject SetObject) (nanodm.Object, error) {
+	object := nanodm.Object{Name: setObject.Name, Type: nanodm.TypeString, Value: setObject.Value}
+	if setObject.Type != nil {
+		object.Type = *setObject.Type
+	} else if registered, listErr := gw.server.List(object.Name); listErr == nil && len(registered) == 1 {
+		object.Type = registered[0].Type
+	}
+
+	var text string
+	switch value := object.Value.(type) {
+	case json.Number:
+		text = value.String()
+	case string:
+		text = value
+	default:
+		return object, nil
+	}
+	if object.Type == nanodm.TypeString || !object.Type.IsValue() {
+		object.Value = text
+		return object, nil
+	}
+
+	value, err := nanodm.ParseValue(object.Type, text)
+	if err != nil {
+		return object, nanodm.ObjectErrorf(object.Name, nanodm.CodeInvalidValue, "invalid value for %s: %v", object.Name, err)
+	}
+	object.Value = value
+	return object, nil
+}
+
+// respond writes `response` with a status derived from its errors.  A request
+// that partially succeeded returns 207 (Multi-Status).
+func (gw *Gateway) respond(w http.ResponseWriter, response *Response, succeeded bool) {
+	status := http.StatusOK
+	if len(response.Errors) > 0 {
+		if succeeded {
+			status = http.StatusMultiStatus
+		} else {
+			status = response.Errors[0].Status
+		}
+	}
+	gw.writeJSON(w, status, response)
+}
+
+func (gw *Gateway) respondError(w http.ResponseWriter, status int, name string, errMsg string) {
+	gw.writeJSON(w, status, &Response{
+		Errors: []ObjectError{{Name: name, Error: errMsg, Status: status}},
+	})
+}
+
+func (gw *Gateway) respondMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	gw.respondError(w, http.StatusMethodNotAllowed, "", "method not allowed")
+}
+
+func (gw *Gateway) writeJSON(w http.ResponseWriter, status int, response *Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		gw.log.Errorf("Failed to encode response: %v", err)
+	}
+}
+
+// requestContext returns the context of `r` carrying the identity of the
+// client for the audit log: the basic auth user if any, and the client address
+func requestContext(r *http.Request) context.Context {
+	identity := r.RemoteAddr
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		identity = user + "@" + r.RemoteAddr
+	}
+	return audit.ContextWithIdentity(r.Context(), identity)
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
+
+// normalizeNumbers replaces the json.Number values of a decoded row with an
+// int64 or float64
+func normalizeNumbers(value interface{}) interface{} {
+	switch t := value.(type) {
+	case json.Number:
+		if intVal, err := t.Int64(); err == nil {
+			return intVal
+		}
+		if floatVal, err := t.Float64(); err == nil {
+			return floatVal
+		}
+		return t.String()
+	case map[string]interface{}:
+		for key, val := range t {
+			t[key] = normalizeNumbers(val)
+		}
+	case []interface{}:
+		for i, val := range t {
+			t[i] = normalizeNumbers(val)
+		}
+	}
+	return value
+}
+
+// objectError maps an error returned by the coordinator to an HTTP status
+func objectError(name string, err error) ObjectError {
+	return ObjectError{
+		Name:   name,
+		Error:  err.Error(),
+		Status: statusFromError(err),
+		Code:   nanodm.CodeOf(err),
+	}
+}
+
+var errorCodeStatus = map[nanodm.ErrorCode]int{
+	nanodm.CodeNotFound:          http.StatusNotFound,
+	nanodm.CodeAccessDenied:      http.StatusForbidden,
+	nanodm.CodeInvalidType:       http.StatusBadRequest,
+	nanodm.CodeInvalidValue:      http.StatusBadRequest,
+	nanodm.CodeResourcesExceeded: http.StatusInsufficientStorage,
+	nanodm.CodeTimeout:           http.StatusGatewayTimeout,
+	nanodm.CodeSourceUnavailable: http.StatusServiceUnavailable,
+}
+
+func statusFromError(err error) int {
+	if status, ok := errorCodeStatus[nanodm.CodeOf(err)]; ok {
+		return status
+	}
+	return http.StatusBadGateway
+}
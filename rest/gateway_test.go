@@ -0,0 +1,296 @@
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+	"github.com/zackwine/nanodm/source"
+)
+
+type TestSource struct {
+	objectMap    map[string]nanodm.Object
+	objectValues map[string]interface{}
+	nextIndex    int
+	lock         sync.Mutex
+}
+
+func (ts *TestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, name := range objectNames {
+		object, ok := ts.objectMap[name]
+		if !ok {
+			return objects, fmt.Errorf("unable to get object %s", name)
+		}
+		if object.Type == nanodm.TypeDynamicList {
+			for rowObjName, rowObject := range ts.objectMap {
+				if strings.HasPrefix(rowObjName, name) && rowObjName != name {
+					rowObject.Value = ts.objectValues[rowObjName]
+					objects = append(objects, rowObject)
+				}
+			}
+			continue
+		}
+		object.Value = ts.objectValues[name]
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (ts *TestSource) SetObjects(objects []nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, object := range objects {
+		ts.objectValues[object.Name] = object.Value
+	}
+	return nil
+}
+
+func (ts *TestSource) AddRow(object nanodm.Object) (row string, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	parameterMap, typeOk := object.Value.(map[string]interface{})
+	if !typeOk {
+		return "", fmt.Errorf("object value type is not map[string]interface{}")
+	}
+	row = fmt.Sprintf("%s%d.", object.Name, ts.nextIndex)
+	for paramName, paramValue := range parameterMap {
+		ts.objectMap[row+paramName] = nanodm.Object{Name: row + paramName, Type: nanodm.TypeString}
+		ts.objectValues[row+paramName] = paramValue
+	}
+	ts.nextIndex++
+	return row, nil
+}
+
+func (ts *TestSource) DeleteRow(row nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for objName := range ts.objectMap {
+		if strings.HasPrefix(objName, row.Name) {
+			delete(ts.objectMap, objName)
+			delete(ts.objectValues, objName)
+		}
+	}
+	return nil
+}
+
+func getLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	return logrus.NewEntry(logger)
+}
+
+func doRequest(t *testing.T, method string, url string, body interface{}) (int, Response) {
+	var response Response
+	var reqBody bytes.Buffer
+
+	if body != nil {
+		assert.Nil(t, json.NewEncoder(&reqBody).Encode(body))
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	assert.Nil(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&response))
+	return resp.StatusCode, response
+}
+
+func TestGateway(t *testing.T) {
+	serverUrl := "tcp://127.0.0.1:4600"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4601"
+
+	objectMapSource := map[string]nanodm.Object{
+		"Device.Custom.Setting1": {
+			Name:   "Device.Custom.Setting1",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Setting2": {
+			Name:   "Device.Custom.Setting2",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeInt,
+		},
+		"Device.Custom.Dynamic.": {
+			Name:   "Device.Custom.Dynamic.",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeDynamicList,
+		},
+	}
+	objectValuesSource := map[string]interface{}{
+		"Device.Custom.Setting1": "8.8.8.8",
+		"Device.Custom.Setting2": 600,
+	}
+
+	log := getLogger()
+
+	server := coordinator.NewServer(log, serverUrl, nil)
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		objectMap:    objectMapSource,
+		objectValues: objectValuesSource,
+	}
+	src := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+
+	err = src.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+	<-time.After(2 * time.Second)
+
+	httpServer := httptest.NewServer(NewGateway(log, "", server))
+	defer httpServer.Close()
+	baseUrl := httpServer.URL + API_PREFIX
+
+	// Exact get
+	status, response := doRequest(t, http.MethodGet, baseUrl+"/objects?path=Device.Custom.Setting1", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(response.Objects))
+	assert.Equal(t, "8.8.8.8", response.Objects[0].Value)
+
+	// Partial get
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/objects?path=Device.Custom.", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(response.Objects))
+
+	// Unknown object
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/objects?path=Not.Valid", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, 1, len(response.Errors))
+	assert.Equal(t, "Not.Valid", response.Errors[0].Name)
+	assert.Equal(t, nanodm.CodeNotFound, response.Errors[0].Code)
+
+	// Partially successful get
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/objects?path=Device.Custom.Setting1&path=Not.Valid", nil)
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, 1, len(response.Objects))
+	assert.Equal(t, 1, len(response.Errors))
+
+	// Missing path
+	status, _ = doRequest(t, http.MethodGet, baseUrl+"/objects", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Set with the type taken from the registered object
+	status, _ = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects: []SetObject{{Name: "Device.Custom.Setting2", Value: 700}},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	testSource.lock.Lock()
+	assert.EqualValues(t, 700, testSource.objectValues["Device.Custom.Setting2"])
+	testSource.lock.Unlock()
+
+	status, response = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects: []SetObject{{Name: "Not.Valid", Value: "1"}},
+	})
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, 1, len(response.Errors))
+
+	// Nothing is set by an all or nothing set that fails
+	status, response = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects:      []SetObject{{Name: "Device.Custom.Setting2", Value: 800}, {Name: "Not.Valid", Value: "1"}},
+		AllOrNothing: true,
+	})
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, 2, len(response.Errors))
+	testSource.lock.Lock()
+	assert.EqualValues(t, 700, testSource.objectValues["Device.Custom.Setting2"])
+	testSource.lock.Unlock()
+
+	// Add and delete a row
+	status, response = doRequest(t, http.MethodPost, baseUrl+"/rows", &nanodm.Object{
+		Name:  "Device.Custom.Dynamic.",
+		Value: map[string]interface{}{"Value1": "one"},
+	})
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "Device.Custom.Dynamic.0.", response.Row)
+
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/objects?path=Device.Custom.Dynamic.", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(response.Objects))
+
+	// The parameters of a row are strings unless the request gives their type
+	status, response = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects: []SetObject{{Name: "Device.Custom.Dynamic.0.Value1", Value: 42}},
+	})
+	assert.Equal(t, http.StatusOK, status, "%+v", response)
+	testSource.lock.Lock()
+	assert.Equal(t, "42", testSource.objectValues["Device.Custom.Dynamic.0.Value1"])
+	testSource.lock.Unlock()
+	intType := nanodm.TypeInt
+	status, response = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects: []SetObject{{Name: "Device.Custom.Dynamic.0.Value1", Type: &intType, Value: 43}},
+	})
+	assert.Equal(t, http.StatusOK, status, "%+v", response)
+	testSource.lock.Lock()
+	assert.EqualValues(t, 43, testSource.objectValues["Device.Custom.Dynamic.0.Value1"])
+	testSource.lock.Unlock()
+
+	// An explicit string type is kept over the registered type
+	stringType := nanodm.TypeString
+	status, response = doRequest(t, http.MethodPut, baseUrl+"/objects", &SetRequest{
+		Objects: []SetObject{{Name: "Device.Custom.Setting2", Type: &stringType, Value: "0x10"}},
+	})
+	assert.Equal(t, http.StatusOK, status, "%+v", response)
+	testSource.lock.Lock()
+	assert.Equal(t, "0x10", testSource.objectValues["Device.Custom.Setting2"])
+	testSource.objectValues["Device.Custom.Setting2"] = 700
+	testSource.lock.Unlock()
+
+	status, _ = doRequest(t, http.MethodDelete, baseUrl+"/rows?name="+url.QueryEscape("Device.Custom.Dynamic.0."), nil)
+	assert.Equal(t, http.StatusOK, status)
+	testSource.lock.Lock()
+	assert.Equal(t, 0, len(testSource.objectValues)-2)
+	testSource.lock.Unlock()
+
+	// List
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/list?path=Device.Custom.", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 2, len(response.Objects))
+
+	// Sources
+	status, response = doRequest(t, http.MethodGet, baseUrl+"/sources", nil)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, len(response.Sources))
+	assert.Equal(t, sourceName, response.Sources[0].Name)
+	assert.Equal(t, len(objectMapSource), response.Sources[0].Objects)
+
+	// Unsupported method
+	status, _ = doRequest(t, http.MethodDelete, baseUrl+"/objects", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, status)
+
+	// OpenAPI description
+	resp, err := http.Get(baseUrl + "/openapi.json")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var spec map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&spec))
+	assert.Equal(t, "3.0.3", spec["openapi"])
+
+	// Metrics of the coordinator
+	resp, err = http.Get(httpServer.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `nanodm_coordinator_responses_total{type="AddRow",source="testSource",result="ack"} 1`)
+	assert.Contains(t, string(body), fmt.Sprintf(`nanodm_coordinator_objects{source="testSource"} %d`, len(objectMapSource)))
+}
@@ -0,0 +1,62 @@
+package source
+
+import (
+	"net/http"
+
+	"github.com/zackwine/nanodm/metrics"
+)
+
+// Results of a request sent to the server, or handled for the server
+const (
+	ResultAck     = "ack"
+	ResultNack    = "nack"
+	ResultTimeout = "timeout"
+)
+
+// SourceMetrics are the metrics maintained by a source.  Requests are labelled
+// by the message type.
+type SourceMetrics struct {
+	Registry *metrics.Registry
+
+	// Requests sent to the server
+	Requests *metrics.Counter
+	// Responses to requests sent to the server by result (ack, nack or timeout)
+	Responses *metrics.Counter
+	// Round-trip latency of requests that were acked or nacked
+	Latency *metrics.Histogram
+	// Requests waiting for a response from the server
+	InFlight *metrics.Gauge
+	// Requests from the server handled by the SourceHandler, by result (ack
+	// or nack)
+	Handled *metrics.Counter
+	// Time spent in the SourceHandler
+	HandlerLatency *metrics.Histogram
+	// Objects registered with the server
+	Objects *metrics.Gauge
+	// Ping checks that found no recent ping from the server
+	PingMisses *metrics.Counter
+	// Messages received that were rejected, by reason (size, decode or
+	// invalid)
+	Rejected *metrics.Counter
+}
+
+func newSourceMetrics() *SourceMetrics {
+	registry := metrics.NewRegistry()
+	return &SourceMetrics{
+		Registry:       registry,
+		Requests:       registry.NewCounter("nanodm_source_requests_total", "Requests sent to the server.", "type"),
+		Responses:      registry.NewCounter("nanodm_source_responses_total", "Responses to requests sent to the server by result (ack, nack or timeout).", "type", "result"),
+		Latency:        registry.NewHistogram("nanodm_source_request_duration_seconds", "Round-trip latency of requests sent to the server.", metrics.DefaultLatencyBuckets, "type"),
+		InFlight:       registry.NewGauge("nanodm_source_requests_in_flight", "Requests waiting for a response from the server."),
+		Handled:        registry.NewCounter("nanodm_source_handled_total", "Requests from the server handled by the source by result (ack or nack).", "type", "result"),
+		HandlerLatency: registry.NewHistogram("nanodm_source_handler_duration_seconds", "Time spent handling requests from the server.", metrics.DefaultLatencyBuckets, "type"),
+		Objects:        registry.NewGauge("nanodm_source_objects", "Objects registered with the server."),
+		PingMisses:     registry.NewCounter("nanodm_source_ping_misses_total", "Ping checks that found no recent ping from the server."),
+		Rejected:       registry.NewCounter("nanodm_source_messages_rejected_total", "Messages received that were rejected by reason (size, decode or invalid).", "reason"),
+	}
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (sm *SourceMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sm.Registry.ServeHTTP(w, r)
+}
@@ -1,12 +1,15 @@
 package source
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/tracing"
 )
 
 const (
@@ -25,17 +28,33 @@ type Source struct {
 	pusher           *nanodm.Pusher
 	pusherChan       chan nanodm.Message
 	pusherAckTimeout time.Duration
-	objects          []nanodm.Object
+	// The objects registered, and whether they are, guarded by the
+	// registrationMutex as the pingTask registers again
+	objects           []nanodm.Object
+	registered        bool
+	registrationMutex sync.Mutex
 
 	puller        *nanodm.Puller
 	pullerChan    chan nanodm.Message
 	pullerClose   chan struct{}
 	ackMap        *nanodm.ConcurrentMessageMap
-	registered    bool
 	lastPing      time.Time
 	lastPingMutex sync.Mutex
+	metrics       *SourceMetrics
+	tracer        *tracing.Tracer
+	clock         nanodm.Clock
+	faults        *nanodm.FaultInjector
+	limits        nanodm.Limits
+
+	// The two-phase commit transactions, by transaction ID
+	transactions    map[string]*sourceTransaction
+	preparedTimeout time.Duration
 }
 
+// SourceHandler handles the requests of the server for the objects of a
+// source.  An error returned is sent to the server with its code if it's a
+// nanodm.Error (see nanodm.Errorf and nanodm.ObjectErrorf), or nanodm.Errors
+// for the errors of several objects, and as an internal error otherwise.
 type SourceHandler interface {
 	GetObjects(objectNames []string) (objects []nanodm.Object, err error)
 	SetObjects(objects []nanodm.Object) error
@@ -43,6 +62,16 @@ type SourceHandler interface {
 	DeleteRow(row nanodm.Object) error
 }
 
+// ContextSourceHandler can be implemented by a SourceHandler to receive the
+// context of each request, which carries the trace span of the request.  When
+// implemented these are called instead of the SourceHandler methods.
+type ContextSourceHandler interface {
+	GetObjectsContext(ctx context.Context, objectNames []string) (objects []nanodm.Object, err error)
+	SetObjectsContext(ctx context.Context, objects []nanodm.Object) error
+	AddRowContext(ctx context.Context, object nanodm.Object) (row string, err error)
+	DeleteRowContext(ctx context.Context, row nanodm.Object) error
+}
+
 // NewSource creates a new source where `name` should be unique to the
 // server at `serverUrl`.
 func NewSource(log *logrus.Entry, name string, serverUrl string, pullUrl string, handler SourceHandler) *Source {
@@ -57,6 +86,11 @@ func NewSource(log *logrus.Entry, name string, serverUrl string, pullUrl string,
 		pullerChan:       make(chan nanodm.Message),
 		pullerClose:      make(chan struct{}),
 		ackMap:           nanodm.NewConcurrentMessageMap(),
+		metrics:          newSourceMetrics(),
+		transactions:     make(map[string]*sourceTransaction),
+		preparedTimeout:  defaultPreparedTimeout,
+		clock:            nanodm.SystemClock,
+		limits:           nanodm.DefaultLimits,
 	}
 }
 
@@ -74,14 +108,51 @@ func (so *Source) SetHandler(handler SourceHandler) {
 	so.handler = handler
 }
 
+// SetTracer enables tracing of requests sent and handled by the source.
+// Tracing is disabled if `tracer` is nil.
+func (so *Source) SetTracer(tracer *tracing.Tracer) {
+	so.tracer = tracer
+}
+
+// SetClock sets the clock that times the pings of the server.  Call it
+// before Connect.
+func (so *Source) SetClock(clock nanodm.Clock) {
+	so.clock = clock
+}
+
+// SetFaultInjector injects the faults of `faults` into the messages the
+// source sends and receives, to test how it behaves when the transport
+// fails.  Call it before Connect.
+func (so *Source) SetFaultInjector(faults *nanodm.FaultInjector) {
+	so.faults = faults
+}
+
+// SetLimits sets the limits of the messages the source accepts from the
+// server, nanodm.DefaultLimits unless set.  Call it before Connect.
+func (so *Source) SetLimits(limits nanodm.Limits) {
+	so.limits = limits
+}
+
+// Metrics returns the metrics of the source, which can be served as a
+// /metrics endpoint
+func (so *Source) Metrics() *SourceMetrics {
+	return so.metrics
+}
+
 func (so *Source) Connect() error {
 	so.pusher = nanodm.NewPusher(so.log, so.serverUrl, so.pusherChan)
+	so.pusher.SetFaultInjector(so.faults)
 	err := so.pusher.Start()
 	if err != nil {
 		return err
 	}
 
 	so.puller = nanodm.NewPuller(so.log, so.pullUrl, so.pullerChan)
+	so.puller.SetFaultInjector(so.faults)
+	so.puller.SetLimits(so.limits)
+	so.puller.SetRejectHook(func(reason string) {
+		so.metrics.Rejected.Inc(reason)
+	})
 	err = so.puller.Start()
 	if err != nil {
 		so.pusher.Stop()
@@ -95,7 +166,7 @@ func (so *Source) Connect() error {
 }
 
 func (so *Source) Disconnect() error {
-	if so.registered {
+	if so.isRegistered() {
 		so.Unregister()
 	}
 	return nil
@@ -103,20 +174,23 @@ func (so *Source) Disconnect() error {
 
 func (so *Source) Register(objects []nanodm.Object) error {
 	message := so.newMessage(nanodm.RegisterMessageType)
-	so.objects = objects
+	so.setRegistration(objects, so.isRegistered())
 	message.Objects = objects
-	so.pusherChan <- message
+	message.Capabilities = so.capabilities()
 
 	// Wait for ack
-	ackMessage, err := so.ackMap.WaitForKey(message.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(context.Background(), message)
 	if err != nil {
 		return err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
-		so.registered = true
+		so.setRegistration(objects, true)
+		// The server pings from the registration on
+		so.updatePing()
+		so.metrics.Objects.Set(float64(len(objects)))
 		return nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("received registration error: %v", ackMessage.Error)
+		return fmt.Errorf("received registration error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
@@ -125,78 +199,181 @@ func (so *Source) Register(objects []nanodm.Object) error {
 func (so *Source) Unregister() error {
 	var err error
 	unregMessage := so.newMessage(nanodm.UnregisterMessageType)
-	so.pusherChan <- unregMessage
-	so.registered = false
+	so.setRegistration(so.registeredObjects(), false)
+	so.metrics.Objects.Set(0)
 
-	ackMessage, err := so.ackMap.WaitForKey(unregMessage.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(context.Background(), unregMessage)
 	if err != nil {
 		return err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		return nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("received unregistration error: %v", ackMessage.Error)
+		return fmt.Errorf("received unregistration error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
 
 }
 
+func (so *Source) setRegistration(objects []nanodm.Object, registered bool) {
+	so.registrationMutex.Lock()
+	defer so.registrationMutex.Unlock()
+	so.objects = objects
+	so.registered = registered
+}
+
+func (so *Source) registeredObjects() []nanodm.Object {
+	so.registrationMutex.Lock()
+	defer so.registrationMutex.Unlock()
+	return so.objects
+}
+
+func (so *Source) isRegistered() bool {
+	so.registrationMutex.Lock()
+	defer so.registrationMutex.Unlock()
+	return so.registered
+}
+
 func (so *Source) UpdateObjects(objects []nanodm.Object) error {
 	var err error
 	updateMessage := so.newMessage(nanodm.UpdateObjectsMessageType)
-	so.objects = objects
+	so.setRegistration(objects, so.isRegistered())
 	updateMessage.Objects = objects
-	so.pusherChan <- updateMessage
+	updateMessage.Capabilities = so.capabilities()
 	// Wait for ack
-	ackMessage, err := so.ackMap.WaitForKey(updateMessage.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(context.Background(), updateMessage)
 	if err != nil {
 		return err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
+		so.metrics.Objects.Set(float64(len(objects)))
 		return nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("received update error: %v", ackMessage.Error)
+		return fmt.Errorf("received update error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
 }
 
 func (so *Source) GetObjects(objects []nanodm.Object) ([]nanodm.Object, error) {
+	return so.GetObjectsContext(context.Background(), objects)
+}
+
+// GetObjectsContext gets objects from the server as part of the trace in `ctx`
+func (so *Source) GetObjectsContext(ctx context.Context, objects []nanodm.Object) ([]nanodm.Object, error) {
 	var err error
 	getMessage := so.newMessage(nanodm.GetMessageType)
 	getMessage.Objects = objects
 
-	so.pusherChan <- getMessage
 	// Wait for ack
-	ackMessage, err := so.ackMap.WaitForKey(getMessage.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(ctx, getMessage)
 	if err != nil {
 		return nil, err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		return ackMessage.Objects, nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return ackMessage.Objects, fmt.Errorf("received get error: %v", ackMessage.Error)
+		return ackMessage.Objects, fmt.Errorf("received get error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return ackMessage.Objects, fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
 }
 
 func (so *Source) SetObject(object nanodm.Object) error {
+	return so.SetObjectContext(context.Background(), object)
+}
+
+// SetObjectContext sets an object through the server as part of the trace in
+// `ctx`
+func (so *Source) SetObjectContext(ctx context.Context, object nanodm.Object) error {
 	var err error
 	setMessage := so.newMessage(nanodm.SetMessageType)
 	setMessage.Objects = []nanodm.Object{object}
 
-	so.pusherChan <- setMessage
 	// Wait for ack
-	ackMessage, err := so.ackMap.WaitForKey(setMessage.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(ctx, setMessage)
 	if err != nil {
 		return err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		return nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return fmt.Errorf("received set error: %v", ackMessage.Error)
+		return fmt.Errorf("received set error: %w", nanodm.MessageError(ackMessage))
+	} else {
+		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
+	}
+}
+
+// AddRow adds a row to the dynamic list `object` of another source through
+// the server.  The value of `object` holds the initial values of the row by
+// parameter name.  Returns the name of the row added.
+func (so *Source) AddRow(object nanodm.Object) (string, error) {
+	return so.AddRowContext(context.Background(), object)
+}
+
+// AddRowContext adds a row through the server as part of the trace in `ctx`
+func (so *Source) AddRowContext(ctx context.Context, object nanodm.Object) (string, error) {
+	addRowMessage := so.newMessage(nanodm.AddRowMessageType)
+	addRowMessage.Objects = []nanodm.Object{object}
+
+	// Wait for ack
+	ackMessage, err := so.sendRequest(ctx, addRowMessage)
+	if err != nil {
+		return "", err
+	}
+	if ackMessage.Type == nanodm.AckMessageType {
+		if len(ackMessage.Objects) != 1 {
+			return "", nanodm.Errorf(nanodm.CodeInternal, "received %d rows added", len(ackMessage.Objects))
+		}
+		return ackMessage.Objects[0].Name, nil
+	} else if ackMessage.Type == nanodm.NackMessageType {
+		return "", fmt.Errorf("received add row error: %w", nanodm.MessageError(ackMessage))
+	} else {
+		return "", fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
+	}
+}
+
+// DeleteRow deletes the row `object` of another source through the server
+func (so *Source) DeleteRow(object nanodm.Object) error {
+	return so.DeleteRowContext(context.Background(), object)
+}
+
+// DeleteRowContext deletes a row through the server as part of the trace in
+// `ctx`
+func (so *Source) DeleteRowContext(ctx context.Context, object nanodm.Object) error {
+	deleteRowMessage := so.newMessage(nanodm.DeleteRowMessageType)
+	deleteRowMessage.Objects = []nanodm.Object{object}
+
+	// Wait for ack
+	ackMessage, err := so.sendRequest(ctx, deleteRowMessage)
+	if err != nil {
+		return err
+	}
+	if ackMessage.Type == nanodm.AckMessageType {
+		return nil
+	} else if ackMessage.Type == nanodm.NackMessageType {
+		return fmt.Errorf("received delete row error: %w", nanodm.MessageError(ackMessage))
+	} else {
+		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
+	}
+}
+
+// Notify notifies the controllers subscribed to `objects` of their new
+// values, for the changes the source makes to its own objects
+func (so *Source) Notify(objects []nanodm.Object) error {
+	notifyMessage := so.newMessage(nanodm.NotifyMessageType)
+	notifyMessage.Objects = objects
+
+	// Wait for ack
+	ackMessage, err := so.sendRequest(context.Background(), notifyMessage)
+	if err != nil {
+		return err
+	}
+	if ackMessage.Type == nanodm.AckMessageType {
+		return nil
+	} else if ackMessage.Type == nanodm.NackMessageType {
+		return fmt.Errorf("received notify error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
@@ -207,22 +384,60 @@ func (so *Source) ListObjects(objects []nanodm.Object) ([]nanodm.Object, error)
 	getMessage := so.newMessage(nanodm.ListMessagesType)
 	getMessage.Objects = objects
 
-	so.pusherChan <- getMessage
 	// Wait for ack
-	ackMessage, err := so.ackMap.WaitForKey(getMessage.TransactionUID.String(), so.pusherAckTimeout)
+	ackMessage, err := so.sendRequest(context.Background(), getMessage)
 	if err != nil {
 		return nil, err
 	}
 	if ackMessage.Type == nanodm.AckMessageType {
 		return ackMessage.Objects, nil
 	} else if ackMessage.Type == nanodm.NackMessageType {
-		return ackMessage.Objects, fmt.Errorf("received get error: %v", ackMessage.Error)
+		return ackMessage.Objects, fmt.Errorf("received get error: %w", nanodm.MessageError(ackMessage))
 	} else {
 		return ackMessage.Objects, fmt.Errorf("received unknown message type (%d)", ackMessage.Type)
 	}
 }
 
+// sendRequest sends `message` to the server and waits for the ack or nack
+func (so *Source) sendRequest(ctx context.Context, message nanodm.Message) (ackMessage *nanodm.Message, err error) {
+	msgType := message.Type.Name()
+	_, span := so.tracer.Start(ctx, "source.send "+msgType, tracing.SpanKindClient)
+	span.SetAttribute("nanodm.source", so.name)
+	span.SetAttribute("nanodm.transaction_uid", message.TransactionUID)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	message.TraceParent = span.TraceParent()
+
+	so.metrics.Requests.Inc(msgType)
+	so.metrics.InFlight.Inc()
+	defer so.metrics.InFlight.Dec()
+
+	waitCtx, cancel := context.WithTimeout(ctx, so.pusherAckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	so.pusherChan <- message
+	ackMessage, err = so.ackMap.WaitForKeyContext(waitCtx, message.TransactionUID.String())
+	if err != nil {
+		so.metrics.Responses.Inc(msgType, ResultTimeout)
+		return nil, err
+	}
+	so.metrics.Latency.Observe(time.Since(start).Seconds(), msgType)
+
+	result := ResultAck
+	if ackMessage.Type != nanodm.AckMessageType {
+		result = ResultNack
+	}
+	so.metrics.Responses.Inc(msgType, result)
+	span.SetAttribute("nanodm.result", result)
+	return ackMessage, nil
+}
+
 func (so *Source) pullerTask() {
+	transactionTicker := time.NewTicker(transactionCheckPeriod)
+	defer transactionTicker.Stop()
 	for {
 		select {
 		case message := <-so.pullerChan:
@@ -231,17 +446,25 @@ func (so *Source) pullerTask() {
 			case message.Type == nanodm.AckMessageType || message.Type == nanodm.NackMessageType:
 				so.ackMap.Set(message.TransactionUID.String(), message)
 			case message.Type == nanodm.SetMessageType:
-				so.handleSet(message)
+				so.handleRequest(message, so.handleSet)
 			case message.Type == nanodm.GetMessageType:
-				so.handleGet(message)
+				so.handleRequest(message, so.handleGet)
 			case message.Type == nanodm.AddRowMessageType:
-				so.handleAddRow(message)
+				so.handleRequest(message, so.handleAddRow)
 			case message.Type == nanodm.DeleteRowMessageType:
-				so.handleDeleteRow(message)
+				so.handleRequest(message, so.handleDeleteRow)
+			case message.Type == nanodm.PrepareMessageType:
+				so.handleRequest(message, so.handlePrepare)
+			case message.Type == nanodm.CommitMessageType:
+				so.handleRequest(message, so.handleCommit)
+			case message.Type == nanodm.AbortMessageType:
+				so.handleRequest(message, so.handleAbort)
 			case message.Type == nanodm.PingMessageType:
 				so.updatePing()
 				so.pusherChan <- so.newMessage(nanodm.PingMessageType)
 			}
+		case <-transactionTicker.C:
+			so.expireTransactions(so.clock.Now())
 		case <-so.pullerClose:
 			so.log.Info("exiting pullerTask")
 			return
@@ -251,7 +474,7 @@ func (so *Source) pullerTask() {
 
 func (so *Source) updatePing() {
 	so.lastPingMutex.Lock()
-	so.lastPing = time.Now()
+	so.lastPing = so.clock.Now()
 	so.lastPingMutex.Unlock()
 }
 
@@ -259,17 +482,21 @@ func (so *Source) pingTask() {
 
 	for {
 		select {
-		case now := <-time.After(defaultPingCheckPeriod):
+		case now := <-so.clock.After(defaultPingCheckPeriod):
+			// The lock isn't held while registering, as the pings received
+			// meanwhile take it
 			so.lastPingMutex.Lock()
-			if now.After(so.lastPing.Add(defaultPingTimeout)) {
-				diff := now.Sub(so.lastPing)
+			lastPing := so.lastPing
+			so.lastPingMutex.Unlock()
+			if now.After(lastPing.Add(defaultPingTimeout)) {
+				diff := now.Sub(lastPing)
 				so.log.Warnf("re-registering client %s, last ping was %s ago", so.name, diff.String())
-				err := so.Register(so.objects)
+				so.metrics.PingMisses.Inc()
+				err := so.Register(so.registeredObjects())
 				if err != nil {
 					so.log.Errorf("failed to re-register: %v", err)
 				}
 			}
-			so.lastPingMutex.Unlock()
 		case <-so.pullerClose:
 			so.log.Info("exiting pingTask")
 			return
@@ -277,35 +504,83 @@ func (so *Source) pingTask() {
 	}
 }
 
-func (so *Source) respondNack(msg nanodm.Message, errStr string) {
+// respondNack nacks `msg` with `err`, which keeps its code if it's a
+// nanodm.Error (or nanodm.Errors).  If `err` is a partialResult the objects
+// that were fetched are included.
+func (so *Source) respondNack(msg nanodm.Message, err error) {
 	nackMessasge := so.newMessage(nanodm.NackMessageType)
 	nackMessasge.TransactionUID = msg.TransactionUID
-	nackMessasge.Error = errStr
+	nackMessasge.SetError(err)
+	var partial *partialResult
+	if errors.As(err, &partial) {
+		nackMessasge.Objects = partial.objects
+	}
 	so.pusherChan <- nackMessasge
 }
 
-func (so *Source) handleSet(setMessage nanodm.Message) {
-	if so.handler == nil {
-		so.respondNack(setMessage, "source handler not set")
+// partialResult is the error of a get that fetched some of its objects
+type partialResult struct {
+	objects []nanodm.Object
+	err     error
+}
+
+func (pr *partialResult) Error() string {
+	return pr.err.Error()
+}
+
+func (pr *partialResult) Unwrap() error {
+	return pr.err
+}
+
+// handleRequest calls `handle` for a request from the server, nacking the
+// request if `handle` fails.  The context passed to `handle` carries the span
+// of the request, continuing the trace of the server.
+func (so *Source) handleRequest(request nanodm.Message, handle func(ctx context.Context, request nanodm.Message) error) {
+	msgType := request.Type.Name()
+	ctx := tracing.ContextWithTraceParent(context.Background(), request.TraceParent)
+	ctx, span := so.tracer.Start(ctx, "source.handle "+msgType, tracing.SpanKindServer)
+	span.SetAttribute("nanodm.source", so.name)
+	span.SetAttribute("nanodm.transaction_uid", request.TransactionUID)
+	defer span.End()
+
+	start := time.Now()
+	err := handle(ctx, request)
+	so.metrics.HandlerLatency.Observe(time.Since(start).Seconds(), msgType)
+	span.SetError(err)
+
+	if err != nil {
+		so.metrics.Handled.Inc(msgType, ResultNack)
+		so.respondNack(request, err)
 		return
 	}
+	so.metrics.Handled.Inc(msgType, ResultAck)
+}
+
+func (so *Source) handleSet(ctx context.Context, setMessage nanodm.Message) error {
+	if so.handler == nil {
+		return nanodm.Errorf(nanodm.CodeInternal, "source handler not set")
+	}
 
-	err := so.handler.SetObjects(setMessage.Objects)
+	var err error
+	if ctxHandler, ok := so.handler.(ContextSourceHandler); ok {
+		err = ctxHandler.SetObjectsContext(ctx, setMessage.Objects)
+	} else {
+		err = so.handler.SetObjects(setMessage.Objects)
+	}
 	if err != nil {
-		so.respondNack(setMessage, err.Error())
-		return
+		return err
 	}
 
 	ackMessage := so.newMessage(nanodm.AckMessageType)
 	ackMessage.TransactionUID = setMessage.TransactionUID
 	so.pusherChan <- ackMessage
+	return nil
 }
 
-func (so *Source) handleGet(getMessage nanodm.Message) {
+func (so *Source) handleGet(ctx context.Context, getMessage nanodm.Message) error {
 
 	if so.handler == nil {
-		so.respondNack(getMessage, "source handler not set")
-		return
+		return nanodm.Errorf(nanodm.CodeInternal, "source handler not set")
 	}
 
 	objectNames := make([]string, 0)
@@ -313,59 +588,74 @@ func (so *Source) handleGet(getMessage nanodm.Message) {
 	for _, object := range getMessage.Objects {
 		objectNames = append(objectNames, object.Name)
 	}
-	objects, err := so.handler.GetObjects(objectNames)
-	if err != nil {
-		so.respondNack(getMessage, err.Error())
-		return
+	var objects []nanodm.Object
+	var err error
+	if ctxHandler, ok := so.handler.(ContextSourceHandler); ok {
+		objects, err = ctxHandler.GetObjectsContext(ctx, objectNames)
+	} else {
+		objects, err = so.handler.GetObjects(objectNames)
+	}
+	if err != nil && len(objects) > 0 {
+		return &partialResult{objects: objects, err: err}
+	} else if err != nil {
+		return err
 	}
 
 	ackMessage := so.newMessage(nanodm.AckMessageType)
 	ackMessage.TransactionUID = getMessage.TransactionUID
 	ackMessage.Objects = objects
 	so.pusherChan <- ackMessage
+	return nil
 }
 
-func (so *Source) handleAddRow(addRowMessage nanodm.Message) {
+func (so *Source) handleAddRow(ctx context.Context, addRowMessage nanodm.Message) error {
 	if so.handler == nil {
-		so.respondNack(addRowMessage, "source handler not set")
-		return
+		return nanodm.Errorf(nanodm.CodeInternal, "source handler not set")
 	}
 
 	if len(addRowMessage.Objects) != 1 {
-		so.respondNack(addRowMessage, fmt.Sprintf("Invalid number of objects (%d) in add row", len(addRowMessage.Objects)))
-		return
+		return nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in add row", len(addRowMessage.Objects))
 	}
 
-	row, err := so.handler.AddRow(addRowMessage.Objects[0])
+	var row string
+	var err error
+	if ctxHandler, ok := so.handler.(ContextSourceHandler); ok {
+		row, err = ctxHandler.AddRowContext(ctx, addRowMessage.Objects[0])
+	} else {
+		row, err = so.handler.AddRow(addRowMessage.Objects[0])
+	}
 	if err != nil {
-		so.respondNack(addRowMessage, err.Error())
-		return
+		return err
 	}
 
 	ackMessage := so.newMessage(nanodm.AckMessageType)
 	ackMessage.TransactionUID = addRowMessage.TransactionUID
 	ackMessage.Objects = append(ackMessage.Objects, nanodm.Object{Name: row})
 	so.pusherChan <- ackMessage
+	return nil
 }
 
-func (so *Source) handleDeleteRow(deleteRowMessage nanodm.Message) {
+func (so *Source) handleDeleteRow(ctx context.Context, deleteRowMessage nanodm.Message) error {
 	if so.handler == nil {
-		so.respondNack(deleteRowMessage, "source handler not set")
-		return
+		return nanodm.Errorf(nanodm.CodeInternal, "source handler not set")
 	}
 
 	if len(deleteRowMessage.Objects) != 1 {
-		so.respondNack(deleteRowMessage, fmt.Sprintf("Invalid number of objects (%d) in delete row", len(deleteRowMessage.Objects)))
-		return
+		return nanodm.Errorf(nanodm.CodeInvalidValue, "Invalid number of objects (%d) in delete row", len(deleteRowMessage.Objects))
 	}
 
-	err := so.handler.DeleteRow(deleteRowMessage.Objects[0])
+	var err error
+	if ctxHandler, ok := so.handler.(ContextSourceHandler); ok {
+		err = ctxHandler.DeleteRowContext(ctx, deleteRowMessage.Objects[0])
+	} else {
+		err = so.handler.DeleteRow(deleteRowMessage.Objects[0])
+	}
 	if err != nil {
-		so.respondNack(deleteRowMessage, err.Error())
-		return
+		return err
 	}
 
 	ackMessage := so.newMessage(nanodm.AckMessageType)
 	ackMessage.TransactionUID = deleteRowMessage.TransactionUID
 	so.pusherChan <- ackMessage
+	return nil
 }
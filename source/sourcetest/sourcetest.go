@@ -0,0 +1,585 @@
+// Package sourcetest checks that a source.SourceHandler keeps the contract
+// of nanodm, for the tests of source implementations:
+//
+//	func TestWiFiSource(t *testing.T) {
+//		sourcetest.Run(t, newWiFiSource(), wifiObjects)
+//	}
+//
+// Run calls the handler directly, as the source does for the requests of the
+// coordinator, with the objects the handler would register.  It sets the
+// read-write objects to the values they have, and deletes the rows it adds,
+// so the state of the handler is the same after the suite.
+package sourcetest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/source"
+)
+
+const (
+	// The goroutines calling the handler at once in the concurrency test
+	CONCURRENT_CALLS = 16
+	// The names requested at once in the large batch test
+	LARGE_BATCH = 1000
+	// The rows added at once in the large batch test
+	LARGE_ROW_BATCH = 100
+	// The time the handler has to answer before it's reported as blocked
+	CALL_TIMEOUT = 10 * time.Second
+)
+
+// Run runs the conformance tests of `handler`, which registers `objects`, as
+// subtests of `t`.  A handler implementing source.ContextSourceHandler is
+// called with its context methods, as the source does.
+func Run(t *testing.T, handler source.SourceHandler, objects []nanodm.Object) {
+	t.Helper()
+	suite := newSuite(handler, objects)
+	if len(suite.values) == 0 && len(suite.lists) == 0 {
+		t.Fatal("no objects to test: register at least one object or dynamic list")
+	}
+
+	t.Run("Get", suite.testGet)
+	t.Run("Set", suite.testSet)
+	t.Run("Rows", suite.testRows)
+	t.Run("UnknownPaths", suite.testUnknownPaths)
+	t.Run("Concurrency", suite.testConcurrency)
+	t.Run("LargeBatches", suite.testLargeBatches)
+}
+
+type suite struct {
+	handler source.SourceHandler
+	// The registered objects with a value, and the dynamic lists, by name
+	values map[string]nanodm.Object
+	lists  map[string]nanodm.Object
+	// The names of the values, sorted
+	valueNames []string
+	listNames  []string
+}
+
+func newSuite(handler source.SourceHandler, objects []nanodm.Object) *suite {
+	su := &suite{
+		handler: handler,
+		values:  make(map[string]nanodm.Object),
+		lists:   make(map[string]nanodm.Object),
+	}
+	for _, object := range objects {
+		switch {
+		case object.Type == nanodm.TypeDynamicList:
+			su.lists[object.Name] = object
+			su.listNames = append(su.listNames, object.Name)
+		case object.Type.IsValue():
+			su.values[object.Name] = object
+			su.valueNames = append(su.valueNames, object.Name)
+		}
+	}
+	sort.Strings(su.valueNames)
+	sort.Strings(su.listNames)
+	return su
+}
+
+// testGet gets each object, then all of them at once, checking the names,
+// types and values returned
+func (su *suite) testGet(t *testing.T) {
+	for _, name := range su.valueNames {
+		objects, err := su.get([]string{name})
+		if err != nil {
+			t.Errorf("get %s failed: %v", name, err)
+			continue
+		}
+		if len(objects) != 1 || objects[0].Name != name {
+			t.Errorf("get %s returned %s, must return the object requested", name, objectNames(objects))
+			continue
+		}
+		su.checkObject(t, objects[0])
+	}
+
+	if len(su.valueNames) > 1 {
+		objects, err := su.get(su.valueNames)
+		if err != nil {
+			t.Errorf("get of all the objects failed: %v", err)
+		} else {
+			su.checkAnswered(t, "get of all the objects", su.valueNames, objects)
+		}
+	}
+
+	// The get of a dynamic list returns the objects of its rows
+	for _, list := range su.listNames {
+		objects, err := su.get([]string{list})
+		if err != nil {
+			t.Errorf("get of dynamic list %s failed: %v", list, err)
+			continue
+		}
+		for _, object := range objects {
+			if _, err := rowOf(list, object.Name); err != nil {
+				t.Errorf("get of dynamic list %s returned %s: %v", list, object.Name, err)
+			}
+			if !object.Type.IsValue() {
+				t.Errorf("get of dynamic list %s returned %s of type %v, must return the objects with a value", list, object.Name, object.Type)
+			} else if err := CheckValue(object.Type, object.Value); err != nil {
+				t.Errorf("get of dynamic list %s returned %s: %v", list, object.Name, err)
+			}
+		}
+	}
+}
+
+// testSet sets the read-write objects to their value, and checks that the
+// read-only objects can't be set
+func (su *suite) testSet(t *testing.T) {
+	for _, name := range su.valueNames {
+		registered := su.values[name]
+		objects, err := su.get([]string{name})
+		if err != nil || len(objects) != 1 {
+			t.Errorf("get %s failed, can't test its set: %v", name, err)
+			continue
+		}
+		current := objects[0]
+
+		err = su.set([]nanodm.Object{{Name: name, Type: registered.Type, Value: current.Value}})
+		if registered.Access == nanodm.AccessRO {
+			if err == nil {
+				t.Errorf("set of read-only object %s succeeded, must fail with %v", name, nanodm.CodeAccessDenied)
+			} else if code := nanodm.CodeOf(err); code != nanodm.CodeAccessDenied {
+				t.Errorf("set of read-only object %s failed with %v (%v), must fail with %v", name, code, err, nanodm.CodeAccessDenied)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("set %s to its value %v failed: %v", name, current.Value, err)
+			continue
+		}
+
+		objects, err = su.get([]string{name})
+		if err != nil || len(objects) != 1 {
+			t.Errorf("get %s after its set failed: %v", name, err)
+		} else if nanodm.FormatValue(objects[0].Value) != nanodm.FormatValue(current.Value) {
+			t.Errorf("get %s after setting it to %v returned %v", name, current.Value, objects[0].Value)
+		}
+	}
+}
+
+// testRows adds rows to each dynamic list, and deletes them
+func (su *suite) testRows(t *testing.T) {
+	if len(su.listNames) == 0 {
+		t.Skip("no dynamic lists")
+	}
+	for _, list := range su.listNames {
+		first, err := su.addRow(list)
+		if err != nil {
+			t.Errorf("add row to %s failed: %v", list, err)
+			continue
+		}
+		second, err := su.addRow(list)
+		if err != nil {
+			t.Errorf("add a second row to %s failed: %v", list, err)
+		} else if second == first {
+			t.Errorf("add row to %s returned the row %s twice", list, first)
+		}
+
+		for _, row := range []string{first, second} {
+			if row == "" {
+				continue
+			}
+			if err := checkRow(list, row); err != nil {
+				t.Errorf("add row to %s returned the row %q: %v", list, row, err)
+				continue
+			}
+			if err := su.deleteRow(row); err != nil {
+				t.Errorf("delete row %s failed: %v", row, err)
+				continue
+			}
+			if err := su.deleteRow(row); err == nil {
+				t.Errorf("delete of deleted row %s succeeded, must fail with %v", row, nanodm.CodeNotFound)
+			} else if code := nanodm.CodeOf(err); code != nanodm.CodeNotFound {
+				t.Errorf("delete of deleted row %s failed with %v (%v), must fail with %v", row, code, err, nanodm.CodeNotFound)
+			}
+
+			objects, err := su.get([]string{list})
+			if err != nil {
+				t.Errorf("get of dynamic list %s after deleting %s failed: %v", list, row, err)
+			}
+			for _, object := range objects {
+				if strings.HasPrefix(object.Name, row) {
+					t.Errorf("get of dynamic list %s returned %s of the deleted row %s", list, object.Name, row)
+				}
+			}
+		}
+	}
+}
+
+// testUnknownPaths checks that the requests of objects and rows that don't
+// exist fail with CodeNotFound
+func (su *suite) testUnknownPaths(t *testing.T) {
+	missing := su.missingName()
+	checkNotFound := func(request string, err error) {
+		if err == nil {
+			t.Errorf("%s succeeded, must fail with %v", request, nanodm.CodeNotFound)
+		} else if code := nanodm.CodeOf(err); code != nanodm.CodeNotFound {
+			t.Errorf("%s failed with %v (%v), must fail with %v", request, code, err, nanodm.CodeNotFound)
+		}
+	}
+
+	_, err := su.get([]string{missing})
+	checkNotFound("get of unknown object "+missing, err)
+	err = su.set([]nanodm.Object{{Name: missing, Type: nanodm.TypeString, Value: "value"}})
+	checkNotFound("set of unknown object "+missing, err)
+	_, err = su.addRow(missing + ".")
+	checkNotFound("add row to unknown dynamic list "+missing+".", err)
+
+	// The objects that exist are still returned with the error of the others
+	if len(su.valueNames) > 0 {
+		name := su.valueNames[0]
+		objects, err := su.get([]string{name, missing})
+		checkNotFound(fmt.Sprintf("get of %s and unknown object %s", name, missing), err)
+		if len(objects) > 0 && (len(objects) != 1 || objects[0].Name != name) {
+			t.Errorf("get of %s and unknown object %s returned %s, must return %s or nothing", name, missing, objectNames(objects), name)
+		}
+	}
+
+	for _, list := range su.listNames {
+		row := fmt.Sprintf("%s%d.", list, math.MaxInt32)
+		checkNotFound("delete of unknown row "+row, su.deleteRow(row))
+	}
+}
+
+// testConcurrency calls the handler from several goroutines at once: gets
+// of all the objects, sets of the read-write objects to their values and
+// rows added, then the rows deleted.  Run the tests with -race to find the
+// data races.
+func (su *suite) testConcurrency(t *testing.T) {
+	var writable []nanodm.Object
+	if len(su.valueNames) > 0 {
+		initial, err := su.get(su.valueNames)
+		if err != nil {
+			t.Fatalf("get of all the objects failed: %v", err)
+		}
+		for _, object := range initial {
+			if su.values[object.Name].Access == nanodm.AccessRW {
+				writable = append(writable, nanodm.Object{Name: object.Name, Type: object.Type, Value: object.Value})
+			}
+		}
+	}
+
+	rows := make([]string, CONCURRENT_CALLS)
+	su.concurrently(t, func(i int) error {
+		if len(su.valueNames) > 0 {
+			if objects, err := su.get(su.valueNames); err != nil {
+				return fmt.Errorf("concurrent get failed: %w", err)
+			} else if len(objects) != len(su.valueNames) {
+				return fmt.Errorf("concurrent get of %d objects returned %d", len(su.valueNames), len(objects))
+			}
+		}
+		if len(writable) > 0 {
+			if err := su.set(writable); err != nil {
+				return fmt.Errorf("concurrent set failed: %w", err)
+			}
+		}
+		if len(su.listNames) > 0 {
+			list := su.listNames[i%len(su.listNames)]
+			row, err := su.addRow(list)
+			if err != nil {
+				return fmt.Errorf("concurrent add row to %s failed: %w", list, err)
+			}
+			rows[i] = row
+		}
+		return nil
+	})
+
+	// A row returned twice is deleted once
+	added := make(map[string]bool)
+	for i, row := range rows {
+		if row != "" && added[row] {
+			t.Errorf("concurrent add rows returned the row %s twice", row)
+			rows[i] = ""
+		}
+		added[row] = true
+	}
+	su.concurrently(t, func(i int) error {
+		if rows[i] == "" {
+			return nil
+		}
+		if err := su.deleteRow(rows[i]); err != nil {
+			return fmt.Errorf("concurrent delete row %s failed: %w", rows[i], err)
+		}
+		return nil
+	})
+}
+
+// concurrently calls `call` from CONCURRENT_CALLS goroutines at once, and
+// reports the errors returned
+func (su *suite) concurrently(t *testing.T, call func(i int) error) {
+	errs := make(chan error, CONCURRENT_CALLS)
+	var wg sync.WaitGroup
+	for i := 0; i < CONCURRENT_CALLS; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := call(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(CALL_TIMEOUT):
+		t.Fatalf("%d concurrent calls didn't return within %v, the handler may be deadlocked", CONCURRENT_CALLS, CALL_TIMEOUT)
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// testLargeBatches gets and sets LARGE_BATCH objects at once, and adds and
+// deletes LARGE_ROW_BATCH rows
+func (su *suite) testLargeBatches(t *testing.T) {
+	if len(su.valueNames) > 0 {
+		var names []string
+		for len(names) < LARGE_BATCH {
+			names = append(names, su.valueNames...)
+		}
+		objects, err := su.timedGet(t, names)
+		if err != nil {
+			t.Errorf("get of %d objects failed: %v", len(names), err)
+		} else {
+			su.checkAnswered(t, fmt.Sprintf("get of %d objects", len(names)), su.valueNames, objects)
+		}
+
+		var writable []nanodm.Object
+		for _, object := range objects {
+			if su.values[object.Name].Access == nanodm.AccessRW {
+				writable = append(writable, nanodm.Object{Name: object.Name, Type: object.Type, Value: object.Value})
+			}
+		}
+		if len(writable) > 0 {
+			if err := su.set(writable); err != nil {
+				t.Errorf("set of %d objects failed: %v", len(writable), err)
+			}
+		}
+	}
+
+	for _, list := range su.listNames {
+		var rows []string
+		for i := 0; i < LARGE_ROW_BATCH; i++ {
+			row, err := su.addRow(list)
+			if err != nil {
+				t.Errorf("add of row %d to %s failed: %v", i+1, list, err)
+				break
+			}
+			rows = append(rows, row)
+		}
+		if _, err := su.timedGet(t, []string{list}); err != nil {
+			t.Errorf("get of dynamic list %s with %d rows failed: %v", list, len(rows), err)
+		}
+		for _, row := range rows {
+			if err := su.deleteRow(row); err != nil {
+				t.Errorf("delete row %s failed: %v", row, err)
+			}
+		}
+	}
+}
+
+// checkObject checks an object returned by a get against its registration
+func (su *suite) checkObject(t *testing.T, object nanodm.Object) {
+	registered := su.values[object.Name]
+	if object.Type != registered.Type {
+		t.Errorf("get %s returned type %v, registered as %v", object.Name, object.Type, registered.Type)
+		return
+	}
+	if err := CheckValue(object.Type, object.Value); err != nil {
+		t.Errorf("get %s: %v", object.Name, err)
+	}
+}
+
+// checkAnswered checks that `objects` has every one of `names`, and no others
+func (su *suite) checkAnswered(t *testing.T, request string, names []string, objects []nanodm.Object) {
+	requested := make(map[string]bool, len(names))
+	for _, name := range names {
+		requested[name] = true
+	}
+	answered := make(map[string]bool, len(objects))
+	for _, object := range objects {
+		if !requested[object.Name] {
+			t.Errorf("%s returned %s, which wasn't requested", request, object.Name)
+		}
+		answered[object.Name] = true
+	}
+	for _, name := range names {
+		if !answered[name] {
+			t.Errorf("%s didn't return %s", request, name)
+		}
+	}
+}
+
+// missingName returns the name of an object under the objects of the
+// handler that it doesn't have
+func (su *suite) missingName() string {
+	var name string
+	if len(su.valueNames) > 0 {
+		name = su.valueNames[0]
+	} else {
+		name = su.listNames[0]
+	}
+	root := strings.SplitN(name, ".", 2)[0]
+	return root + ".NanodmSourcetest.Missing"
+}
+
+// CheckValue returns an error if the Go type of `value` isn't a type of
+// `objectType`, or the value is out of its range.  The integer types take
+// any Go integer, the float types float32 and float64, and the other types
+// the Go type nanodm.ParseValue returns.
+func CheckValue(objectType nanodm.ObjectType, value interface{}) error {
+	if !objectType.IsValue() {
+		return fmt.Errorf("objects of type %v don't have values", objectType)
+	}
+	switch objectType {
+	case nanodm.TypeInt, nanodm.TypeLong, nanodm.TypeUnsignedInt, nanodm.TypeUnsignedLong, nanodm.TypeByte:
+		text, isInteger := formatInteger(value)
+		if !isInteger {
+			return fmt.Errorf("value %v (%T) of type %v isn't an integer", value, value, objectType)
+		}
+		// Parsed in the range of the type
+		if _, err := nanodm.ParseValue(objectType, text); err != nil {
+			return fmt.Errorf("value %v (%T) is out of the range of %v", value, value, objectType)
+		}
+		return nil
+	case nanodm.TypeFloat, nanodm.TypeDouble:
+		switch t := value.(type) {
+		case float32:
+			return checkFinite(objectType, float64(t))
+		case float64:
+			return checkFinite(objectType, t)
+		}
+	case nanodm.TypeString:
+		if _, ok := value.(string); ok {
+			return nil
+		}
+	case nanodm.TypeBool:
+		if _, ok := value.(bool); ok {
+			return nil
+		}
+	case nanodm.TypeDateTime:
+		if _, ok := value.(time.Time); ok {
+			return nil
+		}
+	case nanodm.TypeBase64:
+		if _, ok := value.([]byte); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("value %v (%T) isn't a %v value", value, value, objectType)
+}
+
+func formatInteger(value interface{}) (string, bool) {
+	switch t := value.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(t), true
+	}
+	return "", false
+}
+
+func checkFinite(objectType nanodm.ObjectType, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("value %v of type %v isn't finite", value, objectType)
+	}
+	return nil
+}
+
+// rowOf returns the row of the object `name` of a row of `list`, or an error
+// if it isn't named "<list><index>.<name>"
+func rowOf(list string, name string) (string, error) {
+	segments := strings.SplitN(strings.TrimPrefix(name, list), ".", 2)
+	if !strings.HasPrefix(name, list) || len(segments) < 2 || segments[1] == "" {
+		return "", fmt.Errorf("%s isn't an object of a row of %s", name, list)
+	}
+	row := list + segments[0] + "."
+	return row, checkRow(list, row)
+}
+
+// checkRow returns an error if `row` isn't named "<list><index>." with a
+// positive index
+func checkRow(list string, row string) error {
+	index := strings.TrimSuffix(strings.TrimPrefix(row, list), ".")
+	if !strings.HasPrefix(row, list) || !strings.HasSuffix(row, ".") {
+		return fmt.Errorf("%s isn't a row of %s", row, list)
+	}
+	if number, err := strconv.ParseUint(index, 10, 32); err != nil || number == 0 {
+		return fmt.Errorf("%s doesn't have a row index (a positive integer) after %s", row, list)
+	}
+	return nil
+}
+
+func objectNames(objects []nanodm.Object) string {
+	var names []string
+	for _, object := range objects {
+		names = append(names, object.Name)
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
+// timedGet gets `names`, failing the test if the handler doesn't answer
+// within CALL_TIMEOUT
+func (su *suite) timedGet(t *testing.T, names []string) ([]nanodm.Object, error) {
+	type result struct {
+		objects []nanodm.Object
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		objects, err := su.get(names)
+		done <- result{objects, err}
+	}()
+	select {
+	case got := <-done:
+		return got.objects, got.err
+	case <-time.After(CALL_TIMEOUT):
+		t.Fatalf("get of %d names didn't return within %v", len(names), CALL_TIMEOUT)
+		return nil, nil
+	}
+}
+
+// The calls of the handler, through its context methods if it has them
+
+func (su *suite) get(names []string) ([]nanodm.Object, error) {
+	if ctxHandler, ok := su.handler.(source.ContextSourceHandler); ok {
+		return ctxHandler.GetObjectsContext(context.Background(), names)
+	}
+	return su.handler.GetObjects(names)
+}
+
+func (su *suite) set(objects []nanodm.Object) error {
+	if ctxHandler, ok := su.handler.(source.ContextSourceHandler); ok {
+		return ctxHandler.SetObjectsContext(context.Background(), objects)
+	}
+	return su.handler.SetObjects(objects)
+}
+
+func (su *suite) addRow(list string) (string, error) {
+	object := nanodm.Object{Name: list, Type: nanodm.TypeRow, Value: map[string]interface{}{}}
+	if ctxHandler, ok := su.handler.(source.ContextSourceHandler); ok {
+		return ctxHandler.AddRowContext(context.Background(), object)
+	}
+	return su.handler.AddRow(object)
+}
+
+func (su *suite) deleteRow(row string) error {
+	object := nanodm.Object{Name: row, Type: nanodm.TypeRow}
+	if ctxHandler, ok := su.handler.(source.ContextSourceHandler); ok {
+		return ctxHandler.DeleteRowContext(context.Background(), object)
+	}
+	return su.handler.DeleteRow(object)
+}
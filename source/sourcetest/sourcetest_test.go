@@ -0,0 +1,95 @@
+package sourcetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/nanodmtest"
+)
+
+func TestRunFakeSource(t *testing.T) {
+	fakeSource := nanodmtest.NewFakeSource(map[string]interface{}{
+		"Device.WiFi.SSID":                  "home",
+		"Device.WiFi.Channel":               int32(6),
+		"Device.WiFi.Enable":                true,
+		"Device.WiFi.MaxBitRate":            uint32(300),
+		"Device.DeviceInfo.UpTime":          uint64(3600),
+		"Device.DeviceInfo.Serial":          "ABC123",
+		"Device.DeviceInfo.Temperature":     42.5,
+		"Device.DeviceInfo.LastBoot":        time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC),
+		"Device.DeviceInfo.Certificate":     []byte("certificate"),
+		"Device.NAT.PortMapping.":           nil,
+		"Device.NAT.PortMapping.1.Enable":   true,
+		"Device.NAT.PortMapping.1.Protocol": "TCP",
+	})
+	fakeSource.SetReadOnly("Device.DeviceInfo.Serial", "Device.DeviceInfo.UpTime")
+	objects := fakeSource.Objects()
+
+	Run(t, fakeSource, objects)
+
+	// The state is the same after the suite
+	value, _ := fakeSource.Value("Device.WiFi.SSID")
+	assert.Equal(t, "home", value)
+	rows, err := fakeSource.GetObjects([]string{"Device.NAT.PortMapping."})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rows))
+}
+
+func TestCheckValue(t *testing.T) {
+	var valid = []struct {
+		objectType nanodm.ObjectType
+		value      interface{}
+	}{
+		{nanodm.TypeString, "home"},
+		{nanodm.TypeInt, -42},
+		{nanodm.TypeInt, int8(-1)},
+		{nanodm.TypeLong, int64(-9000000000)},
+		{nanodm.TypeUnsignedInt, uint32(42)},
+		{nanodm.TypeUnsignedInt, int64(42)},
+		{nanodm.TypeByte, uint8(255)},
+		{nanodm.TypeBool, false},
+		{nanodm.TypeFloat, float32(0.5)},
+		{nanodm.TypeDouble, 0.5},
+		{nanodm.TypeDateTime, time.Now()},
+		{nanodm.TypeBase64, []byte{1}},
+	}
+	for _, test := range valid {
+		assert.Nil(t, CheckValue(test.objectType, test.value), "%v %v", test.objectType, test.value)
+	}
+
+	var invalid = []struct {
+		objectType nanodm.ObjectType
+		value      interface{}
+	}{
+		{nanodm.TypeString, 1},
+		{nanodm.TypeInt, "6"},
+		{nanodm.TypeInt, int64(3000000000)},
+		{nanodm.TypeUnsignedInt, -1},
+		{nanodm.TypeByte, 256},
+		{nanodm.TypeBool, "true"},
+		{nanodm.TypeDouble, 1},
+		{nanodm.TypeDateTime, "2021-06-01T12:30:00Z"},
+		{nanodm.TypeBase64, "aGVsbG8="},
+		{nanodm.TypeRow, nil},
+	}
+	for _, test := range invalid {
+		assert.NotNil(t, CheckValue(test.objectType, test.value), "%v %v", test.objectType, test.value)
+	}
+}
+
+func TestRowNames(t *testing.T) {
+	list := "Device.NAT.PortMapping."
+	assert.Nil(t, checkRow(list, "Device.NAT.PortMapping.3."))
+	assert.NotNil(t, checkRow(list, "Device.NAT.PortMapping.3"))
+	assert.NotNil(t, checkRow(list, "Device.NAT.PortMapping.0."))
+	assert.NotNil(t, checkRow(list, "Device.NAT.PortMapping.first."))
+	assert.NotNil(t, checkRow(list, "Device.NAT.3."))
+
+	row, err := rowOf(list, "Device.NAT.PortMapping.3.Enable")
+	assert.Nil(t, err)
+	assert.Equal(t, "Device.NAT.PortMapping.3.", row)
+	_, err = rowOf(list, "Device.NAT.PortMapping.3.")
+	assert.NotNil(t, err)
+}
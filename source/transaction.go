@@ -0,0 +1,183 @@
+package source
+
+import (
+	"context"
+	"time"
+
+	"github.com/zackwine/nanodm"
+)
+
+const (
+	// The time a prepared transaction waits for the server to commit or
+	// abort it before it's aborted
+	defaultPreparedTimeout = 2 * time.Minute
+	// The time the outcome of a transaction is kept to answer a repeated
+	// commit or abort
+	defaultOutcomeRetention = 10 * time.Minute
+	// How often prepared transactions are checked for expiry
+	transactionCheckPeriod = time.Second
+)
+
+// TransactionalSourceHandler can be implemented by a SourceHandler to take
+// part in two-phase commit transactions.  The source registers with the
+// transactions capability when its handler implements it.
+//
+// Prepare validates and stages the operations of a transaction without
+// applying them, and must fail if they can't be applied.  The server then
+// either commits the transaction, which applies the staged operations and
+// returns the rows added (in the order of the AddRow operations), or aborts
+// it, which discards them.  A prepared transaction that isn't committed or
+// aborted in time is aborted.
+type TransactionalSourceHandler interface {
+	Prepare(transactionID string, operations []nanodm.Operation) error
+	Commit(transactionID string) (rows []string, err error)
+	Abort(transactionID string) error
+}
+
+// sourceTransaction tracks a transaction of the source.  Transactions are
+// only handled by the pullerTask, so they aren't locked.
+type sourceTransaction struct {
+	prepared time.Time
+	// Set once the transaction is committed or aborted
+	done      time.Time
+	committed bool
+	rows      []string
+}
+
+// SetPreparedTimeout sets the time a prepared transaction waits for the
+// server to commit or abort it before it's aborted.  Call it before Connect.
+func (so *Source) SetPreparedTimeout(timeout time.Duration) {
+	so.preparedTimeout = timeout
+}
+
+// capabilities returns the capabilities the source registers with
+func (so *Source) capabilities() (capabilities []string) {
+	if _, ok := so.handler.(TransactionalSourceHandler); ok {
+		capabilities = append(capabilities, nanodm.CapabilityTransactions)
+	}
+	return capabilities
+}
+
+func (so *Source) transactionalHandler() (TransactionalSourceHandler, error) {
+	txnHandler, ok := so.handler.(TransactionalSourceHandler)
+	if !ok {
+		return nil, nanodm.Errorf(nanodm.CodeInternal, "source %s doesn't support transactions", so.name)
+	}
+	return txnHandler, nil
+}
+
+func (so *Source) handlePrepare(ctx context.Context, prepareMessage nanodm.Message) error {
+	txnHandler, err := so.transactionalHandler()
+	if err != nil {
+		return err
+	}
+	txnID := prepareMessage.TxnID.String()
+
+	_, exists := so.transactions[txnID]
+	if exists {
+		return nanodm.Errorf(nanodm.CodeInvalidValue, "transaction %s was already prepared", txnID)
+	}
+
+	if err := txnHandler.Prepare(txnID, prepareMessage.Operations); err != nil {
+		return err
+	}
+
+	so.transactions[txnID] = &sourceTransaction{prepared: so.clock.Now()}
+
+	so.respondAck(prepareMessage, nil)
+	return nil
+}
+
+func (so *Source) handleCommit(ctx context.Context, commitMessage nanodm.Message) error {
+	txnHandler, err := so.transactionalHandler()
+	if err != nil {
+		return err
+	}
+	txnID := commitMessage.TxnID.String()
+
+	txn, exists := so.transactions[txnID]
+	switch {
+	case !exists:
+		return nanodm.Errorf(nanodm.CodeNotFound, "transaction %s isn't prepared", txnID)
+	case !txn.done.IsZero() && !txn.committed:
+		return nanodm.Errorf(nanodm.CodeInvalidValue, "transaction %s was aborted", txnID)
+	case !txn.done.IsZero():
+		// The ack of the commit was lost, and the server is retrying it
+		so.respondAck(commitMessage, txn.rows)
+		return nil
+	}
+
+	rows, err := txnHandler.Commit(txnID)
+	if err != nil {
+		return err
+	}
+
+	txn.done, txn.committed, txn.rows = so.clock.Now(), true, rows
+
+	so.respondAck(commitMessage, rows)
+	return nil
+}
+
+func (so *Source) handleAbort(ctx context.Context, abortMessage nanodm.Message) error {
+	txnHandler, err := so.transactionalHandler()
+	if err != nil {
+		return err
+	}
+	txnID := abortMessage.TxnID.String()
+
+	txn, exists := so.transactions[txnID]
+	switch {
+	case !exists || (!txn.done.IsZero() && !txn.committed):
+		// Aborting a transaction that failed to prepare, or was aborted
+		so.respondAck(abortMessage, nil)
+		return nil
+	case !txn.done.IsZero():
+		return nanodm.Errorf(nanodm.CodeInvalidValue, "transaction %s was committed", txnID)
+	}
+
+	if err := txnHandler.Abort(txnID); err != nil {
+		return err
+	}
+
+	txn.done = so.clock.Now()
+
+	so.respondAck(abortMessage, nil)
+	return nil
+}
+
+// expireTransactions aborts the prepared transactions that the server hasn't
+// committed or aborted in time, and forgets the outcomes of old ones
+func (so *Source) expireTransactions(now time.Time) {
+	txnHandler, ok := so.handler.(TransactionalSourceHandler)
+	if !ok {
+		return
+	}
+
+	var expired []string
+	for txnID, txn := range so.transactions {
+		if txn.done.IsZero() && now.Sub(txn.prepared) > so.preparedTimeout {
+			expired = append(expired, txnID)
+			txn.done = now
+		} else if !txn.done.IsZero() && now.Sub(txn.done) > defaultOutcomeRetention {
+			delete(so.transactions, txnID)
+		}
+	}
+
+	for _, txnID := range expired {
+		so.log.Warnf("Aborting transaction %s, it wasn't committed or aborted in time", txnID)
+		if err := txnHandler.Abort(txnID); err != nil {
+			so.log.Errorf("Failed to abort transaction %s: %v", txnID, err)
+		}
+	}
+}
+
+// respondAck acks `request` with the objects named `names`
+func (so *Source) respondAck(request nanodm.Message, names []string) {
+	ackMessage := so.newMessage(nanodm.AckMessageType)
+	ackMessage.TransactionUID = request.TransactionUID
+	ackMessage.TxnID = request.TxnID
+	for _, name := range names {
+		ackMessage.Objects = append(ackMessage.Objects, nanodm.Object{Name: name})
+	}
+	so.pusherChan <- ackMessage
+}
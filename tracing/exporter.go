@@ -0,0 +1,134 @@
+package tracing
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Exporter receives each span once it has ended
+type Exporter interface {
+	ExportSpan(span *Span)
+	// Close flushes any buffered spans and releases the exporter
+	Close() error
+}
+
+// SpanRecord is the JSON form of a span written by the WriterExporter
+type SpanRecord struct {
+	TraceID      string            `json:"traceId"`
+	SpanID       string            `json:"spanId"`
+	ParentSpanID string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Kind         SpanKind          `json:"kind"`
+	Service      string            `json:"service,omitempty"`
+	Start        string            `json:"start"`
+	DurationUs   int64             `json:"durationUs"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// Record returns the JSON form of the span
+func (sp *Span) Record() SpanRecord {
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+
+	record := SpanRecord{
+		TraceID:    sp.TraceID.String(),
+		SpanID:     sp.SpanID.String(),
+		Name:       sp.Name,
+		Kind:       sp.Kind,
+		Service:    sp.ServiceName,
+		Start:      sp.StartTime.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		DurationUs: sp.EndTime.Sub(sp.StartTime).Microseconds(),
+		Error:      sp.Error,
+	}
+	if sp.ParentSpanID.IsValid() {
+		record.ParentSpanID = sp.ParentSpanID.String()
+	}
+	if len(sp.Attributes) > 0 {
+		record.Attributes = make(map[string]string, len(sp.Attributes))
+		for key, value := range sp.Attributes {
+			record.Attributes[key] = value
+		}
+	}
+	return record
+}
+
+// WriterExporter writes each span as a line of JSON, for local use
+type WriterExporter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+	closer  io.Closer
+}
+
+// NewWriterExporter writes spans to `w`, for example os.Stdout
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// NewFileExporter appends spans to the file at `path`
+func NewFileExporter(path string) (*WriterExporter, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	exporter := NewWriterExporter(file)
+	exporter.closer = file
+	return exporter, nil
+}
+
+func (we *WriterExporter) ExportSpan(span *Span) {
+	record := span.Record()
+	we.lock.Lock()
+	defer we.lock.Unlock()
+	we.encoder.Encode(record)
+}
+
+func (we *WriterExporter) Close() error {
+	if we.closer == nil {
+		return nil
+	}
+	return we.closer.Close()
+}
+
+// MemoryExporter keeps ended spans in memory, for example for tests
+type MemoryExporter struct {
+	lock  sync.Mutex
+	spans []*Span
+}
+
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+func (me *MemoryExporter) ExportSpan(span *Span) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.spans = append(me.spans, span)
+}
+
+func (me *MemoryExporter) Close() error {
+	return nil
+}
+
+// Spans returns the exported spans ordered by start time
+func (me *MemoryExporter) Spans() []*Span {
+	me.lock.Lock()
+	spans := append([]*Span{}, me.spans...)
+	me.lock.Unlock()
+
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].StartTime.Before(spans[j].StartTime)
+	})
+	return spans
+}
+
+func (me *MemoryExporter) Reset() {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.spans = nil
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OTLP_SCOPE_NAME = "github.com/zackwine/nanodm"
+
+	defaultOTLPBatchSize   = 512
+	defaultOTLPFlushPeriod = 5 * time.Second
+	defaultOTLPTimeout     = 10 * time.Second
+)
+
+// OTLP status codes
+const (
+	otlpStatusUnset = 0
+	otlpStatusError = 2
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector using
+// OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	log      *logrus.Entry
+	endpoint string
+	client   *http.Client
+
+	lock      sync.Mutex
+	spans     []*Span
+	flushChan chan struct{}
+	closeChan chan struct{}
+	doneChan  chan struct{}
+}
+
+// NewOTLPExporter creates an exporter sending spans to the OTLP/HTTP traces
+// `endpoint` of a collector (for example "http://127.0.0.1:4318/v1/traces").
+// Spans are sent every 5 seconds, or once 512 spans are buffered.
+func NewOTLPExporter(log *logrus.Entry, endpoint string) *OTLPExporter {
+	oe := &OTLPExporter{
+		log:       log,
+		endpoint:  endpoint,
+		client:    &http.Client{Timeout: defaultOTLPTimeout},
+		flushChan: make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	go oe.flushTask()
+	return oe
+}
+
+func (oe *OTLPExporter) ExportSpan(span *Span) {
+	oe.lock.Lock()
+	oe.spans = append(oe.spans, span)
+	full := len(oe.spans) >= defaultOTLPBatchSize
+	oe.lock.Unlock()
+
+	if full {
+		select {
+		case oe.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Close sends any buffered spans and stops the exporter
+func (oe *OTLPExporter) Close() error {
+	close(oe.closeChan)
+	<-oe.doneChan
+	return nil
+}
+
+// Flush sends the buffered spans to the collector
+func (oe *OTLPExporter) Flush() error {
+	oe.lock.Lock()
+	spans := oe.spans
+	oe.spans = nil
+	oe.lock.Unlock()
+
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := oe.client.Post(oe.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector %s responded with status %d", oe.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+func (oe *OTLPExporter) flushTask() {
+	defer close(oe.doneChan)
+	for {
+		select {
+		case <-time.After(defaultOTLPFlushPeriod):
+		case <-oe.flushChan:
+		case <-oe.closeChan:
+			if err := oe.Flush(); err != nil {
+				oe.log.Errorf("Failed to export spans to %s: %v", oe.endpoint, err)
+			}
+			return
+		}
+		if err := oe.Flush(); err != nil {
+			oe.log.Errorf("Failed to export spans to %s: %v", oe.endpoint, err)
+		}
+	}
+}
+
+/*
+ * The OTLP/HTTP JSON request, see
+ * https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+ */
+
+type OTLPTraceRequest struct {
+	ResourceSpans []OTLPResourceSpans `json:"resourceSpans"`
+}
+
+type OTLPResourceSpans struct {
+	Resource   OTLPResource     `json:"resource"`
+	ScopeSpans []OTLPScopeSpans `json:"scopeSpans"`
+}
+
+type OTLPResource struct {
+	Attributes []OTLPKeyValue `json:"attributes"`
+}
+
+type OTLPScopeSpans struct {
+	Scope OTLPScope  `json:"scope"`
+	Spans []OTLPSpan `json:"spans"`
+}
+
+type OTLPScope struct {
+	Name string `json:"name"`
+}
+
+type OTLPSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []OTLPKeyValue `json:"attributes,omitempty"`
+	Status            OTLPStatus     `json:"status"`
+}
+
+type OTLPKeyValue struct {
+	Key   string       `json:"key"`
+	Value OTLPAnyValue `json:"value"`
+}
+
+type OTLPAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type OTLPStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpRequest groups the spans by service into an OTLP request
+func otlpRequest(spans []*Span) OTLPTraceRequest {
+	var request OTLPTraceRequest
+	services := make(map[string]int)
+
+	for _, span := range spans {
+		record := span.Record()
+		index, exists := services[record.Service]
+		if !exists {
+			index = len(request.ResourceSpans)
+			services[record.Service] = index
+			request.ResourceSpans = append(request.ResourceSpans, OTLPResourceSpans{
+				Resource:   OTLPResource{Attributes: otlpAttributes(map[string]string{"service.name": record.Service})},
+				ScopeSpans: []OTLPScopeSpans{{Scope: OTLPScope{Name: OTLP_SCOPE_NAME}}},
+			})
+		}
+
+		otlpSpan := OTLPSpan{
+			TraceID:           record.TraceID,
+			SpanID:            record.SpanID,
+			ParentSpanID:      record.ParentSpanID,
+			Name:              record.Name,
+			Kind:              record.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(record.Attributes),
+			Status:            OTLPStatus{Code: otlpStatusUnset},
+		}
+		if record.Error != "" {
+			otlpSpan.Status = OTLPStatus{Code: otlpStatusError, Message: record.Error}
+		}
+
+		scopeSpans := &request.ResourceSpans[index].ScopeSpans[0]
+		scopeSpans.Spans = append(scopeSpans.Spans, otlpSpan)
+	}
+	return request
+}
+
+func otlpAttributes(attributes map[string]string) (keyValues []OTLPKeyValue) {
+	for key, value := range attributes {
+		keyValues = append(keyValues, OTLPKeyValue{Key: key, Value: OTLPAnyValue{StringValue: value}})
+	}
+	sort.Slice(keyValues, func(i, j int) bool {
+		return keyValues[i].Key < keyValues[j].Key
+	})
+	return keyValues
+}
@@ -0,0 +1,250 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * Lightweight distributed tracing for nanodm.  The trace context of a request
+ * is carried between processes in the `TraceParent` field of nanodm.Message
+ * using the W3C traceparent format, so spans can be exported to any
+ * OpenTelemetry collector.
+ *
+ * A nil *Tracer and a nil *Span are valid and do nothing, so tracing can be
+ * left disabled without checks at each call site.
+ */
+
+type TraceID [16]byte
+
+type SpanID [8]byte
+
+func (ti TraceID) String() string {
+	return hex.EncodeToString(ti[:])
+}
+
+func (ti TraceID) IsValid() bool {
+	return ti != TraceID{}
+}
+
+func (si SpanID) String() string {
+	return hex.EncodeToString(si[:])
+}
+
+func (si SpanID) IsValid() bool {
+	return si != SpanID{}
+}
+
+// SpanContext identifies a span, and is what is propagated between processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// TraceParent formats the span context as a W3C traceparent header value
+func (sc SpanContext) TraceParent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", sc.TraceID, sc.SpanID)
+}
+
+// ParseTraceParent parses a W3C traceparent header value
+func ParseTraceParent(traceParent string) (SpanContext, error) {
+	var sc SpanContext
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[3]) != 2 {
+		return sc, fmt.Errorf("invalid traceparent (%s)", traceParent)
+	}
+	if n, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil || n != len(sc.TraceID) || len(parts[1]) != 32 {
+		return sc, fmt.Errorf("invalid trace ID in traceparent (%s)", traceParent)
+	}
+	if n, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil || n != len(sc.SpanID) || len(parts[2]) != 16 {
+		return sc, fmt.Errorf("invalid span ID in traceparent (%s)", traceParent)
+	}
+	if !sc.IsValid() {
+		return sc, fmt.Errorf("invalid zero ID in traceparent (%s)", traceParent)
+	}
+	return sc, nil
+}
+
+type SpanKind int
+
+// Span kinds, numbered as in OpenTelemetry
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a single timed operation of a trace
+type Span struct {
+	Name         string
+	Kind         SpanKind
+	ServiceName  string
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string
+	// The error message if the operation failed
+	Error string
+
+	tracer *Tracer
+	lock   sync.Mutex
+	ended  bool
+}
+
+// Context returns the span context, or an invalid context for a nil span
+func (sp *Span) Context() SpanContext {
+	if sp == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: sp.TraceID, SpanID: sp.SpanID}
+}
+
+// TraceParent returns the W3C traceparent of the span, or "" for a nil span
+func (sp *Span) TraceParent() string {
+	return sp.Context().TraceParent()
+}
+
+func (sp *Span) SetAttribute(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.Attributes[key] = fmt.Sprint(value)
+}
+
+// SetError marks the span as failed with `err`.  A nil error is ignored.
+func (sp *Span) SetError(err error) {
+	if sp == nil || err == nil {
+		return
+	}
+	sp.lock.Lock()
+	defer sp.lock.Unlock()
+	sp.Error = err.Error()
+}
+
+// End ends the span and passes it to the exporter of the tracer
+func (sp *Span) End() {
+	if sp == nil {
+		return
+	}
+	sp.lock.Lock()
+	if sp.ended {
+		sp.lock.Unlock()
+		return
+	}
+	sp.ended = true
+	sp.EndTime = time.Now()
+	sp.lock.Unlock()
+
+	sp.tracer.export(sp)
+}
+
+// Tracer creates spans for a service and passes them to an exporter
+type Tracer struct {
+	serviceName string
+	exporter    Exporter
+}
+
+// NewTracer creates a tracer for the service `serviceName` exporting ended
+// spans to `exporter`
+func NewTracer(serviceName string, exporter Exporter) *Tracer {
+	return &Tracer{
+		serviceName: serviceName,
+		exporter:    exporter,
+	}
+}
+
+// Start starts a span that is a child of the span in `ctx`, or of the remote
+// parent in `ctx`, or the root of a new trace.  The returned context carries
+// the new span.
+func (tr *Tracer) Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if tr == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:        name,
+		Kind:        kind,
+		ServiceName: tr.serviceName,
+		SpanID:      newSpanID(),
+		StartTime:   time.Now(),
+		Attributes:  make(map[string]string),
+		tracer:      tr,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID, span.ParentSpanID = parent.TraceID, parent.SpanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(SpanContext); ok {
+		span.TraceID, span.ParentSpanID = remote.TraceID, remote.SpanID
+	} else {
+		span.TraceID = newTraceID()
+	}
+
+	return ContextWithSpan(ctx, span), span
+}
+
+func (tr *Tracer) export(span *Span) {
+	if tr == nil || tr.exporter == nil {
+		return
+	}
+	tr.exporter.ExportSpan(span)
+}
+
+type spanKey struct{}
+
+type remoteParentKey struct{}
+
+// ContextWithSpan returns a copy of `ctx` carrying `span`
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// SpanFromContext returns the span carried by `ctx`, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// ContextWithTraceParent returns a copy of `ctx` with the remote parent in
+// the W3C `traceParent`, which spans started from the context continue.  An
+// empty or invalid traceparent returns `ctx`.
+func ContextWithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	remote, err := ParseTraceParent(traceParent)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteParentKey{}, remote)
+}
+
+func newTraceID() (traceID TraceID) {
+	rand.Read(traceID[:])
+	return traceID
+}
+
+func newSpanID() (spanID SpanID) {
+	rand.Read(spanID[:])
+	return spanID
+}
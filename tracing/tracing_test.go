@@ -0,0 +1,167 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceParent(t *testing.T) {
+	traceParent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	spanContext, err := ParseTraceParent(traceParent)
+	assert.Nil(t, err)
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spanContext.TraceID.String())
+	assert.Equal(t, "b7ad6b7169203331", spanContext.SpanID.String())
+	assert.Equal(t, traceParent, spanContext.TraceParent())
+
+	for _, invalid := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"00-0af7651916cd43dd8448eb211c8031-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b71692033-01",
+		"00-zzf7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+	} {
+		_, err = ParseTraceParent(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+
+	assert.Equal(t, "", SpanContext{}.TraceParent())
+}
+
+func TestSpans(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer("test", exporter)
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindInternal)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("count", 2)
+	child.SetError(fmt.Errorf("failed"))
+	child.End()
+	root.End()
+	root.End()
+
+	spans := exporter.Spans()
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "root", spans[0].Name)
+	assert.Equal(t, "test", spans[0].ServiceName)
+	assert.False(t, spans[0].ParentSpanID.IsValid())
+	assert.Equal(t, "child", spans[1].Name)
+	assert.Equal(t, SpanKindClient, spans[1].Kind)
+	assert.Equal(t, root.TraceID, spans[1].TraceID)
+	assert.Equal(t, root.SpanID, spans[1].ParentSpanID)
+	assert.Equal(t, "2", spans[1].Attributes["count"])
+	assert.Equal(t, "failed", spans[1].Error)
+
+	// A remote parent is continued from the traceparent
+	remoteCtx := ContextWithTraceParent(context.Background(), child.TraceParent())
+	_, remote := tracer.Start(remoteCtx, "remote", SpanKindServer)
+	remote.End()
+	assert.Equal(t, child.TraceID, remote.TraceID)
+	assert.Equal(t, child.SpanID, remote.ParentSpanID)
+
+	// An invalid traceparent starts a new trace
+	_, other := tracer.Start(ContextWithTraceParent(context.Background(), "invalid"), "other", SpanKindServer)
+	other.End()
+	assert.NotEqual(t, child.TraceID, other.TraceID)
+	assert.False(t, other.ParentSpanID.IsValid())
+
+	exporter.Reset()
+	assert.Equal(t, 0, len(exporter.Spans()))
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop", SpanKindInternal)
+	assert.Nil(t, span)
+	assert.Nil(t, SpanFromContext(ctx))
+	span.SetAttribute("key", "value")
+	span.SetError(fmt.Errorf("failed"))
+	span.End()
+	assert.Equal(t, "", span.TraceParent())
+}
+
+func TestWriterExporter(t *testing.T) {
+	var buffer bytes.Buffer
+	tracer := NewTracer("test", NewWriterExporter(&buffer))
+
+	ctx, root := tracer.Start(context.Background(), "root", SpanKindInternal)
+	_, child := tracer.Start(ctx, "child", SpanKindClient)
+	child.SetAttribute("nanodm.source", "testSource")
+	child.End()
+	root.End()
+
+	decoder := json.NewDecoder(&buffer)
+	var childRecord, rootRecord SpanRecord
+	assert.Nil(t, decoder.Decode(&childRecord))
+	assert.Nil(t, decoder.Decode(&rootRecord))
+
+	assert.Equal(t, "child", childRecord.Name)
+	assert.Equal(t, "test", childRecord.Service)
+	assert.Equal(t, root.SpanID.String(), childRecord.ParentSpanID)
+	assert.Equal(t, "testSource", childRecord.Attributes["nanodm.source"])
+	assert.Equal(t, "root", rootRecord.Name)
+	assert.Equal(t, "", rootRecord.ParentSpanID)
+	assert.Equal(t, rootRecord.TraceID, childRecord.TraceID)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var lock sync.Mutex
+	var requests []OTLPTraceRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request OTLPTraceRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		assert.Nil(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		lock.Lock()
+		requests = append(requests, request)
+		lock.Unlock()
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(logrus.NewEntry(logrus.New()), collector.URL)
+	coordinatorTracer := NewTracer("coordinator", exporter)
+	sourceTracer := NewTracer("source", exporter)
+
+	ctx, send := coordinatorTracer.Start(context.Background(), "coordinator.send Get", SpanKindClient)
+	_, handle := sourceTracer.Start(ContextWithTraceParent(ctx, send.TraceParent()), "source.handle Get", SpanKindServer)
+	handle.SetError(fmt.Errorf("failed"))
+	handle.End()
+	send.End()
+
+	assert.Nil(t, exporter.Close())
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, 1, len(requests))
+	resourceSpans := requests[0].ResourceSpans
+	assert.Equal(t, 2, len(resourceSpans))
+
+	services := make(map[string]OTLPSpan)
+	for _, resource := range resourceSpans {
+		assert.Equal(t, "service.name", resource.Resource.Attributes[0].Key)
+		assert.Equal(t, 1, len(resource.ScopeSpans))
+		assert.Equal(t, OTLP_SCOPE_NAME, resource.ScopeSpans[0].Scope.Name)
+		assert.Equal(t, 1, len(resource.ScopeSpans[0].Spans))
+		services[resource.Resource.Attributes[0].Value.StringValue] = resource.ScopeSpans[0].Spans[0]
+	}
+
+	assert.Equal(t, "coordinator.send Get", services["coordinator"].Name)
+	assert.Equal(t, otlpStatusUnset, services["coordinator"].Status.Code)
+	assert.Equal(t, "source.handle Get", services["source"].Name)
+	assert.Equal(t, SpanKindServer, services["source"].Kind)
+	assert.Equal(t, services["coordinator"].TraceID, services["source"].TraceID)
+	assert.Equal(t, services["coordinator"].SpanID, services["source"].ParentSpanID)
+	assert.Equal(t, otlpStatusError, services["source"].Status.Code)
+	assert.Equal(t, "failed", services["source"].Status.Message)
+}
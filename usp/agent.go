@@ -0,0 +1,890 @@
+package usp
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/audit"
+	"github.com/zackwine/nanodm/coordinator"
+)
+
+const (
+	SUPPORTED_PROTOCOL_VERSIONS = "1.0,1.1,1.2"
+
+	defaultRootObject    = "Device."
+	defaultNotifyTimeout = 10 * time.Second
+)
+
+// OperateHandler is called to execute a USP command such as "Device.Reboot()".
+// The returned output arguments are sent to the controller.
+type OperateHandler func(command string, commandKey string, inputArgs map[string]string) (map[string]string, error)
+
+type Config struct {
+	// USP endpoint ID of the agent, for example "os::012345-0101"
+	EndpointID string
+	// Endpoint ID of the controller that connect records and notifications
+	// are sent to
+	ControllerID string
+	// Object used for requests with an empty path (defaults to "Device.")
+	RootObject string
+	// Called to execute Operate requests.  Operate isn't supported if nil.
+	OperateHandler OperateHandler
+	// How long Notify waits for a NotifyResp (defaults to 10 seconds)
+	NotifyTimeout time.Duration
+}
+
+// Agent is a USP agent serving the data model of a coordinator server to USP
+// controllers over one or more MTPs
+type Agent struct {
+	log    *logrus.Entry
+	config Config
+	server *coordinator.Server
+
+	mtps          []MTP
+	notifyMutex   sync.Mutex
+	pendingNotify map[string]chan struct{}
+}
+
+// NewAgent creates a USP agent for the coordinator `server`
+func NewAgent(log *logrus.Entry, server *coordinator.Server, config Config) *Agent {
+	if config.RootObject == "" {
+		config.RootObject = defaultRootObject
+	}
+	if config.NotifyTimeout == 0 {
+		config.NotifyTimeout = defaultNotifyTimeout
+	}
+	return &Agent{
+		log:           log,
+		config:        config,
+		server:        server,
+		pendingNotify: make(map[string]chan struct{}),
+	}
+}
+
+// AddMTP adds an MTP to the agent.  Must be called before Start.
+func (ag *Agent) AddMTP(mtp MTP) {
+	ag.mtps = append(ag.mtps, mtp)
+}
+
+func (ag *Agent) Start() error {
+	if ag.config.EndpointID == "" {
+		return fmt.Errorf("the agent endpoint ID isn't configured")
+	}
+	for i, mtp := range ag.mtps {
+		if err := mtp.Start(ag.config.EndpointID, ag.handleRecord); err != nil {
+			for _, started := range ag.mtps[:i] {
+				started.Stop()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (ag *Agent) Stop() error {
+	var err error
+	for _, mtp := range ag.mtps {
+		if stopErr := mtp.Stop(); stopErr != nil {
+			err = stopErr
+		}
+	}
+	return err
+}
+
+// Notify sends a notification to the controller on every MTP.  If
+// `notify.SendResp` is set Notify waits for the controller's NotifyResp.
+func (ag *Agent) Notify(notify *Notify) error {
+	msgID := uuid.New().String()
+	msg := &Msg{
+		Header: &Header{MsgId: msgID, MsgType: int32(MsgTypeNotify)},
+		Body:   &Body{Request: &Request{Notify: notify}},
+	}
+
+	var respChan chan struct{}
+	if notify.SendResp {
+		respChan = make(chan struct{}, 1)
+		ag.notifyMutex.Lock()
+		ag.pendingNotify[msgID] = respChan
+		ag.notifyMutex.Unlock()
+		defer func() {
+			ag.notifyMutex.Lock()
+			delete(ag.pendingNotify, msgID)
+			ag.notifyMutex.Unlock()
+		}()
+	}
+
+	sent := false
+	for _, mtp := range ag.mtps {
+		if err := ag.sendMsg(mtp, ag.config.ControllerID, msg); err != nil {
+			ag.log.Errorf("Failed to send notify: %v", err)
+			continue
+		}
+		sent = true
+	}
+	if !sent {
+		return fmt.Errorf("failed to send notify on any MTP")
+	}
+
+	if respChan == nil {
+		return nil
+	}
+	select {
+	case <-respChan:
+		return nil
+	case <-time.After(ag.config.NotifyTimeout):
+		return fmt.Errorf("timeout waiting for NotifyResp (%s)", msgID)
+	}
+}
+
+func (ag *Agent) handleRecord(mtp MTP, data []byte) {
+	if data == nil {
+		if record := mtp.ConnectRecord(); record != nil {
+			if err := ag.sendRecord(mtp, ag.config.ControllerID, record); err != nil {
+				ag.log.Errorf("Failed to send connect record: %v", err)
+			}
+		}
+		return
+	}
+
+	var record Record
+	if err := Unmarshal(data, &record); err != nil {
+		ag.log.Errorf("Failed to decode USP record: %v", err)
+		return
+	}
+	if record.ToId != "" && record.ToId != ag.config.EndpointID {
+		ag.log.Warnf("Dropping USP record for endpoint (%s)", record.ToId)
+		return
+	}
+	if record.Disconnect != nil {
+		ag.log.Warnf("Controller (%s) disconnected: %s", record.FromId, record.Disconnect.Reason)
+		return
+	}
+	if record.NoSessionContext == nil {
+		return
+	}
+
+	var msg Msg
+	if err := Unmarshal(record.NoSessionContext.Payload, &msg); err != nil {
+		ag.log.Errorf("Failed to decode USP message from (%s): %v", record.FromId, err)
+		return
+	}
+
+	// Changes are audited as made by the controller sending the record
+	ctx := audit.ContextWithIdentity(context.Background(), record.FromId)
+	response := ag.handleMsg(ctx, &msg)
+	if response == nil {
+		return
+	}
+	if err := ag.sendMsg(mtp, record.FromId, response); err != nil {
+		ag.log.Errorf("Failed to send USP response to (%s): %v", record.FromId, err)
+	}
+}
+
+func (ag *Agent) sendMsg(mtp MTP, toID string, msg *Msg) error {
+	payload, err := Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return ag.sendRecord(mtp, toID, &Record{NoSessionContext: &NoSessionContextRecord{Payload: payload}})
+}
+
+func (ag *Agent) sendRecord(mtp MTP, toID string, record *Record) error {
+	record.Version = RECORD_VERSION
+	record.ToId = toID
+	record.FromId = ag.config.EndpointID
+	data, err := Marshal(record)
+	if err != nil {
+		return err
+	}
+	return mtp.Send(data)
+}
+
+// handleMsg handles a message from a controller and returns the response, or
+// nil if no response is required
+func (ag *Agent) handleMsg(ctx context.Context, msg *Msg) *Msg {
+	if msg.Header == nil || msg.Body == nil {
+		ag.log.Errorf("Dropping USP message without header or body")
+		return nil
+	}
+
+	if msg.Body.Response != nil {
+		if msg.Body.Response.NotifyResp != nil {
+			ag.notifyMutex.Lock()
+			if respChan, ok := ag.pendingNotify[msg.Header.MsgId]; ok {
+				// A duplicate NotifyResp is dropped
+				select {
+				case respChan <- struct{}{}:
+				default:
+				}
+			}
+			ag.notifyMutex.Unlock()
+		}
+		return nil
+	}
+	if msg.Body.Error != nil {
+		ag.log.Errorf("Controller responded to (%s) with error %d: %s", msg.Header.MsgId, msg.Body.Error.ErrCode, msg.Body.Error.ErrMsg)
+		return nil
+	}
+	request := msg.Body.Request
+	if request == nil {
+		return errorMsg(msg.Header.MsgId, NewAgentError(ErrMessageNotSupported), nil)
+	}
+
+	var response *Response
+	var respType MsgType
+	var err error
+
+	switch {
+	case request.Get != nil:
+		response, respType = &Response{GetResp: ag.handleGet(request.Get)}, MsgTypeGetResp
+	case request.Set != nil:
+		var setResp *SetResp
+		setResp, err = ag.handleSet(ctx, request.Set)
+		response, respType = &Response{SetResp: setResp}, MsgTypeSetResp
+	case request.Add != nil:
+		var addResp *AddResp
+		addResp, err = ag.handleAdd(ctx, request.Add)
+		response, respType = &Response{AddResp: addResp}, MsgTypeAddResp
+	case request.Delete != nil:
+		var deleteResp *DeleteResp
+		deleteResp, err = ag.handleDelete(ctx, request.Delete)
+		response, respType = &Response{DeleteResp: deleteResp}, MsgTypeDeleteResp
+	case request.GetInstances != nil:
+		response, respType = &Response{GetInstancesResp: ag.handleGetInstances(request.GetInstances)}, MsgTypeGetInstancesResp
+	case request.GetSupportedDM != nil:
+		response, respType = &Response{GetSupportedDMResp: ag.handleGetSupportedDM(request.GetSupportedDM)}, MsgTypeGetSupportedDMResp
+	case request.Operate != nil:
+		var operateResp *OperateResp
+		operateResp, err = ag.handleOperate(ctx, request.Operate)
+		if err == nil && !request.Operate.SendResp {
+			return nil
+		}
+		response, respType = &Response{OperateResp: operateResp}, MsgTypeOperateResp
+	case request.GetSupportedProtocol != nil:
+		response = &Response{GetSupportedProtocolResp: &GetSupportedProtocolResp{
+			AgentSupportedProtocolVersions: SUPPORTED_PROTOCOL_VERSIONS,
+		}}
+		respType = MsgTypeGetSupportedProtoResp
+	default:
+		err = NewAgentError(ErrMessageNotSupported)
+	}
+
+	if err != nil {
+		ag.log.Errorf("USP request (%s) failed: %v", msg.Header.MsgId, err)
+		var paramErrs []ParamError
+		if failure, ok := err.(*requestFailure); ok {
+			err, paramErrs = failure.err, failure.paramErrs
+		}
+		return errorMsg(msg.Header.MsgId, agentError(err, ErrObjectDoesNotExist), paramErrs)
+	}
+
+	return &Msg{
+		Header: &Header{MsgId: msg.Header.MsgId, MsgType: int32(respType)},
+		Body:   &Body{Response: response},
+	}
+}
+
+// requestFailure fails a whole request that doesn't allow partial success
+type requestFailure struct {
+	err       *AgentError
+	paramErrs []ParamError
+}
+
+func (rf *requestFailure) Error() string {
+	return rf.err.Error()
+}
+
+func errorMsg(msgID string, err *AgentError, paramErrs []ParamError) *Msg {
+	return &Msg{
+		Header: &Header{MsgId: msgID, MsgType: int32(MsgTypeError)},
+		Body: &Body{Error: &Error{
+			ErrCode:   err.Code,
+			ErrMsg:    err.Message,
+			ParamErrs: paramErrs,
+		}},
+	}
+}
+
+func (ag *Agent) handleGet(get *Get) *GetResp {
+	resp := &GetResp{}
+	for _, path := range get.ParamPaths {
+		result := RequestedPathResult{RequestedPath: path}
+		objects, err := ag.resolvePath(path)
+		if err != nil {
+			agentErr := agentError(err, ErrInvalidPath)
+			result.ErrCode, result.ErrMsg = agentErr.Code, agentErr.Message
+		} else {
+			result.ResolvedPathResults = resolvedPathResults(objects)
+		}
+		resp.ReqPathResults = append(resp.ReqPathResults, result)
+	}
+	return resp
+}
+
+// resolvePath gets the objects at `path`.  Partial paths return every object
+// under the path and the `*` wildcard matches any instance.  Search
+// expressions aren't supported.
+func (ag *Agent) resolvePath(path string) ([]nanodm.Object, error) {
+	if path == "" {
+		path = ag.config.RootObject
+	}
+	if strings.ContainsAny(path, "[]{}#+") {
+		return nil, NewAgentError(ErrInvalidPathSyntax)
+	}
+
+	wildcard := strings.Index(path, "*")
+	if wildcard < 0 {
+		objects, errs := ag.server.GetPartial(path)
+		if len(errs) > 0 {
+			return nil, errs[0]
+		}
+		return objects, nil
+	}
+
+	prefix := path[:wildcard]
+	if !strings.HasSuffix(prefix, ".") {
+		return nil, NewAgentError(ErrInvalidPathSyntax)
+	}
+	objects, errs := ag.server.GetPartial(prefix)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	var matched []nanodm.Object
+	for _, object := range objects {
+		if matchPath(path, object.Name) {
+			matched = append(matched, object)
+		}
+	}
+	return matched, nil
+}
+
+// matchPath returns true if `name` matches `pattern`, where `*` matches any
+// single path segment and a pattern ending in "." matches everything under it
+func matchPath(pattern string, name string) bool {
+	patternSegs := strings.Split(pattern, ".")
+	nameSegs := strings.Split(name, ".")
+	partial := strings.HasSuffix(pattern, ".")
+	if partial {
+		patternSegs = patternSegs[:len(patternSegs)-1]
+		if len(nameSegs) <= len(patternSegs) {
+			return false
+		}
+	} else if len(nameSegs) != len(patternSegs) {
+		return false
+	}
+
+	for i, seg := range patternSegs {
+		if seg != "*" && seg != nameSegs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// resolvedPathResults groups parameters by the object that contains them
+func resolvedPathResults(objects []nanodm.Object) []ResolvedPathResult {
+	var results []ResolvedPathResult
+	indexes := make(map[string]int)
+
+	for _, object := range objects {
+		objPath, param := splitPath(object.Name)
+		if param == "" {
+			continue
+		}
+		index, exists := indexes[objPath]
+		if !exists {
+			index = len(results)
+			indexes[objPath] = index
+			results = append(results, ResolvedPathResult{ResolvedPath: objPath, ResultParams: make(map[string]string)})
+		}
+		results[index].ResultParams[param] = nanodm.FormatValue(object.Value)
+	}
+	return results
+}
+
+// splitPath splits a parameter path into the object path and parameter name
+func splitPath(name string) (objPath string, param string) {
+	idx := strings.LastIndex(name, ".")
+	return name[:idx+1], name[idx+1:]
+}
+
+// setUpdate is the part of a Set request updating one object
+type setUpdate struct {
+	objPath     string
+	invalidPath bool
+	// The objects of the settings that converted, and whether each is
+	// required, by name
+	objects  []nanodm.Object
+	required map[string]bool
+	// The parameters that failed, by name
+	failed         map[string]bool
+	paramErrs      []ParameterError
+	requiredFailed bool
+}
+
+// fail records that the setting of `param` failed with `err`
+func (su *setUpdate) fail(param string, required bool, err error) ParamError {
+	agentErr := agentError(err, ErrUnsupportedParameter)
+	su.failed[param] = true
+	su.paramErrs = append(su.paramErrs, ParameterError{Param: param, ErrCode: agentErr.Code, ErrMsg: agentErr.Message})
+	su.requiredFailed = su.requiredFailed || required
+	return ParamError{ParamPath: su.objPath + param, ErrCode: agentErr.Code, ErrMsg: agentErr.Message}
+}
+
+// setResult records the objects of the update that `result` failed to set
+func (su *setUpdate) setResult(result *coordinator.SetResult) (failedParams []ParamError) {
+	for _, object := range su.objects {
+		if err, failed := result.Errors[object.Name]; failed {
+			_, param := splitPath(object.Name)
+			failedParams = append(failedParams, su.fail(param, su.required[object.Name], err))
+		}
+	}
+	return failedParams
+}
+
+// result returns the result of the update
+func (su *setUpdate) result() UpdatedObjectResult {
+	result := UpdatedObjectResult{RequestedPath: su.objPath}
+	if su.invalidPath {
+		result.OperStatus = &SetOperStatus{OperFailure: &SetOperationFailure{ErrCode: ErrInvalidPathSyntax, ErrMsg: errorMessages[ErrInvalidPathSyntax]}}
+		return result
+	}
+
+	updated := make(map[string]string)
+	for _, object := range su.objects {
+		if _, param := splitPath(object.Name); !su.failed[param] {
+			updated[param] = nanodm.FormatValue(object.Value)
+		}
+	}
+	if su.requiredFailed || len(updated) == 0 && len(su.paramErrs) > 0 {
+		result.OperStatus = &SetOperStatus{OperFailure: &SetOperationFailure{
+			ErrCode: ErrMessageFailed,
+			ErrMsg:  errorMessages[ErrMessageFailed],
+			UpdatedInstFailures: []UpdatedInstanceFailure{{
+				AffectedPath: su.objPath,
+				ParamErrs:    su.paramErrs,
+			}},
+		}}
+		return result
+	}
+	result.OperStatus = &SetOperStatus{OperSuccess: &SetOperationSuccess{
+		UpdatedInstResults: []UpdatedInstanceResult{{
+			AffectedPath:  su.objPath,
+			ParamErrs:     su.paramErrs,
+			UpdatedParams: updated,
+		}},
+	}}
+	return result
+}
+
+// handleSet converts every setting before setting any.  Without AllowPartial
+// the parameters of every object are set all or nothing, otherwise each
+// object is set on its own.
+func (ag *Agent) handleSet(ctx context.Context, set *Set) (*SetResp, error) {
+	var failedParams []ParamError
+	var objects []nanodm.Object
+	updates := make([]*setUpdate, 0, len(set.UpdateObjs))
+
+	for _, updateObj := range set.UpdateObjs {
+		update := &setUpdate{objPath: updateObj.ObjPath, required: make(map[string]bool), failed: make(map[string]bool)}
+		updates = append(updates, update)
+
+		if !strings.HasSuffix(updateObj.ObjPath, ".") || strings.ContainsAny(updateObj.ObjPath, "*[]{}#+") {
+			update.invalidPath = true
+			failedParams = append(failedParams, ParamError{ParamPath: updateObj.ObjPath, ErrCode: ErrInvalidPathSyntax, ErrMsg: errorMessages[ErrInvalidPathSyntax]})
+			continue
+		}
+
+		for _, setting := range updateObj.ParamSettings {
+			object, err := ag.objectFromSetting(updateObj.ObjPath+setting.Param, setting.Value)
+			if err != nil {
+				failedParams = append(failedParams, update.fail(setting.Param, setting.Required, err))
+				continue
+			}
+			update.objects = append(update.objects, object)
+			update.required[object.Name] = setting.Required
+		}
+		objects = append(objects, update.objects...)
+	}
+
+	if !set.AllowPartial {
+		if len(failedParams) > 0 {
+			return nil, &requestFailure{err: NewAgentError(ErrMessageFailed), paramErrs: failedParams}
+		}
+		result := ag.setObjects(ctx, objects, true)
+		for _, update := range updates {
+			failedParams = append(failedParams, update.setResult(result)...)
+		}
+		if len(failedParams) > 0 {
+			return nil, &requestFailure{err: NewAgentError(ErrMessageFailed), paramErrs: failedParams}
+		}
+	} else {
+		for _, update := range updates {
+			ag.applyUpdate(ctx, update)
+		}
+	}
+
+	resp := &SetResp{}
+	for _, update := range updates {
+		resp.UpdatedObjResults = append(resp.UpdatedObjResults, update.result())
+	}
+	return resp, nil
+}
+
+// applyUpdate sets the objects of `update` on its own.  The required
+// parameters are set all or nothing first, and the others only if they were.
+func (ag *Agent) applyUpdate(ctx context.Context, update *setUpdate) {
+	if update.invalidPath || update.requiredFailed {
+		return
+	}
+	var required, optional []nanodm.Object
+	for _, object := range update.objects {
+		if update.required[object.Name] {
+			required = append(required, object)
+		} else {
+			optional = append(optional, object)
+		}
+	}
+	if len(required) > 0 {
+		update.setResult(ag.setObjects(ctx, required, true))
+		if update.requiredFailed {
+			return
+		}
+	}
+	if len(optional) > 0 {
+		update.setResult(ag.setObjects(ctx, optional, false))
+	}
+}
+
+// setObjects sets `objects`, logging the objects that failed to be restored
+func (ag *Agent) setObjects(ctx context.Context, objects []nanodm.Object, allOrNothing bool) *coordinator.SetResult {
+	result := ag.server.SetObjects(ctx, objects, allOrNothing)
+	for name, err := range result.RestoreErrors {
+		ag.log.Errorf("Failed to restore (%s) after a failed set: %v", name, err)
+	}
+	return result
+}
+
+// objectFromSetting converts a parameter setting into an object for Set
+func (ag *Agent) objectFromSetting(name string, value string) (nanodm.Object, error) {
+	object := nanodm.Object{Name: name}
+
+	if registered, err := ag.server.List(name); err == nil && len(registered) == 1 {
+		if registered[0].Access != nanodm.AccessRW {
+			return object, NewAgentError(ErrNonWritableParameter)
+		}
+		object.Type = registered[0].Type
+	} else if !ag.server.IsObjectHandledByDynamicList(name) {
+		return object, NewAgentError(ErrUnsupportedParameter)
+	}
+
+	parsed, err := nanodm.ParseValue(object.Type, value)
+	if err != nil {
+		return object, NewAgentError(ErrInvalidValue)
+	}
+	object.Value = parsed
+	return object, nil
+}
+
+// handleAdd adds a row for each object.  Without AllowPartial the rows are
+// added until one fails, and those added are then deleted.
+func (ag *Agent) handleAdd(ctx context.Context, add *Add) (*AddResp, error) {
+	resp := &AddResp{}
+	var failedParams []ParamError
+	var rows []string
+
+	for _, createObj := range add.CreateObjs {
+		result := CreatedObjectResult{RequestedPath: createObj.ObjPath}
+
+		row, err := ag.addRow(ctx, createObj)
+		if err != nil {
+			agentErr := agentError(err, ErrObjectNotCreated)
+			result.OperStatus = &AddOperStatus{OperFailure: &OperationFailure{ErrCode: agentErr.Code, ErrMsg: agentErr.Message}}
+			failedParams = append(failedParams, ParamError{ParamPath: createObj.ObjPath, ErrCode: agentErr.Code, ErrMsg: agentErr.Message})
+			if !add.AllowPartial {
+				break
+			}
+		} else {
+			rows = append(rows, row)
+			result.OperStatus = &AddOperStatus{OperSuccess: &AddOperationSuccess{InstantiatedPath: row}}
+		}
+		resp.CreatedObjResults = append(resp.CreatedObjResults, result)
+	}
+
+	if !add.AllowPartial && len(failedParams) > 0 {
+		for i := len(rows) - 1; i >= 0; i-- {
+			if err := ag.server.DeleteRowContext(ctx, nanodm.Object{Name: rows[i], Type: nanodm.TypeRow}); err != nil {
+				ag.log.Errorf("Failed to delete (%s) after a failed add: %v", rows[i], err)
+			}
+		}
+		return nil, &requestFailure{err: NewAgentError(ErrMessageFailed), paramErrs: failedParams}
+	}
+	return resp, nil
+}
+
+func (ag *Agent) addRow(ctx context.Context, createObj CreateObject) (string, error) {
+	if !strings.HasSuffix(createObj.ObjPath, ".") || strings.ContainsAny(createObj.ObjPath, "*[]{}#+") {
+		return "", NewAgentError(ErrInvalidPathSyntax)
+	}
+	if !ag.server.IsObjectHandledByDynamicList(createObj.ObjPath) {
+		return "", NewAgentError(ErrObjectNotATable)
+	}
+
+	values := make(map[string]interface{})
+	for _, setting := range createObj.ParamSettings {
+		values[setting.Param] = setting.Value
+	}
+	return ag.server.AddRowContext(ctx, nanodm.Object{
+		Name:  createObj.ObjPath,
+		Type:  nanodm.TypeRow,
+		Value: values,
+	})
+}
+
+// deletedRow is a row deleted by a Delete request, and the values to add it
+// back with
+type deletedRow struct {
+	table  string
+	values map[string]interface{}
+}
+
+// handleDelete deletes each row.  Without AllowPartial the values of the rows
+// are fetched first, so that if a row fails to be deleted those deleted are
+// added back, under new instance numbers.
+func (ag *Agent) handleDelete(ctx context.Context, del *Delete) (*DeleteResp, error) {
+	resp := &DeleteResp{}
+	var failedParams []ParamError
+
+	var rowValues map[string]*deletedRow
+	if !del.AllowPartial {
+		var row string
+		var err error
+		if rowValues, row, err = ag.rowValues(ctx, del.ObjPaths); err != nil {
+			agentErr := agentError(err, ErrObjectDoesNotExist)
+			return nil, &requestFailure{err: NewAgentError(ErrMessageFailed), paramErrs: []ParamError{{ParamPath: row, ErrCode: agentErr.Code, ErrMsg: agentErr.Message}}}
+		}
+	}
+
+	var deleted []*deletedRow
+	for _, objPath := range del.ObjPaths {
+		result := DeletedObjectResult{RequestedPath: objPath}
+
+		var err error
+		if !strings.HasSuffix(objPath, ".") || strings.ContainsAny(objPath, "*[]{}#+") {
+			err = NewAgentError(ErrInvalidPathSyntax)
+		} else {
+			err = ag.server.DeleteRowContext(ctx, nanodm.Object{Name: objPath, Type: nanodm.TypeRow})
+		}
+
+		if err != nil {
+			agentErr := agentError(err, ErrObjectDoesNotExist)
+			result.OperStatus = &DeleteOperStatus{OperFailure: &OperationFailure{ErrCode: agentErr.Code, ErrMsg: agentErr.Message}}
+			failedParams = append(failedParams, ParamError{ParamPath: objPath, ErrCode: agentErr.Code, ErrMsg: agentErr.Message})
+			if !del.AllowPartial {
+				break
+			}
+		} else {
+			deleted = append(deleted, rowValues[objPath])
+			result.OperStatus = &DeleteOperStatus{OperSuccess: &DeleteOperationSuccess{AffectedPaths: []string{objPath}}}
+		}
+		resp.DeletedObjResults = append(resp.DeletedObjResults, result)
+	}
+
+	if !del.AllowPartial && len(failedParams) > 0 {
+		for i := len(deleted) - 1; i >= 0; i-- {
+			row := deleted[i]
+			if _, err := ag.server.AddRowContext(ctx, nanodm.Object{Name: row.table, Type: nanodm.TypeRow, Value: row.values}); err != nil {
+				ag.log.Errorf("Failed to add back a row of (%s) after a failed delete: %v", row.table, err)
+			}
+		}
+		return nil, &requestFailure{err: NewAgentError(ErrMessageFailed), paramErrs: failedParams}
+	}
+	return resp, nil
+}
+
+// rowValues gets the values of the rows `rows`, by row.  Rows are fetched
+// from their tables, as sources may not get a row by its name.  Returns the
+// row that failed with the error.
+func (ag *Agent) rowValues(ctx context.Context, rows []string) (rowValues map[string]*deletedRow, failed string, err error) {
+	rowValues = make(map[string]*deletedRow, len(rows))
+	var tables []string
+	for _, row := range rows {
+		if !strings.HasSuffix(row, ".") || strings.ContainsAny(row, "*[]{}#+") {
+			return nil, row, NewAgentError(ErrInvalidPathSyntax)
+		}
+		if !ag.server.IsObjectHandledByDynamicList(row) {
+			return nil, row, NewAgentError(ErrObjectDoesNotExist)
+		}
+		table, _ := splitPath(strings.TrimSuffix(row, "."))
+		rowValues[row] = &deletedRow{table: table, values: make(map[string]interface{})}
+		tables = append(tables, table)
+	}
+
+	result := ag.server.GetResults(ctx, tables)
+	for _, row := range rows {
+		if err, ok := result.Errors[rowValues[row].table]; ok {
+			return nil, row, err
+		}
+	}
+	found := make(map[string]bool)
+	for _, object := range result.Objects {
+		for row, deleted := range rowValues {
+			if strings.HasPrefix(object.Name, row) {
+				deleted.values[strings.TrimPrefix(object.Name, row)] = object.Value
+				found[row] = true
+			}
+		}
+	}
+	for _, row := range rows {
+		if !found[row] {
+			return nil, row, NewAgentError(ErrObjectDoesNotExist)
+		}
+	}
+	return rowValues, "", nil
+}
+
+func (ag *Agent) handleGetInstances(getInstances *GetInstances) *GetInstancesResp {
+	resp := &GetInstancesResp{}
+
+	for _, objPath := range getInstances.ObjPaths {
+		result := InstancesRequestedPathResult{RequestedPath: objPath}
+
+		objects, err := ag.resolvePath(objPath)
+		if err != nil {
+			agentErr := agentError(err, ErrObjectDoesNotExist)
+			result.ErrCode, result.ErrMsg = agentErr.Code, agentErr.Message
+			resp.ReqPathResults = append(resp.ReqPathResults, result)
+			continue
+		}
+
+		instances := make(map[string]bool)
+		for _, object := range objects {
+			segments := strings.Split(strings.TrimPrefix(object.Name, objPath), ".")
+			instPath := objPath
+			for i, segment := range segments[:len(segments)-1] {
+				instPath = instPath + segment + "."
+				if _, err := strconv.ParseUint(segment, 10, 32); err != nil {
+					continue
+				}
+				if i > 0 && getInstances.FirstLevelOnly {
+					break
+				}
+				instances[instPath] = true
+			}
+		}
+
+		for instPath := range instances {
+			result.CurrInsts = append(result.CurrInsts, CurrInstance{InstantiatedObjPath: instPath})
+		}
+		sort.Slice(result.CurrInsts, func(i, j int) bool {
+			return result.CurrInsts[i].InstantiatedObjPath < result.CurrInsts[j].InstantiatedObjPath
+		})
+		resp.ReqPathResults = append(resp.ReqPathResults, result)
+	}
+	return resp
+}
+
+// handleGetSupportedDM describes the registered objects.  Rows of dynamic
+// lists aren't registered, so only the tables themselves are described.
+func (ag *Agent) handleGetSupportedDM(getSupported *GetSupportedDM) *GetSupportedDMResp {
+	resp := &GetSupportedDMResp{}
+
+	for _, objPath := range getSupported.ObjPaths {
+		result := RequestedObjectResult{ReqObjPath: objPath}
+		if objPath == "" {
+			objPath = ag.config.RootObject
+		}
+		if !strings.HasSuffix(objPath, ".") {
+			result.ErrCode, result.ErrMsg = ErrInvalidPathSyntax, errorMessages[ErrInvalidPathSyntax]
+			resp.ReqObjResults = append(resp.ReqObjResults, result)
+			continue
+		}
+
+		supported := make(map[string]*SupportedObjectResult)
+		supportedObject := func(path string) *SupportedObjectResult {
+			if _, exists := supported[path]; !exists {
+				supported[path] = &SupportedObjectResult{SupportedObjPath: path, Access: int32(ObjReadOnly)}
+			}
+			return supported[path]
+		}
+
+		objects, _ := ag.server.List(objPath)
+		for _, object := range objects {
+			parent, param := splitPath(object.Name)
+			if param == "" {
+				continue
+			}
+			if getSupported.FirstLevelOnly && strings.Count(parent, ".") > strings.Count(objPath, ".")+1 {
+				continue
+			}
+			supportedObj := supportedObject(parent)
+			if getSupported.ReturnParams {
+				access := ParamReadOnly
+				if object.Access == nanodm.AccessRW {
+					access = ParamReadWrite
+				}
+				supportedObj.SupportedParams = append(supportedObj.SupportedParams, SupportedParamResult{
+					ParamName: param,
+					Access:    int32(access),
+					ValueType: int32(paramValueType(object.Type)),
+				})
+			}
+		}
+		for _, dynObject := range ag.server.ListDynamicLists(objPath) {
+			tablePath := dynObject.Name + "{i}."
+			if getSupported.FirstLevelOnly && strings.Count(tablePath, ".") > strings.Count(objPath, ".")+2 {
+				continue
+			}
+			supportedObj := supportedObject(tablePath)
+			supportedObj.IsMultiInstance = true
+			if dynObject.Access == nanodm.AccessRW {
+				supportedObj.Access = int32(ObjAddDelete)
+			}
+		}
+
+		if len(supported) == 0 {
+			result.ErrCode, result.ErrMsg = ErrInvalidPath, errorMessages[ErrInvalidPath]
+		}
+		for _, supportedObj := range supported {
+			sort.Slice(supportedObj.SupportedParams, func(i, j int) bool {
+				return supportedObj.SupportedParams[i].ParamName < supportedObj.SupportedParams[j].ParamName
+			})
+			result.SupportedObjs = append(result.SupportedObjs, *supportedObj)
+		}
+		sort.Slice(result.SupportedObjs, func(i, j int) bool {
+			return result.SupportedObjs[i].SupportedObjPath < result.SupportedObjs[j].SupportedObjPath
+		})
+		resp.ReqObjResults = append(resp.ReqObjResults, result)
+	}
+	return resp
+}
+
+func (ag *Agent) handleOperate(ctx context.Context, operate *Operate) (*OperateResp, error) {
+	if ag.config.OperateHandler == nil {
+		return nil, NewAgentError(ErrMessageNotSupported)
+	}
+
+	result := OperationResult{ExecutedCommand: operate.Command}
+	outputArgs, err := ag.config.OperateHandler(operate.Command, operate.CommandKey, operate.InputArgs)
+	ag.server.AuditLog().Record(audit.NewRecord(ctx, audit.OperationOperate, operate.Command, nil, operate.InputArgs, err))
+	if err != nil {
+		failure := &CommandFailure{ErrCode: ErrCommandFailure, ErrMsg: err.Error()}
+		if agentErr, ok := err.(*AgentError); ok {
+			failure.ErrCode, failure.ErrMsg = agentErr.Code, agentErr.Message
+		}
+		result.CmdFailure = failure
+	} else {
+		result.ReqOutputArgs = &OutputArgs{OutputArgs: outputArgs}
+	}
+
+	return &OperateResp{OperationResults: []OperationResult{result}}, nil
+}
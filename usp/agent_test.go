@@ -0,0 +1,554 @@
+package usp
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/zackwine/nanodm"
+	"github.com/zackwine/nanodm/coordinator"
+	"github.com/zackwine/nanodm/source"
+)
+
+const (
+	agentID      = "os::nanodm-0101"
+	controllerID = "self::controller"
+)
+
+type TestSource struct {
+	objectMap    map[string]nanodm.Object
+	objectValues map[string]interface{}
+	nextIndex    int
+	lock         sync.Mutex
+}
+
+func (ts *TestSource) GetObjects(objectNames []string) (objects []nanodm.Object, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, name := range objectNames {
+		object, ok := ts.objectMap[name]
+		if !ok {
+			return objects, fmt.Errorf("unable to get object %s", name)
+		}
+		if object.Type == nanodm.TypeDynamicList {
+			for rowObjName, rowObject := range ts.objectMap {
+				if strings.HasPrefix(rowObjName, name) && rowObjName != name {
+					rowObject.Value = ts.objectValues[rowObjName]
+					objects = append(objects, rowObject)
+				}
+			}
+			continue
+		}
+		object.Value = ts.objectValues[name]
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+func (ts *TestSource) SetObjects(objects []nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for _, object := range objects {
+		ts.objectValues[object.Name] = object.Value
+	}
+	return nil
+}
+
+func (ts *TestSource) AddRow(object nanodm.Object) (row string, err error) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	row = fmt.Sprintf("%s%d.", object.Name, ts.nextIndex)
+	ts.objectMap[row+"Enable"] = nanodm.Object{Name: row + "Enable", Access: nanodm.AccessRW, Type: nanodm.TypeBool}
+	ts.objectValues[row+"Enable"] = false
+	ts.nextIndex++
+	return row, nil
+}
+
+func (ts *TestSource) DeleteRow(row nanodm.Object) error {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	for objName := range ts.objectMap {
+		if strings.HasPrefix(objName, row.Name) {
+			delete(ts.objectMap, objName)
+			delete(ts.objectValues, objName)
+		}
+	}
+	return nil
+}
+
+// TestController is a stand-in USP controller accepting a websocket
+// connection from the agent
+type TestController struct {
+	t         *testing.T
+	upgrader  websocket.Upgrader
+	conn      *websocket.Conn
+	connected chan struct{}
+	records   chan *Record
+	lock      sync.Mutex
+}
+
+func NewTestController(t *testing.T) *TestController {
+	return &TestController{
+		t:         t,
+		upgrader:  websocket.Upgrader{Subprotocols: []string{WEBSOCKET_SUBPROTOCOL}},
+		connected: make(chan struct{}, 1),
+		records:   make(chan *Record, 10),
+	}
+}
+
+func (tc *TestController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := tc.upgrader.Upgrade(w, r, nil)
+	if !assert.Nil(tc.t, err) {
+		return
+	}
+	assert.Equal(tc.t, WEBSOCKET_SUBPROTOCOL, conn.Subprotocol())
+
+	tc.lock.Lock()
+	tc.conn = conn
+	tc.lock.Unlock()
+	tc.connected <- struct{}{}
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var record Record
+		assert.Nil(tc.t, Unmarshal(data, &record))
+		tc.records <- &record
+	}
+}
+
+func (tc *TestController) send(data []byte) error {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+	return tc.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (tc *TestController) nextRecord() *Record {
+	select {
+	case record := <-tc.records:
+		return record
+	case <-time.After(5 * time.Second):
+		tc.t.Fatalf("timeout waiting for a USP record")
+	}
+	return nil
+}
+
+// request sends a request to the agent and returns the response
+func (tc *TestController) request(request *Request) *Msg {
+	msgID := fmt.Sprintf("msg-%d", time.Now().UnixNano())
+	assert.Nil(tc.t, tc.send(encodeMsg(tc.t, msgID, request)))
+
+	response := decodeMsg(tc.t, tc.nextRecord())
+	assert.Equal(tc.t, msgID, response.Header.MsgId)
+	return response
+}
+
+func encodeMsg(t *testing.T, msgID string, request *Request) []byte {
+	payload, err := Marshal(&Msg{
+		Header: &Header{MsgId: msgID},
+		Body:   &Body{Request: request},
+	})
+	assert.Nil(t, err)
+	data, err := Marshal(&Record{
+		Version:          RECORD_VERSION,
+		ToId:             agentID,
+		FromId:           controllerID,
+		NoSessionContext: &NoSessionContextRecord{Payload: payload},
+	})
+	assert.Nil(t, err)
+	return data
+}
+
+func decodeMsg(t *testing.T, record *Record) *Msg {
+	assert.Equal(t, controllerID, record.ToId)
+	assert.Equal(t, agentID, record.FromId)
+	if !assert.NotNil(t, record.NoSessionContext) {
+		t.FailNow()
+	}
+	var msg Msg
+	assert.Nil(t, Unmarshal(record.NoSessionContext.Payload, &msg))
+	return &msg
+}
+
+func getLogger() *logrus.Entry {
+	logger := logrus.New()
+	logger.SetLevel(logrus.DebugLevel)
+	return logrus.NewEntry(logger)
+}
+
+func TestProto(t *testing.T) {
+	msg := &Msg{
+		Header: &Header{MsgId: "1234", MsgType: int32(MsgTypeGetResp)},
+		Body: &Body{Response: &Response{GetResp: &GetResp{
+			ReqPathResults: []RequestedPathResult{{
+				RequestedPath: "Device.Custom.",
+				ResolvedPathResults: []ResolvedPathResult{{
+					ResolvedPath: "Device.Custom.",
+					ResultParams: map[string]string{"Setting1": "8.8.8.8", "Setting2": "600"},
+				}},
+			}, {
+				RequestedPath: "Not.Valid",
+				ErrCode:       ErrInvalidPath,
+				ErrMsg:        "Invalid path",
+			}},
+		}}},
+	}
+	data, err := Marshal(msg)
+	assert.Nil(t, err)
+
+	var decoded Msg
+	err = Unmarshal(data, &decoded)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, &decoded)
+
+	// The header is field 1 and the msg_id is field 1 of the header
+	assert.Equal(t, []byte{0x0a, 0x08, 0x0a, 0x04, '1', '2', '3', '4'}, data[:8])
+
+	err = Unmarshal([]byte{0x0a, 0xff}, &decoded)
+	assert.NotNil(t, err)
+}
+
+func TestMatchPath(t *testing.T) {
+	assert.True(t, matchPath("Device.Custom.*.Enable", "Device.Custom.1.Enable"))
+	assert.False(t, matchPath("Device.Custom.*.Enable", "Device.Custom.1.Name"))
+	assert.True(t, matchPath("Device.Custom.*.", "Device.Custom.1.Enable"))
+	assert.False(t, matchPath("Device.Custom.*.", "Device.Custom.Setting1"))
+}
+
+func TestAgentWebSocket(t *testing.T) {
+	serverUrl := "tcp://127.0.0.1:4620"
+	sourceName := "testSource"
+	sourceUrl := "tcp://127.0.0.1:4621"
+
+	objectMapSource := map[string]nanodm.Object{
+		"Device.Custom.Setting1": {
+			Name:   "Device.Custom.Setting1",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Setting2": {
+			Name:   "Device.Custom.Setting2",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeInt,
+		},
+		"Device.Custom.Version": {
+			Name:   "Device.Custom.Version",
+			Access: nanodm.AccessRO,
+			Type:   nanodm.TypeString,
+		},
+		"Device.Custom.Dynamic.": {
+			Name:   "Device.Custom.Dynamic.",
+			Access: nanodm.AccessRW,
+			Type:   nanodm.TypeDynamicList,
+		},
+	}
+	objectValuesSource := map[string]interface{}{
+		"Device.Custom.Setting1": "8.8.8.8",
+		"Device.Custom.Setting2": 600,
+		"Device.Custom.Version":  "2.3.4",
+	}
+
+	log := getLogger()
+
+	server := coordinator.NewServer(log, serverUrl, nil)
+	err := server.Start()
+	assert.Nil(t, err)
+	defer server.Stop()
+
+	testSource := &TestSource{
+		objectMap:    objectMapSource,
+		objectValues: objectValuesSource,
+	}
+	src := source.NewSource(log, sourceName, serverUrl, sourceUrl, testSource)
+	err = src.Connect()
+	assert.Nil(t, err)
+	defer src.Disconnect()
+
+	err = src.Register(nanodm.GetObjectsFromMap(objectMapSource))
+	assert.Nil(t, err)
+	<-time.After(2 * time.Second)
+
+	controller := NewTestController(t)
+	httpServer := httptest.NewServer(controller)
+	defer httpServer.Close()
+
+	operateKey := ""
+	agent := NewAgent(log, server, Config{
+		EndpointID:   agentID,
+		ControllerID: controllerID,
+		OperateHandler: func(command string, commandKey string, inputArgs map[string]string) (map[string]string, error) {
+			if command != "Device.Custom.Check()" {
+				return nil, fmt.Errorf("unknown command %s", command)
+			}
+			operateKey = commandKey
+			return map[string]string{"Result": inputArgs["Value"]}, nil
+		},
+	})
+	agent.AddMTP(NewWebSocketMTP(log, "ws"+strings.TrimPrefix(httpServer.URL, "http")))
+	err = agent.Start()
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	defer agent.Stop()
+
+	<-controller.connected
+	record := controller.nextRecord()
+	assert.NotNil(t, record.WebsocketConnect)
+	assert.Equal(t, RECORD_VERSION, record.Version)
+
+	// Get
+	response := controller.request(&Request{Get: &Get{ParamPaths: []string{"Device.Custom.", "Device.Custom.Setting1", "Not.Valid"}}})
+	assert.EqualValues(t, MsgTypeGetResp, response.Header.MsgType)
+	results := response.Body.Response.GetResp.ReqPathResults
+	assert.Equal(t, 3, len(results))
+	assert.Equal(t, []ResolvedPathResult{{
+		ResolvedPath: "Device.Custom.",
+		ResultParams: map[string]string{"Setting1": "8.8.8.8", "Setting2": "600", "Version": "2.3.4"},
+	}}, results[0].ResolvedPathResults)
+	assert.Equal(t, "8.8.8.8", results[1].ResolvedPathResults[0].ResultParams["Setting1"])
+	assert.EqualValues(t, ErrInvalidPath, results[2].ErrCode)
+
+	// Set
+	response = controller.request(&Request{Set: &Set{UpdateObjs: []UpdateObject{{
+		ObjPath:       "Device.Custom.",
+		ParamSettings: []UpdateParamSetting{{Param: "Setting2", Value: "700", Required: true}},
+	}}}})
+	assert.EqualValues(t, MsgTypeSetResp, response.Header.MsgType)
+	success := response.Body.Response.SetResp.UpdatedObjResults[0].OperStatus.OperSuccess
+	assert.Equal(t, map[string]string{"Setting2": "700"}, success.UpdatedInstResults[0].UpdatedParams)
+	testSource.lock.Lock()
+	assert.EqualValues(t, 700, testSource.objectValues["Device.Custom.Setting2"])
+	testSource.lock.Unlock()
+
+	// Set of a read-only parameter fails the whole message
+	response = controller.request(&Request{Set: &Set{UpdateObjs: []UpdateObject{{
+		ObjPath:       "Device.Custom.",
+		ParamSettings: []UpdateParamSetting{{Param: "Version", Value: "1.0", Required: true}},
+	}}}})
+	assert.EqualValues(t, MsgTypeError, response.Header.MsgType)
+	assert.EqualValues(t, ErrMessageFailed, response.Body.Error.ErrCode)
+	assert.Equal(t, 1, len(response.Body.Error.ParamErrs))
+	assert.Equal(t, "Device.Custom.Version", response.Body.Error.ParamErrs[0].ParamPath)
+	assert.EqualValues(t, ErrNonWritableParameter, response.Body.Error.ParamErrs[0].ErrCode)
+
+	// Add
+	response = controller.request(&Request{Add: &Add{CreateObjs: []CreateObject{{ObjPath: "Device.Custom.Dynamic."}}}})
+	assert.EqualValues(t, MsgTypeAddResp, response.Header.MsgType)
+	created := response.Body.Response.AddResp.CreatedObjResults[0]
+	assert.Equal(t, "Device.Custom.Dynamic.0.", created.OperStatus.OperSuccess.InstantiatedPath)
+
+	// Get with a wildcard
+	response = controller.request(&Request{Get: &Get{ParamPaths: []string{"Device.Custom.Dynamic.*.Enable"}}})
+	results = response.Body.Response.GetResp.ReqPathResults
+	assert.Equal(t, []ResolvedPathResult{{
+		ResolvedPath: "Device.Custom.Dynamic.0.",
+		ResultParams: map[string]string{"Enable": "false"},
+	}}, results[0].ResolvedPathResults)
+
+	// GetInstances
+	response = controller.request(&Request{GetInstances: &GetInstances{ObjPaths: []string{"Device.Custom.Dynamic."}}})
+	assert.EqualValues(t, MsgTypeGetInstancesResp, response.Header.MsgType)
+	instances := response.Body.Response.GetInstancesResp.ReqPathResults[0].CurrInsts
+	assert.Equal(t, []CurrInstance{{InstantiatedObjPath: "Device.Custom.Dynamic.0."}}, instances)
+
+	// Delete
+	response = controller.request(&Request{Delete: &Delete{ObjPaths: []string{"Device.Custom.Dynamic.0."}}})
+	assert.EqualValues(t, MsgTypeDeleteResp, response.Header.MsgType)
+	deleted := response.Body.Response.DeleteResp.DeletedObjResults[0]
+	assert.Equal(t, []string{"Device.Custom.Dynamic.0."}, deleted.OperStatus.OperSuccess.AffectedPaths)
+	testSource.lock.Lock()
+	_, exists := testSource.objectMap["Device.Custom.Dynamic.0.Enable"]
+	testSource.lock.Unlock()
+	assert.False(t, exists)
+
+	// Set of a read-only parameter without AllowPartial sets nothing
+	response = controller.request(&Request{Set: &Set{UpdateObjs: []UpdateObject{{
+		ObjPath: "Device.Custom.",
+		ParamSettings: []UpdateParamSetting{
+			{Param: "Setting1", Value: "9.9.9.9"},
+			{Param: "Version", Value: "1.0"},
+		},
+	}}}})
+	assert.EqualValues(t, ErrMessageFailed, response.Body.Error.ErrCode)
+	assert.Equal(t, 1, len(response.Body.Error.ParamErrs))
+	testSource.lock.Lock()
+	assert.Equal(t, "8.8.8.8", testSource.objectValues["Device.Custom.Setting1"])
+	testSource.lock.Unlock()
+
+	// With AllowPartial the parameters that can be set are
+	response = controller.request(&Request{Set: &Set{AllowPartial: true, UpdateObjs: []UpdateObject{{
+		ObjPath: "Device.Custom.",
+		ParamSettings: []UpdateParamSetting{
+			{Param: "Setting1", Value: "9.9.9.9", Required: true},
+			{Param: "Version", Value: "1.0"},
+		},
+	}}}})
+	assert.EqualValues(t, MsgTypeSetResp, response.Header.MsgType)
+	success = response.Body.Response.SetResp.UpdatedObjResults[0].OperStatus.OperSuccess
+	assert.Equal(t, map[string]string{"Setting1": "9.9.9.9"}, success.UpdatedInstResults[0].UpdatedParams)
+	assert.Equal(t, "Version", success.UpdatedInstResults[0].ParamErrs[0].Param)
+	testSource.lock.Lock()
+	assert.Equal(t, "9.9.9.9", testSource.objectValues["Device.Custom.Setting1"])
+	testSource.lock.Unlock()
+
+	// A failed Add without AllowPartial deletes the rows it added
+	response = controller.request(&Request{Add: &Add{CreateObjs: []CreateObject{{ObjPath: "Device.Custom.Dynamic."}, {ObjPath: "Device.Custom."}}}})
+	assert.EqualValues(t, ErrMessageFailed, response.Body.Error.ErrCode)
+	assert.Equal(t, "Device.Custom.", response.Body.Error.ParamErrs[0].ParamPath)
+	testSource.lock.Lock()
+	_, exists = testSource.objectMap["Device.Custom.Dynamic.1.Enable"]
+	testSource.lock.Unlock()
+	assert.False(t, exists)
+
+	// A failed Delete without AllowPartial deletes no row
+	response = controller.request(&Request{Add: &Add{CreateObjs: []CreateObject{{ObjPath: "Device.Custom.Dynamic."}}}})
+	row := response.Body.Response.AddResp.CreatedObjResults[0].OperStatus.OperSuccess.InstantiatedPath
+	assert.Equal(t, "Device.Custom.Dynamic.2.", row)
+	response = controller.request(&Request{Delete: &Delete{ObjPaths: []string{row, "Device.Custom.Dynamic.7."}}})
+	assert.EqualValues(t, ErrMessageFailed, response.Body.Error.ErrCode)
+	assert.Equal(t, "Device.Custom.Dynamic.7.", response.Body.Error.ParamErrs[0].ParamPath)
+	testSource.lock.Lock()
+	_, exists = testSource.objectMap[row+"Enable"]
+	testSource.lock.Unlock()
+	assert.True(t, exists)
+
+	// GetSupportedDM
+	response = controller.request(&Request{GetSupportedDM: &GetSupportedDM{ObjPaths: []string{"Device.Custom."}, ReturnParams: true}})
+	assert.EqualValues(t, MsgTypeGetSupportedDMResp, response.Header.MsgType)
+	supported := response.Body.Response.GetSupportedDMResp.ReqObjResults[0].SupportedObjs
+	assert.Equal(t, 2, len(supported))
+	assert.Equal(t, "Device.Custom.", supported[0].SupportedObjPath)
+	assert.Equal(t, SupportedParamResult{ParamName: "Setting2", Access: int32(ParamReadWrite), ValueType: int32(ParamInt)}, supported[0].SupportedParams[1])
+	assert.Equal(t, "Device.Custom.Dynamic.{i}.", supported[1].SupportedObjPath)
+	assert.True(t, supported[1].IsMultiInstance)
+	assert.EqualValues(t, ObjAddDelete, supported[1].Access)
+
+	// Operate
+	response = controller.request(&Request{Operate: &Operate{
+		Command:    "Device.Custom.Check()",
+		CommandKey: "check1",
+		SendResp:   true,
+		InputArgs:  map[string]string{"Value": "42"},
+	}})
+	assert.EqualValues(t, MsgTypeOperateResp, response.Header.MsgType)
+	result := response.Body.Response.OperateResp.OperationResults[0]
+	assert.Equal(t, map[string]string{"Result": "42"}, result.ReqOutputArgs.OutputArgs)
+	assert.Equal(t, "check1", operateKey)
+
+	// GetSupportedProtocol
+	response = controller.request(&Request{GetSupportedProtocol: &GetSupportedProtocol{ControllerSupportedProtocolVersions: RECORD_VERSION}})
+	assert.Equal(t, SUPPORTED_PROTOCOL_VERSIONS, response.Body.Response.GetSupportedProtocolResp.AgentSupportedProtocolVersions)
+
+	// Unsupported request
+	response = controller.request(&Request{Notify: &Notify{}})
+	assert.EqualValues(t, ErrMessageNotSupported, response.Body.Error.ErrCode)
+
+	// Notify waits for the NotifyResp
+	notifyErr := make(chan error, 1)
+	go func() {
+		notifyErr <- agent.Notify(&Notify{
+			SubscriptionId: "sub1",
+			SendResp:       true,
+			ValueChange:    &ValueChange{ParamPath: "Device.Custom.Setting1", ParamValue: "1.1.1.1"},
+		})
+	}()
+	notify := decodeMsg(t, controller.nextRecord())
+	assert.Equal(t, "1.1.1.1", notify.Body.Request.Notify.ValueChange.ParamValue)
+	payload, err := Marshal(&Msg{
+		Header: &Header{MsgId: notify.Header.MsgId, MsgType: int32(MsgTypeNotifyResp)},
+		Body:   &Body{Response: &Response{NotifyResp: &NotifyResp{SubscriptionId: "sub1"}}},
+	})
+	assert.Nil(t, err)
+	data, err := Marshal(&Record{Version: RECORD_VERSION, ToId: agentID, FromId: controllerID, NoSessionContext: &NoSessionContextRecord{Payload: payload}})
+	assert.Nil(t, err)
+	// A duplicate NotifyResp is dropped
+	assert.Nil(t, controller.send(data))
+	assert.Nil(t, controller.send(data))
+	assert.Nil(t, <-notifyErr)
+
+	// The agent still handles requests
+	response = controller.request(&Request{Get: &Get{ParamPaths: []string{"Device.Custom.Setting1"}}})
+	assert.EqualValues(t, MsgTypeGetResp, response.Header.MsgType)
+}
+
+func TestAgentUnixSocket(t *testing.T) {
+	log := getLogger()
+
+	dir, err := ioutil.TempDir("", "usp")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "controller.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	mtp := NewUnixSocketMTP(log, socketPath)
+	agent := NewAgent(log, coordinator.NewServer(log, "", nil), Config{
+		EndpointID:   agentID,
+		ControllerID: controllerID,
+	})
+	agent.AddMTP(mtp)
+
+	err = agent.Start()
+	assert.Nil(t, err)
+	defer agent.Stop()
+
+	conn := <-accepted
+	defer conn.Close()
+	err = WriteUDSFrame(conn, UDSFrameHandshake, []byte(controllerID))
+	assert.Nil(t, err)
+	reader := bufio.NewReader(conn)
+	readRecord := func() *Record {
+		frameType, value, err := ReadUDSFrame(reader)
+		assert.Nil(t, err)
+		for frameType != UDSFrameRecord {
+			frameType, value, err = ReadUDSFrame(reader)
+			assert.Nil(t, err)
+		}
+		var record Record
+		assert.Nil(t, Unmarshal(value, &record))
+		return &record
+	}
+
+	frameType, value, err := ReadUDSFrame(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, UDSFrameHandshake, frameType)
+	assert.Equal(t, agentID, string(value))
+	assert.NotNil(t, readRecord().UdsConnect)
+
+	err = WriteUDSFrame(conn, UDSFrameRecord, encodeMsg(t, "proto1", &Request{GetSupportedProtocol: &GetSupportedProtocol{}}))
+	assert.Nil(t, err)
+	response := decodeMsg(t, readRecord())
+	assert.Equal(t, "proto1", response.Header.MsgId)
+	assert.Equal(t, SUPPORTED_PROTOCOL_VERSIONS, response.Body.Response.GetSupportedProtocolResp.AgentSupportedProtocolVersions)
+	assert.Equal(t, controllerID, mtp.PeerID())
+
+	// Operate isn't supported without a handler
+	err = WriteUDSFrame(conn, UDSFrameRecord, encodeMsg(t, "operate1", &Request{Operate: &Operate{Command: "Device.Reboot()", SendResp: true}}))
+	assert.Nil(t, err)
+	response = decodeMsg(t, readRecord())
+	assert.EqualValues(t, ErrMessageNotSupported, response.Body.Error.ErrCode)
+}
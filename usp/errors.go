@@ -0,0 +1,84 @@
+package usp
+
+import (
+	"fmt"
+
+	"github.com/zackwine/nanodm"
+)
+
+// USP error codes (TR-369 section 10.13)
+const (
+	ErrMessageFailed           = 7000
+	ErrMessageNotSupported     = 7001
+	ErrRequestDenied           = 7002
+	ErrInternalError           = 7003
+	ErrInvalidArguments        = 7004
+	ErrResourcesExceeded       = 7005
+	ErrPermissionDenied        = 7006
+	ErrInvalidPathSyntax       = 7008
+	ErrUnsupportedParameter    = 7010
+	ErrInvalidType             = 7011
+	ErrInvalidValue            = 7012
+	ErrNonWritableParameter    = 7013
+	ErrObjectDoesNotExist      = 7016
+	ErrObjectNotCreated        = 7017
+	ErrObjectNotATable         = 7018
+	ErrCommandFailure          = 7022
+	ErrInvalidPath             = 7026
+	ErrInvalidCommandArguments = 7027
+
+	// Vendor specific error codes
+	ErrTimeout           = 7800
+	ErrSourceUnavailable = 7801
+)
+
+var errorMessages = map[uint32]string{
+	ErrMessageFailed:           "Message failed",
+	ErrMessageNotSupported:     "Message not supported",
+	ErrRequestDenied:           "Request denied",
+	ErrInternalError:           "Internal error",
+	ErrInvalidArguments:        "Invalid arguments",
+	ErrResourcesExceeded:       "Resources exceeded",
+	ErrPermissionDenied:        "Permission denied",
+	ErrInvalidPathSyntax:       "Invalid path syntax",
+	ErrUnsupportedParameter:    "Unsupported parameter",
+	ErrInvalidType:             "Invalid type",
+	ErrInvalidValue:            "Invalid value",
+	ErrNonWritableParameter:    "Attempt to update non-writeable parameter",
+	ErrObjectDoesNotExist:      "Object does not exist",
+	ErrObjectNotCreated:        "Object could not be created",
+	ErrObjectNotATable:         "Object is not a table",
+	ErrCommandFailure:          "Command failure",
+	ErrInvalidPath:             "Invalid path",
+	ErrInvalidCommandArguments: "Invalid command arguments",
+	ErrTimeout:                 "Timeout",
+	ErrSourceUnavailable:       "Source unavailable",
+}
+
+// AgentError is an error with a USP error code
+type AgentError struct {
+	Code    uint32
+	Message string
+}
+
+// NewAgentError creates an error with the standard message for `code`
+func NewAgentError(code uint32) *AgentError {
+	return &AgentError{Code: code, Message: errorMessages[code]}
+}
+
+func (ae *AgentError) Error() string {
+	return fmt.Sprintf("USP error %d: %s", ae.Code, ae.Message)
+}
+
+// agentError maps an error returned by the coordinator to a USP error
+func agentError(err error, notFoundCode uint32) *AgentError {
+	if agentErr, ok := err.(*AgentError); ok {
+		return agentErr
+	}
+
+	code := nanodm.CodeOf(err).USPCode()
+	if code == nanodm.CodeNotFound.USPCode() {
+		code = notFoundCode
+	}
+	return &AgentError{Code: code, Message: errorMessages[code] + ": " + err.Error()}
+}
@@ -0,0 +1,431 @@
+package usp
+
+/*
+ * USP Record (usp-record-1-2.proto) and Msg (usp-msg-1-2.proto) types.  Field
+ * numbers match the Broadband Forum schemas so records are interoperable with
+ * other USP endpoints.  Messages not used by the agent are omitted and are
+ * skipped when decoding.
+ */
+
+const RECORD_VERSION = "1.2"
+
+type PayloadSecurity int32
+
+const (
+	PayloadSecurityPlaintext PayloadSecurity = iota
+	PayloadSecurityTLS12
+)
+
+type Record struct {
+	Version          string                  `protobuf:"1"`
+	ToId             string                  `protobuf:"2"`
+	FromId           string                  `protobuf:"3"`
+	PayloadSecurity  int32                   `protobuf:"4"`
+	MacSignature     []byte                  `protobuf:"5"`
+	SenderCert       []byte                  `protobuf:"6"`
+	NoSessionContext *NoSessionContextRecord `protobuf:"7"`
+	WebsocketConnect *WebSocketConnectRecord `protobuf:"9"`
+	Disconnect       *DisconnectRecord       `protobuf:"12"`
+	UdsConnect       *UDSConnectRecord       `protobuf:"13"`
+}
+
+type NoSessionContextRecord struct {
+	Payload []byte `protobuf:"2"`
+}
+
+type WebSocketConnectRecord struct{}
+
+type UDSConnectRecord struct{}
+
+type DisconnectRecord struct {
+	Reason     string `protobuf:"1"`
+	ReasonCode uint32 `protobuf:"2"`
+}
+
+type MsgType int32
+
+const (
+	MsgTypeError MsgType = iota
+	MsgTypeGet
+	MsgTypeGetResp
+	MsgTypeNotify
+	MsgTypeSet
+	MsgTypeSetResp
+	MsgTypeOperate
+	MsgTypeOperateResp
+	MsgTypeAdd
+	MsgTypeAddResp
+	MsgTypeDelete
+	MsgTypeDeleteResp
+	MsgTypeGetSupportedDM
+	MsgTypeGetSupportedDMResp
+	MsgTypeGetInstances
+	MsgTypeGetInstancesResp
+	MsgTypeNotifyResp
+	MsgTypeGetSupportedProto
+	MsgTypeGetSupportedProtoResp
+)
+
+type Msg struct {
+	Header *Header `protobuf:"1"`
+	Body   *Body   `protobuf:"2"`
+}
+
+type Header struct {
+	MsgId   string `protobuf:"1"`
+	MsgType int32  `protobuf:"2"`
+}
+
+type Body struct {
+	Request  *Request  `protobuf:"1"`
+	Response *Response `protobuf:"2"`
+	Error    *Error    `protobuf:"3"`
+}
+
+type Request struct {
+	Get                  *Get                  `protobuf:"1"`
+	GetSupportedDM       *GetSupportedDM       `protobuf:"2"`
+	GetInstances         *GetInstances         `protobuf:"3"`
+	Set                  *Set                  `protobuf:"4"`
+	Add                  *Add                  `protobuf:"5"`
+	Delete               *Delete               `protobuf:"6"`
+	Operate              *Operate              `protobuf:"7"`
+	Notify               *Notify               `protobuf:"8"`
+	GetSupportedProtocol *GetSupportedProtocol `protobuf:"9"`
+}
+
+type Response struct {
+	GetResp                  *GetResp                  `protobuf:"1"`
+	GetSupportedDMResp       *GetSupportedDMResp       `protobuf:"2"`
+	GetInstancesResp         *GetInstancesResp         `protobuf:"3"`
+	SetResp                  *SetResp                  `protobuf:"4"`
+	AddResp                  *AddResp                  `protobuf:"5"`
+	DeleteResp               *DeleteResp               `protobuf:"6"`
+	OperateResp              *OperateResp              `protobuf:"7"`
+	NotifyResp               *NotifyResp               `protobuf:"8"`
+	GetSupportedProtocolResp *GetSupportedProtocolResp `protobuf:"9"`
+}
+
+type Error struct {
+	ErrCode   uint32       `protobuf:"1"`
+	ErrMsg    string       `protobuf:"2"`
+	ParamErrs []ParamError `protobuf:"3"`
+}
+
+type ParamError struct {
+	ParamPath string `protobuf:"1"`
+	ErrCode   uint32 `protobuf:"2"`
+	ErrMsg    string `protobuf:"3"`
+}
+
+type Get struct {
+	ParamPaths []string `protobuf:"1"`
+	MaxDepth   uint32   `protobuf:"2"`
+}
+
+type GetResp struct {
+	ReqPathResults []RequestedPathResult `protobuf:"1"`
+}
+
+type RequestedPathResult struct {
+	RequestedPath       string               `protobuf:"1"`
+	ErrCode             uint32               `protobuf:"2"`
+	ErrMsg              string               `protobuf:"3"`
+	ResolvedPathResults []ResolvedPathResult `protobuf:"4"`
+}
+
+type ResolvedPathResult struct {
+	ResolvedPath string            `protobuf:"1"`
+	ResultParams map[string]string `protobuf:"2"`
+}
+
+type GetSupportedDM struct {
+	ObjPaths       []string `protobuf:"1"`
+	FirstLevelOnly bool     `protobuf:"2"`
+	ReturnCommands bool     `protobuf:"3"`
+	ReturnEvents   bool     `protobuf:"4"`
+	ReturnParams   bool     `protobuf:"5"`
+}
+
+type GetSupportedDMResp struct {
+	ReqObjResults []RequestedObjectResult `protobuf:"1"`
+}
+
+type RequestedObjectResult struct {
+	ReqObjPath       string                  `protobuf:"1"`
+	ErrCode          uint32                  `protobuf:"2"`
+	ErrMsg           string                  `protobuf:"3"`
+	DataModelInstUri string                  `protobuf:"4"`
+	SupportedObjs    []SupportedObjectResult `protobuf:"5"`
+}
+
+type ObjAccessType int32
+
+const (
+	ObjReadOnly ObjAccessType = iota
+	ObjAddDelete
+	ObjAddOnly
+	ObjDeleteOnly
+)
+
+type SupportedObjectResult struct {
+	SupportedObjPath string                 `protobuf:"1"`
+	Access           int32                  `protobuf:"2"`
+	IsMultiInstance  bool                   `protobuf:"3"`
+	SupportedParams  []SupportedParamResult `protobuf:"6"`
+}
+
+type ParamAccessType int32
+
+const (
+	ParamReadOnly ParamAccessType = iota
+	ParamReadWrite
+	ParamWriteOnly
+)
+
+type ParamValueType int32
+
+const (
+	ParamUnknown ParamValueType = iota
+	ParamBase64
+	ParamBoolean
+	ParamDateTime
+	ParamDecimal
+	ParamHexBinary
+	ParamInt
+	ParamLong
+	ParamString
+	ParamUnsignedInt
+	ParamUnsignedLong
+)
+
+type SupportedParamResult struct {
+	ParamName string `protobuf:"1"`
+	Access    int32  `protobuf:"2"`
+	ValueType int32  `protobuf:"3"`
+}
+
+type GetInstances struct {
+	ObjPaths       []string `protobuf:"1"`
+	FirstLevelOnly bool     `protobuf:"2"`
+}
+
+type GetInstancesResp struct {
+	ReqPathResults []InstancesRequestedPathResult `protobuf:"1"`
+}
+
+type InstancesRequestedPathResult struct {
+	RequestedPath string         `protobuf:"1"`
+	ErrCode       uint32         `protobuf:"2"`
+	ErrMsg        string         `protobuf:"3"`
+	CurrInsts     []CurrInstance `protobuf:"4"`
+}
+
+type CurrInstance struct {
+	InstantiatedObjPath string            `protobuf:"1"`
+	UniqueKeys          map[string]string `protobuf:"2"`
+}
+
+type Set struct {
+	AllowPartial bool           `protobuf:"1"`
+	UpdateObjs   []UpdateObject `protobuf:"2"`
+}
+
+type UpdateObject struct {
+	ObjPath       string               `protobuf:"1"`
+	ParamSettings []UpdateParamSetting `protobuf:"2"`
+}
+
+type UpdateParamSetting struct {
+	Param    string `protobuf:"1"`
+	Value    string `protobuf:"2"`
+	Required bool   `protobuf:"3"`
+}
+
+type SetResp struct {
+	UpdatedObjResults []UpdatedObjectResult `protobuf:"1"`
+}
+
+type UpdatedObjectResult struct {
+	RequestedPath string         `protobuf:"1"`
+	OperStatus    *SetOperStatus `protobuf:"2"`
+}
+
+type SetOperStatus struct {
+	OperFailure *SetOperationFailure `protobuf:"1"`
+	OperSuccess *SetOperationSuccess `protobuf:"2"`
+}
+
+type SetOperationFailure struct {
+	ErrCode             uint32                   `protobuf:"1"`
+	ErrMsg              string                   `protobuf:"2"`
+	UpdatedInstFailures []UpdatedInstanceFailure `protobuf:"3"`
+}
+
+type SetOperationSuccess struct {
+	UpdatedInstResults []UpdatedInstanceResult `protobuf:"1"`
+}
+
+type UpdatedInstanceFailure struct {
+	AffectedPath string           `protobuf:"1"`
+	ParamErrs    []ParameterError `protobuf:"2"`
+}
+
+type UpdatedInstanceResult struct {
+	AffectedPath  string            `protobuf:"1"`
+	ParamErrs     []ParameterError  `protobuf:"2"`
+	UpdatedParams map[string]string `protobuf:"3"`
+}
+
+type ParameterError struct {
+	Param   string `protobuf:"1"`
+	ErrCode uint32 `protobuf:"2"`
+	ErrMsg  string `protobuf:"3"`
+}
+
+type Add struct {
+	AllowPartial bool           `protobuf:"1"`
+	CreateObjs   []CreateObject `protobuf:"2"`
+}
+
+type CreateObject struct {
+	ObjPath       string               `protobuf:"1"`
+	ParamSettings []CreateParamSetting `protobuf:"2"`
+}
+
+type CreateParamSetting struct {
+	Param    string `protobuf:"1"`
+	Value    string `protobuf:"2"`
+	Required bool   `protobuf:"3"`
+}
+
+type AddResp struct {
+	CreatedObjResults []CreatedObjectResult `protobuf:"1"`
+}
+
+type CreatedObjectResult struct {
+	RequestedPath string         `protobuf:"1"`
+	OperStatus    *AddOperStatus `protobuf:"2"`
+}
+
+type AddOperStatus struct {
+	OperFailure *OperationFailure    `protobuf:"1"`
+	OperSuccess *AddOperationSuccess `protobuf:"2"`
+}
+
+type OperationFailure struct {
+	ErrCode uint32 `protobuf:"1"`
+	ErrMsg  string `protobuf:"2"`
+}
+
+type AddOperationSuccess struct {
+	InstantiatedPath string            `protobuf:"1"`
+	ParamErrs        []ParameterError  `protobuf:"2"`
+	UniqueKeys       map[string]string `protobuf:"3"`
+}
+
+type Delete struct {
+	AllowPartial bool     `protobuf:"1"`
+	ObjPaths     []string `protobuf:"2"`
+}
+
+type DeleteResp struct {
+	DeletedObjResults []DeletedObjectResult `protobuf:"1"`
+}
+
+type DeletedObjectResult struct {
+	RequestedPath string            `protobuf:"1"`
+	OperStatus    *DeleteOperStatus `protobuf:"2"`
+}
+
+type DeleteOperStatus struct {
+	OperFailure *OperationFailure       `protobuf:"1"`
+	OperSuccess *DeleteOperationSuccess `protobuf:"2"`
+}
+
+type DeleteOperationSuccess struct {
+	AffectedPaths      []string              `protobuf:"1"`
+	UnaffectedPathErrs []UnaffectedPathError `protobuf:"2"`
+}
+
+type UnaffectedPathError struct {
+	UnaffectedPath string `protobuf:"1"`
+	ErrCode        uint32 `protobuf:"2"`
+	ErrMsg         string `protobuf:"3"`
+}
+
+type Operate struct {
+	Command    string            `protobuf:"1"`
+	CommandKey string            `protobuf:"2"`
+	SendResp   bool              `protobuf:"3"`
+	InputArgs  map[string]string `protobuf:"4"`
+}
+
+type OperateResp struct {
+	OperationResults []OperationResult `protobuf:"1"`
+}
+
+type OperationResult struct {
+	ExecutedCommand string          `protobuf:"1"`
+	ReqObjPath      string          `protobuf:"2"`
+	ReqOutputArgs   *OutputArgs     `protobuf:"3"`
+	CmdFailure      *CommandFailure `protobuf:"4"`
+}
+
+type OutputArgs struct {
+	OutputArgs map[string]string `protobuf:"1"`
+}
+
+type CommandFailure struct {
+	ErrCode uint32 `protobuf:"1"`
+	ErrMsg  string `protobuf:"2"`
+}
+
+type Notify struct {
+	SubscriptionId string          `protobuf:"1"`
+	SendResp       bool            `protobuf:"2"`
+	Event          *Event          `protobuf:"3"`
+	ValueChange    *ValueChange    `protobuf:"4"`
+	ObjCreation    *ObjectCreation `protobuf:"5"`
+	ObjDeletion    *ObjectDeletion `protobuf:"6"`
+	OnBoardReq     *OnBoardRequest `protobuf:"8"`
+}
+
+type Event struct {
+	ObjPath   string            `protobuf:"1"`
+	EventName string            `protobuf:"2"`
+	Params    map[string]string `protobuf:"3"`
+}
+
+type ValueChange struct {
+	ParamPath  string `protobuf:"1"`
+	ParamValue string `protobuf:"2"`
+}
+
+type ObjectCreation struct {
+	ObjPath    string            `protobuf:"1"`
+	UniqueKeys map[string]string `protobuf:"2"`
+}
+
+type ObjectDeletion struct {
+	ObjPath string `protobuf:"1"`
+}
+
+type OnBoardRequest struct {
+	Oui                            string `protobuf:"1"`
+	ProductClass                   string `protobuf:"2"`
+	SerialNumber                   string `protobuf:"3"`
+	AgentSupportedProtocolVersions string `protobuf:"4"`
+}
+
+type NotifyResp struct {
+	SubscriptionId string `protobuf:"1"`
+}
+
+type GetSupportedProtocol struct {
+	ControllerSupportedProtocolVersions string `protobuf:"1"`
+}
+
+type GetSupportedProtocolResp struct {
+	AgentSupportedProtocolVersions string `protobuf:"1"`
+}
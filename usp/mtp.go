@@ -0,0 +1,20 @@
+package usp
+
+// RecordHandler is called with each encoded USP record received by an MTP.
+// A nil record is passed each time the MTP connects, so the agent can send
+// the MTP's connect record.
+type RecordHandler func(mtp MTP, record []byte)
+
+// MTP is a message transfer protocol carrying encoded USP records between the
+// agent and its controllers
+type MTP interface {
+	// Start connects the MTP and calls `handler` with each record received.
+	// `endpointID` is the USP endpoint ID of the agent.
+	Start(endpointID string, handler RecordHandler) error
+	Stop() error
+	// Send an encoded USP record
+	Send(record []byte) error
+	// ConnectRecord returns the record sent by the agent once the MTP connects,
+	// or nil if the MTP doesn't use a connect record
+	ConnectRecord() *Record
+}
@@ -0,0 +1,280 @@
+package usp
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+/*
+ * A small protocol buffers codec for the USP record and message types.
+ *
+ * Each message is a Go struct whose fields carry a `protobuf:"<field number>"`
+ * tag.  The wire type is derived from the Go type of the field:
+ *
+ *   string, []byte      length delimited
+ *   bool, int32         varint (int32 is used for enums)
+ *   uint32              fixed32 (every uint32 in the USP schemas is fixed32)
+ *   *struct             embedded message, encoded whenever the pointer is set
+ *   []string, []struct  repeated fields
+ *   map[string]string   map<string, string>
+ *
+ * A oneof is a set of pointer fields of which only one is set.
+ */
+
+// Marshal encodes the USP message `msg` (a pointer to a struct)
+func Marshal(msg interface{}) ([]byte, error) {
+	value := reflect.ValueOf(msg)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot marshal %T, expected a pointer to a struct", msg)
+	}
+	return appendMessage(nil, value.Elem())
+}
+
+// Unmarshal decodes `data` into the USP message `msg` (a pointer to a struct)
+func Unmarshal(data []byte, msg interface{}) error {
+	value := reflect.ValueOf(msg)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("cannot unmarshal into %T, expected a pointer to a struct", msg)
+	}
+	return consumeMessage(data, value.Elem())
+}
+
+func fieldNumber(field reflect.StructField) (protowire.Number, bool) {
+	tag := field.Tag.Get("protobuf")
+	if tag == "" {
+		return 0, false
+	}
+	num, err := strconv.Atoi(strings.Split(tag, ",")[0])
+	if err != nil {
+		return 0, false
+	}
+	return protowire.Number(num), true
+}
+
+func appendMessage(b []byte, value reflect.Value) ([]byte, error) {
+	var err error
+	valueType := value.Type()
+
+	for i := 0; i < valueType.NumField(); i++ {
+		num, ok := fieldNumber(valueType.Field(i))
+		if !ok {
+			continue
+		}
+		if b, err = appendField(b, num, value.Field(i)); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", valueType.Name(), valueType.Field(i).Name, err)
+		}
+	}
+	return b, nil
+}
+
+func appendField(b []byte, num protowire.Number, field reflect.Value) ([]byte, error) {
+	var err error
+
+	switch field.Kind() {
+	case reflect.String:
+		if field.Len() > 0 {
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendString(b, field.String())
+		}
+	case reflect.Bool:
+		if field.Bool() {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, 1)
+		}
+	case reflect.Int32:
+		if field.Int() != 0 {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			b = protowire.AppendVarint(b, uint64(field.Int()))
+		}
+	case reflect.Uint32:
+		if field.Uint() != 0 {
+			b = protowire.AppendTag(b, num, protowire.Fixed32Type)
+			b = protowire.AppendFixed32(b, uint32(field.Uint()))
+		}
+	case reflect.Ptr:
+		if !field.IsNil() {
+			if b, err = appendEmbedded(b, num, field.Elem()); err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Struct:
+		if b, err = appendEmbedded(b, num, field); err != nil {
+			return nil, err
+		}
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.Uint8 {
+			if field.Len() > 0 {
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendBytes(b, field.Bytes())
+			}
+			break
+		}
+		for i := 0; i < field.Len(); i++ {
+			elem := field.Index(i)
+			switch elem.Kind() {
+			case reflect.String:
+				b = protowire.AppendTag(b, num, protowire.BytesType)
+				b = protowire.AppendString(b, elem.String())
+			case reflect.Struct:
+				b, err = appendEmbedded(b, num, elem)
+			case reflect.Ptr:
+				b, err = appendEmbedded(b, num, elem.Elem())
+			default:
+				err = fmt.Errorf("unsupported repeated type %v", elem.Type())
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	case reflect.Map:
+		keys := field.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, key := range keys {
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendString(entry, key.String())
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, field.MapIndex(key).String())
+			b = protowire.AppendTag(b, num, protowire.BytesType)
+			b = protowire.AppendBytes(b, entry)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return b, nil
+}
+
+func appendEmbedded(b []byte, num protowire.Number, value reflect.Value) ([]byte, error) {
+	embedded, err := appendMessage(nil, value)
+	if err != nil {
+		return nil, err
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, embedded), nil
+}
+
+func consumeMessage(b []byte, value reflect.Value) error {
+	valueType := value.Type()
+	fields := make(map[protowire.Number]int)
+	for i := 0; i < valueType.NumField(); i++ {
+		if num, ok := fieldNumber(valueType.Field(i)); ok {
+			fields[num] = i
+		}
+	}
+
+	for len(b) > 0 {
+		num, wireType, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		index, known := fields[num]
+		if !known {
+			n = protowire.ConsumeFieldValue(num, wireType, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		n, err := consumeField(b, wireType, value.Field(index))
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", valueType.Name(), valueType.Field(index).Name, err)
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func consumeField(b []byte, wireType protowire.Type, field reflect.Value) (int, error) {
+	switch field.Kind() {
+	case reflect.Bool, reflect.Int32:
+		if wireType != protowire.VarintType {
+			return 0, fmt.Errorf("unexpected wire type %d", wireType)
+		}
+		v, n := protowire.ConsumeVarint(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		if field.Kind() == reflect.Bool {
+			field.SetBool(v != 0)
+		} else {
+			field.SetInt(int64(int32(v)))
+		}
+		return n, nil
+	case reflect.Uint32:
+		if wireType != protowire.Fixed32Type {
+			return 0, fmt.Errorf("unexpected wire type %d", wireType)
+		}
+		v, n := protowire.ConsumeFixed32(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		field.SetUint(uint64(v))
+		return n, nil
+	}
+
+	if wireType != protowire.BytesType {
+		return 0, fmt.Errorf("unexpected wire type %d", wireType)
+	}
+	data, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return 0, protowire.ParseError(n)
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(string(data))
+	case reflect.Ptr:
+		if field.IsNil() {
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+		return n, consumeMessage(data, field.Elem())
+	case reflect.Struct:
+		return n, consumeMessage(data, field)
+	case reflect.Slice:
+		elemType := field.Type().Elem()
+		switch elemType.Kind() {
+		case reflect.Uint8:
+			field.SetBytes(append([]byte(nil), data...))
+		case reflect.String:
+			field.Set(reflect.Append(field, reflect.ValueOf(string(data))))
+		case reflect.Struct:
+			elem := reflect.New(elemType).Elem()
+			if err := consumeMessage(data, elem); err != nil {
+				return 0, err
+			}
+			field.Set(reflect.Append(field, elem))
+		case reflect.Ptr:
+			elem := reflect.New(elemType.Elem())
+			if err := consumeMessage(data, elem.Elem()); err != nil {
+				return 0, err
+			}
+			field.Set(reflect.Append(field, elem))
+		default:
+			return 0, fmt.Errorf("unsupported repeated type %v", elemType)
+		}
+	case reflect.Map:
+		var entry struct {
+			Key   string `protobuf:"1"`
+			Value string `protobuf:"2"`
+		}
+		if err := consumeMessage(data, reflect.ValueOf(&entry).Elem()); err != nil {
+			return 0, err
+		}
+		if field.IsNil() {
+			field.Set(reflect.MakeMap(field.Type()))
+		}
+		field.SetMapIndex(reflect.ValueOf(entry.Key), reflect.ValueOf(entry.Value))
+	default:
+		return 0, fmt.Errorf("unsupported type %v", field.Type())
+	}
+	return n, nil
+}
@@ -0,0 +1,191 @@
+package usp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+)
+
+// Unix domain socket MTP frame types
+const (
+	UDSFrameHandshake byte = 1
+	UDSFrameError     byte = 2
+	UDSFrameRecord    byte = 3
+)
+
+const MAX_UDS_FRAME_SIZE = 16 * 1024 * 1024
+
+// UnixSocketMTP connects the agent to a controller listening on a unix domain
+// socket.  Each frame is a one byte type, a four byte big endian length and
+// the value.  The endpoint IDs are exchanged in handshake frames when the
+// connection is established.
+type UnixSocketMTP struct {
+	log  *logrus.Entry
+	path string
+
+	conn       net.Conn
+	connMutex  sync.Mutex
+	endpointID string
+	peerID     string
+	handler    RecordHandler
+	closeChan  chan struct{}
+}
+
+// NewUnixSocketMTP creates a unix domain socket MTP for the controller
+// listening at `path`
+func NewUnixSocketMTP(log *logrus.Entry, path string) *UnixSocketMTP {
+	return &UnixSocketMTP{
+		log:       log,
+		path:      path,
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (us *UnixSocketMTP) Start(endpointID string, handler RecordHandler) error {
+	us.endpointID = endpointID
+	us.handler = handler
+
+	conn, err := us.dial()
+	if err != nil {
+		return err
+	}
+	go us.readTask(conn)
+	us.handler(us, nil)
+	return nil
+}
+
+func (us *UnixSocketMTP) Stop() error {
+	close(us.closeChan)
+	us.connMutex.Lock()
+	defer us.connMutex.Unlock()
+	if us.conn == nil {
+		return nil
+	}
+	return us.conn.Close()
+}
+
+func (us *UnixSocketMTP) Send(record []byte) error {
+	us.connMutex.Lock()
+	defer us.connMutex.Unlock()
+	if us.conn == nil {
+		return fmt.Errorf("unix socket %s isn't connected", us.path)
+	}
+	return WriteUDSFrame(us.conn, UDSFrameRecord, record)
+}
+
+func (us *UnixSocketMTP) ConnectRecord() *Record {
+	return &Record{UdsConnect: &UDSConnectRecord{}}
+}
+
+// PeerID returns the endpoint ID sent by the controller in its handshake
+func (us *UnixSocketMTP) PeerID() string {
+	us.connMutex.Lock()
+	defer us.connMutex.Unlock()
+	return us.peerID
+}
+
+func (us *UnixSocketMTP) dial() (net.Conn, error) {
+	conn, err := net.Dial("unix", us.path)
+	if err != nil {
+		us.log.Errorf("failed to dial unix socket (%s): %v", us.path, err)
+		return nil, err
+	}
+	if err = WriteUDSFrame(conn, UDSFrameHandshake, []byte(us.endpointID)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	us.connMutex.Lock()
+	us.conn = conn
+	us.connMutex.Unlock()
+	return conn, nil
+}
+
+func (us *UnixSocketMTP) readTask(conn net.Conn) {
+	defer us.log.Infof("Exiting unix socket readTask (%s)", us.path)
+	reader := bufio.NewReader(conn)
+	for {
+		frameType, value, err := ReadUDSFrame(reader)
+		if err != nil {
+			select {
+			case <-us.closeChan:
+				return
+			default:
+			}
+			us.log.Errorf("unix socket (%s) read failed: %v", us.path, err)
+			if conn = us.reconnect(); conn == nil {
+				return
+			}
+			reader = bufio.NewReader(conn)
+			continue
+		}
+
+		switch frameType {
+		case UDSFrameHandshake:
+			us.connMutex.Lock()
+			us.peerID = string(value)
+			us.connMutex.Unlock()
+		case UDSFrameError:
+			us.log.Errorf("unix socket (%s) peer reported error: %s", us.path, string(value))
+		case UDSFrameRecord:
+			us.handler(us, value)
+		default:
+			us.log.Warnf("ignoring unknown unix socket frame type (%d)", frameType)
+		}
+	}
+}
+
+// reconnect retries until connected with progressive backoff.  Returns nil
+// if the MTP is stopped.
+func (us *UnixSocketMTP) reconnect() net.Conn {
+	retryWait := nanodm.RETRY_PERIOD
+	for {
+		select {
+		case <-time.After(retryWait):
+			if conn, err := us.dial(); err == nil {
+				us.handler(us, nil)
+				return conn
+			}
+			if retryWait < nanodm.MAX_RETRY_PERIOD {
+				retryWait = retryWait * 2
+			}
+		case <-us.closeChan:
+			return nil
+		}
+	}
+}
+
+// WriteUDSFrame writes a single unix domain socket MTP frame
+func WriteUDSFrame(w io.Writer, frameType byte, value []byte) error {
+	header := make([]byte, 5)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(value)))
+	if _, err := w.Write(append(header, value...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReadUDSFrame reads a single unix domain socket MTP frame
+func ReadUDSFrame(r io.Reader) (frameType byte, value []byte, err error) {
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MAX_UDS_FRAME_SIZE {
+		return 0, nil, fmt.Errorf("unix socket frame of %d bytes exceeds the maximum size", length)
+	}
+	value = make([]byte, length)
+	if _, err = io.ReadFull(r, value); err != nil {
+		return 0, nil, err
+	}
+	return header[0], value, nil
+}
@@ -0,0 +1,26 @@
+package usp
+
+import (
+	"github.com/zackwine/nanodm"
+)
+
+var paramValueTypes = map[nanodm.ObjectType]ParamValueType{
+	nanodm.TypeString:       ParamString,
+	nanodm.TypeInt:          ParamInt,
+	nanodm.TypeUnsignedInt:  ParamUnsignedInt,
+	nanodm.TypeBool:         ParamBoolean,
+	nanodm.TypeDateTime:     ParamDateTime,
+	nanodm.TypeBase64:       ParamBase64,
+	nanodm.TypeLong:         ParamLong,
+	nanodm.TypeUnsignedLong: ParamUnsignedLong,
+	nanodm.TypeFloat:        ParamDecimal,
+	nanodm.TypeDouble:       ParamDecimal,
+	nanodm.TypeByte:         ParamUnsignedInt,
+}
+
+func paramValueType(objType nanodm.ObjectType) ParamValueType {
+	if valueType, ok := paramValueTypes[objType]; ok {
+		return valueType
+	}
+	return ParamUnknown
+}
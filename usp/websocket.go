@@ -0,0 +1,137 @@
+package usp
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/zackwine/nanodm"
+)
+
+const WEBSOCKET_SUBPROTOCOL = "v1.usp"
+
+// WebSocketMTP connects the agent to a controller listening for WebSocket
+// connections.  The connection is re-established with a progressive backoff
+// if it is lost.
+type WebSocketMTP struct {
+	log *logrus.Entry
+	url string
+
+	conn       *websocket.Conn
+	connMutex  sync.Mutex
+	endpointID string
+	handler    RecordHandler
+	closeChan  chan struct{}
+}
+
+// NewWebSocketMTP creates a WebSocket MTP for the controller at `url` (for
+// example "ws://127.0.0.1:8080/usp")
+func NewWebSocketMTP(log *logrus.Entry, url string) *WebSocketMTP {
+	return &WebSocketMTP{
+		log:       log,
+		url:       url,
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (ws *WebSocketMTP) Start(endpointID string, handler RecordHandler) error {
+	ws.endpointID = endpointID
+	ws.handler = handler
+
+	conn, err := ws.dial()
+	if err != nil {
+		return err
+	}
+	go ws.readTask(conn)
+	ws.handler(ws, nil)
+	return nil
+}
+
+func (ws *WebSocketMTP) Stop() error {
+	close(ws.closeChan)
+	ws.connMutex.Lock()
+	defer ws.connMutex.Unlock()
+	if ws.conn == nil {
+		return nil
+	}
+	ws.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return ws.conn.Close()
+}
+
+func (ws *WebSocketMTP) Send(record []byte) error {
+	ws.connMutex.Lock()
+	defer ws.connMutex.Unlock()
+	if ws.conn == nil {
+		return fmt.Errorf("websocket to %s isn't connected", ws.url)
+	}
+	return ws.conn.WriteMessage(websocket.BinaryMessage, record)
+}
+
+func (ws *WebSocketMTP) ConnectRecord() *Record {
+	return &Record{WebsocketConnect: &WebSocketConnectRecord{}}
+}
+
+func (ws *WebSocketMTP) dial() (*websocket.Conn, error) {
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{WEBSOCKET_SUBPROTOCOL},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	// The bbf-usp-protocol extension isn't sent, the controller learns the
+	// agent endpoint ID from the connect record
+	conn, _, err := dialer.Dial(ws.url, nil)
+	if err != nil {
+		ws.log.Errorf("failed to dial websocket (%s): %v", ws.url, err)
+		return nil, err
+	}
+
+	ws.connMutex.Lock()
+	ws.conn = conn
+	ws.connMutex.Unlock()
+	return conn, nil
+}
+
+func (ws *WebSocketMTP) readTask(conn *websocket.Conn) {
+	defer ws.log.Infof("Exiting websocket readTask (%s)", ws.url)
+	for {
+		msgType, data, err := conn.ReadMessage()
+		if err != nil {
+			select {
+			case <-ws.closeChan:
+				return
+			default:
+			}
+			ws.log.Errorf("websocket (%s) read failed: %v", ws.url, err)
+			if conn = ws.reconnect(); conn == nil {
+				return
+			}
+			continue
+		}
+		if msgType != websocket.BinaryMessage {
+			ws.log.Warnf("ignoring non-binary websocket message from %s", ws.url)
+			continue
+		}
+		ws.handler(ws, data)
+	}
+}
+
+// reconnect retries until connected with progressive backoff.  Returns nil
+// if the MTP is stopped.
+func (ws *WebSocketMTP) reconnect() *websocket.Conn {
+	retryWait := nanodm.RETRY_PERIOD
+	for {
+		select {
+		case <-time.After(retryWait):
+			if conn, err := ws.dial(); err == nil {
+				ws.handler(ws, nil)
+				return conn
+			}
+			if retryWait < nanodm.MAX_RETRY_PERIOD {
+				retryWait = retryWait * 2
+			}
+		case <-ws.closeChan:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package nanodm
+
+const (
+	// The default largest message a Puller accepts, which is the default of
+	// the mangos transports
+	DEFAULT_MAX_MESSAGE_SIZE = 1024 * 1024
+	// The default most objects, or operations, in a message a Puller accepts
+	DEFAULT_MAX_OBJECTS = 65536
+)
+
+// Reasons a Puller, or the server, rejects a message received
+const (
+	// The message is larger than the MaxMessageSize of the Limits
+	RejectSize = "size"
+	// The message doesn't decode
+	RejectDecode = "decode"
+	// The message decodes but isn't valid, see ValidateMessage
+	RejectInvalid = "invalid"
+	// The message claims to be from a client it wasn't received from, or
+	// from a client that isn't registered
+	RejectSender = "sender"
+)
+
+// Limits bound the messages a Puller accepts
+type Limits struct {
+	// The largest message in bytes, unlimited if 0
+	MaxMessageSize int
+	// The most objects, or operations, in a message, unlimited if 0
+	MaxObjects int
+}
+
+// DefaultLimits are the limits of a Puller unless it's given others
+var DefaultLimits = Limits{
+	MaxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+	MaxObjects:     DEFAULT_MAX_OBJECTS,
+}
+
+// ValidateMessage returns an error if `message` is malformed: its type is
+// unknown, it's a register message without the url of its sender, it has more
+// objects or operations than `limits` allow, or the name of one of them isn't
+// a valid path
+func ValidateMessage(message *Message, limits Limits) error {
+	if _, known := messageTypeNames[message.Type]; !known {
+		return Errorf(CodeInvalidValue, "unknown message type %d", message.Type)
+	}
+	if message.Type == RegisterMessageType && message.Source == "" {
+		return Errorf(CodeInvalidValue, "register message of (%s) has no source url", message.SourceName)
+	}
+	if limits.MaxObjects > 0 && len(message.Objects)+len(message.Operations) > limits.MaxObjects {
+		return Errorf(CodeResourcesExceeded, "%s message has %d objects and operations, more than %d",
+			message.Type.Name(), len(message.Objects)+len(message.Operations), limits.MaxObjects)
+	}
+	for _, object := range message.Objects {
+		if err := ValidatePath(object.Name); err != nil {
+			return err
+		}
+	}
+	for _, operation := range message.Operations {
+		if err := ValidatePath(operation.Object.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidatePath returns an error if `path` isn't an object name, or a partial
+// path ending in ".", made of segments of letters, digits, "_" and "-"
+// separated by ".".  A segment may also be the instance placeholder "{i}" of
+// the supported data model, or the wildcard "*".  The empty path is the root
+// of the data model.
+func ValidatePath(path string) error {
+	segmentStart := 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) && path[i] != '.' {
+			continue
+		}
+		if i == len(path) && segmentStart == i {
+			// The root, or a partial path
+			break
+		}
+		segment := path[segmentStart:i]
+		if segment == "" {
+			return ObjectErrorf(path, CodeInvalidValue, "path %q has an empty segment", path)
+		}
+		if segment != "{i}" && segment != "*" {
+			for j := 0; j < len(segment); j++ {
+				c := segment[j]
+				if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+					return ObjectErrorf(path, CodeInvalidValue, "path %q has an invalid character %q", path, c)
+				}
+			}
+		}
+		segmentStart = i + 1
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package nanodm
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestValidatePath(t *testing.T) {
+	for _, path := range []string{"", "Device.", "Device.WiFi.SSID", "Device.NAT.PortMapping.1.", "Device.X_ACME-Com.Value2",
+		"Device.NAT.PortMapping.{i}.", "Device.NAT.PortMapping.{i}.Enable", "Device.WiFi.*.SSID", "Device.WiFi.SSID.*."} {
+		assert.Nil(t, ValidatePath(path), path)
+	}
+	for _, path := range []string{".", "Device..WiFi", ".Device", "Device.Reboot()", "Device.Wi Fi", "Device.WiFi.\x00",
+		"Device.WiFi.*SSID", "Device.WiFi.{i}1.", "Device.WiFi.{j}.", "Device.WiFi.[Enable==true]."} {
+		err := ValidatePath(path)
+		assert.True(t, errors.Is(err, ErrInvalidValue), path)
+		var objectErr *Error
+		assert.True(t, errors.As(err, &objectErr))
+		assert.Equal(t, path, objectErr.Name)
+	}
+}
+
+func TestValidateMessage(t *testing.T) {
+	limits := Limits{MaxObjects: 2}
+	assert.Nil(t, ValidateMessage(&Message{Type: GetMessageType, Objects: []Object{{Name: "Device.A"}, {Name: "Device.B."}}}, limits))
+	assert.Nil(t, ValidateMessage(&Message{Type: RegisterMessageType, SourceName: "wifi", Source: "tcp://127.0.0.1:4801"}, limits))
+
+	err := ValidateMessage(&Message{Type: MessageType(1000)}, limits)
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	err = ValidateMessage(&Message{Type: RegisterMessageType, SourceName: "wifi"}, limits)
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	err = ValidateMessage(&Message{Type: GetMessageType, Objects: []Object{{Name: "Device.A"}, {Name: "Device.B"}, {Name: "Device.C"}}}, limits)
+	assert.True(t, errors.Is(err, ErrResourcesExceeded))
+	err = ValidateMessage(&Message{Type: PrepareMessageType, Operations: []Operation{{Object: Object{Name: "Device..A"}}}}, limits)
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+	// The paths of the supported data model, and wildcards, are valid
+	assert.Nil(t, ValidateMessage(&Message{Type: ListMessagesType, Objects: []Object{{Name: "Device.NAT.PortMapping.{i}."}, {Name: "Device.WiFi.*.SSID"}}}, limits))
+	assert.Nil(t, ValidateMessage(&Message{Type: GetMessageType, Objects: make([]Object, 3)}, Limits{}))
+}
+
+func TestDecodeMessage(t *testing.T) {
+	message := Message{Type: SetMessageType, SourceName: "wifi", Objects: []Object{{Name: "Device.WiFi.SSID", Value: "home"}}}
+	msgBytes, err := msgpack.Marshal(&message)
+	assert.Nil(t, err)
+
+	decoded, reason, err := DecodeMessage(msgBytes, DefaultLimits)
+	assert.Nil(t, err)
+	assert.Equal(t, "", reason)
+	assert.Equal(t, message.Objects, decoded.Objects)
+
+	_, reason, err = DecodeMessage(msgBytes, Limits{MaxMessageSize: len(msgBytes) - 1})
+	assert.Equal(t, RejectSize, reason)
+	assert.True(t, errors.Is(err, ErrResourcesExceeded))
+
+	_, reason, err = DecodeMessage(msgBytes[:len(msgBytes)-1], DefaultLimits)
+	assert.Equal(t, RejectDecode, reason)
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+
+	message.Objects[0].Name = "Device.WiFi.SSID()"
+	msgBytes, err = msgpack.Marshal(&message)
+	assert.Nil(t, err)
+	_, reason, err = DecodeMessage(msgBytes, DefaultLimits)
+	assert.Equal(t, RejectInvalid, reason)
+	assert.True(t, errors.Is(err, ErrInvalidValue))
+}
+
+func TestPullerRejects(t *testing.T) {
+	log := logrus.NewEntry(logrus.New())
+	url := "inproc://nanodm/TestPullerRejects"
+
+	pullerChan := make(chan Message, 4)
+	puller := NewPuller(log, url, pullerChan)
+	puller.SetLimits(Limits{MaxObjects: 1})
+	// The get messages received are corrupted
+	faults := NewFaultInjector(1, FaultRule{Fault: FaultCorrupt, Types: []MessageType{GetMessageType}, Receive: true})
+	puller.SetFaultInjector(faults)
+	rejected := make(chan string, 4)
+	puller.SetRejectHook(func(reason string) { rejected <- reason })
+	assert.Nil(t, puller.Start())
+	defer puller.Stop()
+
+	pusherChan := make(chan Message)
+	pusher := NewPusher(log, url, pusherChan)
+	assert.Nil(t, pusher.Start())
+	defer pusher.Stop()
+
+	pusherChan <- Message{Type: GetMessageType, SourceName: "wifi"}
+	pusherChan <- Message{Type: SetMessageType, SourceName: "wifi", Objects: []Object{{Name: "Device.A"}, {Name: "Device.B"}}}
+	pusherChan <- Message{Type: SetMessageType, SourceName: "wifi", Objects: []Object{{Name: "Device.A"}}}
+	assert.Equal(t, RejectDecode, <-rejected)
+	assert.Equal(t, RejectInvalid, <-rejected)
+
+	select {
+	case message := <-pullerChan:
+		assert.Equal(t, SetMessageType, message.Type)
+		assert.Equal(t, 1, len(message.Objects))
+		assert.NotEqual(t, uint32(0), message.Pipe)
+		assert.True(t, puller.Connected(message.Pipe))
+	case <-time.After(3 * time.Second):
+		t.Error("Timeout waiting for message")
+	}
+	assert.Equal(t, 0, len(pullerChan))
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, message := range []Message{
+		{Type: RegisterMessageType, SourceName: "wifi", Source: "tcp://127.0.0.1:4801", Objects: []Object{{Name: "Device.WiFi.SSID", Type: TypeString}}},
+		{Type: SetMessageType, TransactionUID: GetTransactionUID(), Objects: []Object{{Name: "Device.WiFi.Channel", Type: TypeInt, Value: 6}}},
+		{Type: AddRowMessageType, Objects: []Object{{Name: "Device.NAT.PortMapping.", Type: TypeRow, Value: map[string]interface{}{"ExternalPort": 8080}}}},
+		{Type: PrepareMessageType, Operations: []Operation{{Type: OperationDeleteRow, Object: Object{Name: "Device.NAT.PortMapping.1."}}}},
+		{Type: NackMessageType, Error: "failed", Errors: []ErrorEntry{{Name: "Device.A", Code: CodeNotFound, Message: "missing"}}},
+	} {
+		msgBytes, err := msgpack.Marshal(&message)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(msgBytes)
+	}
+	limits := Limits{MaxMessageSize: 4096, MaxObjects: 16}
+
+	f.Fuzz(func(t *testing.T, msgBytes []byte) {
+		message, reason, err := DecodeMessage(msgBytes, limits)
+		if err != nil {
+			if reason == "" {
+				t.Errorf("rejected without a reason: %v", err)
+			}
+			return
+		}
+		// A message accepted is valid, and survives encoding again
+		if err := ValidateMessage(&message, limits); err != nil {
+			t.Errorf("accepted an invalid message: %v", err)
+		}
+		encoded, err := msgpack.Marshal(&message)
+		if err != nil {
+			t.Fatalf("cannot encode a message accepted: %v", err)
+		}
+		if _, _, err := DecodeMessage(encoded, Limits{}); err != nil {
+			t.Errorf("cannot decode a message accepted once encoded: %v", err)
+		}
+	})
+}
@@ -0,0 +1,252 @@
+package nanodm
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The TR-106 names of the object types
+var objectTypeNames = map[ObjectType]string{
+	TypeString:       "string",
+	TypeInt:          "int",
+	TypeUnsignedInt:  "unsignedInt",
+	TypeBool:         "boolean",
+	TypeDateTime:     "dateTime",
+	TypeBase64:       "base64",
+	TypeLong:         "long",
+	TypeUnsignedLong: "unsignedLong",
+	TypeFloat:        "float",
+	TypeDouble:       "double",
+	TypeByte:         "unsignedByte",
+	TypeRow:          "row",
+	TypeDynamicList:  "dynamicList",
+}
+
+// The layouts of dateTime values, with and without a time zone.  TR-106 takes
+// a dateTime without a time zone as UTC.
+var dateTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999"}
+
+// String returns the TR-106 name of the type, the xsd type without its
+// prefix, for example "unsignedInt"
+func (ot ObjectType) String() string {
+	if name, ok := objectTypeNames[ot]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", uint(ot))
+}
+
+// IsValue returns true if objects of the type have a value, that is unless
+// they're rows or dynamic lists
+func (ot ObjectType) IsValue() bool {
+	return ot != TypeRow && ot != TypeDynamicList
+}
+
+// ParseObjectType returns the object type named `name`, with or without an
+// xsd prefix such as "xsd:"
+func ParseObjectType(name string) (ObjectType, bool) {
+	if idx := strings.Index(name, ":"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	for objectType, typeName := range objectTypeNames {
+		if typeName == name {
+			return objectType, true
+		}
+	}
+	return TypeString, false
+}
+
+// ParseValue converts `value` from the TR-106 string form of `objectType` to
+// its Go value:
+//
+//	string                     string
+//	int, long                  int64
+//	unsignedInt, unsignedLong  uint64
+//	unsignedByte               uint64
+//	boolean                    bool ("true", "false", "1" or "0")
+//	float, double              float64
+//	dateTime                   time.Time
+//	base64                     []byte
+//
+// The error of an invalid value has the code CodeInvalidValue.
+func ParseValue(objectType ObjectType, value string) (interface{}, error) {
+	var parsed interface{}
+	var err error
+	switch objectType {
+	case TypeString:
+		return value, nil
+	case TypeInt:
+		parsed, err = strconv.ParseInt(value, 10, 32)
+	case TypeLong:
+		parsed, err = strconv.ParseInt(value, 10, 64)
+	case TypeUnsignedInt:
+		parsed, err = strconv.ParseUint(value, 10, 32)
+	case TypeUnsignedLong:
+		parsed, err = strconv.ParseUint(value, 10, 64)
+	case TypeByte:
+		parsed, err = strconv.ParseUint(value, 10, 8)
+	case TypeBool:
+		switch strings.ToLower(value) {
+		case "true", "1":
+			parsed = true
+		case "false", "0":
+			parsed = false
+		default:
+			err = fmt.Errorf("must be true, false, 1 or 0")
+		}
+	case TypeFloat, TypeDouble:
+		var floatVal float64
+		if floatVal, err = strconv.ParseFloat(value, 64); err == nil && (math.IsNaN(floatVal) || math.IsInf(floatVal, 0)) {
+			err = fmt.Errorf("must be a finite number")
+		}
+		parsed = floatVal
+	case TypeDateTime:
+		for _, layout := range dateTimeLayouts {
+			var timeVal time.Time
+			if timeVal, err = time.Parse(layout, value); err == nil {
+				parsed = timeVal.UTC()
+				break
+			}
+		}
+	case TypeBase64:
+		parsed, err = base64.StdEncoding.DecodeString(value)
+	default:
+		return nil, Errorf(CodeInvalidType, "objects of type %v don't have values", objectType)
+	}
+	if err != nil {
+		return nil, Errorf(CodeInvalidValue, "invalid %v value %q: %v", objectType, value, unwrapNumError(err))
+	}
+	return parsed, nil
+}
+
+// FormatValue converts the Go value `value` to its TR-106 string form: a
+// dateTime in UTC, base64 for bytes and decimal for the numbers
+func FormatValue(value interface{}) string {
+	switch t := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case bool:
+		return strconv.FormatBool(t)
+	case time.Time:
+		return t.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(t)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// unwrapNumError drops the function and input from the errors of strconv,
+// which ParseValue already reports
+func unwrapNumError(err error) error {
+	if numErr, ok := err.(*strconv.NumError); ok {
+		return numErr.Err
+	}
+	return err
+}
+
+// NormalizeValue converts the Go value `value` of an object of `objectType`
+// to the Go type ParseValue returns for the type.  Numbers of any width
+// convert to the numeric types if they fit, a dateTime is converted to UTC,
+// and a string is parsed as the TR-106 form of the value.  The values of rows
+// and dynamic lists, and nil, are returned as they are.  The error of a value
+// that doesn't convert has the code CodeInvalidValue.
+func NormalizeValue(objectType ObjectType, value interface{}) (interface{}, error) {
+	if value == nil || !objectType.IsValue() {
+		return value, nil
+	}
+	if str, isString := value.(string); isString {
+		return ParseValue(objectType, str)
+	}
+	var normalized interface{}
+	ok := false
+	switch objectType {
+	case TypeInt:
+		normalized, ok = toInt64(value, math.MinInt32, math.MaxInt32)
+	case TypeLong:
+		normalized, ok = toInt64(value, math.MinInt64, math.MaxInt64)
+	case TypeUnsignedInt:
+		normalized, ok = toUint64(value, math.MaxUint32)
+	case TypeUnsignedLong:
+		normalized, ok = toUint64(value, math.MaxUint64)
+	case TypeByte:
+		normalized, ok = toUint64(value, math.MaxUint8)
+	case TypeFloat, TypeDouble:
+		normalized, ok = toFloat64(value)
+	case TypeBool:
+		normalized, ok = value.(bool)
+	case TypeDateTime:
+		var timeVal time.Time
+		if timeVal, ok = value.(time.Time); ok {
+			normalized = timeVal.UTC()
+		}
+	case TypeBase64:
+		normalized, ok = value.([]byte)
+	}
+	if !ok {
+		return nil, Errorf(CodeInvalidValue, "invalid %v value %v (%T)", objectType, value, value)
+	}
+	return normalized, nil
+}
+
+// toInt64 converts a number to an int64 if it's an integer between `min` and
+// `max`
+func toInt64(value interface{}, min int64, max int64) (int64, bool) {
+	switch t := value.(type) {
+	case int, int8, int16, int32, int64:
+		intVal := reflect.ValueOf(t).Int()
+		return intVal, intVal >= min && intVal <= max
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		uintVal := reflect.ValueOf(t).Uint()
+		return int64(uintVal), uintVal <= uint64(max)
+	case float32, float64:
+		floatVal, _ := toFloat64(t)
+		return int64(floatVal), floatVal == math.Trunc(floatVal) && floatVal >= float64(min) && floatVal < float64(max)+1
+	}
+	return 0, false
+}
+
+// toUint64 converts a number to a uint64 if it's an integer between 0 and
+// `max`
+func toUint64(value interface{}, max uint64) (uint64, bool) {
+	switch t := value.(type) {
+	case int, int8, int16, int32, int64:
+		intVal := reflect.ValueOf(t).Int()
+		return uint64(intVal), intVal >= 0 && uint64(intVal) <= max
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		uintVal := reflect.ValueOf(t).Uint()
+		return uintVal, uintVal <= max
+	case float32, float64:
+		floatVal, _ := toFloat64(t)
+		return uint64(floatVal), floatVal == math.Trunc(floatVal) && floatVal >= 0 && floatVal < float64(max)+1
+	}
+	return 0, false
+}
+
+// toFloat64 converts a finite number to a float64
+func toFloat64(value interface{}) (float64, bool) {
+	var floatVal float64
+	switch t := value.(type) {
+	case float32:
+		floatVal = float64(t)
+	case float64:
+		floatVal = t
+	case int, int8, int16, int32, int64:
+		floatVal = float64(reflect.ValueOf(t).Int())
+	case uint, uint8, uint16, uint32, uint64, uintptr:
+		floatVal = float64(reflect.ValueOf(t).Uint())
+	default:
+		return 0, false
+	}
+	return floatVal, !math.IsNaN(floatVal) && !math.IsInf(floatVal, 0)
+}
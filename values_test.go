@@ -0,0 +1,158 @@
+package nanodm
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseValue(t *testing.T) {
+	dateTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	var valid = []struct {
+		objectType ObjectType
+		value      string
+		parsed     interface{}
+	}{
+		{TypeString, "home network", "home network"},
+		{TypeInt, "-42", int64(-42)},
+		{TypeLong, "-9000000000", int64(-9000000000)},
+		{TypeUnsignedInt, "42", uint64(42)},
+		{TypeUnsignedLong, "9000000000", uint64(9000000000)},
+		{TypeByte, "255", uint64(255)},
+		{TypeBool, "true", true},
+		{TypeBool, "0", false},
+		{TypeFloat, "1.5", 1.5},
+		{TypeDouble, "-0.25", -0.25},
+		{TypeDateTime, "2021-06-01T12:30:00Z", dateTime},
+		{TypeDateTime, "2021-06-01T14:30:00+02:00", dateTime},
+		{TypeDateTime, "2021-06-01T12:30:00", dateTime},
+		{TypeBase64, "aGVsbG8=", []byte("hello")},
+	}
+	for _, test := range valid {
+		parsed, err := ParseValue(test.objectType, test.value)
+		assert.Nil(t, err, "%v %s", test.objectType, test.value)
+		assert.Equal(t, test.parsed, parsed, "%v %s", test.objectType, test.value)
+	}
+
+	var invalid = []struct {
+		objectType ObjectType
+		value      string
+	}{
+		{TypeInt, "3000000000"},
+		{TypeInt, "0x10"},
+		{TypeUnsignedInt, "-1"},
+		{TypeUnsignedInt, "5000000000"},
+		{TypeByte, "256"},
+		{TypeBool, "yes"},
+		{TypeFloat, "NaN"},
+		{TypeDateTime, "yesterday"},
+		{TypeBase64, "not base64!"},
+	}
+	for _, test := range invalid {
+		_, err := ParseValue(test.objectType, test.value)
+		assert.True(t, errors.Is(err, ErrInvalidValue), "%v %s: %v", test.objectType, test.value, err)
+	}
+
+	_, err := ParseValue(TypeRow, "1")
+	assert.True(t, errors.Is(err, ErrInvalidType))
+}
+
+func TestFormatValue(t *testing.T) {
+	assert.Equal(t, "", FormatValue(nil))
+	assert.Equal(t, "home", FormatValue("home"))
+	assert.Equal(t, "-42", FormatValue(int64(-42)))
+	assert.Equal(t, "42", FormatValue(uint8(42)))
+	assert.Equal(t, "true", FormatValue(true))
+	assert.Equal(t, "1.5", FormatValue(1.5))
+	assert.Equal(t, "1000000000000000000000", FormatValue(1e21))
+	assert.Equal(t, "0.1", FormatValue(float32(0.1)))
+	assert.Equal(t, "aGVsbG8=", FormatValue([]byte("hello")))
+	assert.Equal(t, "2021-06-01T12:30:00Z", FormatValue(time.Date(2021, 6, 1, 14, 30, 0, 0, time.FixedZone("CEST", 2*3600))))
+
+	// The formatted values parse back to the same values
+	for objectType, value := range map[ObjectType]interface{}{
+		TypeInt:      int64(-7),
+		TypeBool:     false,
+		TypeDouble:   3.25,
+		TypeDateTime: time.Date(2021, 6, 1, 12, 30, 0, 500, time.UTC),
+		TypeBase64:   []byte{0, 1, 2},
+	} {
+		parsed, err := ParseValue(objectType, FormatValue(value))
+		assert.Nil(t, err)
+		assert.Equal(t, value, parsed)
+	}
+}
+
+func TestObjectTypeNames(t *testing.T) {
+	assert.Equal(t, "unsignedInt", TypeUnsignedInt.String())
+	assert.Equal(t, "dynamicList", TypeDynamicList.String())
+
+	objectType, ok := ParseObjectType("xsd:boolean")
+	assert.True(t, ok)
+	assert.Equal(t, TypeBool, objectType)
+	objectType, ok = ParseObjectType("unsignedByte")
+	assert.True(t, ok)
+	assert.Equal(t, TypeByte, objectType)
+	_, ok = ParseObjectType("xsd:decimal")
+	assert.False(t, ok)
+}
+
+func TestNormalizeValue(t *testing.T) {
+	dateTime := time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	var valid = []struct {
+		objectType ObjectType
+		value      interface{}
+		normalized interface{}
+	}{
+		{TypeString, "home", "home"},
+		{TypeInt, int8(-42), int64(-42)},
+		{TypeInt, uint16(42), int64(42)},
+		{TypeInt, float64(42), int64(42)},
+		{TypeInt, "-42", int64(-42)},
+		{TypeLong, int64(-9000000000), int64(-9000000000)},
+		{TypeUnsignedInt, int32(42), uint64(42)},
+		{TypeUnsignedLong, uint64(math.MaxUint64), uint64(math.MaxUint64)},
+		{TypeByte, uint8(255), uint64(255)},
+		{TypeBool, true, true},
+		{TypeBool, "1", true},
+		{TypeFloat, float32(1.5), 1.5},
+		{TypeDouble, int(2), 2.0},
+		{TypeDateTime, dateTime.In(time.FixedZone("CEST", 2*3600)), dateTime},
+		{TypeDateTime, "2021-06-01T12:30:00Z", dateTime},
+		{TypeBase64, []byte("hello"), []byte("hello")},
+		{TypeBase64, "aGVsbG8=", []byte("hello")},
+		{TypeInt, nil, nil},
+		{TypeRow, map[string]interface{}{"Port": "80"}, map[string]interface{}{"Port": "80"}},
+	}
+	for _, test := range valid {
+		normalized, err := NormalizeValue(test.objectType, test.value)
+		assert.Nil(t, err, "%v %v", test.objectType, test.value)
+		assert.Equal(t, test.normalized, normalized, "%v %v", test.objectType, test.value)
+	}
+
+	var invalid = []struct {
+		objectType ObjectType
+		value      interface{}
+	}{
+		{TypeString, 42},
+		{TypeInt, int64(3000000000)},
+		{TypeInt, 1.5},
+		{TypeLong, uint64(math.MaxUint64)},
+		{TypeLong, float64(math.MaxInt64)},
+		{TypeUnsignedInt, -1},
+		{TypeByte, 256},
+		{TypeBool, 1},
+		{TypeDouble, math.Inf(1)},
+		{TypeDateTime, int64(0)},
+		{TypeBase64, 42},
+	}
+	for _, test := range invalid {
+		_, err := NormalizeValue(test.objectType, test.value)
+		assert.True(t, errors.Is(err, ErrInvalidValue), "%v %v: %v", test.objectType, test.value, err)
+	}
+}